@@ -1,39 +1,111 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// name of the cookie carrying the session token for browser clients
+const sessionCookieName = "archiiv_session"
+
+// getSessionToken reads the token from the Authorization header. Both the
+// standard `Bearer <token>` form and a bare token are accepted. Without the
+// header the session cookie is used
 func getSessionToken(r *http.Request) string {
-	return r.Header.Get("Authorization")
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return header[len("Bearer "):]
+	}
+	if header != "" {
+		return header
+	}
+
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		return c.Value
+	}
+	return ""
 }
 
-func getUsername(r *http.Request, secret string) string {
-	// This function is only called in endpoints wrapped around
-	// `requireLogin` middleware so this function can assume that some user
-	// is logged in
+func sessionCookie(token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(tokenTTL.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// how long a session token stays valid
+const tokenTTL = 7 * 24 * time.Hour
+
+// usernameKey is the context key of the user that logged in, see
+// userFromContext
+type usernameKey struct{}
+
+var errTokenRevoked = errors.New("token was revoked")
+
+// verifyUser checks the token of the request once and stores the username in
+// the request context, so the handlers behind it don't parse the token again
+func verifyUser(r *http.Request, secret string, revoked *revokedTokens) (*http.Request, string, error) {
 	token := getSessionToken(r)
-	username, err := verifySignature(token, secret, 7*24*time.Hour)
+	username, err := verifySignature(token, secret, tokenTTL)
 	if err != nil {
-		panic(err)
+		return nil, "", err
 	}
-	return username
+	if revoked.isRevoked(token) {
+		return nil, "", errTokenRevoked
+	}
+	return r.WithContext(context.WithValue(r.Context(), usernameKey{}, username)), username, nil
+}
+
+// userFromContext returns the user let through by `requireLogin` or
+// `adminOnly`. It is false when the handler wasn't wrapped in either
+func userFromContext(r *http.Request) (string, bool) {
+	username, ok := r.Context().Value(usernameKey{}).(string)
+	return username, ok
 }
 
-func validateToken(secret, token string) bool {
-	_, err := verifySignature(token, secret, 7*24*time.Hour)
-	return err == nil
+// adminUsername is the one user allowed to use the admin endpoints
+const adminUsername = "admin"
+
+// userRoles returns the roles of the user. There are no configurable roles,
+// only the admin user is special
+func userRoles(username string) []string {
+	if username == adminUsername {
+		return []string{"admin"}
+	}
+	return []string{}
+}
+
+// dummyPassword stands in for the password of users that don't exist, so that
+// login takes the same time for them. Random, so that nothing can match it
+var dummyPassword = func() (pwd [64]byte) {
+	_, _ = rand.Read(pwd[:])
+	return
+}()
+
+// passwordsEqual compares in constant time. A variable for tests
+var passwordsEqual = func(a, b [64]byte) bool {
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
 }
 
 func login(name string, pwd [64]byte, secret string, userStore userStore) (ok bool, token string) {
+	// a missing user still goes through the comparison, otherwise the
+	// response time would tell which usernames exist
 	correctPwd, err := userStore.userPassword(name)
 	if err != nil {
-		ok = false
-		return
+		correctPwd = dummyPassword
 	}
 
-	if correctPwd != pwd {
+	if !passwordsEqual(correctPwd, pwd) || err != nil {
 		ok = false
 		return
 	}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archiiv/fs"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// subcommands run instead of the server when named by the first argument
+var subcommands = map[string]func(args []string) error{
+	"init": func(args []string) error {
+		return runInit(os.Stdout, args)
+	},
+	"user": func(args []string) error {
+		return runUser(passwordInput(os.Stdin), os.Stdout, args)
+	},
+}
+
+// runInit bootstraps a fresh data directory and prints the root ID to be
+// passed to the server with --root_id
+func runInit(out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("archiiv init", flag.ContinueOnError)
+
+	var dataDir, dirPermString, filePermString string
+	flags.StringVar(&dataDir, "data_dir", "", "")
+	flags.StringVar(&dirPermString, "dir_perm", "0750", "")
+	flags.StringVar(&filePermString, "file_perm", "0600", "")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("flags parse: %w", err)
+	}
+
+	if !filepath.IsAbs(dataDir) {
+		return fmt.Errorf("data dir must be absolute path (is %#v)", dataDir)
+	}
+
+	dirPerm, err := parsePerm(dirPermString, 0700)
+	if err != nil {
+		return fmt.Errorf("dir perm: %w", err)
+	}
+
+	filePerm, err := parsePerm(filePermString, 0600)
+	if err != nil {
+		return fmt.Errorf("file perm: %w", err)
+	}
+
+	if err = os.MkdirAll(dataDir, dirPerm); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+
+	rootID, err := fs.InitFsDir(dataDir, nil, fs.Options{DirPerm: dirPerm, FilePerm: filePerm})
+	if err != nil {
+		return fmt.Errorf("init fs dir: %w", err)
+	}
+
+	_, err = fmt.Fprintln(out, rootID)
+	return err
+}
+
+// runUser manages user files directly in the data directory, which is the only
+// way to create the first admin
+//
+//	archiiv user add --data_dir <dir> <name>
+//	archiiv user passwd --data_dir <dir> <name>
+func runUser(in io.Reader, out io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected add or passwd")
+	}
+	action := args[0]
+	if action != "add" && action != "passwd" {
+		return fmt.Errorf("unknown user action %#v", action)
+	}
+
+	flags := flag.NewFlagSet("archiiv user "+action, flag.ContinueOnError)
+
+	var dataDir, filePermString string
+	flags.StringVar(&dataDir, "data_dir", "", "")
+	flags.StringVar(&filePermString, "file_perm", "0600", "")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return fmt.Errorf("flags parse: %w", err)
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("expected exactly one username")
+	}
+	username := flags.Arg(0)
+
+	if !filepath.IsAbs(dataDir) {
+		return fmt.Errorf("data dir must be absolute path (is %#v)", dataDir)
+	}
+
+	filePerm, err := parsePerm(filePermString, 0600)
+	if err != nil {
+		return fmt.Errorf("file perm: %w", err)
+	}
+
+	users, err := newUserStore(filepath.Join(dataDir, "users"), filePerm)
+	if err != nil {
+		return fmt.Errorf("new user store: %w", err)
+	}
+
+	if err = users.usernameIsSane(username); err != nil {
+		return err
+	}
+
+	exists, err := users.userExists(username)
+	if err != nil {
+		return err
+	}
+	if action == "add" && exists {
+		return fmt.Errorf("user %v already exists", username)
+	}
+	if action == "passwd" && !exists {
+		return fmt.Errorf("user %v does not exist", username)
+	}
+
+	lines := bufio.NewScanner(in)
+	readPassword := func(prompt string) (string, error) {
+		fmt.Fprint(out, prompt)
+		if !lines.Scan() {
+			if lines.Err() != nil {
+				return "", lines.Err()
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		fmt.Fprintln(out)
+		return lines.Text(), nil
+	}
+
+	pwd, err := readPassword("Password: ")
+	if err != nil {
+		return fmt.Errorf("read password: %w", err)
+	}
+	again, err := readPassword("Repeat password: ")
+	if err != nil {
+		return fmt.Errorf("read password: %w", err)
+	}
+	if pwd != again {
+		return errors.New("passwords don't match")
+	}
+	if pwd == "" {
+		return errors.New("empty password")
+	}
+
+	return users.setUserPassword(username, hashPassword(pwd))
+}
+
+// passwordInput returns stdin that doesn't echo what is typed into it when it
+// is a terminal
+func passwordInput(stdin *os.File) io.Reader {
+	st, err := stdin.Stat()
+	if err != nil || st.Mode()&os.ModeCharDevice == 0 {
+		return stdin
+	}
+	return &noEchoReader{stdin}
+}
+
+// noEchoReader turns the terminal echo off only for the duration of each
+// read, so the terminal is never left without echo after we are done
+type noEchoReader struct {
+	tty *os.File
+}
+
+func (r *noEchoReader) Read(p []byte) (int, error) {
+	if err := stty(r.tty, "-echo"); err != nil {
+		return 0, fmt.Errorf("disable echo: %w", err)
+	}
+	defer func() { _ = stty(r.tty, "echo") }()
+
+	return r.tty.Read(p)
+}
+
+func stty(tty *os.File, arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archiiv/fs"
+	"archiiv/id"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInit(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join(t.TempDir(), "archive")
+
+	var out bytes.Buffer
+	require.NoError(t, runInit(&out, []string{"--data_dir", dir}))
+
+	rootID, err := id.Parse(strings.TrimSpace(out.String()))
+	require.NoError(t, err)
+
+	for _, sub := range []string{"files", "users"} {
+		st, err := os.Stat(filepath.Join(dir, sub))
+		require.NoError(t, err)
+		assert.True(t, st.IsDir())
+	}
+
+	_, err = fs.NewFs(rootID, filepath.Join(dir, "files"), fs.Options{})
+	assert.NoError(t, err)
+
+	assert.Error(t, runInit(&out, []string{"--data_dir", "relative"}))
+}
+
+func TestUserAddAndPasswd(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	var out bytes.Buffer
+	require.NoError(t, runInit(&out, []string{"--data_dir", dir}))
+
+	userFile := filepath.Join(dir, "users", "admin")
+
+	err := runUser(strings.NewReader("heslo123\nheslo123\n"), &out, []string{"add", "--data_dir", dir, "admin"})
+	require.NoError(t, err)
+	content, err := os.ReadFile(userFile)
+	require.NoError(t, err)
+	pwd := hashPassword("heslo123")
+	assert.Equal(t, pwd[:], content)
+
+	err = runUser(strings.NewReader("x\nx\n"), &out, []string{"add", "--data_dir", dir, "admin"})
+	assert.ErrorContains(t, err, "already exists")
+
+	err = runUser(strings.NewReader("new\nnope\n"), &out, []string{"passwd", "--data_dir", dir, "admin"})
+	assert.ErrorContains(t, err, "don't match")
+
+	err = runUser(strings.NewReader("new\nnew\n"), &out, []string{"passwd", "--data_dir", dir, "admin"})
+	require.NoError(t, err)
+	content, err = os.ReadFile(userFile)
+	require.NoError(t, err)
+	pwd = hashPassword("new")
+	assert.Equal(t, pwd[:], content)
+
+	err = runUser(strings.NewReader("x\nx\n"), &out, []string{"passwd", "--data_dir", dir, "nobody"})
+	assert.ErrorContains(t, err, "does not exist")
+
+	err = runUser(strings.NewReader("x\nx\n"), &out, []string{"add", "--data_dir", dir, "bad/name"})
+	assert.Error(t, err)
+}
@@ -113,34 +113,45 @@ func sign(username, secret string) (string, error) {
 	return base64.URLEncoding.EncodeToString(fullTokenBytes), nil
 }
 
-func verifySignature(dataStr, secret string, maxAge time.Duration) (string, error) {
+// parseToken checks the token signature and returns its payload without
+// looking at its age
+func parseToken(dataStr, secret string) (tokenPayload, error) {
 	data, err := base64.URLEncoding.DecodeString(dataStr)
 	if err != nil {
-		return "", fmt.Errorf("base64 decode token: %w", err)
+		return tokenPayload{}, fmt.Errorf("base64 decode token: %w", err)
 	}
 
 	ft, err := gobDecode[fullToken](data)
 	if err != nil {
-		return "", fmt.Errorf("decode FullToken: %w", err)
+		return tokenPayload{}, fmt.Errorf("decode FullToken: %w", err)
 	}
 
 	priv, err := secretToKeys(secret)
 	if err != nil {
-		return "", fmt.Errorf("derive key from secret: %w", err)
+		return tokenPayload{}, fmt.Errorf("derive key from secret: %w", err)
 	}
 
 	payloadBytes, err := payloadToBytes(ft.Data)
 	if err != nil {
-		return "", fmt.Errorf("payload to bytes: %w", err)
+		return tokenPayload{}, fmt.Errorf("payload to bytes: %w", err)
 	}
 
 	if !ed25519.Verify(priv.Public().(ed25519.PublicKey), payloadBytes, ft.Sign) {
-		return "", errors.New("signature is invalid")
+		return tokenPayload{}, errors.New("signature is invalid")
+	}
+
+	return ft.Data, nil
+}
+
+func verifySignature(dataStr, secret string, maxAge time.Duration) (string, error) {
+	payload, err := parseToken(dataStr, secret)
+	if err != nil {
+		return "", err
 	}
 
-	if time.Since(ft.Data.Timestamp).Microseconds() > maxAge.Microseconds() {
+	if time.Since(payload.Timestamp).Microseconds() > maxAge.Microseconds() {
 		return "", errors.New("signature is too old")
 	}
 
-	return ft.Data.Username, nil
+	return payload.Username, nil
 }
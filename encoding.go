@@ -3,18 +3,26 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 )
 
 type responseError struct {
 	Ok    bool   `json:"ok"`
 	Error string `json:"error"`
+	// Code names the error for clients to branch on, only some errors
+	// have one
+	Code string `json:"code,omitempty"`
 }
 
 func encodeError(w http.ResponseWriter, status int, e string) error {
 	return encode(w, status, responseError{Ok: false, Error: e})
 }
 
+func encodeErrorCode(w http.ResponseWriter, status int, code, e string) error {
+	return encode(w, status, responseError{Ok: false, Error: e, Code: code})
+}
+
 func encodeOK[T any](w http.ResponseWriter, v T) error {
 	return encode(w, http.StatusOK, struct {
 		Ok   bool `json:"ok"`
@@ -29,7 +37,12 @@ func encode(w http.ResponseWriter, status int, v any) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 
-	err := json.NewEncoder(w).Encode(v)
+	enc := json.NewEncoder(w)
+	if isPretty(w) {
+		enc.SetIndent("", "  ")
+	}
+
+	err := enc.Encode(v)
 	if err != nil {
 		return fmt.Errorf("encode json: %w", err)
 	}
@@ -37,6 +50,93 @@ func encode(w http.ResponseWriter, status int, v any) error {
 	return nil
 }
 
+// okArrayWriter streams the ok envelope with an array as its data, for
+// responses too large to build in memory first. Nothing is written before the
+// first element, so an error up to that point can still be sent as usual.
+// The ok field comes after the data, so that an error past that point can
+// still end the response as a failure, see fail
+type okArrayWriter struct {
+	w http.ResponseWriter
+	n int
+}
+
+func (a *okArrayWriter) add(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode json: %w", err)
+	}
+
+	prefix := ","
+	if a.n == 0 {
+		a.start()
+		prefix = ""
+	}
+	a.n++
+
+	_, err = io.WriteString(a.w, prefix+string(b))
+	return err
+}
+
+func (a *okArrayWriter) start() {
+	a.w.Header().Set("Content-Type", "application/json")
+	a.w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(a.w, `{"data":[`)
+}
+
+func (a *okArrayWriter) close() error {
+	if a.n == 0 {
+		a.start()
+	}
+	_, err := io.WriteString(a.w, `],"ok":true}`+"\n")
+	return err
+}
+
+// fail ends a started response with ok false and the error next to the
+// data, the status is already sent
+func (a *okArrayWriter) fail(e string) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encode json: %w", err)
+	}
+	_, err = io.WriteString(a.w, `],"ok":false,"error":`+string(b)+"}\n")
+	return err
+}
+
+// prettyWriter marks a response whose JSON should be indented
+type prettyWriter struct {
+	http.ResponseWriter
+}
+
+func (pw *prettyWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// isPretty looks for a prettyWriter through the writers wrapping it, like
+// the recordingWriter of idempotent requests
+func isPretty(w http.ResponseWriter) bool {
+	for {
+		switch ww := w.(type) {
+		case *prettyWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = ww.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// prettyJSON indents JSON responses of requests with ?pretty=true, which is
+// handy when poking at the API with curl
+func prettyJSON(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("pretty") == "true" {
+			w = &prettyWriter{w}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 // decodes the given struct as JSON from the request body
 func decode[T any](r *http.Request) (T, error) {
 	var v T
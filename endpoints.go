@@ -3,10 +3,31 @@ package main
 import (
 	"archiiv/fs"
 	"archiiv/id"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -18,6 +39,14 @@ func sendError(log *slog.Logger, w http.ResponseWriter, errorCode int, errorText
 	}
 }
 
+// sendErrorCode is sendError with a code in the response, see responseError
+func sendErrorCode(log *slog.Logger, w http.ResponseWriter, errorCode int, code, errorText string) {
+	err := encodeErrorCode(w, errorCode, code, errorText)
+	if err != nil {
+		log.Error("failed to send error response", "error", err)
+	}
+}
+
 func sendOK(log *slog.Logger, w http.ResponseWriter, v any) {
 	err := encodeOK(w, v)
 	if err != nil {
@@ -25,54 +54,321 @@ func sendOK(log *slog.Logger, w http.ResponseWriter, v any) {
 	}
 }
 
-func logAccesses(log *slog.Logger, h http.Handler) http.Handler {
+// sendWriteError reports a failed write. A full disk gets its own status and
+// a stable message, the other errors are told without the paths in them
+func sendWriteError(log *slog.Logger, w http.ResponseWriter, what string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		sendError(log, w, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload is larger than %d bytes", tooLarge.Limit))
+		return
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		log.Error("disk full", "during", what, "error", err)
+		sendError(log, w, http.StatusInsufficientStorage, "insufficient storage")
+		return
+	}
+	log.Error("write failed", "during", what, "error", err)
+	sendError(log, w, http.StatusInternalServerError, what+": "+clientError(err))
+}
+
+// clientError is the text of err fit for a response. Errors of file
+// operations name files in the data dir, so of those only the operation and
+// the cause are told
+func clientError(err error) string {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Op + ": " + pathErr.Err.Error()
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return linkErr.Op + ": " + linkErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// sendFsError answers with the status code matching the fs sentinel error,
+// anything else is reported as a failed write
+func sendFsError(log *slog.Logger, w http.ResponseWriter, what string, err error) {
+	var status int
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, errExists):
+		status = http.StatusConflict
+	case errors.Is(err, errCycle), errors.Is(err, errNotDir), errors.Is(err, errInvalidName), errors.Is(err, errTooDeep):
+		status = http.StatusBadRequest
+	default:
+		sendWriteError(log, w, what, err)
+		return
+	}
+	sendError(log, w, status, what+": "+clientError(err))
+}
+
+// The formats of the access log, see --access_log_format
+const (
+	accessLogJSON = "json"
+	accessLogCLF  = "clf"
+)
+
+// clfTimeFormat is the time of a request in the Common Log Format
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessWriter notes the status and the size of the response for the access
+// log
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// clfLine formats the request as a line of the Common Log Format. The user
+// is always "-", the access log sits in front of the authentication
+func clfLine(r *http.Request, status int, size int64, at time.Time) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if host == "" {
+		host = "-"
+	}
+
+	sent := "-"
+	if size > 0 {
+		sent = strconv.FormatInt(size, 10)
+	}
+
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s\n",
+		host, at.Format(clfTimeFormat), r.Method, r.URL.RequestURI(), r.Proto, status, sent)
+}
+
+// logAccesses logs every request once it is handled, either to the server
+// log or as Common Log Format lines to out
+func logAccesses(log *slog.Logger, format string, out io.Writer, h http.Handler) http.Handler {
+	var outLock sync.Mutex
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Info("request", "url", r.URL.Path)
-		h.ServeHTTP(w, r)
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		h.ServeHTTP(aw, r)
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		if format != accessLogCLF {
+			log.Info("request", "method", r.Method, "url", r.URL.Path, "status", status,
+				"size", aw.size, "duration", time.Since(start))
+			return
+		}
+
+		outLock.Lock()
+		defer outLock.Unlock()
+		if _, err := io.WriteString(out, clfLine(r, status, aw.size, start)); err != nil {
+			log.Error("access log", "error", err)
+		}
 	})
 }
 
-func adminOnly(secret string, log *slog.Logger, h http.Handler) http.Handler {
+// recoverPanics turns a panicking handler into a 500 response instead of a
+// dropped connection
+func recoverPanics(log *slog.Logger, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if validateToken(secret, getSessionToken(r)) {
-			if getUsername(r, secret) == "admin" {
-				h.ServeHTTP(w, r)
+		defer func() {
+			v := recover()
+			if v == nil {
 				return
 			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			log.Error("handler panicked", "url", r.URL.Path, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			sendError(log, w, http.StatusInternalServerError, "500 internal server error")
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withTimeout puts a deadline on the request context, which the long fs
+// operations respect. Streaming endpoints end at the deadline too, clients
+// have to reconnect
+func withTimeout(timeout time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func adminOnly(secret string, revoked *revokedTokens, log *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r, name, err := verifyUser(r, secret, revoked); err == nil && name == adminUsername {
+			h.ServeHTTP(w, r)
+			return
 		}
 		sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
 	})
 }
 
-func requireLogin(secret string, log *slog.Logger, h http.Handler) http.Handler {
+func requireLogin(secret string, revoked *revokedTokens, log *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, _, err := verifyUser(r, secret, revoked)
+		if err != nil {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loginPassword is either the plaintext password as a JSON string, which is
+// hashed on the server, or the pre-hashed form. The pre-hashed form is the
+// legacy array of 64 numbers or an object with the 64 bytes encoded as
+// {"hex": "..."} or {"base64": "..."}, which is easier to produce outside JS
+type loginPassword struct {
+	hash      [64]byte
+	prehashed bool
+}
+
+func (p *loginPassword) UnmarshalJSON(data []byte) error {
+	var plain string
+	if err := json.Unmarshal(data, &plain); err == nil {
+		p.hash = hashPassword(plain)
+		p.prehashed = false
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '{' {
+		return p.unmarshalEncoded(data)
+	}
+
+	if err := json.Unmarshal(data, &p.hash); err != nil {
+		return err
+	}
+	p.prehashed = true
+	return nil
+}
+
+func (p *loginPassword) unmarshalEncoded(data []byte) error {
+	var encoded struct {
+		Hex    *string `json:"hex"`
+		Base64 *string `json:"base64"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&encoded); err != nil {
+		return err
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	switch {
+	case (encoded.Hex == nil) == (encoded.Base64 == nil):
+		return errors.New("password needs exactly one of hex and base64")
+	case encoded.Hex != nil:
+		b, err = hex.DecodeString(*encoded.Hex)
+	default:
+		b, err = base64.StdEncoding.DecodeString(*encoded.Base64)
+	}
+	if err != nil {
+		return fmt.Errorf("decode password: %w", err)
+	}
+	if len(b) != len(p.hash) {
+		return fmt.Errorf("pre-hashed password must be %d bytes (is %d)", len(p.hash), len(b))
+	}
+
+	copy(p.hash[:], b)
+	p.prehashed = true
+	return nil
+}
+
+// handleLogout revokes the token of the request, it stops working before it
+// expires. A session cookie is removed too
+func handleLogout(secret string, revoked *revokedTokens, log *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := getSessionToken(r)
-		if validateToken(secret, token) {
-			h.ServeHTTP(w, r)
-		} else {
+		payload, err := parseToken(token, secret)
+		if err != nil {
 			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+		revoked.revoke(token, payload.Timestamp.Add(tokenTTL))
+
+		if _, err := r.Cookie(sessionCookieName); err == nil {
+			cookie := sessionCookie("")
+			cookie.MaxAge = -1
+			http.SetCookie(w, cookie)
 		}
+		sendOK(log, w, nil)
 	})
 }
 
-func handleLogin(secret string, log *slog.Logger, userStore userStore) http.Handler {
+func handleLogin(secret string, allowPrehashed, setCookie bool, log *slog.Logger, userStore userStore) http.Handler {
 	type loginRequest struct {
-		Username string   `json:"username"`
-		Password [64]byte `json:"password"`
+		Username string         `json:"username"`
+		Password *loginPassword `json:"password"`
 	}
 
 	type loginResponse struct {
 		Token      string    `json:"token"`
 		ExpireDate time.Time `json:"expireDate"`
+		Roles      []string  `json:"roles"`
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// clients that send no type at all have always been accepted
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			mediaType, _, err := mime.ParseMediaType(ct)
+			if err != nil || mediaType != "application/json" {
+				sendError(log, w, http.StatusUnsupportedMediaType, "login expects application/json")
+				return
+			}
+		}
+
 		lr, err := decode[loginRequest](r)
-		if err != nil {
-			sendError(log, w, http.StatusBadRequest, "wrong name or password")
+		switch {
+		case errors.Is(err, io.EOF):
+			sendError(log, w, http.StatusBadRequest, "empty body")
+			return
+		case err != nil:
+			sendError(log, w, http.StatusBadRequest, "malformed json")
+			return
+		case lr.Username == "":
+			sendError(log, w, http.StatusBadRequest, "missing username")
+			return
+		case lr.Password == nil:
+			sendError(log, w, http.StatusBadRequest, "missing password")
+			return
+		}
+
+		if lr.Password.prehashed && !allowPrehashed {
+			sendError(log, w, http.StatusBadRequest, "pre-hashed passwords are not accepted")
 			return
 		}
 
-		ok, token := login(lr.Username, lr.Password, secret, userStore)
+		ok, token := login(lr.Username, lr.Password.hash, secret, userStore)
 
 		if !ok {
 			log.Info("Failed login", "user", lr.Username)
@@ -81,133 +377,281 @@ func handleLogin(secret string, log *slog.Logger, userStore userStore) http.Hand
 		}
 
 		log.Info("New login", "user", lr.Username)
-		sendOK(log, w, loginResponse{Token: token})
+		if setCookie {
+			http.SetCookie(w, sessionCookie(token))
+		}
+		sendOK(log, w, loginResponse{Token: token, Roles: userRoles(lr.Username)})
 	})
 }
 
-func handleWhoami(secret string, log *slog.Logger) http.Handler {
+// setCacheControl lets clients reuse the response for a while. The responses
+// depend on the session token, so shared caches must not keep them
+func setCacheControl(w http.ResponseWriter, maxAge time.Duration) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds())))
+}
+
+func handleWhoami(cacheMaxAge time.Duration, log *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		name := getUsername(r, secret)
+		name, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		setCacheControl(w, cacheMaxAge)
+
 		sendOK(log, w, struct {
 			Name string `json:"name"`
 		}{Name: name})
 	})
 }
 
-func handleLs(fs *fs.Fs, log *slog.Logger) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		idArg := r.PathValue("id")
-
-		id, e := id.Parse(idArg)
-		if e != nil {
-			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
-			return
-		}
+// handleRoutes lists the route table, so clients and dashboards can see what
+// the server offers. routes is read on every request, the table includes this
+// route too
+func handleRoutes(routePrefix string, routes *[]route, log *slog.Logger) http.Handler {
+	type routeResponse struct {
+		Method     string   `json:"method"`
+		Pattern    string   `json:"pattern"`
+		Auth       string   `json:"auth"`
+		Middleware []string `json:"middleware"`
+	}
 
-		ch, e := fs.GetChildren(id)
-		if e != nil {
-			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
-			return
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := make([]routeResponse, 0, len(*routes))
+		for _, rt := range *routes {
+			names := make([]string, 0, len(rt.middleware))
+			for _, m := range rt.middleware {
+				names = append(names, m.name)
+			}
+			res = append(res, routeResponse{Method: rt.method, Pattern: routePrefix + rt.pattern, Auth: rt.auth(), Middleware: names})
 		}
+		sendOK(log, w, res)
+	})
+}
 
-		// TODO(matěj) check permission
+// handleTime tells the clients the server's clock and how long tokens last,
+// so that they can notice a skew and log in again before their token expires
+func handleTime(log *slog.Logger) http.Handler {
+	type timeResponse struct {
+		Time            time.Time `json:"time"`
+		TokenTTL        string    `json:"tokenTTL"`
+		TokenTTLSeconds int64     `json:"tokenTTLSeconds"`
+	}
 
-		sendOK(log, w, ch)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendOK(log, w, timeResponse{
+			Time:            time.Now().UTC(),
+			TokenTTL:        tokenTTL.String(),
+			TokenTTLSeconds: int64(tokenTTL.Seconds()),
+		})
 	})
 }
 
-func handleCat(fs *fs.Fs, log *slog.Logger) http.Handler {
+// handleMethodNotAllowed answers the methods a path has no route for. The mux
+// would do that too, but without the JSON envelope
+func handleMethodNotAllowed(allow []string, log *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		idArg := r.PathValue("id")
-		sectionArg := r.PathValue("section")
-
-		id, e := id.Parse(idArg)
-		if e != nil {
-			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
-			return
-		}
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		sendErrorCode(log, w, http.StatusMethodNotAllowed, "method_not_allowed", "405 method not allowed")
+	})
+}
 
-		// TODO(matěj) check permission
+// handleVerifyToken reports whether the token in the Authorization header is
+// valid and not logged out. Invalid tokens are not an error here so gateways
+// can branch on the response
+func handleVerifyToken(secret string, revoked *revokedTokens, log *slog.Logger) http.Handler {
+	type verifyResponse struct {
+		Valid     bool       `json:"valid"`
+		Username  string     `json:"username,omitempty"`
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	}
 
-		sectionReader, e := fs.OpenSection(id, sectionArg)
-		if e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("open section: %v", e))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := getSessionToken(r)
+		payload, err := parseToken(token, secret)
+		if err != nil || revoked.isRevoked(token) {
+			sendOK(log, w, verifyResponse{Valid: false})
 			return
 		}
 
-		if _, e = io.Copy(w, sectionReader); e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("io copy: %v", e))
+		expiresAt := payload.Timestamp.Add(tokenTTL)
+		if time.Now().After(expiresAt) {
+			sendOK(log, w, verifyResponse{Valid: false})
 			return
 		}
 
-		sendOK(log, w, nil)
+		sendOK(log, w, verifyResponse{
+			Valid:     true,
+			Username:  payload.Username,
+			ExpiresAt: &expiresAt,
+		})
 	})
 }
 
-func handleUpload(log *slog.Logger, fs *fs.Fs) http.Handler {
+// handleValidateID tells clients whether a string is a well-formed ID,
+// without looking at the fs
+func handleValidateID(log *slog.Logger) http.Handler {
+	type validateResponse struct {
+		Valid  bool   `json:"valid"`
+		Reason string `json:"reason,omitempty"`
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		idArg := r.PathValue("id")
-		sectionArg := r.PathValue("section")
+		if _, e := id.Parse(r.PathValue("id")); e != nil {
+			sendOK(log, w, validateResponse{Valid: false, Reason: e.Error()})
+			return
+		}
+		sendOK(log, w, validateResponse{Valid: true})
+	})
+}
 
-		id, e := id.Parse(idArg)
+func handleStat(fs *fs.Fs, obscureNotFound bool, cacheMaxAge time.Duration, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
 		if e != nil {
-			log.Error("handleUpload", "error", e)
-			sendError(log, w, http.StatusBadRequest, "invalid id")
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
 			return
 		}
 
-		// TODO(matěj) check permission
-
-		sectionWriter, e := fs.CreateSection(id, sectionArg)
-		if e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("create section: %v", e))
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permReadMeta) {
 			return
 		}
 
-		if _, e = io.Copy(sectionWriter, r.Body); e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("io copy: %v", e))
+		info, e := fs.Stat(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
 			return
 		}
 
-		sendOK(log, w, nil)
+		setCacheControl(w, cacheMaxAge)
+		w.Header().Set("Last-Modified", info.Modified.UTC().Format(http.TimeFormat))
+		sendOK(log, w, info)
 	})
 }
 
-func handleTouch(fs *fs.Fs, log *slog.Logger) http.Handler {
-	type OkResponse struct {
-		NewFileid id.ID `json:"new_file_id"`
+// maxStatMany is how many IDs one statmany request can ask for
+const maxStatMany = 1000
+
+// maxStatManyBytes bounds the statmany request body, so that a huge array is
+// refused before it's decoded. An ID takes 25 bytes in the array, the rest is
+// left for whitespace
+const maxStatManyBytes = maxStatMany * 64
+
+// handleStatMany stats many records at once, so that a listing needs a single
+// request. The records that can't be stat'ed are in errors instead, the
+// request as a whole succeeds
+func handleStatMany(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	type statManyResponse struct {
+		Files  map[string]fileInfo `json:"files"`
+		Errors map[string]string   `json:"errors"`
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		idArg := r.PathValue("id")
-		name := r.PathValue("name")
-
-		parentID, e := id.Parse(idArg)
+		r.Body = http.MaxBytesReader(w, r.Body, maxStatManyBytes)
+		ids, e := decode[[]id.ID](r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(e, &tooLarge) {
+			sendError(log, w, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d ids per request", maxStatMany))
+			return
+		}
 		if e != nil {
-			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+		if len(ids) > maxStatMany {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("at most %d ids per request", maxStatMany))
 			return
 		}
 
-		// TODO(matěj) check permission
-
-		fileID, e := fs.Touch(parentID, name)
-		if e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("touch: %v", e))
+		username, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
 			return
 		}
 
-		sendOK(log, w, OkResponse{NewFileid: fileID})
+		res := statManyResponse{Files: make(map[string]fileInfo), Errors: make(map[string]string)}
+		for _, u := range ids {
+			info, e := fs.Stat(u)
+			if e != nil {
+				res.Errors[u.String()] = "not found"
+				continue
+			}
+
+			ok, e := fs.CanAccess(u, username, permReadMeta)
+			switch {
+			case e != nil:
+				log.Error("statmany", "id", u, "error", e)
+				res.Errors[u.String()] = "read meta failed"
+			case !ok && obscureNotFound:
+				res.Errors[u.String()] = "not found"
+			case !ok:
+				res.Errors[u.String()] = "forbidden"
+			default:
+				res.Files[u.String()] = info
+			}
+		}
+
+		sendOK(log, w, res)
 	})
 }
 
-func handleMkdir(fs *fs.Fs, log *slog.Logger) http.Handler {
-	type OkResponse struct {
-		NewDirID id.ID `json:"new_dir_id"`
+// maxLsPage is the largest ?limit of a paged listing
+const maxLsPage = 1000
+
+// encodeCursor makes the opaque ?cursor continuing a listing after the ID
+func encodeCursor(last id.ID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last.String()))
+}
+
+// decodeCursor returns the last ID of the previous page, false for the first
+// page
+func decodeCursor(cursor string) (id.ID, bool, error) {
+	if cursor == "" {
+		return id.ID{}, false, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return id.ID{}, false, errors.New("invalid cursor")
+	}
+	last, err := id.Parse(string(b))
+	if err != nil {
+		return id.ID{}, false, errors.New("invalid cursor")
+	}
+	return last, true, nil
+}
+
+// lsPage returns up to limit of the children after the cursor in the order
+// of ID.Compare, and the cursor of the next page ("" after the last one).
+// Unlike an offset, the cursor doesn't move when children are added or
+// removed before it
+func lsPage(children []id.ID, after id.ID, hasAfter bool, limit int) ([]id.ID, string) {
+	sorted := slices.SortedFunc(slices.Values(children), id.ID.Compare)
+	if hasAfter {
+		i, found := slices.BinarySearchFunc(sorted, after, id.ID.Compare)
+		if found {
+			i++
+		}
+		sorted = sorted[i:]
+	}
+
+	if len(sorted) <= limit {
+		return sorted, ""
+	}
+	page := sorted[:limit]
+	return page, encodeCursor(page[len(page)-1])
+}
+
+// handleLs lists the children of a directory. With ?limit or ?cursor the
+// listing is paged, see lsPage
+func handleLs(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	type pageResponse struct {
+		Children []id.ID `json:"children"`
+		Next     string  `json:"next,omitempty"`
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		idArg := r.PathValue("id")
-		name := r.PathValue("name")
 
 		id, e := id.Parse(idArg)
 		if e != nil {
@@ -215,69 +659,1754 @@ func handleMkdir(fs *fs.Fs, log *slog.Logger) http.Handler {
 			return
 		}
 
-		// TODO(matěj) check permission
+		var wantDirs bool
+		typeArg := r.URL.Query().Get("type")
+		switch typeArg {
+		case "":
+		case "dir":
+			wantDirs = true
+		case "file":
+			wantDirs = false
+		default:
+			sendError(log, w, http.StatusBadRequest, "type must be dir or file")
+			return
+		}
 
-		fileID, e := fs.Mkdir(id, name)
+		cursorArg := r.URL.Query().Get("cursor")
+		limitArg := r.URL.Query().Get("limit")
+		paged := cursorArg != "" || limitArg != ""
+		after, hasAfter, e := decodeCursor(cursorArg)
 		if e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("mkdir: %v", e))
+			sendError(log, w, http.StatusBadRequest, e.Error())
 			return
 		}
+		limit := maxLsPage
+		if limitArg != "" {
+			limit, e = strconv.Atoi(limitArg)
+			if e != nil || limit <= 0 || limit > maxLsPage {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("limit must be a number from 1 to %d", maxLsPage))
+				return
+			}
+		}
 
-		sendOK(log, w, OkResponse{NewDirID: fileID})
-	})
-}
-
-func handleMount(fs *fs.Fs, log *slog.Logger) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		parentArg := r.PathValue("parentID")
-		childArg := r.PathValue("childID")
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permRead) {
+			return
+		}
 
-		parentID, e := id.Parse(parentArg)
+		ch, version, e := fs.GetChildrenVersioned(id)
 		if e != nil {
-			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			sendFsError(log, w, "ls", e)
 			return
 		}
 
-		childID, e := id.Parse(childArg)
-		if e != nil {
-			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+		// the filter and the page are part of the representation, so they
+		// are part of the tag too
+		tag := version + typeArg
+		if paged {
+			tag += "/" + cursorArg + "/" + limitArg
+		}
+		etag := `"` + tag + `"`
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
 
-		// TODO(matěj) check permission
+		if typeArg != "" {
+			filtered := ch[:0]
+			for _, c := range ch {
+				info, e := fs.Stat(c)
+				if e != nil {
+					sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("stat: %v", e))
+					return
+				}
+				if info.IsDir == wantDirs {
+					filtered = append(filtered, c)
+				}
+			}
+			ch = filtered
+		}
 
-		e = fs.Mount(parentID, childID)
-		if e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("parse id: %v", e))
+		if paged {
+			page, next := lsPage(ch, after, hasAfter, limit)
+			sendOK(log, w, pageResponse{Children: page, Next: next})
 			return
 		}
 
-		sendOK(log, w, nil)
+		sendOK(log, w, ch)
 	})
 }
 
-func handleUnmount(fs *fs.Fs, log *slog.Logger) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		parentArg := r.PathValue("parentID")
-		childArg := r.PathValue("childID")
+const (
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+)
 
-		parentID, e := id.Parse(parentArg)
+// handleWatch long-polls a directory listing. It answers once the listing
+// version differs from ?version (the current one if not given) or after
+// ?timeout
+func handleWatch(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	type OkResponse struct {
+		Changed  bool    `json:"changed"`
+		Version  string  `json:"version"`
+		Children []id.ID `json:"children"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
 		if e != nil {
 			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
 			return
 		}
 
-		childID, e := id.Parse(childArg)
-		if e != nil {
-			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+		timeout := defaultWatchTimeout
+		if timeoutArg := r.URL.Query().Get("timeout"); timeoutArg != "" {
+			timeout, e = time.ParseDuration(timeoutArg)
+			if e != nil || timeout <= 0 || timeout > maxWatchTimeout {
+				sendError(log, w, http.StatusBadRequest, "invalid timeout")
+				return
+			}
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permRead) {
 			return
 		}
 
-		// TODO(matěj) check permission
+		version := r.URL.Query().Get("version")
+		if version == "" {
+			_, version, e = fs.GetChildrenVersioned(id)
+			if e != nil {
+				sendFsError(log, w, "watch", e)
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
 
-		e = fs.Unmount(parentID, childID)
+		ch, newVersion, e := fs.WaitChildren(ctx, id, version)
 		if e != nil {
-			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("parse id: %v", e))
+			sendFsError(log, w, "watch", e)
+			return
+		}
+
+		sendOK(log, w, OkResponse{
+			Changed:  newVersion != version,
+			Version:  newVersion,
+			Children: ch,
+		})
+	})
+}
+
+// handleEvents streams the fs events as server-sent events. Only events on
+// directories the user can read are sent. The stream ends when the client
+// goes away or can't keep up with the events
+func handleEvents(fs *fs.Fs, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		events, unsubscribe := fs.Subscribe()
+		defer unsubscribe()
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		// lets the client know it is subscribed
+		if _, e := io.WriteString(w, ": subscribed\n\n"); e != nil {
+			return
+		}
+		if e := rc.Flush(); e != nil {
+			return
+		}
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+
+				if !eventReadable(fs, ev, username) {
+					continue
+				}
+
+				data, e := json.Marshal(ev)
+				if e != nil {
+					log.Error("handleEvents", "error", e)
+					return
+				}
+
+				if _, e = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); e != nil {
+					return
+				}
+				if e = rc.Flush(); e != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+// eventReadable tells whether the user can see the event. Changes of the
+// tree show to those who can read the directory, changes of sections to
+// those who can read the records on both ends
+func eventReadable(fs *fs.Fs, ev fs.Event, username string) bool {
+	check := []id.ID{ev.Parent}
+	if ev.Type == eventRename {
+		check = []id.ID{ev.From, ev.ID}
+	}
+	for _, u := range check {
+		readable, e := fs.CanAccess(u, username, permRead)
+		if e != nil || !readable {
+			return false
+		}
+	}
+	return true
+}
+
+// etagMatches implements the If-None-Match comparison, which is the weak one
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// handlers take the store as `fs`, which shadows the package
+const (
+	permRead     = fs.PermRead
+	permWrite    = fs.PermWrite
+	permReadMeta = fs.PermReadMeta
+	permOwner    = fs.PermOwner
+
+	encodingGzip = fs.EncodingGzip
+	eventRename  = fs.EventRename
+)
+
+var (
+	errSectionExists = fs.ErrSectionExists
+	errFsNotEmpty    = fs.ErrNotEmpty
+	errMetaIntact    = fs.ErrMetaIntact
+	errNotFound      = fs.ErrNotFound
+	errExists        = fs.ErrExists
+	errCycle         = fs.ErrCycle
+	errNotDir        = fs.ErrNotDir
+	errInvalidName   = fs.ErrInvalidName
+	errTooDeep       = fs.ErrTooDeep
+	errTooMany       = fs.ErrTooManyEntries
+	errOwnerBit      = fs.ErrOwnerBit
+	errUnknownPerm   = fs.ErrUnknownPerm
+	errUnknownUser   = fs.ErrUnknownUser
+	errDirNotEmpty   = fs.ErrDirNotEmpty
+	errRootIsDir     = fs.ErrRootIsDir
+)
+
+type (
+	fileInfo = fs.FileInfo
+	treeNode = fs.TreeNode
+)
+
+// canAccess checks that the logged-in user has the perm bits on the file. If
+// not, it sends the error response and returns false
+func canAccess(log *slog.Logger, w http.ResponseWriter, r *http.Request, fs *fs.Fs, obscureNotFound bool, file id.ID, perm uint8) bool {
+	return canAccessSection(log, w, r, fs, obscureNotFound, file, "", perm)
+}
+
+// canAccessSection is canAccess for one section of the file, reading the meta
+// section takes only permReadMeta
+func canAccessSection(log *slog.Logger, w http.ResponseWriter, r *http.Request, fs *fs.Fs, obscureNotFound bool, file id.ID, section string, perm uint8) bool {
+	username, ok := userFromContext(r)
+	if !ok {
+		sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+		return false
+	}
+
+	if _, e := fs.Stat(file); e != nil {
+		if obscureNotFound {
+			sendError(log, w, http.StatusNotFound, "file not found")
+		} else {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+		}
+		return false
+	}
+
+	ok, e := fs.CanAccessSection(file, section, username, perm)
+	if e != nil {
+		sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("read meta: %v", e))
+		return false
+	}
+	if !ok {
+		sendForbidden(log, w, obscureNotFound)
+		return false
+	}
+
+	return true
+}
+
+// sendForbidden refuses access. With obscureNotFound the refusal looks
+// exactly like a missing file, so IDs can't be probed for existence
+func sendForbidden(log *slog.Logger, w http.ResponseWriter, obscureNotFound bool) {
+	if obscureNotFound {
+		sendError(log, w, http.StatusNotFound, "file not found")
+		return
+	}
+	sendError(log, w, http.StatusForbidden, "403 forbidden")
+}
+
+// handleMeta returns the parsed meta of the record
+func handleMeta(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permReadMeta) {
+			return
+		}
+
+		fm, e := fs.Meta(id)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("read meta: %v", e))
+			return
+		}
+
+		sendOK(log, w, fm)
+	})
+}
+
+// handleRebuildMeta replaces a missing or broken meta with a fresh one owned
+// by the caller. Only the admin can rebuild a meta that can't be read, owners
+// of a readable one get a conflict
+func handleRebuildMeta(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		username, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		if _, e = fs.Stat(id); e != nil {
+			sendError(log, w, http.StatusNotFound, "file not found")
+			return
+		}
+
+		if username != adminUsername {
+			if owner, e := fs.IsOwner(id, username); e != nil || !owner {
+				sendForbidden(log, w, obscureNotFound)
+				return
+			}
+		}
+
+		fm, e := fs.RebuildMeta(id, username)
+		if errors.Is(e, errMetaIntact) {
+			sendError(log, w, http.StatusConflict, "meta is intact")
+			return
+		}
+		if e != nil {
+			sendWriteError(log, w, "rebuild meta", e)
+			return
+		}
+
+		sendOK(log, w, fm)
+	})
+}
+
+// handleSections lists the sections of the record, with ?detail=true along
+// with their sizes and types
+func handleSections(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		detail := false
+		if detailArg := r.URL.Query().Get("detail"); detailArg != "" {
+			detail, e = strconv.ParseBool(detailArg)
+			if e != nil {
+				sendError(log, w, http.StatusBadRequest, "detail must be true or false")
+				return
+			}
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permReadMeta) {
+			return
+		}
+
+		if !detail {
+			sections, e := fs.Sections(id)
+			if e != nil {
+				sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("sections: %v", e))
+				return
+			}
+			if sections == nil {
+				sections = []string{}
+			}
+			sendOK(log, w, sections)
+			return
+		}
+
+		infos, e := fs.SectionInfos(id)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("sections: %v", e))
+			return
+		}
+		sendOK(log, w, infos)
+	})
+}
+
+// handleSectionExists tells whether the section exists without reading it
+func handleSectionExists(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	type existsResponse struct {
+		Exists bool  `json:"exists"`
+		Size   int64 `json:"size"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permReadMeta) {
+			return
+		}
+
+		exists, size, e := fs.SectionExists(id, r.PathValue("section"))
+		if e != nil {
+			sendFsError(log, w, "section exists", e)
+			return
+		}
+
+		sendOK(log, w, existsResponse{Exists: exists, Size: size})
+	})
+}
+
+func handleCat(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idArg := r.PathValue("id")
+		sectionArg := r.PathValue("section")
+
+		id, e := id.Parse(idArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccessSection(log, w, r, fs, obscureNotFound, id, sectionArg, permRead) {
+			return
+		}
+
+		info, e := fs.Stat(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		sectionReader, e := fs.OpenSection(id, sectionArg)
+		if e != nil {
+			sendFsError(log, w, "open section", e)
+			return
+		}
+		defer sectionReader.Close()
+
+		typ, e := fs.SectionType(id, sectionArg)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("section type: %v", e))
+			return
+		}
+		if typ != "" {
+			// the meta can be uploaded with any type in it
+			if typ, e = sectionType(typ); e != nil {
+				typ = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", typ)
+		}
+		// browsers must not guess a more dangerous type than the one given
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		encoding, e := fs.SectionEncoding(id, sectionArg)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("section encoding: %v", e))
+			return
+		}
+
+		// clients that take gzip get the stored bytes as they are
+		var body io.Reader = sectionReader
+		if encoding != "" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				w.Header().Set("Content-Encoding", encoding)
+			} else if body, e = decodeSection(sectionReader, encoding); e != nil {
+				sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("decode section: %v", e))
+				return
+			}
+		}
+
+		w.Header().Set("Content-Disposition", contentDisposition(info.Name, r.URL.Query().Get("inline") == "true"))
+
+		// the body is the section itself, so there is no envelope to send
+		// after the copy
+		if _, e = io.Copy(w, body); e != nil {
+			log.Error("handleCat", "error", e)
+		}
+	})
+}
+
+// handleBundle streams every section of the record as one zip, with entries
+// named by section
+func handleBundle(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permRead) {
+			return
+		}
+
+		info, e := fs.Stat(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+
+		// the zip itself isn't byte for byte stable, hence the weak tag
+		version, e := fs.SubtreeVersion(r.Context(), id)
+		if errors.Is(e, context.DeadlineExceeded) {
+			sendError(log, w, http.StatusServiceUnavailable, "handler timeout")
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("version: %v", e))
+			return
+		}
+		etag := `W/"` + version + `"`
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		sections, e := fs.Sections(id)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("sections: %v", e))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", contentDisposition(info.Name+".zip", false))
+
+		// the status is sent with the first entry, so errors past this point
+		// can only cut the zip short
+		zw := zip.NewWriter(w)
+		for _, section := range sections {
+			if e = bundleSection(zw, fs, id, section); e != nil {
+				log.Error("handleBundle", "section", section, "error", e)
+				return
+			}
+		}
+
+		if e = zw.Close(); e != nil {
+			log.Error("handleBundle", "error", e)
+		}
+	})
+}
+
+func bundleSection(zw *zip.Writer, fs *fs.Fs, id id.ID, section string) error {
+	sectionReader, err := fs.OpenSection(id, section)
+	if err != nil {
+		return err
+	}
+	defer sectionReader.Close()
+
+	encoding, err := fs.SectionEncoding(id, section)
+	if err != nil {
+		return err
+	}
+
+	body, err := decodeSection(sectionReader, encoding)
+	if err != nil {
+		return err
+	}
+
+	entry, err := zw.Create(section)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, body)
+	return err
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSection undoes the encoding a section is stored with
+func decodeSection(r io.Reader, encoding string) (io.Reader, error) {
+	if encoding != encodingGzip {
+		return r, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// contentDisposition makes browsers save the file under its record name.
+// Inline disposition lets them show previewable types instead
+func contentDisposition(name string, inline bool) string {
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+
+	// FormatMediaType escapes quotes and encodes non-ASCII names, and
+	// gives up on names it can't represent at all
+	if v := mime.FormatMediaType(disposition, map[string]string{"filename": name}); v != "" {
+		return v
+	}
+	return disposition
+}
+
+// uploadPerm is what writing the section takes. The meta holds the
+// permissions, so only the owner writes it
+func uploadPerm(section string) uint8 {
+	if section == "meta" {
+		return permOwner
+	}
+	return permWrite
+}
+
+func handleUpload(log *slog.Logger, fs *fs.Fs, obscureNotFound bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idArg := r.PathValue("id")
+		sectionArg := r.PathValue("section")
+
+		id, e := id.Parse(idArg)
+		if e != nil {
+			log.Error("handleUpload", "error", e)
+			sendError(log, w, http.StatusBadRequest, "invalid id")
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, uploadPerm(sectionArg)) {
+			return
+		}
+
+		compress := r.URL.Query().Get("compress")
+		switch {
+		case compress != "" && compress != encodingGzip:
+			sendError(log, w, http.StatusBadRequest, "compress must be gzip")
+			return
+		case compress != "" && sectionArg == "meta":
+			// the fs reads meta itself
+			sendError(log, w, http.StatusBadRequest, "meta can't be compressed")
+			return
+		}
+
+		sums, e := uploadChecksums(r.Header)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+
+		typ, e := sectionType(r.Header.Get("Content-Type"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+
+		if offsetArg := r.URL.Query().Get("offset"); offsetArg != "" {
+			offset, e := strconv.ParseInt(offsetArg, 10, 64)
+			if e != nil || offset < 0 {
+				sendError(log, w, http.StatusBadRequest, "invalid offset")
+				return
+			}
+			if compress != "" {
+				sendError(log, w, http.StatusBadRequest, "compressed sections can't be written at an offset")
+				return
+			}
+			if len(sums) > 0 {
+				sendError(log, w, http.StatusBadRequest, "checksums can't be verified for uploads at an offset")
+				return
+			}
+
+			uploadAt(log, w, r, fs, id, sectionArg, offset)
+			return
+		}
+
+		var src io.Reader = r.Body
+		if len(sums) > 0 {
+			src = &checksumReader{r: r.Body, sums: sums}
+		}
+		body := compressed(src, compress)
+		defer body.Close()
+
+		if _, e := fs.PutSection(id, sectionArg, body); e != nil {
+			if errors.Is(e, errChecksumMismatch) {
+				sendError(log, w, http.StatusBadRequest, e.Error())
+				return
+			}
+			sendFsError(log, w, "put section", e)
+			return
+		}
+
+		if e := recordSection(fs, id, sectionArg, typ, compress, verified(sums)); e != nil {
+			sendWriteError(log, w, "section type", e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+// compressed returns src as stored under the given encoding, gzip compressed
+// if the encoding says so. Closing it stops the compression early
+func compressed(src io.Reader, encoding string) io.ReadCloser {
+	if encoding != encodingGzip {
+		return io.NopCloser(src)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, src)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// recordSection remembers the media type the section was uploaded with and
+// how it is stored, so cat can serve it back, and the checksum it was
+// verified against. Every write forgets the checksum of the previous content.
+// The meta section describes itself and is skipped
+func recordSection(fs *fs.Fs, file id.ID, section, typ, encoding, checksum string) error {
+	if section == "meta" {
+		return nil
+	}
+
+	// the section was written whole
+	if err := fs.SetSectionWritten(file, section, -1); err != nil {
+		return err
+	}
+
+	if typ != "" {
+		if err := fs.SetSectionType(file, section, typ); err != nil {
+			return err
+		}
+	}
+	if err := fs.SetSectionChecksum(file, section, checksum); err != nil {
+		return err
+	}
+	return fs.SetSectionEncoding(file, section, encoding)
+}
+
+// sectionType checks the media type a section is uploaded with and returns it
+// in its canonical form. No type at all is fine, the section then has none
+func sectionType(contentType string) (string, error) {
+	if contentType == "" {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid content type %q", contentType)
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// uploadChecksum is a checksum the client sent with an upload in the
+// Content-MD5 or the X-Checksum-SHA256 header
+type uploadChecksum struct {
+	name string
+	want []byte
+	hash hash.Hash
+}
+
+// uploadChecksums reads the checksums of the upload from the headers.
+// Content-MD5 is base64 as RFC 1864 has it, X-Checksum-SHA256 is hex
+func uploadChecksums(h http.Header) ([]*uploadChecksum, error) {
+	var sums []*uploadChecksum
+	if v := h.Get("X-Checksum-SHA256"); v != "" {
+		want, err := hex.DecodeString(v)
+		if err != nil || len(want) != sha256.Size {
+			return nil, errors.New("X-Checksum-SHA256 must be a hex encoded sha256")
+		}
+		sums = append(sums, &uploadChecksum{name: "sha256", want: want, hash: sha256.New()})
+	}
+	if v := h.Get("Content-MD5"); v != "" {
+		want, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(want) != md5.Size {
+			return nil, errors.New("Content-MD5 must be a base64 encoded md5")
+		}
+		sums = append(sums, &uploadChecksum{name: "md5", want: want, hash: md5.New()}) // #nosec G401: only detects corruption
+	}
+	return sums, nil
+}
+
+// checksumReader hashes what is read through it. At the end it fails with
+// errChecksumMismatch instead of io.EOF if a checksum doesn't match, so the
+// section batch reading it is aborted and the bad content never replaces the
+// section
+type checksumReader struct {
+	r    io.Reader
+	sums []*uploadChecksum
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	for _, s := range cr.sums {
+		s.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		for _, s := range cr.sums {
+			if !bytes.Equal(s.hash.Sum(nil), s.want) {
+				return n, fmt.Errorf("%w (%s)", errChecksumMismatch, s.name)
+			}
+		}
+	}
+	return n, err
+}
+
+// verified is the checksum to keep in the meta, sha256 if there is one
+func verified(sums []*uploadChecksum) string {
+	if len(sums) == 0 {
+		return ""
+	}
+	return sums[0].name + ":" + hex.EncodeToString(sums[0].want)
+}
+
+// handleUploadMultipart writes every part of a multipart body into the
+// section named by the part's form name. Nothing is changed unless all parts
+// are received and put in place successfully
+func handleUploadMultipart(log *slog.Logger, fs *fs.Fs, obscureNotFound bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permWrite) {
+			return
+		}
+
+		mr, e := r.MultipartReader()
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("multipart: %v", e))
+			return
+		}
+
+		batch, e := fs.NewSectionBatch(id)
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("file not found: %v", e))
+			return
+		}
+		defer batch.Abort()
+
+		username, _ := userFromContext(r)
+		types := map[string]string{}
+		for {
+			part, e := mr.NextPart()
+			if e == io.EOF {
+				break
+			}
+			if e != nil {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("multipart: %v", e))
+				return
+			}
+
+			if perm := uploadPerm(part.FormName()); perm != permWrite {
+				ok, e := fs.CanAccess(id, username, perm)
+				if e != nil {
+					sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("read meta: %v", e))
+					return
+				}
+				if !ok {
+					sendForbidden(log, w, obscureNotFound)
+					return
+				}
+			}
+
+			typ, e := sectionType(part.Header.Get("Content-Type"))
+			if e != nil {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("section %#v: %v", part.FormName(), e))
+				return
+			}
+
+			sectionWriter, e := batch.Create(part.FormName())
+			if e != nil {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("section %#v: %v", part.FormName(), e))
+				return
+			}
+
+			if _, e = io.Copy(sectionWriter, part); e != nil {
+				sendWriteError(log, w, "io copy", e)
+				return
+			}
+			types[part.FormName()] = typ
+		}
+
+		if e = batch.Commit(); e != nil {
+			sendWriteError(log, w, "commit", e)
+			return
+		}
+
+		for section, typ := range types {
+			if e = recordSection(fs, id, section, typ, "", ""); e != nil {
+				sendWriteError(log, w, "section type", e)
+				return
+			}
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+// uploadAt writes one chunk of a resumable upload. Chunks at different
+// offsets can be written concurrently
+func uploadAt(log *slog.Logger, w http.ResponseWriter, r *http.Request, fs *fs.Fs, id id.ID, section string, offset int64) {
+	unlock := fs.LockSectionShared(id, section)
+	defer unlock()
+
+	// the chunk would land in the middle of the compressed stream
+	encoding, e := fs.SectionEncoding(id, section)
+	if e != nil {
+		sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("read meta: %v", e))
+		return
+	}
+	if encoding != "" {
+		sendError(log, w, http.StatusBadRequest, "compressed sections can't be written at an offset")
+		return
+	}
+
+	sectionWriter, e := fs.OpenSectionAt(id, section)
+	if e != nil {
+		sendWriteError(log, w, "open section", e)
+		return
+	}
+	defer sectionWriter.Close()
+
+	n, e := io.Copy(io.NewOffsetWriter(sectionWriter, offset), r.Body)
+	if e != nil {
+		sendWriteError(log, w, "io copy", e)
+		return
+	}
+
+	// the content changed under the checksum, the encoding is known to be
+	// none already
+	if e = fs.SetSectionChecksum(id, section, ""); e != nil {
+		sendWriteError(log, w, "section checksum", e)
+		return
+	}
+	size, e := fs.SectionSize(id, section)
+	if e == nil {
+		e = fs.AddSectionWritten(id, section, offset, n, size)
+	}
+	if e != nil {
+		sendWriteError(log, w, "section written", e)
+		return
+	}
+
+	sendOK(log, w, nil)
+}
+
+// handleAllocate creates a section of the declared size for a client that
+// uploads it in chunks at offsets. The size is only bounded by
+// max_upload_bytes, a limit of a single upload that is off by default. It is
+// not a quota, nothing adds up what a user has stored
+func handleAllocate(fs *fs.Fs, obscureNotFound bool, live *atomic.Pointer[tunables], log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idArg := r.PathValue("id")
+		sectionArg := r.PathValue("section")
+
+		id, e := id.Parse(idArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		size, e := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		if e != nil || size < 0 {
+			sendError(log, w, http.StatusBadRequest, "invalid size")
+			return
+		}
+		if limit := live.Load().maxUploadBytes; limit > 0 && size > limit {
+			sendError(log, w, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload is larger than %d bytes", limit))
+			return
+		}
+		if sectionArg == "meta" {
+			// the fs reads meta itself, zeros aren't valid meta
+			sendError(log, w, http.StatusBadRequest, "meta can't be allocated")
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permWrite) {
+			return
+		}
+
+		if e = fs.AllocateSection(id, sectionArg, size); e != nil {
+			sendFsError(log, w, "allocate section", e)
+			return
+		}
+
+		if e = recordSection(fs, id, sectionArg, "", "", ""); e != nil {
+			sendWriteError(log, w, "section encoding", e)
+			return
+		}
+		if size > 0 {
+			if e = fs.SetSectionWritten(id, sectionArg, 0); e != nil {
+				sendWriteError(log, w, "section written", e)
+				return
+			}
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+// handleUploadOffset tells a client resuming an upload how much of the section
+// is already there
+func handleUploadOffset(log *slog.Logger, fs *fs.Fs, obscureNotFound bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idArg := r.PathValue("id")
+		sectionArg := r.PathValue("section")
+
+		id, e := id.Parse(idArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permWrite) {
+			return
+		}
+
+		// an allocated section is as long as it will be, only the part
+		// written so far counts
+		offset, partial, e := fs.SectionWritten(id, sectionArg)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("read meta: %v", e))
+			return
+		}
+		if !partial {
+			if offset, e = fs.SectionSize(id, sectionArg); e != nil {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("section size: %v", e))
+				return
+			}
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// requestedID is the ID a client asks for with ?id= when it creates a record.
+// Imports use it to keep the IDs of the records they bring in. Only the admin
+// may ask for one
+func requestedID(r *http.Request) (u id.ID, ok bool, err error) {
+	arg := r.URL.Query().Get("id")
+	if arg == "" {
+		return id.ID{}, false, nil
+	}
+
+	u, err = id.Parse(arg)
+	if err != nil {
+		return id.ID{}, false, fmt.Errorf("parse new id: %w", err)
+	}
+	if u == (id.ID{}) {
+		return id.ID{}, false, errors.New("the new id is zero")
+	}
+	return u, true, nil
+}
+
+func handleTouch(fs *fs.Fs, inheritPerms, obscureNotFound bool, log *slog.Logger) http.Handler {
+	type OkResponse struct {
+		NewFileid id.ID `json:"new_file_id"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idArg := r.PathValue("id")
+		name := r.PathValue("name")
+
+		parentID, e := id.Parse(idArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+		newID, withID, e := requestedID(r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, parentID, permWrite) {
+			return
+		}
+
+		username, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+		// a chosen ID could take the place of a record that is about to be
+		// imported, only the admin may pick one
+		if withID && username != adminUsername {
+			sendError(log, w, http.StatusForbidden, "only the admin can choose the id")
+			return
+		}
+
+		fileID := newID
+		if withID {
+			e = fs.TouchWithID(parentID, newID, name, false)
+		} else {
+			fileID, e = fs.Touch(parentID, name)
+		}
+		if e != nil {
+			sendFsError(log, w, "touch", e)
+			return
+		}
+
+		if e = fs.InitFileMeta(parentID, fileID, username, inheritPerms); e != nil {
+			sendWriteError(log, w, "init file meta", e)
+			return
+		}
+
+		sendOK(log, w, OkResponse{NewFileid: fileID})
+	})
+}
+
+func handleMkdir(fs *fs.Fs, inheritPerms, obscureNotFound bool, log *slog.Logger) http.Handler {
+	type OkResponse struct {
+		NewDirID id.ID `json:"new_dir_id"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idArg := r.PathValue("id")
+		name := r.PathValue("name")
+
+		id, e := id.Parse(idArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+		newID, withID, e := requestedID(r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permWrite) {
+			return
+		}
+
+		username, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+		// a chosen ID could take the place of a record that is about to be
+		// imported, only the admin may pick one
+		if withID && username != adminUsername {
+			sendError(log, w, http.StatusForbidden, "only the admin can choose the id")
+			return
+		}
+
+		fileID := newID
+		if withID {
+			e = fs.TouchWithID(id, newID, name, true)
+		} else {
+			fileID, e = fs.Mkdir(id, name)
+		}
+		if e != nil {
+			sendFsError(log, w, "mkdir", e)
+			return
+		}
+
+		if e = fs.InitFileMeta(id, fileID, username, inheritPerms); e != nil {
+			sendWriteError(log, w, "init file meta", e)
+			return
+		}
+
+		sendOK(log, w, OkResponse{NewDirID: fileID})
+	})
+}
+
+// errNoWrite is returned by canWriteIn
+var errNoWrite = errors.New("no write access")
+
+// canWriteIn is the mayCreate of fs.MkdirAll, the user has to be able to
+// write in every directory a child is created in
+func canWriteIn(fs *fs.Fs, username string) func(dir id.ID) error {
+	return func(dir id.ID) error {
+		ok, err := fs.CanAccess(dir, username, permWrite)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s: %w", dir, errNoWrite)
+		}
+		return nil
+	}
+}
+
+// handleMkdirp creates the directories of ?path= under the parent that don't
+// exist yet, like `mkdir -p`, and returns the last one
+func handleMkdirp(fs *fs.Fs, inheritPerms, obscureNotFound bool, log *slog.Logger) http.Handler {
+	type OkResponse struct {
+		DirID   id.ID `json:"dir_id"`
+		Created int   `json:"created"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			sendError(log, w, http.StatusBadRequest, "path is required")
+			return
+		}
+
+		username, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permWrite) {
+			return
+		}
+
+		// the path can go through directories of other users, creating in
+		// them takes write there too
+		dirs, created, mkdirErr := fs.MkdirAll(id, path, canWriteIn(fs, username))
+
+		// the created directories get their meta even if a later part of
+		// the path failed
+		for i := len(dirs) - created; i < len(dirs); i++ {
+			parent := id
+			if i > 0 {
+				parent = dirs[i-1]
+			}
+			if e = fs.InitFileMeta(parent, dirs[i], username, inheritPerms); e != nil {
+				sendWriteError(log, w, "init file meta", e)
+				return
+			}
+		}
+
+		if errors.Is(mkdirErr, errNoWrite) {
+			sendForbidden(log, w, obscureNotFound)
+			return
+		}
+		if mkdirErr != nil {
+			sendFsError(log, w, "mkdirp", mkdirErr)
+			return
+		}
+
+		sendOK(log, w, OkResponse{DirID: dirs[len(dirs)-1], Created: created})
+	})
+}
+
+// handleChown hands the file over to another user, see fs.Chown. Only the
+// owner and the admin can do it
+func handleChown(fs *fs.Fs, userStore userStore, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+		newOwner := r.PathValue("username")
+
+		username, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		if _, e = fs.Stat(id); e != nil {
+			sendError(log, w, http.StatusNotFound, "file not found")
+			return
+		}
+
+		if username != adminUsername {
+			if owner, e := fs.IsOwner(id, username); e != nil || !owner {
+				sendForbidden(log, w, obscureNotFound)
+				return
+			}
+		}
+
+		if exists, e := userStore.userExists(newOwner); e != nil || !exists {
+			sendError(log, w, http.StatusNotFound, "username not found")
+			return
+		}
+
+		fm, e := fs.Chown(id, newOwner)
+		if e != nil {
+			sendFsError(log, w, "chown", e)
+			return
+		}
+
+		sendOK(log, w, fm)
+	})
+}
+
+func handleCopyPerms(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srcID, e := id.Parse(r.PathValue("srcID"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		dstID, e := id.Parse(r.PathValue("dstID"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		var merge bool
+		switch r.URL.Query().Get("mode") {
+		case "", "replace":
+		case "merge":
+			merge = true
+		default:
+			sendError(log, w, http.StatusBadRequest, "mode must be replace or merge")
+			return
+		}
+
+		username, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		for _, file := range []id.ID{srcID, dstID} {
+			owner, e := fs.IsOwner(file, username)
+			if errors.Is(e, os.ErrNotExist) {
+				sendError(log, w, http.StatusNotFound, "file not found")
+				return
+			}
+			if e != nil {
+				sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("read meta: %v", e))
+				return
+			}
+			if !owner {
+				sendForbidden(log, w, obscureNotFound)
+				return
+			}
+		}
+
+		if e = fs.CopyPerms(srcID, dstID, merge); e != nil {
+			sendWriteError(log, w, "copy perms", e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+func handleDefaultPerms(fs *fs.Fs, userStore userStore, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dirID, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		perms, e := decode[map[string]uint8](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+
+		username, ok := userFromContext(r)
+		if !ok {
+			sendError(log, w, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		owner, e := fs.IsOwner(dirID, username)
+		if errors.Is(e, os.ErrNotExist) {
+			sendError(log, w, http.StatusNotFound, "file not found")
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("read meta: %v", e))
+			return
+		}
+		if !owner {
+			sendForbidden(log, w, obscureNotFound)
+			return
+		}
+
+		e = fs.SetDefaultChildPerms(dirID, perms, userStore.userExists)
+		if errors.Is(e, errOwnerBit) || errors.Is(e, errUnknownPerm) || errors.Is(e, errUnknownUser) {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+		if e != nil {
+			sendFsError(log, w, "set default perms", e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+// handleMount mounts the child in the parent, which takes write access to the
+// parent
+func handleMount(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parentArg := r.PathValue("parentID")
+		childArg := r.PathValue("childID")
+
+		parentID, e := id.Parse(parentArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		childID, e := id.Parse(childArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, parentID, permWrite) {
+			return
+		}
+
+		e = fs.Mount(parentID, childID)
+		if e != nil {
+			sendFsError(log, w, "mount", e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+// handleUnmount unmounts the child from the parent, which takes write access
+// to the parent
+func handleUnmount(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parentArg := r.PathValue("parentID")
+		childArg := r.PathValue("childID")
+
+		parentID, e := id.Parse(parentArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		childID, e := id.Parse(childArg)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, parentID, permWrite) {
+			return
+		}
+
+		e = fs.Unmount(parentID, childID)
+		if e != nil {
+			sendFsError(log, w, "unmount", e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+func handleMoveSection(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srcID, e := id.Parse(r.PathValue("srcID"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		dstID, e := id.Parse(r.PathValue("dstID"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		srcSection, dstSection := r.PathValue("srcSection"), r.PathValue("dstSection")
+
+		// the section leaves the source, so that takes write too
+		if !canAccessSection(log, w, r, fs, obscureNotFound, srcID, srcSection, permRead|permWrite) {
+			return
+		}
+		if !canAccessSection(log, w, r, fs, obscureNotFound, dstID, dstSection, permWrite) {
+			return
+		}
+
+		e = fs.MoveSection(srcID, srcSection, dstID, dstSection)
+		if e != nil {
+			sendFsError(log, w, "move section", e)
+			return
+		}
+
+		sendOK(log, w, nil)
+	})
+}
+
+// handleSetType turns a record into a file or a directory. That changes what
+// the record is, so only its owner does it
+func handleSetType(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		isDir, e := strconv.ParseBool(r.PathValue("isDir"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, "isDir must be true or false")
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permOwner) {
+			return
+		}
+
+		e = fs.SetIsDir(id, isDir)
+		switch {
+		case errors.Is(e, errDirNotEmpty), errors.Is(e, errRootIsDir):
+			sendError(log, w, http.StatusConflict, fmt.Sprintf("set type: %v", e))
+		case e != nil:
+			sendFsError(log, w, "set type", e)
+		default:
+			sendOK(log, w, nil)
+		}
+	})
+}
+
+func handleRenameSection(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permWrite) {
+			return
+		}
+
+		e = fs.RenameSection(id, r.PathValue("old"), r.PathValue("new"))
+		switch {
+		case errors.Is(e, os.ErrNotExist):
+			sendError(log, w, http.StatusNotFound, "section not found")
+		case errors.Is(e, errSectionExists):
+			sendError(log, w, http.StatusConflict, e.Error())
+		case e != nil:
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("rename section: %v", e))
+		default:
+			sendOK(log, w, nil)
+		}
+	})
+}
+
+func handleDiskUsage(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	type duResponse struct {
+		Size int64 `json:"size"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permRead) {
+			return
+		}
+
+		size, e := fs.DiskUsage(r.Context(), id)
+		if errors.Is(e, context.DeadlineExceeded) {
+			sendError(log, w, http.StatusServiceUnavailable, "handler timeout")
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("disk usage: %v", e))
+			return
+		}
+
+		sendOK(log, w, duResponse{Size: size})
+	})
+}
+
+// handleTreeHash returns the Merkle hash of the tree under a record, see
+// fs.TreeHash. Records the user can't read are left out, so that the hash
+// tells nothing about them
+func handleTreeHash(fs *fs.Fs, obscureNotFound bool, log *slog.Logger) http.Handler {
+	type treeHashResponse struct {
+		Hash string `json:"hash"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permRead) {
+			return
+		}
+		username, _ := userFromContext(r)
+
+		hash, e := fs.TreeHash(id, readableBy(fs, username))
+		if e != nil {
+			sendFsError(log, w, "tree hash", e)
+			return
+		}
+
+		sendOK(log, w, treeHashResponse{Hash: hash})
+	})
+}
+
+// handleTree returns the whole tree under a record. ?depth limits how deep
+// it goes, but never past maxDepth (zero means no cap)
+func handleTree(fs *fs.Fs, maxDepth int, obscureNotFound bool, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		depth := -1
+		if depthArg := r.URL.Query().Get("depth"); depthArg != "" {
+			depth, e = strconv.Atoi(depthArg)
+			if e != nil || depth < 0 {
+				sendError(log, w, http.StatusBadRequest, "invalid depth")
+				return
+			}
+		}
+		if maxDepth > 0 && (depth < 0 || depth > maxDepth) {
+			depth = maxDepth
+		}
+
+		if !canAccess(log, w, r, fs, obscureNotFound, id, permRead) {
+			return
+		}
+
+		tree, e := fs.Tree(r.Context(), id, depth)
+		if errors.Is(e, context.DeadlineExceeded) {
+			sendError(log, w, http.StatusServiceUnavailable, "handler timeout")
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusNotFound, fmt.Sprintf("tree: %v", e))
+			return
+		}
+
+		username, _ := userFromContext(r)
+		if tree.Children, e = readableChildren(fs, tree.Children, username); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("read meta: %v", e))
+			return
+		}
+
+		sendOK(log, w, tree)
+	})
+}
+
+// readableBy tells whether the user can read a record
+func readableBy(fs *fs.Fs, username string) func(u id.ID) (bool, error) {
+	return func(u id.ID) (bool, error) {
+		return fs.CanAccess(u, username, permRead)
+	}
+}
+
+// readableChildren leaves out the subtrees the user can't read, names
+// included
+func readableChildren(fs *fs.Fs, children []treeNode, username string) ([]treeNode, error) {
+	var kept []treeNode
+	for _, c := range children {
+		ok, err := fs.CanAccess(c.ID, username, permRead)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if c.Children, err = readableChildren(fs, c.Children, username); err != nil {
+			return nil, err
+		}
+		kept = append(kept, c)
+	}
+	return kept, nil
+}
+
+func handleDetach(fs *fs.Fs, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		if id == fs.GetRoot() {
+			sendError(log, w, http.StatusBadRequest, "can't detach the root")
+			return
+		}
+
+		if e = fs.Detach(r.Context(), id); e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("detach: %v", e))
 			return
 		}
 
@@ -285,9 +2414,31 @@ func handleUnmount(fs *fs.Fs, log *slog.Logger) http.Handler {
 	})
 }
 
-func handleDeleteUser(secret string, log *slog.Logger, userStore userStore) http.Handler {
+// handleDeleteUser deletes the user. Their permissions on the records are
+// cleaned up first as the deletedFiles mode says, so that a failed cleanup can
+// be retried
+func handleDeleteUser(secret string, log *slog.Logger, userStore userStore, fs *fs.Fs, deletedFiles string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		targetUser := r.PathValue("username")
+
+		if exists, err := userStore.userExists(targetUser); err != nil || !exists {
+			sendError(log, w, http.StatusNotFound, "username not found")
+			return
+		}
+
+		if deletedFiles != deletedUserKeep {
+			heir := ""
+			if deletedFiles == deletedUserReassign {
+				heir = adminUsername
+			}
+			changed, err := fs.ForgetUser(r.Context(), targetUser, heir)
+			if err != nil {
+				sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("clean up files: %v", err))
+				return
+			}
+			log.Info("cleaned up files of deleted user", "user", targetUser, "heir", heir, "records", changed)
+		}
+
 		err := userStore.deleteUser(targetUser)
 
 		if err != nil {
@@ -298,3 +2449,396 @@ func handleDeleteUser(secret string, log *slog.Logger, userStore userStore) http
 		sendOK(log, w, nil)
 	})
 }
+
+// handleOwned lists the records created by the user. The list is streamed
+// while walking the tree, an error once it started can't change the status
+// any more and ends the body with ok false and the error instead
+func handleOwned(fs *fs.Fs, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+
+		out := &okArrayWriter{w: w}
+		e := fs.OwnedBy(r.Context(), fs.GetRoot(), username, func(u id.ID) error {
+			return out.add(u)
+		})
+		if e != nil && out.n > 0 {
+			log.Error("handleOwned", "error", e)
+			if e = out.fail(fmt.Sprintf("owned: %v", e)); e != nil {
+				log.Error("handleOwned", "error", e)
+			}
+			return
+		}
+		if errors.Is(e, context.DeadlineExceeded) {
+			sendError(log, w, http.StatusServiceUnavailable, "handler timeout")
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("owned: %v", e))
+			return
+		}
+
+		if e = out.close(); e != nil {
+			log.Error("handleOwned", "error", e)
+		}
+	})
+}
+
+// handleConfig reports the configuration the server runs with. The secret is
+// deliberately not part of the response
+func handleConfig(conf config, log *slog.Logger) http.Handler {
+	type configResponse struct {
+		Host        string `json:"host"`
+		Port        string `json:"port"`
+		H2C         bool   `json:"h2c"`
+		DataDir     string `json:"dataDir"`
+		RootID      id.ID  `json:"rootId"`
+		RoutePrefix string `json:"routePrefix"`
+
+		TokenTTL       string `json:"tokenTtl"`
+		CacheMaxAge    string `json:"cacheMaxAge"`
+		HandlerTimeout string `json:"handlerTimeout"`
+
+		DirPerm           string `json:"dirPerm"`
+		FilePerm          string `json:"filePerm"`
+		MaxChildren       int    `json:"maxChildren"`
+		MaxDepth          int    `json:"maxDepth"`
+		MaxTreeDepth      int    `json:"maxTreeDepth"`
+		NormalizeNames    bool   `json:"normalizeNames"`
+		FoldNameCase      bool   `json:"foldNameCase"`
+		Checksums         bool   `json:"checksums"`
+		InheritPerms      bool   `json:"inheritPerms"`
+		Shard             bool   `json:"shard"`
+		RecordCache       int    `json:"recordCache"`
+		SectionCacheLimit int64  `json:"sectionCacheLimit"`
+		VerifyOnStart     bool   `json:"verifyOnStart"`
+		StrictVerify      bool   `json:"strictVerify"`
+
+		AllowPrehashedLogin bool     `json:"allowPrehashedLogin"`
+		SessionCookie       bool     `json:"sessionCookie"`
+		UsernameMinLen      int      `json:"usernameMinLen"`
+		UsernameMaxLen      int      `json:"usernameMaxLen"`
+		ReservedUsernames   []string `json:"reservedUsernames"`
+		ObscureNotFound     bool     `json:"obscureNotFound"`
+		ImportMaxEntries    int      `json:"importMaxEntries"`
+		ImportTimeout       string   `json:"importTimeout"`
+		DeletedUserFiles    string   `json:"deletedUserFiles"`
+		AccessLogFormat     string   `json:"accessLogFormat"`
+		RevokedReapInterval string   `json:"revokedReapInterval"`
+
+		// the live tunables, see reloadConfig
+		MaxUploadBytes int64  `json:"maxUploadBytes"`
+		LogLevel       string `json:"logLevel"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		live := conf.live.Load()
+		sendOK(log, w, configResponse{
+			Host:        conf.host,
+			Port:        conf.port,
+			H2C:         conf.h2c,
+			DataDir:     conf.dataDir,
+			RootID:      conf.rootID,
+			RoutePrefix: conf.routePrefix,
+
+			TokenTTL:       tokenTTL.String(),
+			CacheMaxAge:    conf.cacheMaxAge.String(),
+			HandlerTimeout: conf.handlerTimeout.String(),
+
+			DirPerm:           fmt.Sprintf("%#o", conf.dirPerm),
+			FilePerm:          fmt.Sprintf("%#o", conf.filePerm),
+			MaxChildren:       conf.maxChildren,
+			MaxDepth:          conf.maxDepth,
+			MaxTreeDepth:      conf.maxTreeDepth,
+			NormalizeNames:    conf.normalizeNames,
+			FoldNameCase:      conf.foldNameCase,
+			Checksums:         conf.checksums,
+			InheritPerms:      conf.inheritPerms,
+			Shard:             conf.shard,
+			RecordCache:       conf.recordCache,
+			SectionCacheLimit: conf.sectionCacheLimit,
+			VerifyOnStart:     conf.verifyOnStart || conf.strictVerify,
+			StrictVerify:      conf.strictVerify,
+
+			AllowPrehashedLogin: conf.allowPrehashedLogin,
+			SessionCookie:       conf.sessionCookie,
+			UsernameMinLen:      conf.usernamePolicy.minLen,
+			UsernameMaxLen:      conf.usernamePolicy.maxLen,
+			ReservedUsernames:   append([]string{}, conf.usernamePolicy.reserved...),
+			ObscureNotFound:     conf.obscureNotFound,
+			ImportMaxEntries:    conf.importMaxEntries,
+			ImportTimeout:       conf.importTimeout.String(),
+			DeletedUserFiles:    conf.deletedUserFiles,
+			AccessLogFormat:     conf.accessLogFormat,
+			RevokedReapInterval: conf.revokedReapInterval.String(),
+
+			MaxUploadBytes: live.maxUploadBytes,
+			LogLevel:       live.logLevel.String(),
+		})
+	})
+}
+
+// handleSnapshot streams a backup of the whole fs as a tar
+func handleSnapshot(fs *fs.Fs, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "archiiv-" + time.Now().UTC().Format("20060102-150405") + ".tar"
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", contentDisposition(name, false))
+
+		// like the bundle, errors past the first write can only cut the
+		// stream short
+		if e := fs.Snapshot(w); e != nil {
+			log.Error("handleSnapshot", "error", e)
+		}
+	})
+}
+
+// handleRestore fills an empty fs from a snapshot made by handleSnapshot
+func handleRestore(fs *fs.Fs, maxEntries int, timeout time.Duration, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, cancel := importDeadline(w, r, timeout)
+		defer cancel()
+
+		e := fs.Restore(r.Context(), r.Body, maxEntries)
+		if errors.Is(e, errFsNotEmpty) {
+			sendError(log, w, http.StatusConflict, e.Error())
+			return
+		}
+		if errors.Is(e, errTooMany) {
+			sendError(log, w, http.StatusRequestEntityTooLarge, fmt.Sprintf("restore: %v, nothing restored", e))
+			return
+		}
+		if errors.Is(e, context.DeadlineExceeded) || errors.Is(e, os.ErrDeadlineExceeded) {
+			sendError(log, w, http.StatusServiceUnavailable, "restore timed out, nothing restored")
+			return
+		}
+		if errors.Is(e, syscall.ENOSPC) {
+			sendWriteError(log, w, "restore", e)
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("restore: %v", e))
+			return
+		}
+
+		log.Info("restored snapshot")
+		sendOK(log, w, nil)
+	})
+}
+
+// handleImport brings a snapshot made by handleSnapshot into a directory of
+// the live fs, keeping the IDs of its records
+func handleImport(fs *fs.Fs, maxEntries int, timeout time.Duration, log *slog.Logger) http.Handler {
+	type OkResponse struct {
+		Imported int `json:"imported"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dir, e := id.Parse(r.PathValue("id"))
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("parse id: %v", e))
+			return
+		}
+
+		r, cancel := importDeadline(w, r, timeout)
+		defer cancel()
+
+		n, e := fs.Import(r.Context(), dir, r.Body, maxEntries)
+		if errors.Is(e, errNotFound) || errors.Is(e, errExists) || errors.Is(e, errNotDir) {
+			sendFsError(log, w, "import", e)
+			return
+		}
+		if errors.Is(e, errTooMany) {
+			sendError(log, w, http.StatusRequestEntityTooLarge, fmt.Sprintf("import: %v, nothing imported", e))
+			return
+		}
+		if errors.Is(e, context.DeadlineExceeded) || errors.Is(e, os.ErrDeadlineExceeded) {
+			sendError(log, w, http.StatusServiceUnavailable, fmt.Sprintf("import timed out after %d records", n))
+			return
+		}
+		if errors.Is(e, syscall.ENOSPC) {
+			sendWriteError(log, w, "import", e)
+			return
+		}
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("import: %v", e))
+			return
+		}
+
+		log.Info("imported snapshot", "dir", dir, "records", n)
+		sendOK(log, w, OkResponse{Imported: n})
+	})
+}
+
+// handleCreateUser creates a user with the password from the JSON body, in
+// any form login takes. It isn't in the path, which ends up in the access log
+func handleCreateUser(log *slog.Logger, userStore userStore) http.Handler {
+	type createRequest struct {
+		Password *loginPassword `json:"password"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+
+		if e := userStore.usernameIsSane(username); e != nil {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+
+		req, e := decode[createRequest](r)
+		if e != nil {
+			sendError(log, w, http.StatusBadRequest, e.Error())
+			return
+		}
+		if req.Password == nil {
+			sendError(log, w, http.StatusBadRequest, "password is missing")
+			return
+		}
+
+		exists, e := userStore.userExists(username)
+		if e != nil {
+			sendError(log, w, http.StatusInternalServerError, fmt.Sprintf("user exists: %v", e))
+			return
+		}
+		if exists {
+			sendError(log, w, http.StatusConflict, "user already exists")
+			return
+		}
+
+		if e = userStore.setUserPassword(username, req.Password.hash); e != nil {
+			sendWriteError(log, w, "set password", e)
+			return
+		}
+
+		log.Info("created user", "user", username)
+		sendOK(log, w, nil)
+	})
+}
+
+// importTruncatedHeader marks an import that stopped early, see
+// handleImportUsers. The value says why
+const importTruncatedHeader = "Import-Truncated"
+
+// importDeadline bounds the time an import can take. The read deadline stops
+// bodies that trickle in, the context the work on what was already read
+func importDeadline(w http.ResponseWriter, r *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	if timeout <= 0 {
+		return r, func() {}
+	}
+
+	deadline := time.Now().Add(timeout)
+	// not every writer supports it (like the test recorder), the context
+	// still applies then
+	_ = http.NewResponseController(w).SetReadDeadline(deadline)
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	return r.WithContext(ctx), cancel
+}
+
+// handleImportUsers creates users from a JSON array of {username, password}
+// and reports the outcome of every row. With ?strict=true one invalid row
+// rejects the whole batch before anything is written. Only the first
+// maxEntries rows and the rows read before the timeout are imported, the
+// response to such a partial import carries the Import-Truncated header
+func handleImportUsers(log *slog.Logger, userStore userStore, maxEntries int, timeout time.Duration) http.Handler {
+	type importRow struct {
+		Username string         `json:"username"`
+		Password *loginPassword `json:"password"`
+	}
+
+	type rowResult struct {
+		Username string `json:"username"`
+		Ok       bool   `json:"ok"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, cancel := importDeadline(w, r, timeout)
+		defer cancel()
+
+		dec := json.NewDecoder(r.Body)
+		if tok, e := dec.Token(); e != nil || tok != json.Delim('[') {
+			sendError(log, w, http.StatusBadRequest, "decode json: expected an array of users")
+			return
+		}
+
+		var rows []importRow
+		truncated := ""
+		for dec.More() {
+			if maxEntries > 0 && len(rows) >= maxEntries {
+				truncated = fmt.Sprintf("more than %d entries", maxEntries)
+				break
+			}
+			if r.Context().Err() != nil {
+				truncated = "timeout"
+				break
+			}
+
+			var row importRow
+			if e := dec.Decode(&row); errors.Is(e, os.ErrDeadlineExceeded) {
+				truncated = "timeout"
+				break
+			} else if e != nil {
+				sendError(log, w, http.StatusBadRequest, fmt.Sprintf("decode json: %v", e))
+				return
+			}
+			rows = append(rows, row)
+		}
+
+		strict := r.URL.Query().Get("strict") == "true"
+		if strict && truncated != "" {
+			sendError(log, w, http.StatusBadRequest, fmt.Sprintf("nothing imported, %s", truncated))
+			return
+		}
+
+		results := make([]rowResult, len(rows))
+		valid := true
+		// userExists sees only the users on disk, not the earlier rows
+		seen := make(map[string]bool)
+		for i, row := range rows {
+			results[i].Username = row.Username
+
+			exists, e := userStore.userExists(row.Username)
+			switch {
+			case e != nil:
+				results[i].Error = e.Error()
+			case exists:
+				results[i].Error = "user already exists"
+			case seen[row.Username]:
+				results[i].Error = "duplicate username"
+			case row.Password == nil:
+				results[i].Error = "password is missing"
+			}
+			if results[i].Error != "" {
+				valid = false
+			}
+			seen[row.Username] = true
+		}
+
+		if strict && !valid {
+			for _, res := range results {
+				if res.Error != "" {
+					sendError(log, w, http.StatusBadRequest, fmt.Sprintf("nothing imported, %s: %s", res.Username, res.Error))
+					return
+				}
+			}
+		}
+
+		for i, row := range rows {
+			if results[i].Error != "" {
+				continue
+			}
+
+			if e := userStore.setUserPassword(row.Username, row.Password.hash); e != nil {
+				results[i].Error = e.Error()
+				continue
+			}
+			results[i].Ok = true
+			log.Info("imported user", "user", row.Username)
+		}
+
+		if truncated != "" {
+			log.Warn("user import truncated", "reason", truncated, "rows", len(rows))
+			w.Header().Set(importTruncatedHeader, truncated)
+		}
+		sendOK(log, w, results)
+	})
+}
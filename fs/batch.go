@@ -0,0 +1,167 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"archiiv/id"
+)
+
+// temporary files live in the fs root so that renaming them into place is
+// atomic. loadRecords removes any that are left behind
+const tempFilePrefix = ".tmp-"
+
+// SectionBatch writes several sections of one record at once. Sections are
+// written into temporary files first and only replace the real ones on
+// Commit, so a failure while the content is being written or put in place
+// never leaves the record half updated. Only a crash during Commit can
+type SectionBatch struct {
+	fs    *Fs
+	file  id.ID
+	temps map[string]*os.File
+}
+
+func (fs *Fs) NewSectionBatch(file id.ID) (*SectionBatch, error) {
+	if _, err := fs.record(file); err != nil {
+		return nil, err
+	}
+	return &SectionBatch{fs: fs, file: file, temps: make(map[string]*os.File)}, nil
+}
+
+// Create returns a writer for the new content of the section. Each section can
+// be created only once per batch
+func (b *SectionBatch) Create(section string) (io.Writer, error) {
+	if err := checkSectionNameSanity(section); err != nil {
+		return nil, err
+	}
+
+	if _, ok := b.temps[section]; ok {
+		return nil, fmt.Errorf("section %v %w in the batch", section, ErrExists)
+	}
+
+	f, err := os.CreateTemp(b.fs.basePath, tempFilePrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Chmod(b.fs.opts.filePerm()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	b.temps[section] = f
+	return f, nil
+}
+
+// Commit puts all written sections in place. The batch can't be used after
+func (b *SectionBatch) Commit() error {
+	sections := make([]string, 0, len(b.temps))
+	for section := range b.temps {
+		sections = append(sections, section)
+	}
+	// sorted so that two batches on the same record don't deadlock
+	slices.Sort(sections)
+
+	for _, section := range sections {
+		defer b.fs.LockSection(b.file, section)()
+	}
+
+	var errs []error
+	for _, section := range sections {
+		if err := b.temps[section].Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		b.Abort()
+		return err
+	}
+
+	// the content being replaced is kept as a hard link until all sections
+	// are in place, so that a failed rename can put back the ones before it.
+	// The links are temporary files, a crash leaves them for loadRecords
+	backups := make(map[string]string)
+	defer func() {
+		for _, backup := range backups {
+			os.Remove(backup)
+		}
+	}()
+	for _, section := range sections {
+		backup := b.temps[section].Name() + ".old"
+		err := os.Link(b.fs.getSectionFileName(b.file, section), backup)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			b.Abort()
+			return err
+		}
+		backups[section] = backup
+	}
+
+	for i, section := range sections {
+		err := os.Rename(b.temps[section].Name(), b.fs.getSectionFileName(b.file, section))
+		if err != nil {
+			b.rollback(sections[:i], backups)
+			b.Abort()
+			return err
+		}
+		b.fs.indexSection(b.file, section, true)
+		b.fs.invalidateSection(b.file, section)
+	}
+
+	for _, section := range sections {
+		delete(b.temps, section)
+	}
+	return nil
+}
+
+// rollback puts back what the sections contained before Commit replaced them,
+// the ones that didn't exist are removed again
+func (b *SectionBatch) rollback(sections []string, backups map[string]string) {
+	for _, section := range sections {
+		name := b.fs.getSectionFileName(b.file, section)
+		if backup, ok := backups[section]; ok {
+			os.Rename(backup, name)
+		} else {
+			os.Remove(name)
+			b.fs.indexSection(b.file, section, false)
+		}
+		b.fs.invalidateSection(b.file, section)
+	}
+}
+
+// Abort throws away everything written in the batch
+func (b *SectionBatch) Abort() {
+	for section, f := range b.temps {
+		f.Close()
+		os.Remove(f.Name())
+		delete(b.temps, section)
+	}
+}
+
+// PutSection replaces the section with everything read from r and returns the
+// number of bytes written. The content goes through a temporary file, so if r
+// fails midway the old content stays untouched
+func (fs *Fs) PutSection(file id.ID, section string, r io.Reader) (int64, error) {
+	b, err := fs.NewSectionBatch(file)
+	if err != nil {
+		return 0, err
+	}
+
+	w, err := b.Create(section)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		b.Abort()
+		return n, err
+	}
+
+	return n, b.Commit()
+}
@@ -0,0 +1,149 @@
+package fs
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"weak"
+
+	"archiiv/id"
+)
+
+// With Options.RecordCache only the most recently used records are kept in
+// memory, the rest is read from its file whenever it is needed. What can't be
+// read back from the file (the reference count, the version and the lock)
+// lives in a small recordState that is kept for every record.
+//
+// A record that is dropped from the cache stays alive for as long as anyone
+// still holds it. Fs finds it through a weak pointer and hands out the same
+// one, so there are never two copies of a record to be changed independently
+
+// recordState is the part of a record that stays in memory even when the
+// record itself is evicted
+type recordState struct {
+	refs uint
+	// version is bumped on every change of Children. It lives only in
+	// memory, see Fs.epoch
+	version uint64
+	// mutex locks the record. It is also held while the record is being
+	// read from its file
+	mutex sync.Mutex
+
+	// loaded is the record while it is in memory. Without a record cache
+	// pinned keeps it there for good
+	loaded weak.Pointer[record]
+	pinned *record
+
+	// sections is the index of the section files the record has, so that
+	// neither deleting the record nor reading it again after an eviction
+	// has to list the fs root. Guarded by mutex
+	sections map[string]bool
+}
+
+// recordCache keeps the most recently used records alive
+type recordCache struct {
+	mutex    sync.Mutex
+	capacity int
+	order    *list.List // of *record, the most recent first
+	elements map[id.ID]*list.Element
+}
+
+func newRecordCache(capacity int) *recordCache {
+	return &recordCache{
+		capacity: capacity,
+		order:    list.New(),
+		elements: make(map[id.ID]*list.Element),
+	}
+}
+
+// use marks the record as the most recently used one, evicting the least
+// recently used if the cache is full
+func (c *recordCache) use(r *record) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.elements[r.id]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.elements[r.id] = c.order.PushFront(r)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.elements, oldest.Value.(*record).id)
+	}
+}
+
+func (c *recordCache) remove(u id.ID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.elements[u]; ok {
+		c.order.Remove(e)
+		delete(c.elements, u)
+	}
+}
+
+// attach makes r the in-memory form of the record described by st
+func (fs *Fs) attach(r *record, st *recordState) {
+	r.recordState = st
+	st.loaded = weak.Make(r)
+	if fs.cache == nil {
+		st.pinned = r
+	} else {
+		fs.cache.use(r)
+	}
+}
+
+// load returns the record of the state, reading it from its file if it isn't
+// in memory
+func (fs *Fs) load(u id.ID, st *recordState) (*record, error) {
+	if r := st.loaded.Value(); r != nil {
+		if fs.cache != nil {
+			fs.cache.use(r)
+		}
+		return r, nil
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	// someone else could have read it while we waited
+	if r := st.loaded.Value(); r != nil {
+		return r, nil
+	}
+
+	r, err := fs.readRecord(u)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.attach(r, st)
+	return r, nil
+}
+
+// readRecord decodes the record file of u
+func (fs *Fs) readRecord(u id.ID) (*record, error) {
+	f, err := os.Open(fs.path(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rec := new(record)
+	if err = json.NewDecoder(f).Decode(rec); err != nil {
+		return nil, fmt.Errorf("json decore err: %w", err)
+	}
+
+	if fs.opts.Checksums {
+		if err = verifyRecordChecksum(rec); err != nil {
+			return nil, fmt.Errorf("record %s: %w", u, err)
+		}
+	}
+
+	rec.id = u
+	return rec, nil
+}
@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordCache(t *testing.T) {
+	t.Parallel()
+
+	fs := newTestFsWithOptions(t, Options{RecordCache: 2})
+	root := fs.GetRoot()
+
+	docs, err := fs.Mkdir(root, "docs")
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		file, err := fs.Touch(docs, name)
+		require.NoError(t, err)
+		writeSection(t, fs, file, "data", name)
+	}
+	other, err := fs.Mkdir(root, "other")
+	require.NoError(t, err)
+
+	// drop everything that isn't in the cache
+	runtime.GC()
+	assert.LessOrEqual(t, fs.cache.order.Len(), 2)
+
+	children, err := fs.GetChildren(docs)
+	require.NoError(t, err)
+	require.Len(t, children, 4)
+
+	// reading an evicted record again takes its sections from the index
+	// instead of listing the fs root
+	stray := filepath.Join(fs.basePath, children[1].String()+".stray")
+	require.NoError(t, os.WriteFile(stray, nil, 0o600))
+	runtime.GC()
+	assert.Nil(t, fs.states[children[1]].loaded.Value())
+	r, err := fs.record(children[1])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data"}, r.sectionNames())
+	r = nil
+	require.NoError(t, os.Remove(stray))
+
+	require.NoError(t, fs.Mount(other, children[0]))
+	runtime.GC()
+	r, err = fs.record(children[0])
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), r.refs)
+	r = nil
+
+	require.NoError(t, fs.Unmount(docs, children[0]))
+	runtime.GC()
+	r, err = fs.record(children[0])
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), r.refs)
+	assert.Equal(t, []string{"data"}, r.sectionNames())
+	r = nil
+
+	// unmounting the last reference deletes the record with its sections
+	require.NoError(t, fs.Unmount(other, children[0]))
+	runtime.GC()
+	_, err = fs.Stat(children[0])
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(fs.basePath, children[0].String()+".data"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	content := walkContent(t, fs)
+	assert.Len(t, content, 6)
+
+	problems, err := fs.Fsck(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// the cache doesn't change what ends up on disk
+	require.NoError(t, fs.Close())
+	loaded, err := NewFs(root, fs.basePath, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, content, walkContent(t, loaded))
+}
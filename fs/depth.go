@@ -0,0 +1,136 @@
+package fs
+
+import (
+	"fmt"
+	"sync"
+
+	"archiiv/id"
+)
+
+// longestPaths returns the length of the longest path from u to every record
+// reachable from it, u itself is 0. It doesn't recurse, so it works on trees
+// of any depth
+func (fs *Fs) longestPaths(u id.ID) map[id.ID]int {
+	children := make(map[id.ID][]id.ID)
+	incoming := make(map[id.ID]int)
+	queue := []id.ID{u}
+	children[u] = nil
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+
+		r, err := fs.record(v)
+		if err != nil {
+			continue
+		}
+		children[v] = r.children()
+		for _, c := range children[v] {
+			incoming[c]++
+			if _, seen := children[c]; !seen {
+				children[c] = nil
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	// the records in topological order, each is done once all of its
+	// parents are
+	lengths := map[id.ID]int{u: 0}
+	queue = []id.ID{u}
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		for _, c := range children[v] {
+			lengths[c] = max(lengths[c], lengths[v]+1)
+			incoming[c]--
+			if incoming[c] == 0 {
+				queue = append(queue, c)
+			}
+		}
+	}
+	return lengths
+}
+
+// checkDepthLimit checks that a child with records below it down to height
+// can be mounted into parent without going deeper than Options.MaxDepth
+func (fs *Fs) checkDepthLimit(parent id.ID, height int) error {
+	if fs.opts.MaxDepth <= 0 {
+		return nil
+	}
+
+	depth := fs.depth(parent) + 1 + height
+	if depth > fs.opts.MaxDepth {
+		return fmt.Errorf("depth %d %w (limit is %d)", depth, ErrTooDeep, fs.opts.MaxDepth)
+	}
+	return nil
+}
+
+// height is the length of the longest path from u down to a leaf
+func (fs *Fs) height(u id.ID) int {
+	height := 0
+	for _, l := range fs.longestPaths(u) {
+		height = max(height, l)
+	}
+	return height
+}
+
+// checkWalkDepth guards the recursive walks against trees deeper than
+// Options.MaxDepth, which could only come from before the limit was set
+func (fs *Fs) checkWalkDepth(depth int) error {
+	if fs.opts.MaxDepth > 0 && depth > fs.opts.MaxDepth {
+		return fmt.Errorf("walk %w (limit is %d)", ErrTooDeep, fs.opts.MaxDepth)
+	}
+	return nil
+}
+
+// depthCache keeps the depths of the records, the lengths of the longest
+// paths to them from the root. Finding them walks the whole tree, so they are
+// kept until a change of some children may have changed them. A new record
+// only adds its own depth, the others stay
+type depthCache struct {
+	lock   sync.Mutex
+	depths map[id.ID]int // nil when not known
+	// bumped by every invalidation, so that depths found before one are
+	// not stored after it
+	generation uint64
+}
+
+// depth is the length of the longest path from the root to u
+func (fs *Fs) depth(u id.ID) int {
+	c := &fs.depths
+	c.lock.Lock()
+	if d, ok := c.depths[u]; ok {
+		c.lock.Unlock()
+		return d
+	}
+	generation := c.generation
+	c.lock.Unlock()
+
+	depths := fs.longestPaths(fs.root)
+
+	c.lock.Lock()
+	if c.generation == generation {
+		c.depths = depths
+	}
+	c.lock.Unlock()
+	return depths[u]
+}
+
+// addDepth records the depth of a record just created in parent
+func (fs *Fs) addDepth(parent, child id.ID) {
+	c := &fs.depths
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if d, ok := c.depths[parent]; ok {
+		c.depths[child] = max(c.depths[child], d+1)
+	}
+}
+
+// depthsChanged throws the depths away after the children of a record changed
+func (fs *Fs) depthsChanged() {
+	c := &fs.depths
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.depths = nil
+	c.generation++
+}
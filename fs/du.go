@@ -0,0 +1,39 @@
+package fs
+
+import (
+	"context"
+	"strings"
+
+	"archiiv/id"
+)
+
+// DiskUsage sums the sizes of the sections of every record reachable from
+// root. A record mounted in several places is counted once
+func (fs *Fs) DiskUsage(ctx context.Context, root id.ID) (int64, error) {
+	entries, err := listStoreFiles(fs.basePath)
+	if err != nil {
+		return 0, err
+	}
+
+	// one pass over the fs root instead of listing it for every record
+	sizes := make(map[string]int64)
+	for _, e := range entries {
+		recordName, _, isSection := strings.Cut(e.Name(), ".")
+		if !isSection || recordName == "" {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return 0, err
+		}
+		sizes[recordName] += info.Size()
+	}
+
+	var total int64
+	err = fs.Walk(ctx, root, func(path string, info FileInfo) error {
+		total += sizes[info.ID.String()]
+		return nil
+	})
+	return total, err
+}
@@ -0,0 +1,49 @@
+package fs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"archiiv/id"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskUsage(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+
+	a, err := fs.Mkdir(fs.GetRoot(), "a")
+	require.NoError(t, err)
+	b, err := fs.Mkdir(fs.GetRoot(), "b")
+	require.NoError(t, err)
+
+	shared, err := fs.Touch(a, "shared")
+	require.NoError(t, err)
+	writeSection(t, fs, shared, "data", strings.Repeat("x", 1000))
+	writeSection(t, fs, shared, "thumb", strings.Repeat("x", 100))
+	require.NoError(t, fs.Mount(b, shared))
+
+	onlyB, err := fs.Touch(b, "only b")
+	require.NoError(t, err)
+	writeSection(t, fs, onlyB, "data", strings.Repeat("x", 10))
+
+	writeSection(t, fs, a, "meta", "{}")
+
+	for _, tt := range []struct {
+		name string
+		root id.ID
+		want int64
+	}{
+		{"root counts shared once", fs.GetRoot(), 1112},
+		{"a", a, 1102},
+		{"b", b, 1110},
+		{"file", onlyB, 10},
+	} {
+		du, err := fs.DiskUsage(context.Background(), tt.root)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, du, tt.name)
+	}
+}
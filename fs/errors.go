@@ -0,0 +1,15 @@
+package fs
+
+import "errors"
+
+// The errors returned by Fs wrap these, so callers can tell the cases apart
+// with errors.Is instead of matching the text
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrExists      = errors.New("already exists")
+	ErrCycle       = errors.New("would create a cycle")
+	ErrNotDir      = errors.New("not a directory")
+	ErrInvalidName = errors.New("invalid name")
+	ErrTooDeep     = errors.New("is too deep")
+	ErrLocked      = errors.New("is used by another process")
+)
@@ -0,0 +1,58 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"archiiv/id"
+)
+
+func TestSentinelErrors(t *testing.T) {
+	t.Parallel()
+
+	fs := newTestFs(t)
+	root := fs.GetRoot()
+	dir, err := fs.Mkdir(root, "dir")
+	require.NoError(t, err)
+	sub, err := fs.Mkdir(dir, "sub")
+	require.NoError(t, err)
+	file, err := fs.Touch(dir, "file")
+	require.NoError(t, err)
+	writeSection(t, fs, file, "data", "x")
+	writeSection(t, fs, file, "other", "x")
+
+	batch, err := fs.NewSectionBatch(file)
+	require.NoError(t, err)
+	defer batch.Abort()
+	_, err = batch.Create("data")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name string
+		err  func() error
+		want error
+	}{
+		{"stat missing", func() error { _, err := fs.Stat(id.New()); return err }, ErrNotFound},
+		{"touch into missing", func() error { _, err := fs.Touch(id.New(), "x"); return err }, ErrNotFound},
+		{"mount missing", func() error { return fs.Mount(dir, id.New()) }, ErrNotFound},
+		{"unmount not mounted", func() error { return fs.Unmount(sub, file) }, ErrNotFound},
+		{"mount twice", func() error { return fs.Mount(dir, file) }, ErrExists},
+		{"rename onto existing", func() error { return fs.RenameSection(file, "data", "other") }, ErrExists},
+		{"rename onto existing is a section", func() error { return fs.RenameSection(file, "data", "other") }, ErrSectionExists},
+		{"section twice in batch", func() error { _, err := batch.Create("data"); return err }, ErrExists},
+		{"mount into itself", func() error { return fs.Mount(dir, dir) }, ErrCycle},
+		{"mount into descendant", func() error { return fs.Mount(sub, dir) }, ErrCycle},
+		{"mount root", func() error { return fs.Mount(dir, root) }, ErrCycle},
+		{"touch into file", func() error { _, err := fs.Touch(file, "x"); return err }, ErrNotDir},
+		{"mount into file", func() error { return fs.Mount(file, sub) }, ErrNotDir},
+		{"bad section name", func() error { _, err := fs.OpenSection(file, "../x"); return err }, ErrInvalidName},
+		{"reserved section name", func() error { _, err := fs.CreateSection(file, root.String()); return err }, ErrInvalidName},
+		{"rename meta", func() error { return fs.RenameSection(file, "meta", "x") }, ErrInvalidName},
+		{"move onto meta", func() error { return fs.MoveSection(file, "data", sub, "meta") }, ErrInvalidName},
+		{"move meta out", func() error { return fs.MoveSection(file, "meta", sub, "x") }, ErrInvalidName},
+	} {
+		assert.ErrorIs(t, tc.err(), tc.want, tc.name)
+	}
+}
@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"sync"
+
+	"archiiv/id"
+)
+
+const (
+	EventCreate  = "create"
+	EventDelete  = "delete"
+	EventMount   = "mount"
+	EventUnmount = "unmount"
+	// EventRename is a section renamed or moved, from OldSection of From
+	// to Section of ID. It has no Parent
+	EventRename = "rename"
+)
+
+// Event describes one change of the tree. Parent is the directory whose
+// listing changed, for deletes it's the one the record was last unmounted
+// from
+type Event struct {
+	Type   string `json:"type"`
+	ID     id.ID  `json:"id"`
+	Parent id.ID  `json:"parent"`
+	Name   string `json:"name,omitempty"`
+
+	Section    string `json:"section,omitempty"`
+	From       id.ID  `json:"from,omitzero"`
+	OldSection string `json:"old_section,omitempty"`
+}
+
+// subscriberBuffer is how many events a subscriber can lag behind before it
+// is dropped
+const subscriberBuffer = 64
+
+type eventBus struct {
+	lock sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel receiving every event from now on, and
+// a function to stop receiving them. Publishing never blocks, so a subscriber
+// that can't keep up gets its channel closed and has to resubscribe
+func (fs *Fs) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	fs.events.lock.Lock()
+	if fs.events.subs == nil {
+		fs.events.subs = make(map[chan Event]struct{})
+	}
+	fs.events.subs[ch] = struct{}{}
+	fs.events.lock.Unlock()
+
+	return ch, func() {
+		fs.events.lock.Lock()
+		defer fs.events.lock.Unlock()
+		if _, ok := fs.events.subs[ch]; ok {
+			delete(fs.events.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (fs *Fs) publish(ev Event) {
+	fs.events.lock.Lock()
+	defer fs.events.lock.Unlock()
+
+	for ch := range fs.events.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(fs.events.subs, ch)
+			close(ch)
+		}
+	}
+}
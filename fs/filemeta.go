@@ -1,7 +1,13 @@
 package fs
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"time"
 
 	"archiiv/id"
 )
@@ -10,17 +16,82 @@ const (
 	PermOwner = uint8(1 << iota)
 	PermRead
 	PermWrite
+	// PermReadMeta lets the user see the record and read its meta, but not
+	// the content of its other sections. PermRead implies it
+	PermReadMeta
 )
 
+// PermEveryone is the Perms key whose bits apply to every logged-in user
+const PermEveryone = "*"
+
 // FileMeta contains the metadata asociated with each file. It is saved in the
 // 'meta' section
 type FileMeta struct {
-	Id        id.ID            `json:"id"`
-	Type      string           `json:"type"`
-	Perms     map[string]uint8 `json:"perms"`
-	Hooks     []string         `json:"hooks"`
-	CreatedBy string           `json:"createdBy"`
-	CreatedAt uint64           `json:"createdAt"`
+	Id id.ID `json:"id"`
+	// SectionTypes maps section names to their media types
+	SectionTypes map[string]string `json:"sectionTypes"`
+	// SectionEncodings marks sections stored compressed, see EncodingGzip
+	SectionEncodings map[string]string `json:"sectionEncodings,omitempty"`
+	// SectionChecksums are the checksums the sections were verified
+	// against when uploaded, as "sha256:<hex>" or "md5:<hex>"
+	SectionChecksums map[string]string `json:"sectionChecksums,omitempty"`
+	// SectionsWritten is how much of the allocated sections that aren't
+	// whole yet has been written from their start, see Fs.AllocateSection
+	SectionsWritten map[string]int64 `json:"sectionsWritten,omitempty"`
+	Perms           map[string]uint8 `json:"perms"`
+	// DefaultChildPerms are the bits a directory grants on the records
+	// created in it, on top of what the creator gets
+	DefaultChildPerms map[string]uint8 `json:"defaultChildPerms,omitempty"`
+	Hooks             []string         `json:"hooks"`
+	CreatedBy         string           `json:"createdBy"`
+	// CreatedAt and ModifiedAt are Unix seconds (UTC). ModifiedAt is set on
+	// every write of the meta and never goes back, even if the clock does
+	CreatedAt  uint64 `json:"createdAt"`
+	ModifiedAt uint64 `json:"modifiedAt"`
+}
+
+// maxClockSkew is how far in the future a timestamp in the meta can be before
+// it is considered broken rather than written by a slightly faster clock
+const maxClockSkew = 24 * time.Hour
+
+var ErrClockSkew = errors.New("timestamp is in the future")
+
+func (fm FileMeta) checkClock(now time.Time) error {
+	limit := uint64(now.Add(maxClockSkew).Unix())
+	for _, ts := range []uint64{fm.CreatedAt, fm.ModifiedAt} {
+		if ts > limit {
+			return fmt.Errorf("%w (%d, limit %d)", ErrClockSkew, ts, limit)
+		}
+	}
+	return nil
+}
+
+// EncodingGzip is the section encoding of gzip compressed sections
+const EncodingGzip = "gzip"
+
+// UnmarshalJSON also accepts the old meta with a single 'type', which was
+// the type of the data section
+func (fm *FileMeta) UnmarshalJSON(data []byte) error {
+	type plain FileMeta
+	var v struct {
+		plain
+		Type string `json:"type"`
+	}
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*fm = FileMeta(v.plain)
+	if v.Type != "" {
+		if fm.SectionTypes == nil {
+			fm.SectionTypes = map[string]string{}
+		}
+		if _, ok := fm.SectionTypes["data"]; !ok {
+			fm.SectionTypes["data"] = v.Type
+		}
+	}
+	return nil
 }
 
 func ReadFileMeta(fs *Fs, file id.ID) (fm FileMeta, err error) {
@@ -30,11 +101,17 @@ func ReadFileMeta(fs *Fs, file id.ID) (fm FileMeta, err error) {
 	}
 	defer r.Close()
 
-	err = json.NewDecoder(r).Decode(&fm)
+	if err = json.NewDecoder(r).Decode(&fm); err != nil {
+		return
+	}
+
+	err = fm.checkClock(time.Now())
 	return
 }
 
 func WriteFileMeta(fs *Fs, file id.ID, fm FileMeta) error {
+	fm.ModifiedAt = max(fm.ModifiedAt, fm.CreatedAt, uint64(time.Now().Unix()))
+
 	w, err := fs.CreateSection(file, "meta")
 	if err != nil {
 		return err
@@ -44,3 +121,502 @@ func WriteFileMeta(fs *Fs, file id.ID, fm FileMeta) error {
 	enc := json.NewEncoder(w)
 	return enc.Encode(fm)
 }
+
+func emptyFileMeta(file id.ID) FileMeta {
+	return FileMeta{
+		Id:           file,
+		SectionTypes: map[string]string{},
+		Perms:        map[string]uint8{},
+		Hooks:        []string{},
+	}
+}
+
+// Meta returns the meta of the record. Records that have none yet (like the
+// root) get an empty one
+func (fs *Fs) Meta(file id.ID) (FileMeta, error) {
+	if _, err := fs.record(file); err != nil {
+		return FileMeta{}, err
+	}
+
+	fm, err := ReadFileMeta(fs, file)
+	if errors.Is(err, os.ErrNotExist) {
+		return emptyFileMeta(file), nil
+	}
+	return fm, err
+}
+
+// InitFileMeta writes the meta of a freshly created record. The creator gets
+// all permission bits. With inherit, everyone with permissions on the parent
+// keeps them on the new record too
+func (fs *Fs) InitFileMeta(parent, file id.ID, creator string, inherit bool) error {
+	fm := emptyFileMeta(file)
+	fm.CreatedBy = creator
+	fm.CreatedAt = uint64(time.Now().Unix())
+
+	pm, err := ReadFileMeta(fs, parent)
+	switch {
+	case err == nil:
+		if inherit {
+			maps.Copy(fm.Perms, pm.Perms)
+		}
+		for user, bits := range pm.DefaultChildPerms {
+			fm.Perms[user] |= bits
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// parent without meta (like the root) has nothing to inherit
+	default:
+		return err
+	}
+
+	fm.Perms[creator] |= PermOwner | PermRead | PermWrite
+
+	return WriteFileMeta(fs, file, fm)
+}
+
+// PermsOf returns the union of the user's own bits and the ones granted to
+// everyone
+func (fm FileMeta) PermsOf(user string) uint8 {
+	return fm.Perms[user] | fm.Perms[PermEveryone]
+}
+
+// CanAccess reports whether the user has all the perm bits on the file.
+// Records without meta (like the root) are accessible to everyone
+func (fs *Fs) CanAccess(file id.ID, user string, perm uint8) (bool, error) {
+	fm, err := ReadFileMeta(fs, file)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := fs.Stat(file); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	perms := fm.PermsOf(user)
+	if perms&PermRead != 0 {
+		perms |= PermReadMeta
+	}
+	return perms&perm == perm, nil
+}
+
+// CanAccessSection is CanAccess for a single section. Reading the meta
+// section takes only PermReadMeta
+func (fs *Fs) CanAccessSection(file id.ID, section, user string, perm uint8) (bool, error) {
+	if section == "meta" && perm&PermRead != 0 {
+		perm = perm&^PermRead | PermReadMeta
+	}
+	return fs.CanAccess(file, user, perm)
+}
+
+// IsOwner reports whether the user has the owner bit on the file
+func (fs *Fs) IsOwner(file id.ID, user string) (bool, error) {
+	fm, err := ReadFileMeta(fs, file)
+	if err != nil {
+		return false, err
+	}
+
+	return fm.PermsOf(user)&PermOwner != 0, nil
+}
+
+// ErrOwnerBit is returned by SetDefaultChildPerms for perms with PermOwner
+var ErrOwnerBit = errors.New("owner bit can't be granted by default")
+
+// ErrUnknownPerm is returned by SetDefaultChildPerms for bits that aren't
+// permissions
+var ErrUnknownPerm = errors.New("unknown permission bits")
+
+// ErrUnknownUser is returned by SetDefaultChildPerms for perms of a user that
+// doesn't exist
+var ErrUnknownUser = errors.New("unknown user")
+
+// SetDefaultChildPerms sets the bits granted on the records created in the
+// directory from now on, see FileMeta.DefaultChildPerms. The owner bit can't
+// be granted this way. userExists tells the users the fs doesn't know about,
+// PermEveryone needs no check
+func (fs *Fs) SetDefaultChildPerms(dir id.ID, perms map[string]uint8, userExists func(user string) (bool, error)) error {
+	info, err := fs.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return fmt.Errorf("%s is %w", dir, ErrNotDir)
+	}
+	for user, bits := range perms {
+		if bits&PermOwner != 0 {
+			return fmt.Errorf("default perms of %q: %w", user, ErrOwnerBit)
+		}
+		if bits >= PermReadMeta<<1 {
+			return fmt.Errorf("default perms of %q: %w", user, ErrUnknownPerm)
+		}
+		if user == PermEveryone {
+			continue
+		}
+		exists, err := userExists(user)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("default perms of %q: %w", user, ErrUnknownUser)
+		}
+	}
+
+	return fs.updateMeta(dir, func(fm *FileMeta) bool {
+		fm.DefaultChildPerms = maps.Clone(perms)
+		return true
+	})
+}
+
+// grantDefaultPerms adds the DefaultChildPerms of the parent to the meta of
+// the new child, writing one if it has none. It reads the meta of the
+// parent, so it runs once the parent is unlocked
+func (fs *Fs) grantDefaultPerms(parent, child id.ID) error {
+	pm, err := ReadFileMeta(fs, parent)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(pm.DefaultChildPerms) == 0 {
+		return nil
+	}
+
+	unlock := fs.LockSection(child, "meta")
+	defer unlock()
+
+	fm, err := ReadFileMeta(fs, child)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		fm = emptyFileMeta(child)
+		fm.CreatedAt = uint64(time.Now().Unix())
+	case err != nil:
+		return err
+	}
+	if fm.Perms == nil {
+		fm.Perms = map[string]uint8{}
+	}
+	for user, bits := range pm.DefaultChildPerms {
+		fm.Perms[user] |= bits
+	}
+	return WriteFileMeta(fs, child, fm)
+}
+
+// CopyPerms writes the permissions of src onto dst. With merge the bits are
+// added to what dst already grants, otherwise they replace them, except for
+// the owners of dst, who keep their bits
+func (fs *Fs) CopyPerms(src, dst id.ID, merge bool) error {
+	sm, err := ReadFileMeta(fs, src)
+	if err != nil {
+		return err
+	}
+
+	unlock := fs.LockSection(dst, "meta")
+	defer unlock()
+
+	dm, err := ReadFileMeta(fs, dst)
+	if err != nil {
+		return err
+	}
+
+	if dm.Perms == nil {
+		dm.Perms = map[string]uint8{}
+	}
+	if !merge {
+		for user, bits := range dm.Perms {
+			if bits&PermOwner == 0 {
+				delete(dm.Perms, user)
+			}
+		}
+	}
+	for user, bits := range sm.Perms {
+		dm.Perms[user] |= bits
+	}
+
+	return WriteFileMeta(fs, dst, dm)
+}
+
+// ForgetUser removes the user's permission bits from the meta of every
+// record, the ones granted by default to new children included, so that a
+// new user of the same name doesn't get them. With heir set, the bits and the
+// ownership of the user's records pass to the heir instead. It returns the
+// number of changed records
+func (fs *Fs) ForgetUser(ctx context.Context, user, heir string) (int, error) {
+	changed := 0
+	for _, u := range fs.sortedIDs() {
+		if err := ctx.Err(); err != nil {
+			return changed, err
+		}
+
+		updated := false
+		err := fs.updateMeta(u, func(fm *FileMeta) bool {
+			bits, had := fm.Perms[user]
+			defaults, hadDefaults := fm.DefaultChildPerms[user]
+			owned := heir != "" && fm.CreatedBy == user
+			if !had && !hadDefaults && !owned {
+				return false
+			}
+
+			delete(fm.Perms, user)
+			delete(fm.DefaultChildPerms, user)
+			if heir != "" {
+				if had {
+					fm.Perms[heir] |= bits
+				}
+				if hadDefaults {
+					fm.DefaultChildPerms[heir] |= defaults
+				}
+				if owned {
+					fm.CreatedBy = heir
+				}
+			}
+			updated = true
+			return true
+		})
+		if errors.Is(err, ErrNotFound) {
+			// deleted in the meantime
+			continue
+		}
+		if err != nil {
+			return changed, fmt.Errorf("record %s: %w", u, err)
+		}
+		if updated {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// OwnedBy calls fn with every record under root created by the user, in the
+// order of Walk. Records whose meta can't be read are skipped
+func (fs *Fs) OwnedBy(ctx context.Context, root id.ID, user string, fn func(id.ID) error) error {
+	return fs.Walk(ctx, root, func(path string, info FileInfo) error {
+		fm, err := ReadFileMeta(fs, info.ID)
+		if err != nil || fm.CreatedBy != user {
+			return nil
+		}
+		return fn(info.ID)
+	})
+}
+
+// updateMeta rewrites the meta of the file with fn applied, unless fn reports
+// that nothing changed. Records without meta have nowhere to keep anything,
+// so they are left alone
+func (fs *Fs) updateMeta(file id.ID, fn func(fm *FileMeta) bool) error {
+	unlock := fs.LockSection(file, "meta")
+	defer unlock()
+
+	fm, err := ReadFileMeta(fs, file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !fn(&fm) {
+		return nil
+	}
+	return WriteFileMeta(fs, file, fm)
+}
+
+// ErrMetaIntact is returned by RebuildMeta when the meta is readable
+var ErrMetaIntact = errors.New("meta is intact")
+
+// RebuildMeta replaces a missing or broken meta with a fresh one, owned by
+// user. Everything the old meta knew (other users' permissions, section types
+// and encodings) is lost. A readable meta is left alone with ErrMetaIntact
+func (fs *Fs) RebuildMeta(file id.ID, user string) (FileMeta, error) {
+	if _, err := fs.record(file); err != nil {
+		return FileMeta{}, err
+	}
+
+	unlock := fs.LockSection(file, "meta")
+	defer unlock()
+
+	if _, err := ReadFileMeta(fs, file); err == nil {
+		return FileMeta{}, ErrMetaIntact
+	}
+
+	fm := emptyFileMeta(file)
+	fm.CreatedBy = user
+	fm.CreatedAt = uint64(time.Now().Unix())
+	fm.Perms[user] = PermOwner | PermRead | PermWrite
+	if err := WriteFileMeta(fs, file, fm); err != nil {
+		return FileMeta{}, err
+	}
+
+	// WriteFileMeta sets ModifiedAt on its own copy
+	return ReadFileMeta(fs, file)
+}
+
+// Chown makes the user the only owner of the file in place of CreatedBy. The
+// new owner gets the bits a creator gets, everyone else only loses PermOwner,
+// co-owners included
+func (fs *Fs) Chown(file id.ID, user string) (FileMeta, error) {
+	unlock := fs.LockSection(file, "meta")
+	defer unlock()
+
+	fm, err := ReadFileMeta(fs, file)
+	if errors.Is(err, os.ErrNotExist) {
+		return FileMeta{}, fmt.Errorf("meta of %s: %w", file, ErrNotFound)
+	}
+	if err != nil {
+		return FileMeta{}, err
+	}
+
+	if fm.Perms == nil {
+		fm.Perms = map[string]uint8{}
+	}
+	for other, perm := range fm.Perms {
+		if other != user {
+			fm.Perms[other] = perm &^ PermOwner
+		}
+	}
+	fm.CreatedBy = user
+	fm.Perms[user] |= PermOwner | PermRead | PermWrite
+	if err := WriteFileMeta(fs, file, fm); err != nil {
+		return FileMeta{}, err
+	}
+
+	return ReadFileMeta(fs, file)
+}
+
+// sectionMetaMaps are the parts of the meta kept per section as strings,
+// SectionsWritten is the only other one
+func (fm *FileMeta) sectionMetaMaps() [3]*map[string]string {
+	return [3]*map[string]string{&fm.SectionTypes, &fm.SectionEncodings, &fm.SectionChecksums}
+}
+
+// SetSectionType records the media type of the section in the meta
+func (fs *Fs) SetSectionType(file id.ID, section, typ string) error {
+	return fs.updateMeta(file, func(fm *FileMeta) bool {
+		if fm.SectionTypes == nil {
+			fm.SectionTypes = map[string]string{}
+		}
+		fm.SectionTypes[section] = typ
+		return true
+	})
+}
+
+// SetSectionEncoding records how the section is stored on disk, empty
+// encoding means as is
+func (fs *Fs) SetSectionEncoding(file id.ID, section, encoding string) error {
+	return fs.updateMeta(file, func(fm *FileMeta) bool {
+		if fm.SectionEncodings[section] == encoding {
+			return false
+		}
+
+		if encoding == "" {
+			delete(fm.SectionEncodings, section)
+			return true
+		}
+
+		if fm.SectionEncodings == nil {
+			fm.SectionEncodings = map[string]string{}
+		}
+		fm.SectionEncodings[section] = encoding
+		return true
+	})
+}
+
+// SetSectionChecksum records the checksum the section was verified against,
+// empty checksum forgets it
+func (fs *Fs) SetSectionChecksum(file id.ID, section, checksum string) error {
+	return fs.updateMeta(file, func(fm *FileMeta) bool {
+		if fm.SectionChecksums[section] == checksum {
+			return false
+		}
+
+		if checksum == "" {
+			delete(fm.SectionChecksums, section)
+			return true
+		}
+
+		if fm.SectionChecksums == nil {
+			fm.SectionChecksums = map[string]string{}
+		}
+		fm.SectionChecksums[section] = checksum
+		return true
+	})
+}
+
+// SetSectionWritten records how much of an allocated section has been written
+// from its start. A negative written forgets it, the section is whole
+func (fs *Fs) SetSectionWritten(file id.ID, section string, written int64) error {
+	return fs.updateMeta(file, func(fm *FileMeta) bool {
+		if written < 0 {
+			_, ok := fm.SectionsWritten[section]
+			delete(fm.SectionsWritten, section)
+			return ok
+		}
+
+		if fm.SectionsWritten == nil {
+			fm.SectionsWritten = map[string]int64{}
+		}
+		fm.SectionsWritten[section] = written
+		return true
+	})
+}
+
+// AddSectionWritten counts n bytes written at offset into a section that
+// isn't whole yet. Only chunks that continue what was written so far move it
+// on, a chunk past a gap is counted once the gap is filled and the client
+// sends it again. The section becomes whole once all of its size is written
+func (fs *Fs) AddSectionWritten(file id.ID, section string, offset, n, size int64) error {
+	return fs.updateMeta(file, func(fm *FileMeta) bool {
+		written, ok := fm.SectionsWritten[section]
+		if !ok || offset > written || offset+n <= written {
+			return false
+		}
+
+		if offset+n >= size {
+			delete(fm.SectionsWritten, section)
+		} else {
+			fm.SectionsWritten[section] = offset + n
+		}
+		return true
+	})
+}
+
+// SectionWritten returns how much of the section has been written from its
+// start, false if the section is whole
+func (fs *Fs) SectionWritten(file id.ID, section string) (int64, bool, error) {
+	fm, err := ReadFileMeta(fs, file)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	written, ok := fm.SectionsWritten[section]
+	return written, ok, nil
+}
+
+// SectionEncoding returns how the section is stored on disk, "" if as is
+func (fs *Fs) SectionEncoding(file id.ID, section string) (string, error) {
+	fm, err := ReadFileMeta(fs, file)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fm.SectionEncodings[section], nil
+}
+
+// SectionType returns the media type recorded for the section, or "" if
+// there is none
+func (fs *Fs) SectionType(file id.ID, section string) (string, error) {
+	fm, err := ReadFileMeta(fs, file)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fm.SectionTypes[section], nil
+}
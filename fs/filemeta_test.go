@@ -0,0 +1,182 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"archiiv/id"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermsOf(t *testing.T) {
+	fm := FileMeta{Perms: map[string]uint8{
+		"prokop":     PermOwner | PermRead,
+		PermEveryone: PermRead | PermWrite,
+	}}
+
+	assert.Equal(t, PermOwner|PermRead|PermWrite, fm.PermsOf("prokop"))
+	assert.Equal(t, PermRead|PermWrite, fm.PermsOf("marek"))
+	assert.Equal(t, uint8(0), FileMeta{}.PermsOf("marek"))
+}
+
+func TestCanAccessSection(t *testing.T) {
+	fs := newTestFs(t)
+	file, err := fs.Touch(fs.GetRoot(), "file")
+	require.NoError(t, err)
+
+	fm := emptyFileMeta(file)
+	fm.Perms["prokop"] = PermRead
+	fm.Perms["marek"] = PermReadMeta
+	require.NoError(t, WriteFileMeta(fs, file, fm))
+
+	for _, tc := range []struct {
+		user, section string
+		ok            bool
+	}{
+		{"prokop", "meta", true},
+		{"prokop", "data", true},
+		{"marek", "meta", true},
+		{"marek", "data", false},
+		{"anicka", "meta", false},
+	} {
+		ok, err := fs.CanAccessSection(file, tc.section, tc.user, PermRead)
+		require.NoError(t, err)
+		assert.Equal(t, tc.ok, ok, tc)
+	}
+
+	ok, err := fs.CanAccess(file, "prokop", PermReadMeta)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestCopyPermsKeepsOwners(t *testing.T) {
+	fs := newTestFs(t)
+	src, err := fs.Touch(fs.GetRoot(), "src")
+	require.NoError(t, err)
+	dst, err := fs.Touch(fs.GetRoot(), "dst")
+	require.NoError(t, err)
+
+	sm := emptyFileMeta(src)
+	sm.Perms["marek"] = PermOwner | PermRead
+	require.NoError(t, WriteFileMeta(fs, src, sm))
+	dm := emptyFileMeta(dst)
+	dm.Perms["prokop"] = PermOwner | PermRead | PermWrite
+	dm.Perms["anicka"] = PermWrite
+	require.NoError(t, WriteFileMeta(fs, dst, dm))
+
+	require.NoError(t, fs.CopyPerms(src, dst, false))
+	dm, err = ReadFileMeta(fs, dst)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint8{
+		"prokop": PermOwner | PermRead | PermWrite,
+		"marek":  PermOwner | PermRead,
+	}, dm.Perms)
+}
+
+func TestFileMetaLegacyType(t *testing.T) {
+	var fm FileMeta
+	require.NoError(t, json.Unmarshal([]byte(`{"type":"text/plain","perms":{"prokop":7}}`), &fm))
+	assert.Equal(t, map[string]string{"data": "text/plain"}, fm.SectionTypes)
+	assert.Equal(t, map[string]uint8{"prokop": 7}, fm.Perms)
+
+	// an explicit type of data wins
+	require.NoError(t, json.Unmarshal([]byte(`{"type":"text/plain","sectionTypes":{"data":"image/png"}}`), &fm))
+	assert.Equal(t, map[string]string{"data": "image/png"}, fm.SectionTypes)
+}
+
+func TestFileMetaTimestamps(t *testing.T) {
+	fs := newTestFs(t)
+	file, err := fs.Touch(fs.GetRoot(), "file")
+	require.NoError(t, err)
+
+	before := uint64(time.Now().Unix())
+	require.NoError(t, fs.InitFileMeta(fs.GetRoot(), file, "prokop", false))
+	after := uint64(time.Now().Unix())
+
+	fm, err := ReadFileMeta(fs, file)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, fm.CreatedAt, before)
+	assert.LessOrEqual(t, fm.CreatedAt, after)
+	assert.GreaterOrEqual(t, fm.ModifiedAt, fm.CreatedAt)
+
+	created := fm.CreatedAt
+	require.NoError(t, fs.SetSectionType(file, "data", "text/plain"))
+	updated, err := ReadFileMeta(fs, file)
+	require.NoError(t, err)
+	assert.Equal(t, created, updated.CreatedAt)
+	assert.GreaterOrEqual(t, updated.ModifiedAt, fm.ModifiedAt)
+
+	// written by a clock that was an hour ahead, the next write must not
+	// move it back
+	ahead := uint64(time.Now().Add(time.Hour).Unix())
+	updated.ModifiedAt = ahead
+	require.NoError(t, WriteFileMeta(fs, file, updated))
+	require.NoError(t, fs.SetSectionType(file, "data", "text/markdown"))
+	updated, err = ReadFileMeta(fs, file)
+	require.NoError(t, err)
+	assert.Equal(t, ahead, updated.ModifiedAt)
+
+	// a day and more is a broken clock
+	updated.CreatedAt = uint64(time.Now().Add(48 * time.Hour).Unix())
+	require.NoError(t, WriteFileMeta(fs, file, updated))
+	_, err = ReadFileMeta(fs, file)
+	assert.ErrorIs(t, err, ErrClockSkew)
+}
+
+func TestDefaultChildPerms(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+	shared, err := fs.Mkdir(fs.GetRoot(), "shared")
+	require.NoError(t, err)
+	require.NoError(t, fs.InitFileMeta(fs.GetRoot(), shared, "prokop", false))
+
+	userExists := func(user string) (bool, error) {
+		return user == "prokop" || user == "marek", nil
+	}
+	err = fs.SetDefaultChildPerms(shared, map[string]uint8{"nobody": PermRead}, userExists)
+	assert.ErrorIs(t, err, ErrUnknownUser)
+	err = fs.SetDefaultChildPerms(shared, map[string]uint8{"marek": PermReadMeta << 1}, userExists)
+	assert.ErrorIs(t, err, ErrUnknownPerm)
+
+	defaults := map[string]uint8{"marek": PermRead, PermEveryone: PermReadMeta}
+	require.NoError(t, fs.SetDefaultChildPerms(shared, defaults, userExists))
+
+	// records get them however they are created, even without InitFileMeta
+	file, err := fs.Touch(shared, "file")
+	require.NoError(t, err)
+	withID := id.New()
+	require.NoError(t, fs.TouchWithID(shared, withID, "with id", true))
+	dirs, _, err := fs.MkdirAll(shared, "a/b", nil)
+	require.NoError(t, err)
+	for _, u := range []id.ID{file, withID, dirs[0]} {
+		fm, err := ReadFileMeta(fs, u)
+		require.NoError(t, err)
+		assert.Equal(t, defaults, fm.Perms)
+	}
+	// only the direct children
+	_, err = ReadFileMeta(fs, dirs[1])
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// imported records keep their own perms and get the defaults on top
+	src := newTestFs(t)
+	imported, err := src.Touch(src.GetRoot(), "imported")
+	require.NoError(t, err)
+	require.NoError(t, src.InitFileMeta(src.GetRoot(), imported, "anicka", false))
+	var buf bytes.Buffer
+	require.NoError(t, src.Snapshot(&buf))
+	_, err = fs.Import(context.Background(), shared, &buf, 0)
+	require.NoError(t, err)
+	fm, err := ReadFileMeta(fs, imported)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint8{
+		"anicka":     PermOwner | PermRead | PermWrite,
+		"marek":      PermRead,
+		PermEveryone: PermReadMeta,
+	}, fm.Perms)
+}
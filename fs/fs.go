@@ -5,7 +5,8 @@ package fs
 // the directory tree is modeled using the Records structs
 // they are reference counted and thus are forbidden to form cycles
 //
-// Records are saved as $fs_root/$id
+// Records are saved as $fs_root/$id, or in a shard directory of the fs root
+// with Options.Shard (see shard.go)
 //
 // Records contain sections saved as $fs_root/$id.$section The file payload
 // is saved in the 'data' section. metadata is in 'meta'. hooks can create own
@@ -15,15 +16,20 @@ package fs
 // functions, which take pointers to records instead are not thread safe.
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"archiiv/id"
 )
@@ -41,15 +47,26 @@ const (
 var (
 	onlySectionPatternRegex      = regexp.MustCompile(onlySectionPattern)
 	onlyFileInFsRootPatternRegex = regexp.MustCompile(onlyFileInFsRootPattern)
+
+	// section names that are valid by the pattern but could be confused
+	// with the internal naming of files in the fs root
+	reservedSectionRegexes = []*regexp.Regexp{
+		regexp.MustCompile(onlyIDPattern),
+	}
 )
 
 type record struct {
-	Children []id.ID    `json:"children,omitempty"`
-	IsDir    bool       `json:"is_dir"`
-	Name     string     `json:"name"`
-	id       id.ID      `json:"-"`
-	refs     uint       `json:"-"`
-	mutex    sync.Mutex `json:"-"`
+	Children []id.ID `json:"children,omitempty"`
+	IsDir    bool    `json:"is_dir"`
+	Name     string  `json:"name"`
+	Checksum string  `json:"checksum,omitempty"`
+	id       id.ID   `json:"-"`
+	// the reference count, version and lock outlive the record in the
+	// record cache, see cache.go
+	*recordState `json:"-"`
+	// watchers wait on it for the version to change, see Fs.WaitChildren.
+	// Created on first use
+	watchers *sync.Cond `json:"-"`
 }
 
 func (r *record) lock() {
@@ -60,64 +77,276 @@ func (r *record) unlock() {
 	r.mutex.Unlock()
 }
 
+// sectionNames returns the indexed sections, sorted
+func (r *record) sectionNames() []string {
+	r.lock()
+	defer r.unlock()
+	return slices.Sorted(maps.Keys(r.sections))
+}
+
+// indexSection records that the section file of u was created or removed.
+// Sections of records that don't exist are not indexed
+func (fs *Fs) indexSection(u id.ID, section string, present bool) {
+	r, err := fs.record(u)
+	if err != nil {
+		return
+	}
+
+	r.lock()
+	defer r.unlock()
+	if !present {
+		delete(r.sections, section)
+		return
+	}
+	if r.sections == nil {
+		r.sections = make(map[string]bool)
+	}
+	r.sections[section] = true
+}
+
+type sectionKey struct {
+	file    id.ID
+	section string
+}
+
+// sectionLock is a mutex that is removed from Fs.sectionLocks once nobody
+// holds or waits for it
+type sectionLock struct {
+	mutex sync.RWMutex
+	users uint
+}
+
+const (
+	DefaultDirPerm  os.FileMode = 0750
+	DefaultFilePerm os.FileMode = 0600
+)
+
+// Options tweak the behaviour of Fs. The zero value is the default
+type Options struct {
+	// DirPerm and FilePerm are the modes of newly created directories
+	// and files. Zero means DefaultDirPerm and DefaultFilePerm
+	DirPerm  os.FileMode
+	FilePerm os.FileMode
+
+	// MaxChildren limits the number of children of a single record.
+	// Zero means unlimited
+	MaxChildren int
+
+	// MaxDepth limits how far below the root a record can be, the
+	// children of the root are at depth 1. Zero means unlimited
+	MaxDepth int
+
+	// NormalizeNames stores the names of new records in NFC, so names
+	// written decomposed match the composed ones. FoldNameCase compares
+	// names case-insensitively. With either of them the names of the
+	// children of a record are unique as compared, see checkNameConflict
+	NormalizeNames bool
+	FoldNameCase   bool
+
+	// Checksums makes every written record carry a checksum of its
+	// content that is verified when the record is loaded. Records
+	// without a checksum (written before the option was enabled) are
+	// accepted and get one on their next write
+	Checksums bool
+
+	// Shard spreads the records over subdirectories of the fs root, see
+	// shard.go. Switching it on or off migrates the files on the next load
+	Shard bool
+
+	// SectionCacheLimit is the size up to which read sections are kept in
+	// memory. Zero disables the section cache
+	SectionCacheLimit int64
+
+	// RecordCache bounds the number of records kept in memory, the others
+	// are read from their files on demand. Zero keeps all of them
+	RecordCache int
+}
+
 type Fs struct {
-	lock     sync.RWMutex
-	records  map[id.ID]*record
-	root     id.ID
-	basePath string
+	lock   sync.RWMutex
+	states map[id.ID]*recordState
+	cache  *recordCache // nil without Options.RecordCache
+	// nil without Options.SectionCacheLimit
+	sectionCache *sectionCache
+	root         id.ID
+	basePath     string
+	opts         Options
+	// epoch is random for every Fs instance, so that listing versions
+	// from before a restart never match the ones after it
+	epoch uint64
+
+	sectionLocksLock sync.Mutex
+	sectionLocks     map[sectionKey]*sectionLock
+
+	events eventBus
+
+	// see checkDepthLimit
+	depths depthCache
+
+	// mountLock makes the checks of Mount and its insert one step, so that
+	// two concurrent mounts can't make a cycle or a too deep tree together
+	mountLock sync.Mutex
+
+	// see Batch
+	writeBatchLock  sync.Mutex
+	writeBatchDepth int
+	pendingWrites   map[id.ID]*record
+
+	// persisted is called after every record write, for tests
+	persisted func(u id.ID)
+
+	// nil after Close
+	dirLock *dirLock
 }
 
 func (fs *Fs) record(u id.ID) (*record, error) {
 	fs.lock.RLock()
-	defer fs.lock.Unlock()
-	r, e := fs.records[u]
-	if e {
-		return nil, errors.New("id doesn't exist")
+	st, e := fs.states[u]
+	fs.lock.RUnlock()
+	if !e {
+		return nil, fmt.Errorf("id %s: %w", u, ErrNotFound)
 	}
-	return r, nil
+	return fs.load(u, st)
 }
 
 func (fs *Fs) setRecord(r *record) {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	fs.records[r.id] = r
+	fs.states[r.id] = r.recordState
+	fs.attach(r, r.recordState)
+}
+
+// addRecord is setRecord for a new record, it fails if the ID is taken
+func (fs *Fs) addRecord(r *record) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, ok := fs.states[r.id]; ok {
+		return fmt.Errorf("id %s %w", r.id, ErrExists)
+	}
+	fs.states[r.id] = r.recordState
+	fs.attach(r, r.recordState)
+	return nil
 }
 
-func (fs *Fs) path(p string) string {
+// path returns where the named record or section file is stored
+func (fs *Fs) path(name string) string {
 	// TODO(marek) sanitize paths
-	return filepath.Join(fs.basePath, p)
+	if fs.opts.Shard && len(name) > shardLen {
+		return filepath.Join(fs.basePath, name[:shardLen], name)
+	}
+	return filepath.Join(fs.basePath, name)
+}
+
+func (opts Options) dirPerm() os.FileMode {
+	if opts.DirPerm == 0 {
+		return DefaultDirPerm
+	}
+	return opts.DirPerm
+}
+
+func (opts Options) filePerm() os.FileMode {
+	if opts.FilePerm == 0 {
+		return DefaultFilePerm
+	}
+	return opts.FilePerm
+}
+
+func (opts Options) createFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, opts.filePerm()) // #nosec G304: callers build paths from sanitized ids and section names
+}
+
+// checkChildrenLimit checks that a record with n children can get another one
+func (fs *Fs) checkChildrenLimit(n int) error {
+	if fs.opts.MaxChildren > 0 && n >= fs.opts.MaxChildren {
+		return fmt.Errorf("too many children (limit is %d)", fs.opts.MaxChildren)
+	}
+	return nil
 }
 
 func (fs *Fs) writeRecord(r *record) error {
-	f, err := os.Create(fs.path(r.id.String()))
+	if fs.deferWrite(r) {
+		return nil
+	}
+	return fs.persistRecord(r)
+}
+
+func (fs *Fs) persistRecord(r *record) error {
+	if fs.opts.Checksums {
+		sum, err := recordChecksum(r)
+		if err != nil {
+			return err
+		}
+		r.Checksum = sum
+	}
+
+	if err := fs.makeDirFor(r.id.String()); err != nil {
+		return err
+	}
+
+	f, err := fs.opts.createFile(fs.path(r.id.String()))
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
 	enc := json.NewEncoder(f)
-	return enc.Encode(r)
+	if err = enc.Encode(r); err != nil {
+		return err
+	}
+
+	if fs.persisted != nil {
+		fs.persisted(r.id)
+	}
+	return nil
 }
 
-func (fs *Fs) newRecord(parent *record, name string, dir bool) (*record, error) {
+func (fs *Fs) newRecord(parent *record, u id.ID, name string, dir bool) (*record, error) {
+	if !parent.IsDir {
+		return nil, fmt.Errorf("parent %s is %w", parent.id, ErrNotDir)
+	}
+	if err := fs.checkChildrenLimit(len(parent.Children)); err != nil {
+		return nil, err
+	}
+
+	name = fs.normalizeName(name)
+	if err := checkNameSanity(name); err != nil {
+		return nil, err
+	}
+	if err := fs.checkNameConflict(parent.Children, name); err != nil {
+		return nil, err
+	}
+
 	child := new(record)
 	child.Children = []id.ID{}
-	child.id = id.New()
+	child.id = u
 	child.Name = name
-	child.refs = 1
+	child.recordState = &recordState{refs: 1}
 	child.IsDir = dir
 
-	fs.setRecord(child)
-
 	for _, e := range parent.Children {
 		if e == child.id {
-			return nil, errors.New("child already there")
+			return nil, fmt.Errorf("child %w", ErrExists)
 		}
 	}
 
+	if err := fs.addRecord(child); err != nil {
+		return nil, err
+	}
+
 	parent.Children = append(parent.Children, child.id)
+	parent.changed()
+	fs.addDepth(parent.id, child.id)
+
+	if err := fs.writeRecord(child); err != nil {
+		return nil, err
+	}
+
+	if err := fs.writeRecord(parent); err != nil {
+		return nil, err
+	}
 
-	return child, fs.writeRecord(child)
+	fs.publish(Event{Type: EventCreate, ID: child.id, Parent: parent.id, Name: name})
+	return child, nil
 }
 
 // return new slice that does not contain v
@@ -131,14 +360,14 @@ func removeID(s []id.ID, v id.ID) ([]id.ID, error) {
 		}
 	}
 
-	for ; i < len(s); i++ {
+	for i++; i < len(s); i++ {
 		if s[i] == v {
 			return s, errors.New("duplicite id")
 		}
 	}
 
 	if pos == -1 {
-		return s, errors.New("id not found")
+		return s, fmt.Errorf("child %s: %w", v, ErrNotFound)
 	}
 
 	// swap remove
@@ -148,7 +377,12 @@ func removeID(s []id.ID, v id.ID) ([]id.ID, error) {
 
 func checkSectionNameSanity(section string) error {
 	if !onlySectionPatternRegex.MatchString(section) {
-		return errors.New("section name is not sane")
+		return fmt.Errorf("%w: section name is not sane", ErrInvalidName)
+	}
+	for _, reserved := range reservedSectionRegexes {
+		if reserved.MatchString(section) {
+			return fmt.Errorf("%w: section name is reserved", ErrInvalidName)
+		}
 	}
 	return nil
 }
@@ -157,29 +391,64 @@ func (fs *Fs) getSectionFileName(file id.ID, section string) string {
 	return fs.path(file.String() + "." + section)
 }
 
-func (fs *Fs) deleteRecord(r *record) error {
-	for _, u := range r.Children {
-		err := fs.Unmount(r.id, u)
+// deleteRecord removes the record with all its sections and drops the
+// references it held to its children. The record must not be locked. parent
+// is the record it was last unmounted from
+func (fs *Fs) deleteRecord(r *record, parent id.ID) error {
+	// the root holds a reference of its own, so this is only reachable
+	// through a refcounting bug. Deleting it would brick the whole archive
+	if r.id == fs.root {
+		return errors.New("refusing to delete the root")
+	}
+
+	for _, u := range r.children() {
+		err := fs.release(r.id, u)
 		if err != nil {
 			return err
 		}
 	}
 
-	entries, err := os.ReadDir(fs.basePath)
-	if err != nil {
-		return err
+	fs.lock.Lock()
+	delete(fs.states, r.id)
+	fs.lock.Unlock()
+	pending := fs.forgetWrite(r.id)
+	if fs.cache != nil {
+		fs.cache.remove(r.id)
 	}
 
-	idStr := r.id.String()
-	for _, e := range entries {
-		if strings.HasPrefix(e.Name(), idStr) {
-			err = os.Remove(e.Name())
-			if err != nil {
-				return err
-			}
+	for _, section := range r.sectionNames() {
+		err := os.Remove(fs.getSectionFileName(r.id, section))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
 		}
+		fs.invalidateSection(r.id, section)
+	}
+	// a record created within a running batch may not be on disk yet
+	err := os.Remove(fs.path(r.id.String()))
+	if err != nil && !(pending && errors.Is(err, os.ErrNotExist)) {
+		return err
+	}
+
+	fs.publish(Event{Type: EventDelete, ID: r.id, Parent: parent})
+	return nil
+}
+
+// release drops one reference to the record and deletes it once nothing
+// references it anymore
+func (fs *Fs) release(parent, u id.ID) error {
+	r, err := fs.record(u)
+	if err != nil {
+		return err
 	}
 
+	r.lock()
+	r.refs--
+	collect := r.refs == 0
+	r.unlock()
+
+	if collect {
+		return fs.deleteRecord(r, parent)
+	}
 	return nil
 }
 
@@ -187,18 +456,175 @@ func (fs *Fs) GetRoot() id.ID {
 	return fs.root
 }
 
+// FileInfo describes a record without its sections
+type FileInfo struct {
+	ID    id.ID  `json:"id"`
+	Name  string `json:"name"`
+	IsDir bool   `json:"is_dir"`
+	// Modified is the last change of the record itself (name, children),
+	// not of its sections. Only filled in by Stat
+	Modified time.Time `json:"modified"`
+}
+
+func (fs *Fs) Stat(u id.ID) (FileInfo, error) {
+	r, err := fs.record(u)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info := r.info()
+
+	st, err := os.Stat(fs.path(u.String()))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info.Modified = st.ModTime()
+
+	return info, nil
+}
+
+func (r *record) info() FileInfo {
+	r.lock()
+	defer r.unlock()
+	return FileInfo{ID: r.id, Name: r.Name, IsDir: r.IsDir}
+}
+
 func (fs *Fs) GetChildren(u id.ID) ([]id.ID, error) {
-	return fs.records[u].Children, nil
+	r, err := fs.record(u)
+	if err != nil {
+		return nil, err
+	}
+	return r.children(), nil
+}
+
+// GetChildrenVersioned returns the children together with an opaque version
+// of the listing that changes whenever the children do
+func (fs *Fs) GetChildrenVersioned(u id.ID) ([]id.ID, string, error) {
+	r, err := fs.record(u)
+	if err != nil {
+		return nil, "", err
+	}
+
+	r.lock()
+	defer r.unlock()
+	return slices.Clone(r.Children), fs.versionString(r), nil
+}
+
+// versionString formats the version of a locked record
+func (fs *Fs) versionString(r *record) string {
+	return fmt.Sprintf("%x-%x", fs.epoch, r.version)
 }
 
 func (fs *Fs) Mkdir(parentID id.ID, name string) (id.ID, error) {
 	parent, err := fs.record(parentID)
 	if err != nil {
-		return id.ID{}, nil
+		return id.ID{}, err
+	}
+	// before the parent is locked, the check reads its children
+	if err := fs.checkDepthLimit(parentID, 0); err != nil {
+		return id.ID{}, err
+	}
+
+	parent.lock()
+	r, err := fs.newRecord(parent, id.New(), name, true)
+	parent.unlock()
+	if err != nil {
+		return id.ID{}, err
+	}
+	return r.id, fs.grantDefaultPerms(parentID, r.id)
+}
+
+// MkdirAll walks the slash separated path of directory names from the
+// parent, reusing the directories that exist and creating the missing ones
+// like `mkdir -p`. It returns the directory for every part of the path, the
+// last created of them are newly created. On error they cover the part of
+// the path done before it. If mayCreate is not nil, it is called with a
+// directory before a child is created in it, its error stops the walk
+func (fs *Fs) MkdirAll(parentID id.ID, path string, mayCreate func(dir id.ID) error) (dirs []id.ID, created int, err error) {
+	names := strings.Split(strings.Trim(path, "/"), "/")
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." {
+			return nil, 0, fmt.Errorf("path %q: %w", path, ErrInvalidName)
+		}
+	}
+
+	current := parentID
+	for _, name := range names {
+		next, isNew, err := fs.mkdirOrGet(current, name, mayCreate)
+		if err != nil {
+			return dirs, created, err
+		}
+		dirs = append(dirs, next)
+		if isNew {
+			created++
+		}
+		current = next
+	}
+	return dirs, created, nil
+}
+
+// mkdirOrGet returns the directory of the name in parent, creating it if
+// there is none. Looking and creating happen under the lock of the parent, so
+// concurrent calls don't create it twice. mayCreate reads the parent, so it
+// runs without the lock and the look is repeated after it
+func (fs *Fs) mkdirOrGet(parentID id.ID, name string, mayCreate func(dir id.ID) error) (id.ID, bool, error) {
+	parent, err := fs.record(parentID)
+	if err != nil {
+		return id.ID{}, false, err
+	}
+	// before the parent is locked, the check reads its children
+	depthErr := fs.checkDepthLimit(parentID, 0)
+
+	for allowed := mayCreate == nil; ; allowed = true {
+		u, isNew, ask, err := fs.mkdirOrGetLocked(parent, name, depthErr, allowed)
+		if isNew {
+			err = fs.grantDefaultPerms(parentID, u)
+		}
+		if !ask {
+			return u, isNew, err
+		}
+		if err := mayCreate(parentID); err != nil {
+			return id.ID{}, false, err
+		}
+	}
+}
+
+// mkdirOrGetLocked is one look of mkdirOrGet. Without allowed it asks for
+// mayCreate instead of creating the directory
+func (fs *Fs) mkdirOrGetLocked(parent *record, name string, depthErr error, allowed bool) (u id.ID, isNew, ask bool, err error) {
+	parent.lock()
+	defer parent.unlock()
+
+	var file bool
+	for _, c := range parent.Children {
+		child, err := fs.record(c)
+		if err != nil {
+			continue
+		}
+		info := child.info()
+		if !fs.namesEqual(info.Name, name) {
+			continue
+		}
+		if info.IsDir {
+			return c, false, false, nil
+		}
+		file = true
+	}
+	if file {
+		return id.ID{}, false, false, fmt.Errorf("%q in %s is %w", name, parent.id, ErrNotDir)
+	}
+	if depthErr != nil {
+		return id.ID{}, false, false, depthErr
+	}
+	if !allowed {
+		return id.ID{}, false, true, nil
 	}
 
-	r, err := fs.newRecord(parent, name, true)
-	return r.id, err
+	r, err := fs.newRecord(parent, id.New(), name, true)
+	if err != nil {
+		return id.ID{}, false, false, err
+	}
+	return r.id, true, false, nil
 }
 
 func (fs *Fs) Touch(parentID id.ID, name string) (id.ID, error) {
@@ -206,43 +632,192 @@ func (fs *Fs) Touch(parentID id.ID, name string) (id.ID, error) {
 	if err != nil {
 		return id.ID{}, err
 	}
+	// before the parent is locked, the check reads its children
+	if err := fs.checkDepthLimit(parentID, 0); err != nil {
+		return id.ID{}, err
+	}
 
-	r, err := fs.newRecord(parent, name, false)
-	return r.id, err
+	parent.lock()
+	r, err := fs.newRecord(parent, id.New(), name, false)
+	parent.unlock()
+	if err != nil {
+		return id.ID{}, err
+	}
+	return r.id, fs.grantDefaultPerms(parentID, r.id)
 }
 
-func (fs *Fs) Unmount(parentID id.ID, childID id.ID) error {
+// TouchWithID creates a file or a directory like Touch and Mkdir, but with the
+// ID the caller chose. Imports use it to keep the IDs of the records they
+// bring in, so that the references between them still hold. An ID that
+// already exists is rejected with ErrExists
+func (fs *Fs) TouchWithID(parentID, u id.ID, name string, dir bool) error {
+	if u == (id.ID{}) {
+		return errors.New("the new id is zero")
+	}
+
 	parent, err := fs.record(parentID)
 	if err != nil {
 		return err
 	}
+	// before the parent is locked, the check reads its children
+	if err := fs.checkDepthLimit(parentID, 0); err != nil {
+		return err
+	}
 
 	parent.lock()
-	defer parent.unlock()
+	_, err = fs.newRecord(parent, u, name, dir)
+	parent.unlock()
+	if err != nil {
+		return err
+	}
+	return fs.grantDefaultPerms(parentID, u)
+}
+
+func (fs *Fs) Unmount(parentID id.ID, childID id.ID) error {
+	parent, err := fs.record(parentID)
+	if err != nil {
+		return err
+	}
+
+	err = fs.updateChildren(parent, func(children []id.ID) ([]id.ID, error) {
+		return removeID(children, childID)
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.publish(Event{Type: EventUnmount, ID: childID, Parent: parentID})
 
-	parent.Children, err = removeID(parent.Children, childID)
+	return fs.release(parentID, childID)
+}
+
+// updateChildren replaces the children of the record with what fn makes of a
+// copy of them. fn runs without the lock, so the new children are stored only
+// if the version of the record still matches the one fn saw. Otherwise fn
+// runs again on the fresh children, so no concurrent change is lost
+func (fs *Fs) updateChildren(r *record, fn func(children []id.ID) ([]id.ID, error)) error {
+	for {
+		r.lock()
+		children := slices.Clone(r.Children)
+		version := r.version
+		r.unlock()
+
+		next, err := fn(children)
+		if err != nil {
+			return err
+		}
+
+		r.lock()
+		if r.version != version {
+			r.unlock()
+			continue
+		}
+		r.Children = next
+		r.changed()
+		fs.depthsChanged()
+		err = fs.writeRecord(r)
+		r.unlock()
+		return err
+	}
+}
+
+// ErrDirNotEmpty is returned by SetIsDir for a directory with children
+var ErrDirNotEmpty = errors.New("directory is not empty")
+
+// ErrRootIsDir is returned by SetIsDir for the root
+var ErrRootIsDir = errors.New("the root must stay a directory")
+
+// SetIsDir changes whether the record is a directory. Only empty directories
+// can become files, and the root stays a directory
+func (fs *Fs) SetIsDir(u id.ID, isDir bool) error {
+	if u == fs.root && !isDir {
+		return ErrRootIsDir
+	}
+
+	r, err := fs.record(u)
 	if err != nil {
 		return err
 	}
 
-	err = fs.writeRecord(parent)
+	r.lock()
+	if r.IsDir == isDir {
+		r.unlock()
+		return nil
+	}
+	if !isDir && len(r.Children) > 0 {
+		r.unlock()
+		return ErrDirNotEmpty
+	}
+
+	r.IsDir = isDir
+	// the listing of the record itself stops or starts being one of a
+	// directory
+	r.changed()
+	err = fs.writeRecord(r)
+	r.unlock()
 	if err != nil {
 		return err
 	}
 
-	child, err := fs.record(childID)
+	// listings filtered by type change with it
+	parents, err := fs.Parents(context.Background(), u)
 	if err != nil {
 		return err
 	}
+	for _, p := range parents {
+		if pr, err := fs.record(p); err == nil {
+			pr.lock()
+			pr.changed()
+			pr.unlock()
+		}
+	}
+	return nil
+}
 
-	child.lock()
-	defer child.unlock()
+// Parents returns the records that have u among their children. It scans all
+// loaded records
+func (fs *Fs) Parents(ctx context.Context, u id.ID) ([]id.ID, error) {
+	var parents []id.ID
+	for _, p := range fs.sortedIDs() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-	child.refs--
-	if child.refs == 0 {
-		return fs.deleteRecord(child)
+		r, err := fs.record(p)
+		if err != nil {
+			// deleted in the meantime
+			continue
+		}
+		if slices.Contains(r.children(), u) {
+			parents = append(parents, p)
+		}
+	}
+	return parents, nil
+}
+
+// Detach unmounts the record from every parent, which deletes it. The root
+// can't be detached
+func (fs *Fs) Detach(ctx context.Context, u id.ID) error {
+	if u == fs.root {
+		return errors.New("can't detach the root")
+	}
+
+	if _, err := fs.record(u); err != nil {
+		return err
+	}
+
+	parents, err := fs.Parents(ctx, u)
+	if err != nil {
+		return err
 	}
 
+	// once unmounting started it runs to the end, so the record isn't left
+	// half detached
+	for _, p := range parents {
+		if err := fs.Unmount(p, u); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -256,22 +831,130 @@ func (fs *Fs) Mount(parent id.ID, newChild id.ID) error {
 	if err != nil {
 		return err
 	}
-	rec.lock()
-	defer rec.unlock()
 
-	for _, child := range rec.Children {
-		if child == newChild {
-			return errors.New("child with this id already exists")
-		}
+	rec.lock()
+	isDir := rec.IsDir
+	rec.unlock()
+	if !isDir {
+		return fmt.Errorf("parent %s is %w", parent, ErrNotDir)
 	}
 
-	rec.Children = append(rec.Children, newChild)
+	fs.mountLock.Lock()
+	defer fs.mountLock.Unlock()
 
+	if fs.reaches(newChild, parent) {
+		return fmt.Errorf("mounting %s into %s %w", newChild, parent, ErrCycle)
+	}
+	if err := fs.checkDepthLimit(parent, fs.height(newChild)); err != nil {
+		return fmt.Errorf("mounting %s into %s: %w", newChild, parent, err)
+	}
+	name := child.info().Name
+
+	// the reference is taken first, so that the child can't be collected
+	// by a concurrent unmount while it is being mounted. A child that
+	// already was is gone for good
 	child.lock()
+	if child.refs == 0 {
+		child.unlock()
+		return fmt.Errorf("id %s: %w", newChild, ErrNotFound)
+	}
 	child.refs++
 	child.unlock()
 
-	return fs.writeRecord(rec)
+	err = fs.updateChildren(rec, func(children []id.ID) ([]id.ID, error) {
+		if slices.Contains(children, newChild) {
+			return nil, fmt.Errorf("child with this id %w", ErrExists)
+		}
+		if err := fs.checkNameConflict(children, name); err != nil {
+			return nil, err
+		}
+		if err := fs.checkChildrenLimit(len(children)); err != nil {
+			return nil, err
+		}
+		return append(children, newChild), nil
+	})
+	if err != nil {
+		if releaseErr := fs.release(parent, newChild); releaseErr != nil {
+			return errors.Join(err, releaseErr)
+		}
+		return err
+	}
+
+	fs.publish(Event{Type: EventMount, ID: newChild, Parent: parent})
+	return nil
+}
+
+// reaches reports whether to is from or one of its descendants
+func (fs *Fs) reaches(from, to id.ID) bool {
+	seen := map[id.ID]bool{from: true}
+	queue := []id.ID{from}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		if u == to {
+			return true
+		}
+
+		r, err := fs.record(u)
+		if err != nil {
+			continue
+		}
+		for _, c := range r.children() {
+			if !seen[c] {
+				seen[c] = true
+				queue = append(queue, c)
+			}
+		}
+	}
+	return false
+}
+
+func (fs *Fs) acquireSectionLock(file id.ID, section string) (*sectionLock, func()) {
+	key := sectionKey{file: file, section: section}
+
+	fs.sectionLocksLock.Lock()
+	l, ok := fs.sectionLocks[key]
+	if !ok {
+		l = new(sectionLock)
+		fs.sectionLocks[key] = l
+	}
+	l.users++
+	fs.sectionLocksLock.Unlock()
+
+	return l, func() {
+		fs.sectionLocksLock.Lock()
+		defer fs.sectionLocksLock.Unlock()
+		l.users--
+		if l.users == 0 {
+			delete(fs.sectionLocks, key)
+		}
+	}
+}
+
+// LockSection blocks until the caller is the only one holding the given
+// section and returns a function that releases it. Used to serialize writes
+// into the same section
+func (fs *Fs) LockSection(file id.ID, section string) (unlock func()) {
+	l, release := fs.acquireSectionLock(file, section)
+	l.mutex.Lock()
+
+	return func() {
+		l.mutex.Unlock()
+		release()
+	}
+}
+
+// LockSectionShared is like LockSection, but any number of shared holders can
+// hold the section at once. Used for writes at explicit offsets, which don't
+// interfere with each other, but must not run during a truncating write
+func (fs *Fs) LockSectionShared(file id.ID, section string) (unlock func()) {
+	l, release := fs.acquireSectionLock(file, section)
+	l.mutex.RLock()
+
+	return func() {
+		l.mutex.RUnlock()
+		release()
+	}
 }
 
 func (fs *Fs) OpenSection(id id.ID, section string) (io.ReadCloser, error) {
@@ -279,6 +962,9 @@ func (fs *Fs) OpenSection(id id.ID, section string) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
+	if fs.sectionCache != nil {
+		return fs.openCachedSection(id, section)
+	}
 	return os.Open(fs.getSectionFileName(id, section))
 }
 
@@ -288,7 +974,346 @@ func (fs *Fs) CreateSection(id id.ID, section string) (io.WriteCloser, error) {
 		return nil, err
 	}
 
-	return os.Create(fs.getSectionFileName(id, section))
+	f, err := fs.opts.createFile(fs.getSectionFileName(id, section))
+	if err != nil {
+		return nil, err
+	}
+	fs.indexSection(id, section, true)
+	return fs.writer(f, id, section), nil
+}
+
+// MoveSection moves a section to another record or under another name,
+// replacing the destination section if it exists. The move is a single rename
+// so readers see either the old or the new state
+func (fs *Fs) MoveSection(srcID id.ID, srcSection string, dstID id.ID, dstSection string) error {
+	if err := checkSectionNameSanity(srcSection); err != nil {
+		return err
+	}
+	if err := checkSectionNameSanity(dstSection); err != nil {
+		return err
+	}
+	// the meta holds the permissions, moving one over it would rewrite them
+	if srcSection == "meta" || dstSection == "meta" {
+		return fmt.Errorf("%w: meta section can't be moved", ErrInvalidName)
+	}
+
+	if _, err := fs.record(srcID); err != nil {
+		return err
+	}
+	if _, err := fs.record(dstID); err != nil {
+		return err
+	}
+
+	src := sectionKey{file: srcID, section: srcSection}
+	dst := sectionKey{file: dstID, section: dstSection}
+	if src == dst {
+		return nil
+	}
+
+	// always lock in the same order so two opposite moves don't deadlock
+	first, second := src, dst
+	if first.file.String()+"."+first.section > second.file.String()+"."+second.section {
+		first, second = second, first
+	}
+	defer fs.LockSection(first.file, first.section)()
+	defer fs.LockSection(second.file, second.section)()
+
+	err := os.Rename(fs.getSectionFileName(srcID, srcSection), fs.getSectionFileName(dstID, dstSection))
+	if err != nil {
+		return err
+	}
+	fs.indexSection(srcID, srcSection, false)
+	fs.indexSection(dstID, dstSection, true)
+	fs.invalidateSection(srcID, srcSection)
+	fs.invalidateSection(dstID, dstSection)
+
+	err = fs.moveSectionMeta(srcID, srcSection, dstID, dstSection)
+	fs.publish(Event{Type: EventRename, ID: dstID, Section: dstSection, From: srcID, OldSection: srcSection})
+	return err
+}
+
+// moveSectionMeta moves what the meta knows about the section (type,
+// encoding, checksum) along with it. What the destination knew about the
+// section it replaced is dropped
+func (fs *Fs) moveSectionMeta(srcID id.ID, srcSection string, dstID id.ID, dstSection string) error {
+	var (
+		values  [3]string
+		present [3]bool
+		written int64
+		partial bool
+	)
+	take := func(fm *FileMeta) bool {
+		changed := false
+		for i, m := range fm.sectionMetaMaps() {
+			values[i], present[i] = (*m)[srcSection]
+			if present[i] {
+				delete(*m, srcSection)
+				changed = true
+			}
+		}
+		if written, partial = fm.SectionsWritten[srcSection]; partial {
+			delete(fm.SectionsWritten, srcSection)
+			changed = true
+		}
+		return changed
+	}
+	put := func(fm *FileMeta) bool {
+		changed := false
+		for i, m := range fm.sectionMetaMaps() {
+			if present[i] {
+				if *m == nil {
+					*m = map[string]string{}
+				}
+				(*m)[dstSection] = values[i]
+				changed = true
+			} else if _, ok := (*m)[dstSection]; ok {
+				delete(*m, dstSection)
+				changed = true
+			}
+		}
+		if partial {
+			if fm.SectionsWritten == nil {
+				fm.SectionsWritten = map[string]int64{}
+			}
+			fm.SectionsWritten[dstSection] = written
+			changed = true
+		} else if _, ok := fm.SectionsWritten[dstSection]; ok {
+			delete(fm.SectionsWritten, dstSection)
+			changed = true
+		}
+		return changed
+	}
+
+	if srcID == dstID {
+		return fs.updateMeta(srcID, func(fm *FileMeta) bool {
+			taken := take(fm)
+			return put(fm) || taken
+		})
+	}
+	if err := fs.updateMeta(srcID, take); err != nil {
+		return err
+	}
+	return fs.updateMeta(dstID, put)
+}
+
+// ErrSectionExists is returned when a section would be overwritten
+var ErrSectionExists = fmt.Errorf("section %w", ErrExists)
+
+// RenameSection renames a section of the record. Unlike MoveSection it never
+// replaces an existing section. The meta section can't be renamed
+func (fs *Fs) RenameSection(u id.ID, oldName, newName string) error {
+	if err := checkSectionNameSanity(oldName); err != nil {
+		return err
+	}
+	if err := checkSectionNameSanity(newName); err != nil {
+		return err
+	}
+	if oldName == "meta" || newName == "meta" {
+		return fmt.Errorf("%w: meta section can't be renamed", ErrInvalidName)
+	}
+
+	if _, err := fs.record(u); err != nil {
+		return err
+	}
+
+	if oldName == newName {
+		return nil
+	}
+
+	first, second := oldName, newName
+	if first > second {
+		first, second = second, first
+	}
+	unlockFirst := fs.LockSection(u, first)
+	unlockSecond := fs.LockSection(u, second)
+	defer unlockFirst()
+	defer unlockSecond()
+
+	_, err := os.Lstat(fs.getSectionFileName(u, newName))
+	if err == nil {
+		return ErrSectionExists
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err = os.Rename(fs.getSectionFileName(u, oldName), fs.getSectionFileName(u, newName)); err != nil {
+		return err
+	}
+	fs.indexSection(u, oldName, false)
+	fs.indexSection(u, newName, true)
+	fs.invalidateSection(u, oldName)
+	fs.invalidateSection(u, newName)
+
+	err = fs.moveSectionMeta(u, oldName, u, newName)
+	fs.publish(Event{Type: EventRename, ID: u, Section: newName, From: u, OldSection: oldName})
+	return err
+}
+
+// SectionWriterAt writes into a section at explicit offsets
+type SectionWriterAt interface {
+	io.WriterAt
+	io.Closer
+}
+
+// OpenSectionAt opens the section for writing at explicit offsets without
+// truncating it. The section is created if it doesn't exist yet
+func (fs *Fs) OpenSectionAt(id id.ID, section string) (SectionWriterAt, error) {
+	err := checkSectionNameSanity(section)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(fs.getSectionFileName(id, section), os.O_WRONLY|os.O_CREATE, fs.opts.filePerm())
+	if err != nil {
+		return nil, err
+	}
+	fs.indexSection(id, section, true)
+	return fs.writer(f, id, section), nil
+}
+
+// AllocateSection creates the section with the given size, or resizes an
+// existing one, so that chunks uploaded with OpenSectionAt have a file of the
+// final size to go into. The parts not written yet read as zeros and, where
+// the filesystem supports it, take no space. How much has been written is
+// kept apart from the size, see SetSectionWritten
+func (fs *Fs) AllocateSection(id id.ID, section string, size int64) error {
+	err := checkSectionNameSanity(section)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("section size %d is negative", size)
+	}
+	if _, err = fs.record(id); err != nil {
+		return err
+	}
+
+	defer fs.LockSection(id, section)()
+
+	f, err := os.OpenFile(fs.getSectionFileName(id, section), os.O_WRONLY|os.O_CREATE, fs.opts.filePerm())
+	if err != nil {
+		return err
+	}
+	fs.indexSection(id, section, true)
+	w := fs.writer(f, id, section)
+
+	err = f.Truncate(size)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SectionSize returns the size of the section in bytes. Sections that don't
+// exist have size zero
+func (fs *Fs) SectionSize(id id.ID, section string) (int64, error) {
+	err := checkSectionNameSanity(section)
+	if err != nil {
+		return 0, err
+	}
+
+	st, err := os.Stat(fs.getSectionFileName(id, section))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// SectionExists reports whether the record has the section and its size.
+// Sections missing from the index aren't looked for on the disk
+func (fs *Fs) SectionExists(u id.ID, section string) (bool, int64, error) {
+	if err := checkSectionNameSanity(section); err != nil {
+		return false, 0, err
+	}
+
+	r, err := fs.record(u)
+	if err != nil {
+		return false, 0, err
+	}
+	r.lock()
+	indexed := r.sections[section]
+	r.unlock()
+	if !indexed {
+		return false, 0, nil
+	}
+
+	st, err := os.Stat(fs.getSectionFileName(u, section))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, st.Size(), nil
+}
+
+// Sections returns the names of the sections the record has, sorted
+func (fs *Fs) Sections(u id.ID) ([]string, error) {
+	if _, err := fs.record(u); err != nil {
+		return nil, err
+	}
+
+	files, err := fs.recordFiles(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// ReadDir sorts by name, so the sections come out sorted too
+	var sections []string
+	prefix := u.String() + "."
+	for _, e := range files {
+		if section, ok := strings.CutPrefix(e.Name(), prefix); ok {
+			sections = append(sections, section)
+		}
+	}
+	return sections, nil
+}
+
+// SectionInfo describes one section of a record
+type SectionInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// Type is the media type from the meta, empty if none was recorded
+	Type string `json:"type"`
+}
+
+// SectionInfos is Sections with the size, modification time and type of
+// every section
+func (fs *Fs) SectionInfos(u id.ID) ([]SectionInfo, error) {
+	sections, err := fs.Sections(u)
+	if err != nil {
+		return nil, err
+	}
+
+	fm, err := fs.Meta(u)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]SectionInfo, 0, len(sections))
+	for _, section := range sections {
+		st, err := os.Stat(fs.getSectionFileName(u, section))
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted since the listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, SectionInfo{
+			Name:     section,
+			Size:     st.Size(),
+			Modified: st.ModTime(),
+			Type:     fm.SectionTypes[section],
+		})
+	}
+	return infos, nil
 }
 
 func (fs *Fs) DeleteSection(id id.ID, section string) error {
@@ -297,81 +1322,180 @@ func (fs *Fs) DeleteSection(id id.ID, section string) error {
 		return err
 	}
 
-	return os.Remove(fs.getSectionFileName(id, section))
+	if err = os.Remove(fs.getSectionFileName(id, section)); err != nil {
+		return err
+	}
+	fs.indexSection(id, section, false)
+	fs.invalidateSection(id, section)
+	return nil
 }
 
 func (fs *Fs) loadRecords() error {
-	entries, err := os.ReadDir(fs.basePath)
+	files, err := listStoreFiles(fs.basePath)
 	if err != nil {
 		return err
 	}
 
 	var recordFiles []string
+	sectionFiles := make(map[string][]string)
+
+	for _, e := range files {
+		name := e.Name()
+
+		if strings.HasPrefix(name, tempFilePrefix) && !e.Type().IsDir() {
+			// leftover of an interrupted write, never visible to
+			// anyone
+			if err = os.Remove(e.path); err != nil {
+				return err
+			}
+			continue
+		}
 
-	for _, e := range entries {
 		if e.Type().IsDir() {
 			return errors.New("garbage directory in fs root")
 		}
 
-		name := e.Name()
-
 		if !onlyFileInFsRootPatternRegex.MatchString(name) {
 			return fmt.Errorf("garbage file in fs root: %s", name)
 		}
 
-		if len(name) == 22 {
+		if err = fs.moveToLayout(e); err != nil {
+			return err
+		}
+
+		if recordName, section, ok := strings.Cut(name, "."); ok {
+			sectionFiles[recordName] = append(sectionFiles[recordName], section)
+		} else {
 			recordFiles = append(recordFiles, name)
-		} // else { TODO: file sections }
+		}
 	}
 
+	// the references are counted while reading, so that with a record
+	// cache the records don't have to be kept around until all are read
+	refs := make(map[id.ID]uint)
 	for _, recordName := range recordFiles {
 		u, err := id.Parse(recordName)
 		if err != nil {
 			return err
 		}
 
-		f, err := os.Open(fs.path(recordName))
+		rec, err := fs.readRecord(u)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
+		for _, c := range rec.Children {
+			refs[c]++
+		}
 
-		rec := new(record)
-		dec := json.NewDecoder(f)
-		err = dec.Decode(rec)
-		if err != nil {
-			return fmt.Errorf("json decore err: %w", err)
+		st := new(recordState)
+		st.sections = make(map[string]bool)
+		for _, section := range sectionFiles[recordName] {
+			st.sections[section] = true
 		}
+		fs.states[u] = st
+		fs.attach(rec, st)
+	}
 
-		fs.records[u] = rec
+	// references from records that don't exist are not counted and the
+	// root has one extra so that it is never collected
+	for u, st := range fs.states {
+		st.refs = refs[u]
+	}
+	if root, ok := fs.states[fs.root]; ok {
+		root.refs++
 	}
 
-	// TODO(prokop) load section file names
+	if !fs.opts.Shard {
+		return fs.removeEmptyShardDirs()
+	}
 	return nil
 }
 
-func checkLoadedRecordsAreSane(map[id.ID]*record) error {
+// sortedIDs returns the IDs of all records in a stable order so that anything
+// iterating over the whole fs behaves the same on every load
+func (fs *Fs) sortedIDs() []id.ID {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	ids := make([]id.ID, 0, len(fs.states))
+	for u := range fs.states {
+		ids = append(ids, u)
+	}
+	slices.SortFunc(ids, id.ID.Compare)
+	return ids
+}
+
+func checkLoadedRecordsAreSane(map[id.ID]*recordState) error {
 	// TODO(prokop)
 	return nil
 }
 
-func NewFs(root id.ID, basePath string) (fs *Fs, err error) {
+// NewFs loads the fs from basePath. The zero root ID means the one stored
+// by InitFsDir. The dir is locked until Close, so that another process can't
+// open it at the same time and overwrite its changes
+func NewFs(root id.ID, basePath string, opts Options) (*Fs, error) {
+	lock, err := lockDir(basePath, opts.filePerm())
+	if err != nil {
+		return nil, fmt.Errorf("lock: %w", err)
+	}
+
+	fs, err := loadFs(root, basePath, opts)
+	if err != nil {
+		if unlockErr := lock.unlock(); unlockErr != nil {
+			err = errors.Join(err, unlockErr)
+		}
+		return nil, err
+	}
+	fs.dirLock = lock
+	return fs, nil
+}
+
+// Close unlocks the fs dir. The fs can't be used after
+func (fs *Fs) Close() error {
+	if fs.dirLock == nil {
+		return nil
+	}
+	err := fs.dirLock.unlock()
+	fs.dirLock = nil
+	return err
+}
+
+// loadFs is NewFs without the lock, for reloading a dir that is already
+// locked
+func loadFs(root id.ID, basePath string, opts Options) (fs *Fs, err error) {
+	if root == (id.ID{}) {
+		root, err = ReadRootID(basePath)
+		if err != nil {
+			err = fmt.Errorf("read root id: %w", err)
+			return
+		}
+	}
+
 	fs = new(Fs)
 	fs.basePath = basePath
 	fs.root = root
-	fs.records = make(map[id.ID]*record)
+	fs.opts = opts
+	fs.epoch = rand.Uint64() // #nosec G404: only needs to differ between restarts
+	fs.states = make(map[id.ID]*recordState)
+	if opts.RecordCache > 0 {
+		fs.cache = newRecordCache(opts.RecordCache)
+	}
+	if opts.SectionCacheLimit > 0 {
+		fs.sectionCache = newSectionCache(opts.SectionCacheLimit)
+	}
+	fs.sectionLocks = make(map[sectionKey]*sectionLock)
 
 	err = fs.loadRecords()
 	if err != nil {
 		return
 	}
 
-	if _, c := fs.records[root]; !c {
+	if _, c := fs.states[root]; !c {
 		err = errors.New("the root ID not found in fs")
 		return
 	}
 
-	return fs, checkLoadedRecordsAreSane(fs.records)
+	return fs, checkLoadedRecordsAreSane(fs.states)
 }
 
 // function argument `dir` has to be checked by the caller. It is assumed that
@@ -385,38 +1509,52 @@ func NewFs(root id.ID, basePath string) (fs *Fs, err error) {
 //	    ├── ...
 //	    └── ...
 //
+// Running it again on an initialized (or partially initialized) dir only
+// creates what is missing. The existing root is kept and returned, existing
+// users keep their passwords.
+//
 // Used to setup a server in unittests.
-func InitFsDir(dir string, users map[string][64]byte) (rootID id.ID, err error) {
+func InitFsDir(dir string, users map[string][64]byte, opts Options) (rootID id.ID, err error) {
 	fsDir := filepath.Join(dir, "files")
-	rootID = id.New()
-	rootIDPath := filepath.Join(fsDir, rootID.String())
 	usersDir := filepath.Join(dir, "users")
 
-	if err = os.Mkdir(fsDir, 0750); err != nil {
+	if err = os.MkdirAll(fsDir, opts.dirPerm()); err != nil {
 		err = fmt.Errorf("mkdir: %w", err)
 		return
 	}
 
-	if err = os.Mkdir(usersDir, 0750); err != nil {
+	if err = os.MkdirAll(usersDir, opts.dirPerm()); err != nil {
 		err = fmt.Errorf("mkdir: %w", err)
 		return
 	}
 
-	f, err := os.Create(rootIDPath) // #nosec G304: the dir argument is trusted
+	rootID, err = ReadRootID(fsDir)
+	found := err == nil
+	if errors.Is(err, os.ErrNotExist) {
+		// initialized before the marker existed, or not at all
+		rootID, found, err = findRoot(fsDir)
+	}
 	if err != nil {
-		err = fmt.Errorf("create root id: %w", err)
+		err = fmt.Errorf("find root: %w", err)
 		return
 	}
-	defer f.Close()
 
-	if err = json.NewEncoder(f).Encode(record{IsDir: true}); err != nil {
-		err = fmt.Errorf("encode root record: %w", err)
+	if !found {
+		rootID = id.New()
+		if err = writeRootRecord(filepath.Join(fsDir, rootID.String()), opts); err != nil {
+			return
+		}
+	}
+
+	err = writeFileIfMissing(filepath.Join(fsDir, rootMarkerName), []byte(rootID.String()+"\n"), opts.filePerm())
+	if err != nil {
+		err = fmt.Errorf("write root marker: %w", err)
 		return
 	}
 
 	for user, pwd := range users {
 		userFilePath := filepath.Join(usersDir, user)
-		err = os.WriteFile(userFilePath, pwd[:], 0600)
+		err = writeFileIfMissing(userFilePath, pwd[:], opts.filePerm())
 		if err != nil {
 			err = fmt.Errorf("write user file: %w", err)
 			return
@@ -425,3 +1563,100 @@ func InitFsDir(dir string, users map[string][64]byte) (rootID id.ID, err error)
 
 	return
 }
+
+// rootMarkerName is the file in the fs root that holds the root ID, so the
+// server can be started with just the data dir
+const rootMarkerName = ".root"
+
+// lockFileName is the file in the fs root NewFs locks
+const lockFileName = ".lock"
+
+// ReadRootID returns the root ID InitFsDir stored in the fs dir
+func ReadRootID(fsDir string) (id.ID, error) {
+	content, err := os.ReadFile(filepath.Join(fsDir, rootMarkerName)) // #nosec G304: fsDir is trusted
+	if err != nil {
+		return id.ID{}, err
+	}
+	return id.Parse(strings.TrimSpace(string(content)))
+}
+
+func writeRootRecord(path string, opts Options) error {
+	f, err := opts.createFile(path)
+	if err != nil {
+		return fmt.Errorf("create root id: %w", err)
+	}
+	defer f.Close()
+
+	if err = json.NewEncoder(f).Encode(record{IsDir: true}); err != nil {
+		return fmt.Errorf("encode root record: %w", err)
+	}
+	return nil
+}
+
+func writeFileIfMissing(path string, content []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm) // #nosec G304: path is built by InitFsDir
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// findRoot looks for the root among the records in an existing fs dir. The
+// root is the one record that no other record has as a child
+func findRoot(fsDir string) (root id.ID, found bool, err error) {
+	entries, err := listStoreFiles(fsDir)
+	if err != nil {
+		return
+	}
+
+	var ids []id.ID
+	children := make(map[id.ID]bool)
+	for _, e := range entries {
+		u, parseErr := id.Parse(e.Name())
+		if parseErr != nil {
+			// sections and leftovers
+			continue
+		}
+
+		content, readErr := os.ReadFile(e.path) // #nosec G304: the name is a valid id
+		if readErr != nil {
+			err = readErr
+			return
+		}
+
+		var r record
+		if err = json.Unmarshal(content, &r); err != nil {
+			err = fmt.Errorf("record %s: %w", e.Name(), err)
+			return
+		}
+
+		ids = append(ids, u)
+		for _, c := range r.Children {
+			children[c] = true
+		}
+	}
+
+	for _, u := range ids {
+		if children[u] {
+			continue
+		}
+		if found {
+			err = errors.New("more than one record without a parent")
+			return
+		}
+		root, found = u, true
+	}
+
+	if len(ids) > 0 && !found {
+		err = errors.New("every record has a parent")
+	}
+	return
+}
@@ -0,0 +1,706 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"archiiv/id"
+)
+
+func newTestFs(t testing.TB) *Fs {
+	return newTestFsWithOptions(t, Options{})
+}
+
+func newTestFsWithOptions(t testing.TB, opts Options) *Fs {
+	dir := t.TempDir()
+	rootID, err := InitFsDir(dir, nil, opts)
+	if err != nil {
+		t.Fatalf("init fs dir: %v", err)
+	}
+
+	fs, err := NewFs(rootID, filepath.Join(dir, "files"), opts)
+	if err != nil {
+		t.Fatalf("new fs: %v", err)
+	}
+
+	return fs
+}
+
+func writeSection(t *testing.T, fs *Fs, file id.ID, section, content string) {
+	w, err := fs.CreateSection(file, section)
+	if err != nil {
+		t.Fatalf("create section: %v", err)
+	}
+	defer w.Close()
+
+	if _, err = w.Write([]byte(content)); err != nil {
+		t.Fatalf("write section: %v", err)
+	}
+}
+
+func TestCreatedFilesGetConfiguredMode(t *testing.T) {
+	t.Parallel()
+	fs := newTestFsWithOptions(t, Options{FilePerm: 0640})
+
+	file, err := fs.Touch(fs.GetRoot(), "hello")
+	require.NoError(t, err)
+	writeSection(t, fs, file, "data", "hello")
+
+	st, err := os.Stat(fs.getSectionFileName(file, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), st.Mode().Perm())
+
+	st, err = os.Stat(fs.path(file.String()))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), st.Mode().Perm())
+}
+
+func TestMaxChildren(t *testing.T) {
+	t.Parallel()
+	fs := newTestFsWithOptions(t, Options{MaxChildren: 2})
+
+	dir, err := fs.Mkdir(fs.GetRoot(), "dir")
+	require.NoError(t, err)
+	file, err := fs.Touch(fs.GetRoot(), "file")
+	require.NoError(t, err)
+
+	_, err = fs.Touch(fs.GetRoot(), "one too many")
+	assert.ErrorContains(t, err, "too many children")
+	_, err = fs.Mkdir(fs.GetRoot(), "one too many")
+	assert.ErrorContains(t, err, "too many children")
+
+	sub, err := fs.Mkdir(dir, "sub")
+	require.NoError(t, err)
+	nested, err := fs.Touch(sub, "nested")
+	require.NoError(t, err)
+
+	require.NoError(t, fs.Mount(dir, file))
+	assert.ErrorContains(t, fs.Mount(dir, nested), "too many children")
+}
+
+func TestMaxDepth(t *testing.T) {
+	t.Parallel()
+	fs := newTestFsWithOptions(t, Options{MaxDepth: 3})
+	root := fs.GetRoot()
+
+	// a chain root -> a -> b -> c right at the limit
+	var chain []id.ID
+	for _, name := range []string{"a", "b", "c"} {
+		dir, err := fs.Mkdir(root, name)
+		require.NoError(t, err)
+		if len(chain) > 0 {
+			require.NoError(t, fs.Mount(chain[len(chain)-1], dir))
+		}
+		chain = append(chain, dir)
+	}
+	last := chain[len(chain)-1]
+
+	file, err := fs.Touch(root, "file")
+	require.NoError(t, err)
+	assert.ErrorIs(t, fs.Mount(last, file), ErrTooDeep)
+	_, err = fs.Mkdir(last, "d")
+	assert.ErrorIs(t, err, ErrTooDeep)
+
+	// the height of the mounted record counts too
+	dir, err := fs.Mkdir(root, "dir")
+	require.NoError(t, err)
+	require.NoError(t, fs.Mount(dir, file))
+	assert.ErrorIs(t, fs.Mount(chain[1], dir), ErrTooDeep)
+	require.NoError(t, fs.Mount(chain[0], dir))
+
+	// the depths are cached, the ones that get shallower must follow
+	_, err = fs.Mkdir(chain[0], "shallow")
+	require.NoError(t, err)
+	require.NoError(t, fs.Unmount(chain[1], last))
+	_, err = fs.Mkdir(last, "d")
+	require.NoError(t, err)
+
+	// walks stop on trees deeper than the limit
+	require.NoError(t, fs.Close())
+	shallow, err := NewFs(root, fs.basePath, Options{MaxDepth: 2})
+	require.NoError(t, err)
+	err = shallow.Walk(context.Background(), root, func(string, FileInfo) error { return nil })
+	assert.ErrorIs(t, err, ErrTooDeep)
+	_, err = shallow.Tree(context.Background(), root, -1)
+	assert.ErrorIs(t, err, ErrTooDeep)
+}
+
+func TestSectionNameSanity(t *testing.T) {
+	t.Parallel()
+
+	for _, ok := range []string{"data", "meta", "thumb_256", "exif-raw", "0000000000000000000000", "lllllllllllllllllllllll"} {
+		assert.NoError(t, checkSectionNameSanity(ok), ok)
+	}
+
+	for _, bad := range []string{"", "a.b", "../data", "with space"} {
+		assert.ErrorContains(t, checkSectionNameSanity(bad), "not sane", bad)
+	}
+
+	for _, reserved := range []string{id.New().String(), id.ID{}.String()} {
+		assert.ErrorContains(t, checkSectionNameSanity(reserved), "reserved", reserved)
+	}
+}
+
+func TestRootIsNeverDeleted(t *testing.T) {
+	fs := newTestFs(t)
+	root := fs.GetRoot()
+
+	a, err := fs.Mkdir(root, "a")
+	require.NoError(t, err)
+	// Mount refuses the cycle, so the root is put under a by hand
+	ar, err := fs.record(a)
+	require.NoError(t, err)
+	ar.lock()
+	ar.Children = append(ar.Children, root)
+	ar.unlock()
+
+	// pretend the root lost its own reference, so the unmount drops the
+	// last one
+	r, err := fs.record(root)
+	require.NoError(t, err)
+	r.lock()
+	r.refs = 1
+	r.unlock()
+
+	assert.Error(t, fs.Unmount(a, root))
+
+	_, err = fs.Stat(root)
+	assert.NoError(t, err)
+	_, err = os.Stat(fs.path(root.String()))
+	assert.NoError(t, err)
+	children, err := fs.GetChildren(root)
+	require.NoError(t, err)
+	assert.Equal(t, []id.ID{a}, children)
+}
+
+func TestRenameSectionKeepsMeta(t *testing.T) {
+	fs := newTestFs(t)
+	file, err := fs.Touch(fs.GetRoot(), "file")
+	require.NoError(t, err)
+	require.NoError(t, fs.InitFileMeta(fs.GetRoot(), file, "prokop", false))
+
+	writeSection(t, fs, file, "notes", "hello")
+	require.NoError(t, fs.SetSectionType(file, "notes", "text/plain"))
+
+	require.NoError(t, fs.RenameSection(file, "notes", "description"))
+
+	typ, err := fs.SectionType(file, "description")
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", typ)
+	sections, err := fs.Sections(file)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"description", "meta"}, sections)
+}
+
+func TestMoveSectionKeepsMeta(t *testing.T) {
+	fs := newTestFs(t)
+	src, err := fs.Touch(fs.GetRoot(), "src")
+	require.NoError(t, err)
+	require.NoError(t, fs.InitFileMeta(fs.GetRoot(), src, "prokop", false))
+	dst, err := fs.Touch(fs.GetRoot(), "dst")
+	require.NoError(t, err)
+	require.NoError(t, fs.InitFileMeta(fs.GetRoot(), dst, "prokop", false))
+
+	writeSection(t, fs, src, "notes", "hello")
+	require.NoError(t, fs.SetSectionType(src, "notes", "text/plain"))
+	require.NoError(t, fs.SetSectionEncoding(src, "notes", EncodingGzip))
+	require.NoError(t, fs.SetSectionChecksum(src, "notes", "sha256:abc"))
+	writeSection(t, fs, dst, "description", "old")
+	require.NoError(t, fs.SetSectionChecksum(dst, "description", "sha256:old"))
+
+	require.NoError(t, fs.MoveSection(src, "notes", dst, "description"))
+
+	sm, err := ReadFileMeta(fs, src)
+	require.NoError(t, err)
+	assert.Empty(t, sm.SectionTypes)
+	assert.Empty(t, sm.SectionEncodings)
+	assert.Empty(t, sm.SectionChecksums)
+
+	dm, err := ReadFileMeta(fs, dst)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"description": "text/plain"}, dm.SectionTypes)
+	assert.Equal(t, map[string]string{"description": EncodingGzip}, dm.SectionEncodings)
+	assert.Equal(t, map[string]string{"description": "sha256:abc"}, dm.SectionChecksums)
+}
+
+func TestInitFsDirTwice(t *testing.T) {
+	dir := t.TempDir()
+	rootID, err := InitFsDir(dir, map[string][64]byte{"prokop": {1}}, Options{})
+	require.NoError(t, err)
+
+	fs, err := NewFs(rootID, filepath.Join(dir, "files"), Options{})
+	require.NoError(t, err)
+	a, err := fs.Mkdir(rootID, "a")
+	require.NoError(t, err)
+
+	again, err := InitFsDir(dir, map[string][64]byte{"prokop": {2}, "marek": {3}}, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, rootID, again)
+
+	pwd, err := os.ReadFile(filepath.Join(dir, "users", "prokop"))
+	require.NoError(t, err)
+	assert.Equal(t, byte(1), pwd[0], "existing user clobbered")
+	pwd, err = os.ReadFile(filepath.Join(dir, "users", "marek"))
+	require.NoError(t, err)
+	assert.Equal(t, byte(3), pwd[0])
+
+	require.NoError(t, fs.Close())
+	fs, err = NewFs(rootID, filepath.Join(dir, "files"), Options{})
+	require.NoError(t, err)
+	children, err := fs.GetChildren(rootID)
+	require.NoError(t, err)
+	assert.Equal(t, []id.ID{a}, children)
+}
+
+func TestRootMarker(t *testing.T) {
+	dir := t.TempDir()
+	fsDir := filepath.Join(dir, "files")
+	rootID, err := InitFsDir(dir, nil, Options{})
+	require.NoError(t, err)
+
+	read, err := ReadRootID(fsDir)
+	require.NoError(t, err)
+	assert.Equal(t, rootID, read)
+
+	fs, err := NewFs(id.ID{}, fsDir, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, rootID, fs.GetRoot())
+	require.NoError(t, fs.Close())
+
+	// dirs initialized before the marker get it on the next init
+	require.NoError(t, os.Remove(filepath.Join(fsDir, rootMarkerName)))
+	_, err = NewFs(id.ID{}, fsDir, Options{})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	again, err := InitFsDir(dir, nil, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, rootID, again)
+	read, err = ReadRootID(fsDir)
+	require.NoError(t, err)
+	assert.Equal(t, rootID, read)
+}
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+
+	_, err := NewFs(fs.GetRoot(), fs.basePath, Options{})
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// a failed NewFs releases the lock
+	require.NoError(t, fs.Close())
+	_, err = NewFs(id.New(), fs.basePath, Options{})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrLocked)
+
+	second, err := NewFs(fs.GetRoot(), fs.basePath, Options{})
+	require.NoError(t, err)
+	_, err = NewFs(fs.GetRoot(), fs.basePath, Options{})
+	assert.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, second.Close())
+	assert.NoError(t, second.Close())
+}
+
+func TestAllocateSection(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+	file, err := fs.Touch(fs.GetRoot(), "big")
+	require.NoError(t, err)
+
+	const size = 1 << 20
+	require.NoError(t, fs.AllocateSection(file, "data", size))
+	st, err := os.Stat(fs.getSectionFileName(file, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), st.Size())
+	sections, err := fs.Sections(file)
+	require.NoError(t, err)
+	assert.Contains(t, sections, "data")
+
+	// the chunks land in place, the rest stays zero
+	w, err := fs.OpenSectionAt(file, "data")
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("tail"), size-4)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	content := readSection(t, fs, file, "data")
+	assert.Len(t, content, size)
+	assert.Equal(t, "\x00\x00tail", content[size-6:])
+
+	// shrinking works too
+	require.NoError(t, fs.AllocateSection(file, "data", 2))
+	assert.Equal(t, "\x00\x00", readSection(t, fs, file, "data"))
+
+	assert.Error(t, fs.AllocateSection(file, "data", -1))
+	assert.ErrorIs(t, fs.AllocateSection(id.New(), "data", 1), ErrNotFound)
+}
+
+func TestTouchWithID(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+	root := fs.GetRoot()
+
+	// the records of an import, one file referenced from two places
+	docs, shared := id.New(), id.New()
+	require.NoError(t, fs.TouchWithID(root, docs, "docs", true))
+	require.NoError(t, fs.TouchWithID(docs, shared, "shared", false))
+	require.NoError(t, fs.Mount(root, shared))
+
+	assert.ErrorIs(t, fs.TouchWithID(root, shared, "again", false), ErrExists)
+	assert.ErrorIs(t, fs.TouchWithID(docs, root, "root", true), ErrExists)
+	assert.Error(t, fs.TouchWithID(root, id.ID{}, "zero", false))
+	assert.ErrorIs(t, fs.TouchWithID(shared, id.New(), "in a file", false), ErrNotDir)
+	assert.ErrorIs(t, fs.TouchWithID(id.New(), id.New(), "orphan", false), ErrNotFound)
+
+	require.NoError(t, fs.Close())
+	loaded, err := NewFs(root, fs.basePath, Options{})
+	require.NoError(t, err)
+	children, err := loaded.GetChildren(root)
+	require.NoError(t, err)
+	assert.Equal(t, []id.ID{docs, shared}, children)
+	children, err = loaded.GetChildren(docs)
+	require.NoError(t, err)
+	assert.Equal(t, []id.ID{shared}, children)
+	info, err := loaded.Stat(docs)
+	require.NoError(t, err)
+	assert.True(t, info.IsDir)
+	assert.Equal(t, "docs", info.Name)
+}
+
+func TestInitFsDirPartial(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "files"), 0750))
+
+	rootID, err := InitFsDir(dir, nil, Options{})
+	require.NoError(t, err)
+	_, err = NewFs(rootID, filepath.Join(dir, "files"), Options{})
+	assert.NoError(t, err)
+}
+
+func TestPutSection(t *testing.T) {
+	fs := newTestFs(t)
+	file, err := fs.Touch(fs.GetRoot(), "file")
+	require.NoError(t, err)
+
+	n, err := fs.PutSection(file, "data", strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	readData := func() string {
+		r, err := fs.OpenSection(file, "data")
+		require.NoError(t, err)
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "hello", readData())
+
+	// the reader fails midway, the old content must survive
+	errBroken := errors.New("broken pipe")
+	n, err = fs.PutSection(file, "data", io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errBroken)))
+	assert.ErrorIs(t, err, errBroken)
+	assert.Equal(t, int64(7), n)
+	assert.Equal(t, "hello", readData())
+
+	entries, err := os.ReadDir(fs.basePath)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), tempFilePrefix), "temp file left behind: %v", e.Name())
+	}
+
+	_, err = fs.PutSection(file, "../escape", strings.NewReader("x"))
+	assert.Error(t, err)
+	_, err = fs.PutSection(id.New(), "data", strings.NewReader("x"))
+	assert.Error(t, err)
+}
+
+func TestSectionBatchAllOrNothing(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+	file, err := fs.Touch(fs.GetRoot(), "file")
+	require.NoError(t, err)
+	writeSection(t, fs, file, "a", "old")
+
+	// "c" can't be replaced, so neither "a" nor the new "b" may be
+	blocker := fs.getSectionFileName(file, "c")
+	require.NoError(t, os.MkdirAll(filepath.Join(blocker, "inside"), 0o700))
+
+	batch, err := fs.NewSectionBatch(file)
+	require.NoError(t, err)
+	for _, section := range []string{"a", "b", "c"} {
+		w, err := batch.Create(section)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, "new")
+		require.NoError(t, err)
+	}
+	assert.Error(t, batch.Commit())
+
+	assert.Equal(t, "old", readSection(t, fs, file, "a"))
+	_, err = os.Stat(fs.getSectionFileName(file, "b"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	r, err := fs.record(file)
+	require.NoError(t, err)
+	assert.NotContains(t, r.sectionNames(), "b")
+
+	require.NoError(t, os.RemoveAll(blocker))
+	entries, err := os.ReadDir(fs.basePath)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), tempFilePrefix), "temp file left behind: %v", e.Name())
+	}
+}
+
+func TestDeleteRemovesIndexedSections(t *testing.T) {
+	fs := newTestFs(t)
+	file, err := fs.Touch(fs.GetRoot(), "file")
+	require.NoError(t, err)
+	other, err := fs.Touch(fs.GetRoot(), "other")
+	require.NoError(t, err)
+
+	writeSection(t, fs, file, "created", "x")
+	_, err = fs.PutSection(file, "put", strings.NewReader("x"))
+	require.NoError(t, err)
+	w, err := fs.OpenSectionAt(file, "at")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	writeSection(t, fs, other, "moved", "x")
+	require.NoError(t, fs.MoveSection(other, "moved", file, "moved"))
+	writeSection(t, fs, file, "old", "x")
+	require.NoError(t, fs.RenameSection(file, "old", "renamed"))
+
+	// the index survives a reload
+	require.NoError(t, fs.Close())
+	fs, err = NewFs(fs.GetRoot(), fs.basePath, Options{})
+	require.NoError(t, err)
+	writeSection(t, fs, file, "after-load", "x")
+
+	require.NoError(t, fs.Unmount(fs.GetRoot(), file))
+
+	entries, err := os.ReadDir(fs.basePath)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), file.String()), "left behind: %v", e.Name())
+	}
+	sections, err := fs.Sections(other)
+	require.NoError(t, err)
+	assert.Empty(t, sections)
+}
+
+// deleteByScan is how deleteRecord found the files of a record before the
+// section index
+func deleteByScan(fs *Fs, u id.ID) error {
+	entries, err := os.ReadDir(fs.basePath)
+	if err != nil {
+		return err
+	}
+
+	idStr := u.String()
+	for _, e := range entries {
+		if e.Name() == idStr || strings.HasPrefix(e.Name(), idStr+".") {
+			if err = os.Remove(fs.path(e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func BenchmarkDeleteRecord(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		delete func(fs *Fs, r *record) error
+	}{
+		{"scan", func(fs *Fs, r *record) error { return deleteByScan(fs, r.id) }},
+		{"indexed", func(fs *Fs, r *record) error { return fs.deleteRecord(r, fs.GetRoot()) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			fs := newTestFs(b)
+			// a fs root with many files to scan through. They don't
+			// need to be loadable
+			for range 10000 {
+				require.NoError(b, os.WriteFile(fs.path(id.New().String()+".data"), []byte("x"), 0600))
+			}
+
+			for b.Loop() {
+				b.StopTimer()
+				file, err := fs.Touch(fs.GetRoot(), "victim")
+				require.NoError(b, err)
+				_, err = fs.PutSection(file, "data", strings.NewReader("x"))
+				require.NoError(b, err)
+				r, err := fs.record(file)
+				require.NoError(b, err)
+				r.refs = 0
+				b.StartTimer()
+
+				require.NoError(b, bc.delete(fs, r))
+			}
+		})
+	}
+}
+
+func TestConcurrentMountUnmount(t *testing.T) {
+	t.Parallel()
+
+	fs := newTestFs(t)
+	root := fs.GetRoot()
+	parent, err := fs.Mkdir(root, "parent")
+	require.NoError(t, err)
+
+	const workers, rounds = 8, 50
+
+	var (
+		toggled   []id.ID // each toggled by its own worker
+		contended []id.ID // mounted and unmounted by two workers at once
+		doomed    []id.ID // only in parent, unmounted while being mounted to root
+	)
+	for range workers {
+		for _, list := range []*[]id.ID{&toggled, &contended} {
+			child, err := fs.Touch(root, "child")
+			require.NoError(t, err)
+			*list = append(*list, child)
+		}
+		child, err := fs.Touch(parent, "doomed")
+		require.NoError(t, err)
+		doomed = append(doomed, child)
+	}
+
+	var wg sync.WaitGroup
+	spawn := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+	for i := range workers {
+		spawn(func() {
+			for r := range rounds {
+				if r%2 == 0 {
+					assert.NoError(t, fs.Mount(parent, toggled[i]))
+				} else {
+					assert.NoError(t, fs.Unmount(parent, toggled[i]))
+				}
+			}
+			// ends mounted
+			assert.NoError(t, fs.Mount(parent, toggled[i]))
+		})
+		for range 2 {
+			spawn(func() {
+				for range rounds {
+					// either can fail, depending on who is first
+					_ = fs.Mount(parent, contended[i])
+					_ = fs.Unmount(parent, contended[i])
+				}
+			})
+		}
+		spawn(func() {
+			// fails if the unmount collected the record first
+			_ = fs.Mount(root, doomed[i])
+		})
+		spawn(func() {
+			assert.NoError(t, fs.Unmount(parent, doomed[i]))
+		})
+	}
+	wg.Wait()
+
+	children, err := fs.GetChildren(parent)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, toggled, children)
+
+	for _, u := range append(toggled, contended...) {
+		r, err := fs.record(u)
+		require.NoError(t, err)
+		want := uint(1)
+		if slices.Contains(children, u) {
+			want++
+		}
+		assert.Equal(t, want, r.refs)
+	}
+
+	rootChildren, err := fs.GetChildren(root)
+	require.NoError(t, err)
+	for _, u := range doomed {
+		_, err := fs.Stat(u)
+		assert.Equal(t, slices.Contains(rootChildren, u), err == nil, "doomed child %s", u)
+	}
+
+	problems, err := fs.Fsck(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	require.NoError(t, fs.Close())
+	loaded, err := NewFs(root, fs.basePath, Options{})
+	require.NoError(t, err)
+	loadedChildren, err := loaded.GetChildren(parent)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, children, loadedChildren)
+}
+
+func TestConcurrentMountCycle(t *testing.T) {
+	t.Parallel()
+	fs := newTestFsWithOptions(t, Options{MaxDepth: 3})
+	root := fs.GetRoot()
+
+	for range 50 {
+		a, err := fs.Mkdir(root, "a")
+		require.NoError(t, err)
+		b, err := fs.Mkdir(root, "b")
+		require.NoError(t, err)
+
+		// each mount is fine alone, together they would make a cycle
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i, pair := range [][2]id.ID{{a, b}, {b, a}} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = fs.Mount(pair[0], pair[1])
+			}()
+		}
+		wg.Wait()
+
+		if errs[0] == nil {
+			assert.ErrorIs(t, errs[1], ErrCycle)
+			require.NoError(t, fs.Unmount(a, b))
+		} else {
+			assert.ErrorIs(t, errs[0], ErrCycle)
+			require.NoError(t, errs[1])
+			require.NoError(t, fs.Unmount(b, a))
+		}
+		require.NoError(t, fs.Unmount(root, a))
+		require.NoError(t, fs.Unmount(root, b))
+	}
+}
+
+func TestSectionRenameEvents(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+
+	a, err := fs.Touch(fs.GetRoot(), "a")
+	require.NoError(t, err)
+	b, err := fs.Touch(fs.GetRoot(), "b")
+	require.NoError(t, err)
+	writeSection(t, fs, a, "data", "content")
+
+	events, unsubscribe := fs.Subscribe()
+	defer unsubscribe()
+
+	require.NoError(t, fs.RenameSection(a, "data", "old"))
+	assert.Equal(t, Event{Type: EventRename, ID: a, Section: "old", From: a, OldSection: "data"}, <-events)
+	require.NoError(t, fs.MoveSection(a, "old", b, "data"))
+	assert.Equal(t, Event{Type: EventRename, ID: b, Section: "data", From: a, OldSection: "old"}, <-events)
+
+	// nothing happens, nothing is published
+	require.NoError(t, fs.RenameSection(b, "data", "data"))
+	assert.Empty(t, events)
+}
@@ -0,0 +1,142 @@
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"archiiv/id"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// recordChecksum hashes the JSON encoding of the record with the checksum
+// field left out
+func recordChecksum(r *record) (string, error) {
+	saved := r.Checksum
+	r.Checksum = ""
+	defer func() { r.Checksum = saved }()
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func verifyRecordChecksum(r *record) error {
+	if r.Checksum == "" {
+		return nil
+	}
+
+	sum, err := recordChecksum(r)
+	if err != nil {
+		return err
+	}
+
+	if sum != r.Checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// Fsck checks the consistency of the loaded records and that all their
+// sections can be read through, and describes every problem it finds. The
+// output only depends on the data on disk, so two loads of the same directory
+// give the same report. The check stops with the context's error once it is
+// done
+func (fs *Fs) Fsck(ctx context.Context) ([]string, error) {
+	var problems []string
+
+	entries, err := listStoreFiles(fs.basePath)
+	if err != nil {
+		return nil, err
+	}
+	sections := make(map[string][]string)
+	for _, e := range entries {
+		recordName, section, isSection := strings.Cut(e.Name(), ".")
+		if isSection && recordName != "" {
+			sections[recordName] = append(sections[recordName], section)
+		}
+	}
+
+	ids := fs.sortedIDs()
+	for _, u := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// with a record cache the record is read from its file again
+		r, err := fs.record(u)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: unreadable record: %v", u, err))
+			continue
+		}
+		info := r.info()
+
+		seen := make(map[id.ID]bool)
+		for _, c := range r.children() {
+			if _, err := fs.record(c); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: dangling child %s", u, c))
+			}
+			if seen[c] {
+				problems = append(problems, fmt.Sprintf("%s: duplicate child %s", u, c))
+			}
+			seen[c] = true
+		}
+
+		if !info.IsDir && len(seen) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: file has children", u))
+		}
+
+		for _, section := range sections[u.String()] {
+			if err := fs.readSection(u, section); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: unreadable section %s: %v", u, section, err))
+			}
+		}
+	}
+
+	reachable := make(map[id.ID]bool)
+	stack := []id.ID{fs.root}
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		u := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		r, err := fs.record(u)
+		if err != nil || reachable[u] {
+			continue
+		}
+		reachable[u] = true
+		stack = append(stack, r.children()...)
+	}
+
+	for _, u := range ids {
+		if !reachable[u] {
+			problems = append(problems, fmt.Sprintf("%s: unreachable from root", u))
+		}
+	}
+
+	return problems, nil
+}
+
+func (fs *Fs) readSection(u id.ID, section string) error {
+	r, err := fs.OpenSection(u, section)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
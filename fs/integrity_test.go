@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"runtime"
+	"testing"
+
+	"archiiv/id"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumMismatchOnLoad(t *testing.T) {
+	t.Parallel()
+	fs := newTestFsWithOptions(t, Options{Checksums: true})
+
+	file, err := fs.Touch(fs.GetRoot(), "hello")
+	require.NoError(t, err)
+
+	require.NoError(t, fs.Close())
+	loaded, err := NewFs(fs.GetRoot(), fs.basePath, Options{Checksums: true})
+	require.NoError(t, err)
+	require.NoError(t, loaded.Close())
+
+	path := fs.path(file.String())
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(content), `"checksum":`)
+
+	content = bytes.Replace(content, []byte("hello"), []byte("hellp"), 1)
+	require.NoError(t, os.WriteFile(path, content, 0600))
+
+	_, err = NewFs(fs.GetRoot(), fs.basePath, Options{Checksums: true})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// without the option the record is trusted
+	_, err = NewFs(fs.GetRoot(), fs.basePath, Options{})
+	assert.NoError(t, err)
+}
+
+func TestFsckIsDeterministic(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+
+	dir, err := fs.Mkdir(fs.GetRoot(), "dir")
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b", "c"} {
+		_, err = fs.Touch(dir, name)
+		require.NoError(t, err)
+	}
+
+	// a parent pointing at records that don't exist and a few records
+	// nobody points at
+	r, err := fs.record(dir)
+	require.NoError(t, err)
+	for range 3 {
+		r.Children = append(r.Children, id.New())
+	}
+	require.NoError(t, fs.writeRecord(r))
+
+	for range 3 {
+		orphan := &record{id: id.New(), Name: "orphan"}
+		require.NoError(t, fs.writeRecord(orphan))
+	}
+
+	require.NoError(t, fs.Close())
+	var reports [][]string
+	for range 2 {
+		loaded, err := NewFs(fs.GetRoot(), fs.basePath, Options{})
+		require.NoError(t, err)
+		report, err := loaded.Fsck(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, loaded.Close())
+		reports = append(reports, report)
+	}
+
+	assert.Len(t, reports[0], 6)
+	assert.Equal(t, reports[0], reports[1])
+}
+
+func TestFsckCleanTree(t *testing.T) {
+	t.Parallel()
+	fs := newTestTree(t)
+
+	report, err := fs.Fsck(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, report)
+}
+
+func TestFsckUnreadableRecord(t *testing.T) {
+	t.Parallel()
+	fs := newTestFsWithOptions(t, Options{RecordCache: 1})
+
+	file, err := fs.Touch(fs.GetRoot(), "file")
+	require.NoError(t, err)
+	_, err = fs.Touch(fs.GetRoot(), "other")
+	require.NoError(t, err)
+
+	// evicted, so Fsck has to read the broken file
+	runtime.GC()
+	require.Nil(t, fs.states[file].loaded.Value())
+	require.NoError(t, os.WriteFile(fs.path(file.String()), []byte("{broken"), 0o600))
+
+	report, err := fs.Fsck(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, report, file.String()+": unreadable record: json decore err: invalid character 'b' looking for beginning of object key string")
+}
@@ -0,0 +1,257 @@
+package fs
+
+// The io/fs adapter exposes a read-only view of the tree. Directory records
+// are directories, file records are regular files whose content is the 'data'
+// section. Names come from record.Name, so two children with the same name
+// shadow each other and only the first one is reachable.
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"archiiv/id"
+)
+
+type archiveFS struct {
+	fs   *Fs
+	root id.ID
+}
+
+// AsFS returns a read-only io/fs.FS (also implementing io/fs.ReadDirFS)
+// rooted at the given record
+func (fs *Fs) AsFS(root id.ID) iofs.FS {
+	return &archiveFS{fs: fs, root: root}
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() any           { return nil }
+
+func (fi *fileInfo) Mode() iofs.FileMode {
+	if fi.dir {
+		return iofs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// children returns a copy of the record's children so the caller doesn't need
+// to hold the record lock
+func (r *record) children() []id.ID {
+	r.lock()
+	defer r.unlock()
+	return slices.Clone(r.Children)
+}
+
+func (a *archiveFS) resolve(name string) (*record, error) {
+	r, err := a.fs.record(a.root)
+	if err != nil {
+		return nil, iofs.ErrNotExist
+	}
+
+	if name == "." {
+		return r, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if !r.info().IsDir {
+			return nil, iofs.ErrNotExist
+		}
+
+		var next *record
+		for _, c := range r.children() {
+			cr, err := a.fs.record(c)
+			if err != nil {
+				continue
+			}
+			if a.fs.namesEqual(cr.info().Name, part) {
+				next = cr
+				break
+			}
+		}
+
+		if next == nil {
+			return nil, iofs.ErrNotExist
+		}
+		r = next
+	}
+
+	return r, nil
+}
+
+// stat describes the record as info saw it, under the name it is opened by
+func (a *archiveFS) stat(info FileInfo, name string) (*fileInfo, error) {
+	fi := &fileInfo{name: name, dir: info.IsDir}
+
+	path := a.fs.path(info.ID.String())
+	if !info.IsDir {
+		path = a.fs.getSectionFileName(info.ID, "data")
+	}
+
+	st, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) && !info.IsDir {
+		// file without a data section is just empty
+		return fi, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fi.modTime = st.ModTime()
+	if !info.IsDir {
+		fi.size = st.Size()
+	}
+
+	return fi, nil
+}
+
+func (a *archiveFS) entries(r *record) ([]iofs.DirEntry, error) {
+	var entries []iofs.DirEntry
+	for _, c := range r.children() {
+		cr, err := a.fs.record(c)
+		if err != nil {
+			return nil, err
+		}
+
+		info := cr.info()
+		fi, err := a.stat(info, info.Name)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, iofs.FileInfoToDirEntry(fi))
+	}
+
+	slices.SortFunc(entries, func(a, b iofs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func baseName(name string) string {
+	if i := strings.LastIndexByte(name, '/'); i != -1 {
+		return name[i+1:]
+	}
+	return name
+}
+
+func (a *archiveFS) Open(name string) (iofs.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	r, err := a.resolve(name)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	info := r.info()
+	fi, err := a.stat(info, baseName(name))
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if info.IsDir {
+		entries, err := a.entries(r)
+		if err != nil {
+			return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dirFile{info: fi, entries: entries}, nil
+	}
+
+	f, err := a.fs.OpenSection(info.ID, "data")
+	if errors.Is(err, os.ErrNotExist) {
+		return &dataFile{ReadSeekCloser: memSection{bytes.NewReader(nil)}, info: fi}, nil
+	}
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &dataFile{ReadSeekCloser: f.(io.ReadSeekCloser), info: fi}, nil
+}
+
+func (a *archiveFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	r, err := a.resolve(name)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	if !r.info().IsDir {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries, err := a.entries(r)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// memSection is a section held in memory
+type memSection struct {
+	*bytes.Reader
+}
+
+func (memSection) Close() error {
+	return nil
+}
+
+type dataFile struct {
+	io.ReadSeekCloser
+	info *fileInfo
+}
+
+func (f *dataFile) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+type dirFile struct {
+	info    *fileInfo
+	entries []iofs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (iofs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+func (d *dirFile) ReadDir(n int) ([]iofs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,126 @@
+package fs
+
+import (
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// builds:
+//
+//	/
+//	├── hello.txt
+//	└── docs/
+//	    ├── empty
+//	    └── notes.md
+func newTestTree(t *testing.T) *Fs {
+	fs := newTestFs(t)
+
+	hello, err := fs.Touch(fs.GetRoot(), "hello.txt")
+	require.NoError(t, err)
+	writeSection(t, fs, hello, "data", "hello world")
+
+	docs, err := fs.Mkdir(fs.GetRoot(), "docs")
+	require.NoError(t, err)
+
+	_, err = fs.Touch(docs, "empty")
+	require.NoError(t, err)
+
+	notes, err := fs.Touch(docs, "notes.md")
+	require.NoError(t, err)
+	writeSection(t, fs, notes, "data", "# notes")
+	writeSection(t, fs, notes, "meta", "{}")
+
+	return fs
+}
+
+func TestAsFSWalkDir(t *testing.T) {
+	t.Parallel()
+	fs := newTestTree(t)
+
+	var paths []string
+	err := iofs.WalkDir(fs.AsFS(fs.GetRoot()), ".", func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{".", "docs", "docs/empty", "docs/notes.md", "hello.txt"}, paths)
+
+	content, err := iofs.ReadFile(fs.AsFS(fs.GetRoot()), "docs/notes.md")
+	assert.NoError(t, err)
+	assert.Equal(t, "# notes", string(content))
+}
+
+func TestAsFSConformance(t *testing.T) {
+	t.Parallel()
+	fs := newTestTree(t)
+
+	err := fstest.TestFS(fs.AsFS(fs.GetRoot()), "hello.txt", "docs/empty", "docs/notes.md")
+	assert.NoError(t, err)
+}
+
+func TestAsFSFileServer(t *testing.T) {
+	t.Parallel()
+	fs := newTestTree(t)
+
+	srv := http.FileServerFS(fs.AsFS(fs.GetRoot()))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hello.txt", nil))
+	res := w.Result()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "hello world", string(body))
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/docs/", nil))
+	res = w.Result()
+	body, err = io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, string(body), "notes.md")
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nope", nil))
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+// the adapter reads records that change under it, the race detector catches
+// reads without the lock
+func TestAsFSConcurrentSetIsDir(t *testing.T) {
+	t.Parallel()
+	fs := newTestTree(t)
+	flipping, err := fs.Mkdir(fs.GetRoot(), "flipping")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 100 {
+			assert.NoError(t, fs.SetIsDir(flipping, i%2 == 1))
+		}
+	}()
+
+	afs := fs.AsFS(fs.GetRoot())
+	for range 100 {
+		var found bool
+		// flipping can stop being a directory between listing and reading it
+		_ = iofs.WalkDir(afs, ".", func(path string, d iofs.DirEntry, err error) error {
+			found = found || path == "flipping"
+			return nil
+		})
+		assert.True(t, found)
+	}
+	<-done
+}
@@ -0,0 +1,35 @@
+//go:build !unix
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dirLock is the lock file itself, created exclusively. Unlike the flock on
+// unix it stays behind after a crash and has to be removed by hand
+type dirLock struct {
+	path string
+}
+
+func lockDir(dir string, perm os.FileMode) (*dirLock, error) {
+	path := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm) // #nosec G304: dir is trusted
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("fs dir %s %w (remove %s if it isn't)", dir, ErrLocked, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	return &dirLock{path: path}, nil
+}
+
+func (l *dirLock) unlock() error {
+	return os.Remove(l.path)
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// dirLock is an flock on the lock file. The kernel drops it when the
+// process exits, so a crash never leaves the dir locked
+type dirLock struct {
+	f *os.File
+}
+
+func lockDir(dir string, perm os.FileMode) (*dirLock, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, perm) // #nosec G304: dir is trusted
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) // #nosec G115: fds fit into int
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		f.Close()
+		return nil, fmt.Errorf("fs dir %s %w", dir, ErrLocked)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &dirLock{f: f}, nil
+}
+
+func (l *dirLock) unlock() error {
+	return l.f.Close()
+}
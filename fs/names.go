@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+
+	"archiiv/id"
+)
+
+// maxNameLength is the longest record name in bytes, the usual limit of a
+// file name on disk
+const maxNameLength = 255
+
+// checkNameSanity checks that a record name can be used as one element of a
+// path, on disk and in a tar alike: valid UTF-8 of at most maxNameLength
+// bytes, not . or .., without slashes and without control characters
+func checkNameSanity(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("%w: name %q is not sane", ErrInvalidName, name)
+	case len(name) > maxNameLength:
+		return fmt.Errorf("%w: name is longer than %d bytes", ErrInvalidName, maxNameLength)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("%w: name is not valid UTF-8", ErrInvalidName)
+	}
+
+	for _, r := range name {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return fmt.Errorf("%w: name %q is not sane", ErrInvalidName, name)
+		}
+	}
+	return nil
+}
+
+// normalizeName is how the name of a new record is stored. With
+// NormalizeNames that is the Normalization Form C
+func (fs *Fs) normalizeName(name string) string {
+	if fs.opts.NormalizeNames {
+		return norm.NFC.String(name)
+	}
+	return name
+}
+
+// namesEqual compares names as Options.NormalizeNames and
+// Options.FoldNameCase say
+func (fs *Fs) namesEqual(a, b string) bool {
+	a, b = fs.normalizeName(a), fs.normalizeName(b)
+	if fs.opts.FoldNameCase {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// checkNameConflict checks that none of the children is named like name.
+// Names are only unique with NormalizeNames or FoldNameCase, the same name
+// is allowed many times otherwise
+func (fs *Fs) checkNameConflict(children []id.ID, name string) error {
+	if !fs.opts.NormalizeNames && !fs.opts.FoldNameCase {
+		return nil
+	}
+
+	for _, c := range children {
+		child, err := fs.record(c)
+		if err != nil {
+			// deleted in the meantime
+			continue
+		}
+		if other := child.info().Name; fs.namesEqual(other, name) {
+			return fmt.Errorf("name %q conflicts with %q: %w", name, other, ErrExists)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package fs
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeNFC(t *testing.T) {
+	fs := &Fs{opts: Options{NormalizeNames: true}}
+	for _, tc := range []struct{ in, want string }{
+		{"Matěj", "Matěj"},
+		{"Matěj", "Matěj"},
+		{"Ångöström", "Ångöström"},
+		// dot below before the circumflex composes both
+		{"ệ", "ệ"},
+		// a mark of a lower class in between doesn't block
+		{"á̖", "á̖"},
+		// there is no composite for a second acute
+		{"á́", "á́"},
+		{"각", "각"},
+		{"", ""},
+		{"́a", "́a"},
+	} {
+		assert.Equal(t, tc.want, fs.normalizeName(tc.in), "%+q", tc.in)
+	}
+}
+
+func TestNameConflicts(t *testing.T) {
+	t.Parallel()
+
+	nfd, nfc := "Matěj", "Matěj"
+
+	fs := newTestFs(t)
+	_, err := fs.Touch(fs.GetRoot(), nfc)
+	require.NoError(t, err)
+	_, err = fs.Touch(fs.GetRoot(), nfd)
+	assert.NoError(t, err, "names are compared verbatim by default")
+
+	normalized := newTestFsWithOptions(t, Options{NormalizeNames: true})
+	root := normalized.GetRoot()
+	file, err := normalized.Touch(root, nfd)
+	require.NoError(t, err)
+	info, err := normalized.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, nfc, info.Name)
+	_, err = normalized.Touch(root, nfc)
+	assert.ErrorIs(t, err, ErrExists)
+	_, err = normalized.Mkdir(root, "matěj")
+	assert.NoError(t, err)
+
+	folded := newTestFsWithOptions(t, Options{NormalizeNames: true, FoldNameCase: true})
+	root = folded.GetRoot()
+	_, err = folded.Mkdir(root, "Photos")
+	require.NoError(t, err)
+	_, err = folded.Touch(root, "photos")
+	assert.ErrorIs(t, err, ErrExists)
+	_, err = folded.Touch(root, "MATĚJ")
+	require.NoError(t, err)
+	_, err = folded.Touch(root, "matěj")
+	assert.ErrorIs(t, err, ErrExists)
+
+	// mounting checks the names in the new parent too
+	dir, err := folded.Mkdir(root, "dir")
+	require.NoError(t, err)
+	other, err := folded.Touch(dir, "PHOTOS")
+	require.NoError(t, err)
+	assert.ErrorIs(t, folded.Mount(root, other), ErrExists)
+}
+
+func TestResolveNormalizedNames(t *testing.T) {
+	t.Parallel()
+
+	tree := newTestFsWithOptions(t, Options{NormalizeNames: true, FoldNameCase: true})
+	dir, err := tree.Mkdir(tree.GetRoot(), "Fotky")
+	require.NoError(t, err)
+	file, err := tree.Touch(dir, "Matěj")
+	require.NoError(t, err)
+	writeSection(t, tree, file, "data", "hello")
+
+	b, err := fs.ReadFile(tree.AsFS(tree.GetRoot()), "fotky/matěj")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestNameSanity(t *testing.T) {
+	t.Parallel()
+
+	for _, ok := range []string{"file", "a.b", "with space", "..hidden", "příliš žluťoučký kůň", strings.Repeat("x", maxNameLength)} {
+		assert.NoError(t, checkNameSanity(ok), ok)
+	}
+
+	for _, bad := range []string{"", ".", "..", "a/b", "/", `a\b`, "line\nbreak", "nul\x00", "\xff", strings.Repeat("x", maxNameLength+1)} {
+		assert.ErrorIs(t, checkNameSanity(bad), ErrInvalidName, bad)
+	}
+
+	fs := newTestFs(t)
+	_, err := fs.Touch(fs.GetRoot(), "a/b")
+	assert.ErrorIs(t, err, ErrInvalidName)
+	_, err = fs.Mkdir(fs.GetRoot(), "..")
+	assert.ErrorIs(t, err, ErrInvalidName)
+	children, err := fs.GetChildren(fs.GetRoot())
+	require.NoError(t, err)
+	assert.Empty(t, children)
+}
+
+// safePathElement checks that s stays a single element of a path on disk and
+// in a tar
+func safePathElement(t *testing.T, s string) {
+	assert.True(t, utf8.ValidString(s), s)
+	assert.Equal(t, s, filepath.Base(s), s)
+	assert.Equal(t, s, path.Base(s), s)
+	assert.NotContains(t, []string{".", ".."}, s)
+	assert.NotContains(t, s, "\x00")
+
+	tw := tar.NewWriter(io.Discard)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: s, Mode: 0600}), s)
+}
+
+func FuzzSanity(f *testing.F) {
+	for _, s := range []string{"data", "meta", "a.b", "../data", "a/b", "..", "line\nbreak", "\xff\xfe", "příliš"} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		if checkNameSanity(s) == nil {
+			safePathElement(t, s)
+		}
+		if checkSectionNameSanity(s) == nil {
+			safePathElement(t, s)
+			safePathElement(t, "0000000000000000000000."+s)
+		}
+	})
+}
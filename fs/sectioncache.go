@@ -0,0 +1,140 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+
+	"archiiv/id"
+)
+
+// sectionCacheEntries bounds the number of sections held by the cache. When it
+// is full an arbitrary entry makes room for the new one
+const sectionCacheEntries = 4096
+
+// sectionCache keeps the content of small sections in memory so that reading
+// them again doesn't go to the disk. Every change of a section invalidates it
+type sectionCache struct {
+	mutex   sync.Mutex
+	limit   int64
+	entries map[sectionKey][]byte
+	// generation is bumped by every invalidation. A read that raced with
+	// one doesn't fill the cache, it could have seen the old content
+	generation uint64
+}
+
+func newSectionCache(limit int64) *sectionCache {
+	return &sectionCache{limit: limit, entries: make(map[sectionKey][]byte)}
+}
+
+func (c *sectionCache) get(key sectionKey) ([]byte, uint64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	b, ok := c.entries[key]
+	return b, c.generation, ok
+}
+
+func (c *sectionCache) put(key sectionKey, b []byte, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= sectionCacheEntries {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = b
+}
+
+func (c *sectionCache) invalidate(key sectionKey) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, key)
+	c.generation++
+}
+
+func (c *sectionCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	clear(c.entries)
+	c.generation++
+}
+
+// invalidateSection is called after every change of a section
+func (fs *Fs) invalidateSection(file id.ID, section string) {
+	if fs.sectionCache != nil {
+		fs.sectionCache.invalidate(sectionKey{file: file, section: section})
+	}
+}
+
+// openCachedSection is OpenSection through the section cache
+func (fs *Fs) openCachedSection(file id.ID, section string) (io.ReadCloser, error) {
+	key := sectionKey{file: file, section: section}
+	b, generation, ok := fs.sectionCache.get(key)
+	if ok {
+		return memSection{bytes.NewReader(b)}, nil
+	}
+
+	f, err := os.Open(fs.getSectionFileName(file, section))
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.Size() > fs.sectionCache.limit {
+		return f, nil
+	}
+
+	// the section can grow between the stat and the read
+	defer f.Close()
+	b, err = io.ReadAll(io.LimitReader(f, fs.sectionCache.limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > fs.sectionCache.limit {
+		return os.Open(f.Name())
+	}
+
+	fs.sectionCache.put(key, b, generation)
+	return memSection{bytes.NewReader(b)}, nil
+}
+
+type sectionWriter interface {
+	io.Writer
+	io.WriterAt
+	io.Closer
+}
+
+// writer wraps a writer of the section so that closing it invalidates the
+// cached section
+func (fs *Fs) writer(f *os.File, file id.ID, section string) sectionWriter {
+	fs.invalidateSection(file, section)
+	if fs.sectionCache == nil {
+		return f
+	}
+	return invalidatingWriter{File: f, fs: fs, file: file, section: section}
+}
+
+// invalidatingWriter invalidates the cached section once the writer is closed,
+// reads during the write could have cached a part of the new content
+type invalidatingWriter struct {
+	*os.File
+	fs      *Fs
+	file    id.ID
+	section string
+}
+
+func (w invalidatingWriter) Close() error {
+	err := w.File.Close()
+	w.fs.invalidateSection(w.file, w.section)
+	return err
+}
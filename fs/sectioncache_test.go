@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"archiiv/id"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readSection(t testing.TB, fs *Fs, file id.ID, section string) string {
+	r, err := fs.OpenSection(file, section)
+	require.NoError(t, err)
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestSectionCache(t *testing.T) {
+	t.Parallel()
+
+	fs := newTestFsWithOptions(t, Options{SectionCacheLimit: 16})
+	file, err := fs.Touch(fs.GetRoot(), "file")
+	require.NoError(t, err)
+
+	writeSection(t, fs, file, "data", "small")
+	assert.Equal(t, "small", readSection(t, fs, file, "data"))
+	assert.Len(t, fs.sectionCache.entries, 1)
+
+	// every kind of change is seen by the next read
+	writeSection(t, fs, file, "data", "changed")
+	assert.Equal(t, "changed", readSection(t, fs, file, "data"))
+
+	_, err = fs.PutSection(file, "data", strings.NewReader("put"))
+	require.NoError(t, err)
+	assert.Equal(t, "put", readSection(t, fs, file, "data"))
+
+	w, err := fs.OpenSectionAt(file, "data")
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("c"), 2)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, "puc", readSection(t, fs, file, "data"))
+
+	require.NoError(t, fs.RenameSection(file, "data", "other"))
+	_, err = fs.OpenSection(file, "data")
+	assert.Error(t, err)
+	assert.Equal(t, "puc", readSection(t, fs, file, "other"))
+
+	require.NoError(t, fs.DeleteSection(file, "other"))
+	_, err = fs.OpenSection(file, "other")
+	assert.Error(t, err)
+
+	// sections over the limit are read from the disk every time
+	big := strings.Repeat("x", 17)
+	writeSection(t, fs, file, "big", big)
+	assert.Equal(t, big, readSection(t, fs, file, "big"))
+	assert.NotContains(t, fs.sectionCache.entries, sectionKey{file: file, section: "big"})
+}
+
+// The cached read skips the open, fstat, read and close of the section file
+func BenchmarkOpenSmallSection(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		limit int64
+	}{
+		{"disk", 0},
+		{"cached", 4096},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			fs := newTestFsWithOptions(b, Options{SectionCacheLimit: bc.limit})
+			file, err := fs.Touch(fs.GetRoot(), "file")
+			require.NoError(b, err)
+			_, err = fs.PutSection(file, "data", strings.NewReader("a small section"))
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			for b.Loop() {
+				readSection(b, fs, file, "data")
+			}
+		})
+	}
+}
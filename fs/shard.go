@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"archiiv/id"
+)
+
+// With Options.Shard the files of a record live in a subdirectory of the fs
+// root named by the first shardLen characters of its ID:
+//
+//	files/
+//	├── 2F/
+//	│   ├── 2FX1MYvKFFz8PqmwsDCvW7
+//	│   └── 2FX1MYvKFFz8PqmwsDCvW7.data
+//	└── Ws/
+//	    └── ...
+//
+// Temporary files stay in the fs root itself. loadRecords reads both layouts
+// and moves every file to the one that is configured
+
+const shardLen = 2
+
+var shardDirRegex = regexp.MustCompile(`^[1-9A-HJ-NP-Za-km-z]{` + strconv.Itoa(shardLen) + `}$`)
+
+// storeFile is a file of the fs root, in whichever layout it was found
+type storeFile struct {
+	os.DirEntry
+	path string
+}
+
+// listStoreFiles lists the fs root together with the content of the shard
+// directories in it. The root marker and the lock file are not store files
+func listStoreFiles(dir string) ([]storeFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []storeFile
+	for _, e := range entries {
+		if e.Name() == rootMarkerName || e.Name() == lockFileName {
+			continue
+		}
+		if !e.IsDir() || !shardDirRegex.MatchString(e.Name()) {
+			files = append(files, storeFile{DirEntry: e, path: filepath.Join(dir, e.Name())})
+			continue
+		}
+
+		shardDir := filepath.Join(dir, e.Name())
+		sub, err := os.ReadDir(shardDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sub {
+			files = append(files, storeFile{DirEntry: s, path: filepath.Join(shardDir, s.Name())})
+		}
+	}
+	return files, nil
+}
+
+// recordFiles lists the record file and the section files of u
+func (fs *Fs) recordFiles(u id.ID) ([]os.DirEntry, error) {
+	recordName := u.String()
+
+	entries, err := os.ReadDir(filepath.Dir(fs.path(recordName)))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []os.DirEntry
+	for _, e := range entries {
+		if e.Name() == recordName || strings.HasPrefix(e.Name(), recordName+".") {
+			files = append(files, e)
+		}
+	}
+	return files, nil
+}
+
+// makeDirFor creates the shard directory the named file belongs in
+func (fs *Fs) makeDirFor(name string) error {
+	if !fs.opts.Shard {
+		return nil
+	}
+	return os.MkdirAll(filepath.Dir(fs.path(name)), fs.opts.dirPerm())
+}
+
+// moveToLayout moves the file to where the configured layout expects it
+func (fs *Fs) moveToLayout(f storeFile) error {
+	want := fs.path(f.Name())
+	if f.path == want {
+		return nil
+	}
+
+	if _, err := os.Lstat(want); err == nil {
+		return errors.New("file " + f.Name() + " is stored in both layouts")
+	}
+	if err := fs.makeDirFor(f.Name()); err != nil {
+		return err
+	}
+	return os.Rename(f.path, want)
+}
+
+// removeEmptyShardDirs cleans up after moving from the sharded layout to the
+// flat one
+func (fs *Fs) removeEmptyShardDirs() error {
+	entries, err := os.ReadDir(fs.basePath)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || !shardDirRegex.MatchString(e.Name()) {
+			continue
+		}
+		sub, err := os.ReadDir(filepath.Join(fs.basePath, e.Name()))
+		if err != nil {
+			return err
+		}
+		if len(sub) == 0 {
+			if err = os.Remove(filepath.Join(fs.basePath, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
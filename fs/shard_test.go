@@ -0,0 +1,83 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"archiiv/id"
+)
+
+func TestShard(t *testing.T) {
+	t.Parallel()
+	fs := newTestFsWithOptions(t, Options{Shard: true})
+
+	dir, err := fs.Mkdir(fs.GetRoot(), "dir")
+	require.NoError(t, err)
+	files := []id.ID{dir}
+	for i := range 200 {
+		file, err := fs.Touch(dir, fmt.Sprint(i))
+		require.NoError(t, err)
+		writeSection(t, fs, file, "data", fmt.Sprint(i))
+		files = append(files, file)
+	}
+
+	// nothing but shard directories (and the root marker) in the fs root
+	entries, err := os.ReadDir(fs.basePath)
+	require.NoError(t, err)
+	for _, e := range entries {
+		if e.Name() == rootMarkerName || e.Name() == lockFileName {
+			continue
+		}
+		assert.True(t, e.IsDir(), e.Name())
+		assert.Len(t, e.Name(), shardLen)
+	}
+	for _, u := range append(files, fs.GetRoot()) {
+		assert.FileExists(t, filepath.Join(fs.basePath, u.String()[:shardLen], u.String()))
+	}
+	assert.FileExists(t, filepath.Join(fs.basePath, files[1].String()[:shardLen], files[1].String()+".data"))
+
+	require.NoError(t, fs.Close())
+	loaded, err := NewFs(fs.GetRoot(), fs.basePath, Options{Shard: true})
+	require.NoError(t, err)
+	children, err := loaded.GetChildren(dir)
+	require.NoError(t, err)
+	assert.Len(t, children, 200)
+	sections, err := loaded.Sections(files[1])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data"}, sections)
+
+	// deleting removes the files from the shard directory
+	require.NoError(t, loaded.Unmount(dir, files[1]))
+	assert.NoFileExists(t, filepath.Join(fs.basePath, files[1].String()[:shardLen], files[1].String()))
+	assert.NoFileExists(t, filepath.Join(fs.basePath, files[1].String()[:shardLen], files[1].String()+".data"))
+}
+
+func TestShardMigration(t *testing.T) {
+	t.Parallel()
+	flat := newTestTree(t)
+	want := walkContent(t, flat)
+
+	require.NoError(t, flat.Close())
+	sharded, err := NewFs(flat.GetRoot(), flat.basePath, Options{Shard: true})
+	require.NoError(t, err)
+	assert.Equal(t, want, walkContent(t, sharded))
+	assert.NoFileExists(t, filepath.Join(flat.basePath, flat.GetRoot().String()))
+	root := flat.GetRoot().String()
+	assert.FileExists(t, filepath.Join(flat.basePath, root[:shardLen], root))
+
+	// and back, leaving no empty shard directories behind
+	require.NoError(t, sharded.Close())
+	unsharded, err := NewFs(flat.GetRoot(), flat.basePath, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, want, walkContent(t, unsharded))
+	entries, err := os.ReadDir(flat.basePath)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.False(t, e.IsDir(), e.Name())
+	}
+}
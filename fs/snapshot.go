@@ -0,0 +1,433 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"archiiv/id"
+)
+
+// A snapshot is a tar stream. The first entry is the manifest, the rest are
+// the files of the fs root under their own names: the records as $id and
+// their sections as $id.$section
+
+const (
+	snapshotFormat       = 1
+	snapshotManifestName = "manifest.json"
+)
+
+var ErrNotEmpty = errors.New("fs is not empty")
+
+// ErrTooManyEntries is returned by Restore for snapshots over its limit
+var ErrTooManyEntries = errors.New("too many entries in the snapshot")
+
+type snapshotManifest struct {
+	Format   int   `json:"format"`
+	Root     id.ID `json:"root"`
+	Records  int   `json:"records"`
+	Sections int   `json:"sections"`
+}
+
+// Snapshot writes every record and section into w. Each record is captured
+// as it is at the moment it is written and each section is copied while
+// holding its lock, but changes to the tree during the snapshot may or may
+// not make it in
+func (fs *Fs) Snapshot(w io.Writer) error {
+	var (
+		ids     []id.ID
+		records [][]byte
+	)
+	for _, u := range fs.sortedIDs() {
+		r, err := fs.record(u)
+		if err != nil {
+			// deleted in the meantime
+			continue
+		}
+
+		r.lock()
+		b, err := json.Marshal(r)
+		r.unlock()
+		if err != nil {
+			return err
+		}
+
+		ids = append(ids, u)
+		records = append(records, append(b, '\n'))
+	}
+
+	entries, err := listStoreFiles(fs.basePath)
+	if err != nil {
+		return err
+	}
+
+	// one pass over the fs root, like DiskUsage
+	sections := make(map[string][]string)
+	sectionCount := 0
+	for _, e := range entries {
+		recordName, section, isSection := strings.Cut(e.Name(), ".")
+		if !isSection || recordName == "" {
+			continue
+		}
+		sections[recordName] = append(sections[recordName], section)
+		sectionCount++
+	}
+
+	tw := tar.NewWriter(w)
+
+	manifest, err := json.Marshal(snapshotManifest{
+		Format:   snapshotFormat,
+		Root:     fs.root,
+		Records:  len(ids),
+		Sections: sectionCount,
+	})
+	if err != nil {
+		return err
+	}
+	if err = writeTarFile(tw, snapshotManifestName, manifest); err != nil {
+		return err
+	}
+
+	for i, u := range ids {
+		if err = writeTarFile(tw, u.String(), records[i]); err != nil {
+			return err
+		}
+
+		for _, section := range sections[u.String()] {
+			if err = fs.snapshotSection(tw, u, section); err != nil {
+				return fmt.Errorf("section %s.%s: %w", u, section, err)
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(content)),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(content)
+	return err
+}
+
+func (fs *Fs) snapshotSection(tw *tar.Writer, u id.ID, section string) error {
+	defer fs.LockSection(u, section)()
+
+	f, err := os.Open(fs.getSectionFileName(u, section))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     u.String() + "." + section,
+		Mode:     0600,
+		Size:     st.Size(),
+		ModTime:  st.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, f, st.Size())
+	return err
+}
+
+// Restore fills a freshly initialized fs with the content of a snapshot. The
+// root of the snapshot becomes the root of fs, every other record keeps its
+// ID. Nothing is put in place until the whole snapshot has been read and
+// checked, a broken one leaves fs untouched. Fails with ErrNotEmpty if the
+// root already has children. Meant to be run before the fs is used by
+// anyone else. maxEntries bounds the number of files in the snapshot, zero
+// means unlimited. Once the context is done the restore stops with its error
+func (fs *Fs) Restore(ctx context.Context, r io.Reader, maxEntries int) (err error) {
+	root, err := fs.record(fs.root)
+	if err != nil {
+		return err
+	}
+	if len(root.children()) != 0 {
+		return ErrNotEmpty
+	}
+
+	content, err := fs.readSnapshot(ctx, r, maxEntries, fs.root)
+	if err != nil {
+		return err
+	}
+	defer content.removeTemps()
+
+	for name, temp := range content.temps {
+		if err = fs.makeDirFor(name); err != nil {
+			return err
+		}
+		if err = os.Rename(temp, fs.path(name)); err != nil {
+			return err
+		}
+		delete(content.temps, name)
+	}
+
+	loaded, err := loadFs(fs.root, fs.basePath, fs.opts)
+	if err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	fs.states = loaded.states
+	fs.cache = loaded.cache
+	if fs.sectionCache != nil {
+		fs.sectionCache.clear()
+	}
+	fs.lock.Unlock()
+	fs.depthsChanged()
+
+	root.changed()
+	return nil
+}
+
+// Import brings the tree of a snapshot into the directory dir of a live fs.
+// The root of the snapshot stands for dir, its own sections are left out.
+// Every other record reachable from it is created with TouchWithID under the
+// ID it has in the snapshot, so the references between them still hold, and
+// later appearances of the same record are mounted. Returns the number of
+// records created. The whole snapshot is read and checked first and any ID
+// that already exists fails the import with ErrExists before anything is
+// created, but an error past that point leaves what was already imported
+func (fs *Fs) Import(ctx context.Context, dir id.ID, r io.Reader, maxEntries int) (int, error) {
+	parent, err := fs.record(dir)
+	if err != nil {
+		return 0, err
+	}
+	if !parent.info().IsDir {
+		return 0, ErrNotDir
+	}
+
+	content, err := fs.readSnapshot(ctx, r, maxEntries, dir)
+	if err != nil {
+		return 0, err
+	}
+	defer content.removeTemps()
+
+	for u := range content.records {
+		if u == dir {
+			continue
+		}
+		if _, err := fs.record(u); err == nil {
+			return 0, fmt.Errorf("%w: %s", ErrExists, u)
+		}
+	}
+
+	created := map[id.ID]bool{dir: true}
+	queue := []id.ID{dir}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		for _, c := range content.records[p].Children {
+			if err := ctx.Err(); err != nil {
+				return len(created) - 1, err
+			}
+
+			if created[c] {
+				if err := fs.Mount(p, c); err != nil {
+					return len(created) - 1, err
+				}
+				continue
+			}
+
+			rec := content.records[c]
+			if err := fs.TouchWithID(p, c, rec.Name, rec.IsDir); err != nil {
+				return len(created) - 1, err
+			}
+			created[c] = true
+			queue = append(queue, c)
+
+			if err := content.importSections(fs, c); err != nil {
+				return len(created) - 1, err
+			}
+			// the imported meta replaced the one TouchWithID granted
+			if err := fs.grantDefaultPerms(p, c); err != nil {
+				return len(created) - 1, err
+			}
+		}
+	}
+
+	return len(created) - 1, nil
+}
+
+// snapshotContent is a snapshot read and checked by readSnapshot
+type snapshotContent struct {
+	records  map[id.ID]*record
+	sections map[id.ID][]string
+	// the temporary files by the name of the file they stand for
+	temps map[string]string
+}
+
+func (s *snapshotContent) removeTemps() {
+	for name, temp := range s.temps {
+		os.Remove(temp)
+		delete(s.temps, name)
+	}
+}
+
+func (s *snapshotContent) importSections(fs *Fs, u id.ID) error {
+	for _, section := range s.sections[u] {
+		f, err := os.Open(s.temps[u.String()+"."+section])
+		if err != nil {
+			return err
+		}
+		_, err = fs.PutSection(u, section, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("section %s.%s: %w", u, section, err)
+		}
+	}
+	return nil
+}
+
+// readSnapshot reads a snapshot into temporary files in the fs root and
+// checks that it is whole. The root of the snapshot is read as root
+func (fs *Fs) readSnapshot(ctx context.Context, r io.Reader, maxEntries int, root id.ID) (_ *snapshotContent, err error) {
+	content := &snapshotContent{
+		records:  make(map[id.ID]*record),
+		sections: make(map[id.ID][]string),
+		temps:    make(map[string]string),
+	}
+	defer func() {
+		if err != nil {
+			content.removeTemps()
+		}
+	}()
+
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if hdr.Name != snapshotManifestName {
+		return nil, fmt.Errorf("snapshot must start with %s (starts with %s)", snapshotManifestName, hdr.Name)
+	}
+	var manifest snapshotManifest
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	if manifest.Format != snapshotFormat {
+		return nil, fmt.Errorf("unsupported snapshot format %d", manifest.Format)
+	}
+
+	sectionCount := 0
+	for entries := 0; ; entries++ {
+		if err = ctx.Err(); err != nil {
+			return nil, fmt.Errorf("after %d entries: %w", entries, err)
+		}
+
+		hdr, err = tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if maxEntries > 0 && entries >= maxEntries {
+			return nil, fmt.Errorf("%w (limit is %d)", ErrTooManyEntries, maxEntries)
+		}
+
+		if hdr.Typeflag != tar.TypeReg || !onlyFileInFsRootPatternRegex.MatchString(hdr.Name) {
+			return nil, fmt.Errorf("unexpected entry in snapshot: %s", hdr.Name)
+		}
+
+		recordName, section, isSection := strings.Cut(hdr.Name, ".")
+		u, err := id.Parse(recordName)
+		if err != nil {
+			return nil, err
+		}
+		if u == manifest.Root {
+			u = root
+		}
+
+		name := u.String()
+		if isSection {
+			name += "." + section
+			content.sections[u] = append(content.sections[u], section)
+			sectionCount++
+		}
+		if _, ok := content.temps[name]; ok {
+			return nil, fmt.Errorf("duplicate entry in snapshot: %s", hdr.Name)
+		}
+
+		f, err := os.CreateTemp(fs.basePath, tempFilePrefix+"*")
+		if err != nil {
+			return nil, err
+		}
+		content.temps[name] = f.Name()
+
+		var data io.Reader = tr
+		if !isSection {
+			// records are small, keep them around for the checks below
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			rec := new(record)
+			if err = json.Unmarshal(b, rec); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("record %s: %w", recordName, err)
+			}
+			content.records[u] = rec
+			data = bytes.NewReader(b)
+		}
+
+		_, err = io.Copy(f, data)
+		if err == nil {
+			err = f.Chmod(fs.opts.filePerm())
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(content.records) != manifest.Records || sectionCount != manifest.Sections {
+		return nil, fmt.Errorf("snapshot is incomplete (%d of %d records, %d of %d sections)",
+			len(content.records), manifest.Records, sectionCount, manifest.Sections)
+	}
+	if _, ok := content.records[root]; !ok {
+		return nil, errors.New("snapshot doesn't contain its root")
+	}
+	for u, rec := range content.records {
+		for _, c := range rec.Children {
+			if _, ok := content.records[c]; !ok || c == root {
+				return nil, fmt.Errorf("record %s has a bad child %s", u, c)
+			}
+		}
+	}
+	for u := range content.sections {
+		if _, ok := content.records[u]; !ok {
+			return nil, fmt.Errorf("section of a missing record %s", u)
+		}
+	}
+
+	return content, nil
+}
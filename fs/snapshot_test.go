@@ -0,0 +1,195 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"archiiv/id"
+)
+
+type walkedFile struct {
+	Path     string
+	Info     FileInfo
+	Sections map[string]string
+}
+
+func walkContent(t *testing.T, fs *Fs) []walkedFile {
+	var files []walkedFile
+	err := fs.Walk(context.Background(), fs.GetRoot(), func(path string, info FileInfo) error {
+		sections, err := fs.Sections(info.ID)
+		require.NoError(t, err)
+
+		f := walkedFile{Path: path, Info: info, Sections: map[string]string{}}
+		if info.ID == fs.GetRoot() {
+			// differs between the two trees
+			f.Info.ID = id.ID{}
+		}
+		for _, section := range sections {
+			r, err := fs.OpenSection(info.ID, section)
+			require.NoError(t, err)
+			b, err := io.ReadAll(r)
+			r.Close()
+			require.NoError(t, err)
+			f.Sections[section] = string(b)
+		}
+		files = append(files, f)
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	t.Parallel()
+	src := newTestTree(t)
+
+	// a record mounted twice must keep both references
+	docs, err := src.Mkdir(src.GetRoot(), "more docs")
+	require.NoError(t, err)
+	shared, err := src.Touch(docs, "shared")
+	require.NoError(t, err)
+	require.NoError(t, src.Mount(src.GetRoot(), shared))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Snapshot(&buf))
+
+	dst := newTestFs(t)
+	require.NoError(t, dst.Restore(context.Background(), bytes.NewReader(buf.Bytes()), 0))
+
+	assert.Equal(t, walkContent(t, src), walkContent(t, dst))
+
+	r, err := dst.record(shared)
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), r.refs)
+
+	// survives a reload
+	require.NoError(t, dst.Close())
+	reloaded, err := NewFs(dst.GetRoot(), dst.basePath, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, walkContent(t, src), walkContent(t, reloaded))
+
+	// and unmounting one of the references keeps the record alive
+	require.NoError(t, dst.Unmount(dst.GetRoot(), shared))
+	_, err = dst.Stat(shared)
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, dst.Restore(context.Background(), bytes.NewReader(buf.Bytes()), 0), ErrNotEmpty)
+}
+
+func TestRestoreBrokenSnapshot(t *testing.T) {
+	t.Parallel()
+	src := newTestTree(t)
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Snapshot(&buf))
+
+	// drop the last entry
+	var truncated bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	tw := tar.NewWriter(&truncated)
+	var entries [][]byte
+	var headers []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		headers = append(headers, hdr)
+		entries = append(entries, b)
+	}
+	for i := range len(headers) - 1 {
+		require.NoError(t, tw.WriteHeader(headers[i]))
+		_, err := tw.Write(entries[i])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	dst := newTestFs(t)
+	before, err := os.ReadDir(dst.basePath)
+	require.NoError(t, err)
+
+	assert.Error(t, dst.Restore(context.Background(), &truncated, 0))
+
+	after, err := os.ReadDir(dst.basePath)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	children, err := dst.GetChildren(dst.GetRoot())
+	require.NoError(t, err)
+	assert.Empty(t, children)
+}
+
+func TestRestoreLimits(t *testing.T) {
+	t.Parallel()
+	src := newTestTree(t)
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Snapshot(&buf))
+
+	dst := newTestFs(t)
+	err := dst.Restore(context.Background(), bytes.NewReader(buf.Bytes()), 2)
+	assert.ErrorIs(t, err, ErrTooManyEntries)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = dst.Restore(ctx, bytes.NewReader(buf.Bytes()), 0)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// nothing of the failed attempts is left behind
+	children, err := dst.GetChildren(dst.GetRoot())
+	require.NoError(t, err)
+	assert.Empty(t, children)
+	require.NoError(t, dst.Restore(context.Background(), bytes.NewReader(buf.Bytes()), 0))
+	assert.Equal(t, walkContent(t, src), walkContent(t, dst))
+}
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+	src := newTestTree(t)
+
+	docs, err := src.Mkdir(src.GetRoot(), "more docs")
+	require.NoError(t, err)
+	shared, err := src.Touch(docs, "shared")
+	require.NoError(t, err)
+	writeSection(t, src, shared, "data", "shared")
+	require.NoError(t, src.Mount(src.GetRoot(), shared))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Snapshot(&buf))
+
+	dst := newTestFs(t)
+	n, err := dst.Import(context.Background(), dst.GetRoot(), bytes.NewReader(buf.Bytes()), 0)
+	require.NoError(t, err)
+
+	ids := src.sortedIDs()
+	assert.Equal(t, len(ids)-1, n)
+	// the root stands for the directory imported into, the rest keep their IDs
+	assert.Equal(t, walkContent(t, src)[1:], walkContent(t, dst)[1:])
+
+	r, err := dst.record(shared)
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), r.refs)
+
+	// nothing is created when an ID is taken
+	again, err := dst.Mkdir(dst.GetRoot(), "again")
+	require.NoError(t, err)
+	_, err = dst.Import(context.Background(), again, bytes.NewReader(buf.Bytes()), 0)
+	assert.ErrorIs(t, err, ErrExists)
+	children, err := dst.GetChildren(again)
+	require.NoError(t, err)
+	assert.Empty(t, children)
+
+	file, err := dst.Touch(dst.GetRoot(), "file")
+	require.NoError(t, err)
+	_, err = dst.Import(context.Background(), file, bytes.NewReader(buf.Bytes()), 0)
+	assert.ErrorIs(t, err, ErrNotDir)
+}
@@ -0,0 +1,61 @@
+package fs
+
+import (
+	"context"
+
+	"archiiv/id"
+)
+
+// TreeNode is one record of the tree returned by Tree
+type TreeNode struct {
+	ID       id.ID      `json:"id"`
+	Name     string     `json:"name"`
+	IsDir    bool       `json:"is_dir"`
+	Children []TreeNode `json:"children,omitempty"`
+	// Truncated marks a node that has children which were left out
+	// because of the depth limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Tree returns the tree under root down to the given depth, negative depth
+// means unlimited. Depth 1 are the children of root. A record mounted in
+// several places appears under each of them
+func (fs *Fs) Tree(ctx context.Context, root id.ID, depth int) (TreeNode, error) {
+	return fs.tree(ctx, root, depth, 0)
+}
+
+func (fs *Fs) tree(ctx context.Context, root id.ID, depth, level int) (TreeNode, error) {
+	if err := ctx.Err(); err != nil {
+		return TreeNode{}, err
+	}
+	if err := fs.checkWalkDepth(level); err != nil {
+		return TreeNode{}, err
+	}
+
+	r, err := fs.record(root)
+	if err != nil {
+		return TreeNode{}, err
+	}
+
+	info := r.info()
+	node := TreeNode{ID: info.ID, Name: info.Name, IsDir: info.IsDir}
+
+	children := r.children()
+	if len(children) == 0 {
+		return node, nil
+	}
+	if depth == 0 {
+		node.Truncated = true
+		return node, nil
+	}
+
+	for _, c := range children {
+		child, err := fs.tree(ctx, c, depth-1, level+1)
+		if err != nil {
+			return TreeNode{}, err
+		}
+		node.Children = append(node.Children, child)
+	}
+
+	return node, nil
+}
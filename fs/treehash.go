@@ -0,0 +1,141 @@
+package fs
+
+import (
+	"cmp"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"archiiv/id"
+)
+
+// TreeHash returns a Merkle hash of the tree under root, for sync tools to
+// tell whether two trees hold the same content. A file hashes the decoded
+// content of its sections (the meta is left out, it changes with every
+// permission and timestamp), so a compressed copy hashes the same as a plain
+// one. A directory folds the names and hashes of its children sorted by name.
+// The record's own name and ID are not part of it, so equal trees hash the
+// same wherever they are mounted. Children include says no to are left out as
+// if they weren't there, a nil include takes all of them
+func (fs *Fs) TreeHash(root id.ID, include func(u id.ID) (bool, error)) (string, error) {
+	if include == nil {
+		include = func(id.ID) (bool, error) { return true, nil }
+	}
+	sum, err := fs.treeHash(root, 0, include, make(map[id.ID][]byte))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// treeHash hashes the record, done keeps the hashes of the records seen so
+// far, so that a record mounted in several places is read once
+func (fs *Fs) treeHash(u id.ID, depth int, include func(u id.ID) (bool, error), done map[id.ID][]byte) ([]byte, error) {
+	if sum, ok := done[u]; ok {
+		return sum, nil
+	}
+	if err := fs.checkWalkDepth(depth); err != nil {
+		return nil, err
+	}
+
+	r, err := fs.record(u)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if r.info().IsDir {
+		type entry struct {
+			name string
+			sum  []byte
+		}
+
+		var entries []entry
+		for _, c := range r.children() {
+			ok, err := include(c)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			child, err := fs.record(c)
+			if err != nil {
+				return nil, err
+			}
+			sum, err := fs.treeHash(c, depth+1, include, done)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{child.info().Name, sum})
+		}
+
+		// names don't have to be unique, the hash breaks the ties
+		slices.SortFunc(entries, func(a, b entry) int {
+			return cmp.Or(cmp.Compare(a.name, b.name), slices.Compare(a.sum, b.sum))
+		})
+		fmt.Fprintf(h, "dir %d\n", len(entries))
+		for _, e := range entries {
+			fmt.Fprintf(h, "%q %x\n", e.name, e.sum)
+		}
+	} else {
+		sections, err := fs.Sections(u)
+		if err != nil {
+			return nil, err
+		}
+		sections = slices.DeleteFunc(sections, func(s string) bool { return s == "meta" })
+
+		var encodings map[string]string
+		if len(sections) > 0 {
+			fm, err := ReadFileMeta(fs, u)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			encodings = fm.SectionEncodings
+		}
+
+		fmt.Fprintf(h, "file %d\n", len(sections))
+		for _, section := range sections {
+			sum, err := fs.sectionHash(u, section, encodings[section])
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(h, "%q %x\n", section, sum)
+		}
+	}
+
+	sum := h.Sum(nil)
+	done[u] = sum
+	return sum, nil
+}
+
+// sectionHash hashes the content of the section as it was uploaded, before
+// the encoding it is stored with
+func (fs *Fs) sectionHash(u id.ID, section, encoding string) ([]byte, error) {
+	f, err := fs.OpenSection(u, section)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var content io.Reader = f
+	if encoding == EncodingGzip {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("section %s.%s: %w", u, section, err)
+		}
+		defer zr.Close()
+		content = zr
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, content); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,122 @@
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"archiiv/id"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeHash(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+
+	a, err := fs.Mkdir(fs.GetRoot(), "a")
+	require.NoError(t, err)
+	b, err := fs.Mkdir(fs.GetRoot(), "b")
+	require.NoError(t, err)
+	sub, err := fs.Mkdir(a, "sub")
+	require.NoError(t, err)
+
+	deep, err := fs.Touch(sub, "deep")
+	require.NoError(t, err)
+	writeSection(t, fs, deep, "data", "deep down")
+
+	shared, err := fs.Touch(a, "shared")
+	require.NoError(t, err)
+	writeSection(t, fs, shared, "data", "shared")
+	require.NoError(t, fs.Mount(b, shared))
+
+	hashes := func() map[id.ID]string {
+		got := make(map[id.ID]string)
+		for _, u := range []id.ID{fs.GetRoot(), a, b, sub, deep, shared} {
+			h, err := fs.TreeHash(u, nil)
+			require.NoError(t, err)
+			got[u] = h
+		}
+		return got
+	}
+
+	before := hashes()
+	assert.Equal(t, before, hashes(), "stable")
+
+	// b holds the shared file under the same name as a does, nothing else
+	other, err := fs.Mkdir(fs.GetRoot(), "other")
+	require.NoError(t, err)
+	require.NoError(t, fs.Mount(other, shared))
+	h, err := fs.TreeHash(other, nil)
+	require.NoError(t, err)
+	assert.Equal(t, before[b], h, "shared children hash the same everywhere")
+	require.NoError(t, fs.Unmount(fs.GetRoot(), other))
+	assert.Equal(t, before, hashes(), "back as it was")
+
+	// the meta is not content
+	writeSection(t, fs, deep, "meta", `{"perms":{"prokop":7}}`)
+	assert.Equal(t, before, hashes(), "meta")
+
+	writeSection(t, fs, deep, "data", "changed")
+	after := hashes()
+	for _, u := range []id.ID{fs.GetRoot(), a, sub, deep} {
+		assert.NotEqual(t, before[u], after[u], "ancestors of the change")
+	}
+	for _, u := range []id.ID{b, shared} {
+		assert.Equal(t, before[u], after[u], "outside of the change")
+	}
+
+	before = after
+	writeSection(t, fs, shared, "thumb", "small")
+	after = hashes()
+	for _, u := range []id.ID{fs.GetRoot(), a, b, shared} {
+		assert.NotEqual(t, before[u], after[u], "new section")
+	}
+	assert.Equal(t, before[sub], after[sub])
+
+	before = after
+	_, err = fs.Touch(sub, "empty")
+	require.NoError(t, err)
+	after = hashes()
+	for _, u := range []id.ID{fs.GetRoot(), a, sub} {
+		assert.NotEqual(t, before[u], after[u], "new child")
+	}
+	assert.Equal(t, before[b], after[b])
+
+	_, err = fs.TreeHash(id.New(), nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// left out children are as if they weren't there
+	h, err = fs.TreeHash(a, func(u id.ID) (bool, error) { return u != sub, nil })
+	require.NoError(t, err)
+	require.NoError(t, fs.Unmount(a, sub))
+	want, err := fs.TreeHash(a, nil)
+	require.NoError(t, err)
+	assert.Equal(t, want, h)
+}
+
+func TestTreeHashDecodes(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+
+	plain, err := fs.Touch(fs.GetRoot(), "plain")
+	require.NoError(t, err)
+	writeSection(t, fs, plain, "data", "same content")
+
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	_, err = zw.Write([]byte("same content"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	compressed, err := fs.Touch(fs.GetRoot(), "compressed")
+	require.NoError(t, err)
+	writeSection(t, fs, compressed, "data", zipped.String())
+	writeSection(t, fs, compressed, "meta", `{"sectionEncodings":{"data":"gzip"}}`)
+
+	want, err := fs.TreeHash(plain, nil)
+	require.NoError(t, err)
+	got, err := fs.TreeHash(compressed, nil)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
@@ -0,0 +1,55 @@
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"archiiv/id"
+)
+
+// SubtreeVersion returns a tag that changes whenever a record reachable from
+// root or any of its sections changes. It is built from the names, sizes and
+// modification times of the files backing the records, so adding, removing
+// or renaming a section changes it as well as rewriting one
+func (fs *Fs) SubtreeVersion(ctx context.Context, root id.ID) (string, error) {
+	entries, err := listStoreFiles(fs.basePath)
+	if err != nil {
+		return "", err
+	}
+
+	// one pass over the fs root, like DiskUsage
+	files := make(map[string][]os.DirEntry)
+	for _, e := range entries {
+		recordName, _, _ := strings.Cut(e.Name(), ".")
+		if recordName == "" {
+			continue
+		}
+		files[recordName] = append(files[recordName], e)
+	}
+
+	h := sha256.New()
+	err = fs.Walk(ctx, root, func(path string, info FileInfo) error {
+		for _, e := range files[info.ID.String()] {
+			st, err := e.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				// removed since the listing, the next request sees it
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s %d %d\n", e.Name(), st.Size(), st.ModTime().UnixNano())
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
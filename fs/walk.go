@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	iofs "io/fs"
+
+	"archiiv/id"
+)
+
+// SkipDir can be returned from a WalkFunc to skip the children of a directory
+var SkipDir = iofs.SkipDir
+
+// WalkFunc is called for every record reachable from the root of the walk.
+// The path is made of record names joined with slashes, the root itself is "."
+type WalkFunc func(path string, info FileInfo) error
+
+// Walk visits the tree under root depth first, in the order of the children.
+// A record mounted in several places is visited only once, on the first path
+// that reaches it. The walk stops with the context's error once it is done
+func (fs *Fs) Walk(ctx context.Context, root id.ID, fn WalkFunc) error {
+	return fs.walk(ctx, root, ".", 0, make(map[id.ID]bool), fn)
+}
+
+func (fs *Fs) walk(ctx context.Context, u id.ID, path string, depth int, visited map[id.ID]bool, fn WalkFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := fs.checkWalkDepth(depth); err != nil {
+		return err
+	}
+
+	if visited[u] {
+		return nil
+	}
+	visited[u] = true
+
+	r, err := fs.record(u)
+	if err != nil {
+		return err
+	}
+
+	err = fn(path, r.info())
+	if errors.Is(err, SkipDir) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, c := range r.children() {
+		child, err := fs.record(c)
+		if err != nil {
+			return err
+		}
+
+		childPath := child.info().Name
+		if path != "." {
+			childPath = path + "/" + childPath
+		}
+
+		if err = fs.walk(ctx, c, childPath, depth+1, visited, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalk(t *testing.T) {
+	t.Parallel()
+	fs := newTestTree(t)
+
+	var paths []string
+	err := fs.Walk(context.Background(), fs.GetRoot(), func(path string, info FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".", "hello.txt", "docs", "docs/empty", "docs/notes.md"}, paths)
+
+	require.NoError(t, fs.Close())
+	loaded, err := NewFs(fs.GetRoot(), fs.basePath, Options{})
+	require.NoError(t, err)
+
+	var reloadedPaths []string
+	err = loaded.Walk(context.Background(), loaded.GetRoot(), func(path string, info FileInfo) error {
+		reloadedPaths = append(reloadedPaths, path)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, paths, reloadedPaths)
+}
+
+func TestWalkSharedChildAndSkipDir(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+
+	a, err := fs.Mkdir(fs.GetRoot(), "a")
+	require.NoError(t, err)
+	b, err := fs.Mkdir(fs.GetRoot(), "b")
+	require.NoError(t, err)
+	shared, err := fs.Touch(a, "shared")
+	require.NoError(t, err)
+	require.NoError(t, fs.Mount(b, shared))
+	_, err = fs.Touch(b, "only in b")
+	require.NoError(t, err)
+
+	var paths []string
+	err = fs.Walk(context.Background(), fs.GetRoot(), func(path string, info FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".", "a", "a/shared", "b", "b/only in b"}, paths)
+
+	paths = nil
+	err = fs.Walk(context.Background(), fs.GetRoot(), func(path string, info FileInfo) error {
+		paths = append(paths, path)
+		if info.Name == "a" {
+			return SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".", "a", "b", "b/shared", "b/only in b"}, paths)
+}
+
+func TestWalkDeadline(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+
+	for i := range 10 {
+		_, err := fs.Touch(fs.GetRoot(), fmt.Sprint(i))
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	visited := 0
+	err := fs.Walk(ctx, fs.GetRoot(), func(path string, info FileInfo) error {
+		visited++
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, visited, 11)
+}
+
+func TestWalkCancel(t *testing.T) {
+	t.Parallel()
+	fs := newTestFs(t)
+
+	for i := range 10 {
+		_, err := fs.Touch(fs.GetRoot(), fmt.Sprint(i))
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	visited := 0
+	err := fs.Walk(ctx, fs.GetRoot(), func(path string, info FileInfo) error {
+		visited++
+		if visited == 3 {
+			cancel()
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 3, visited)
+
+	_, err = fs.DiskUsage(ctx, fs.GetRoot())
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = fs.Fsck(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = fs.Parents(ctx, fs.GetRoot())
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,53 @@
+package fs
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"archiiv/id"
+)
+
+// cond returns the condition variable of a locked record
+func (r *record) cond() *sync.Cond {
+	if r.watchers == nil {
+		r.watchers = sync.NewCond(&r.mutex)
+	}
+	return r.watchers
+}
+
+// changed bumps the version of a locked record and wakes up its watchers
+func (r *record) changed() {
+	r.version++
+	if r.watchers != nil {
+		r.watchers.Broadcast()
+	}
+}
+
+// WaitChildren blocks until the version of the listing differs from the given
+// one (as returned by GetChildrenVersioned) or the context is done. It returns
+// the listing at that moment, so the caller tells a timeout from a change by
+// comparing the versions
+func (fs *Fs) WaitChildren(ctx context.Context, u id.ID, version string) ([]id.ID, string, error) {
+	r, err := fs.record(u)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// broadcast under the lock so the wakeup can't slip in between the check
+	// of ctx and Wait
+	stop := context.AfterFunc(ctx, func() {
+		r.lock()
+		r.cond().Broadcast()
+		r.unlock()
+	})
+	defer stop()
+
+	r.lock()
+	defer r.unlock()
+	for fs.versionString(r) == version && ctx.Err() == nil {
+		r.cond().Wait()
+	}
+
+	return slices.Clone(r.Children), fs.versionString(r), nil
+}
@@ -0,0 +1,93 @@
+package fs
+
+import (
+	"maps"
+	"slices"
+
+	"archiiv/id"
+)
+
+// Batch runs fn with the writes of records deferred. A record changed several
+// times during fn (like the parent of many mounted children) is written only
+// once, when the outermost Batch returns. Batches can be nested.
+//
+// The changes are visible to everyone right away, but they only reach the
+// disk at the end. The batch is not atomic: a crash before the end loses its
+// record changes, and a crash while the pending records are being written
+// leaves some of them written and others not, for example a parent listing a
+// child whose record never made it to the disk. Fsck reports what is left
+// inconsistent. Sections are written directly, so a section of a record that
+// was never persisted is left behind as garbage. Records written by other
+// goroutines while a batch is running are deferred as well and share its fate
+func (fs *Fs) Batch(fn func() error) error {
+	fs.writeBatchLock.Lock()
+	if fs.writeBatchDepth == 0 {
+		fs.pendingWrites = make(map[id.ID]*record)
+	}
+	fs.writeBatchDepth++
+	fs.writeBatchLock.Unlock()
+
+	err := fn()
+
+	if flushErr := fs.endBatch(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// deferWrite remembers the record to be written at the end of the running
+// batch. Returns false when there's no batch
+func (fs *Fs) deferWrite(r *record) bool {
+	fs.writeBatchLock.Lock()
+	defer fs.writeBatchLock.Unlock()
+
+	if fs.writeBatchDepth == 0 {
+		return false
+	}
+	fs.pendingWrites[r.id] = r
+	return true
+}
+
+// forgetWrite drops the pending write of a deleted record, so that the end of
+// the batch doesn't bring it back. Returns whether there was one
+func (fs *Fs) forgetWrite(u id.ID) bool {
+	fs.writeBatchLock.Lock()
+	defer fs.writeBatchLock.Unlock()
+
+	_, pending := fs.pendingWrites[u]
+	delete(fs.pendingWrites, u)
+	return pending
+}
+
+// endBatch writes the pending records once the outermost batch ends
+func (fs *Fs) endBatch() error {
+	fs.writeBatchLock.Lock()
+	fs.writeBatchDepth--
+	if fs.writeBatchDepth > 0 {
+		fs.writeBatchLock.Unlock()
+		return nil
+	}
+	pending := fs.pendingWrites
+	fs.pendingWrites = nil
+	fs.writeBatchLock.Unlock()
+
+	var firstErr error
+	for _, u := range slices.SortedFunc(maps.Keys(pending), id.ID.Compare) {
+		fs.lock.RLock()
+		_, exists := fs.states[u]
+		fs.lock.RUnlock()
+		if !exists {
+			// deleted after the batch ended
+			continue
+		}
+
+		r := pending[u]
+		r.lock()
+		err := fs.persistRecord(r)
+		r.unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"archiiv/id"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchCoalescesWrites(t *testing.T) {
+	t.Parallel()
+
+	fs := newTestFs(t)
+	root := fs.GetRoot()
+
+	parent, err := fs.Mkdir(root, "parent")
+	require.NoError(t, err)
+	var children []id.ID
+	for i := range 100 {
+		child, err := fs.Touch(root, strconv.Itoa(i))
+		require.NoError(t, err)
+		children = append(children, child)
+	}
+
+	writes := make(map[id.ID]int)
+	fs.persisted = func(u id.ID) { writes[u]++ }
+
+	err = fs.Batch(func() error {
+		for _, child := range children {
+			if err := fs.Mount(parent, child); err != nil {
+				return err
+			}
+		}
+		// nothing reached the disk yet
+		assert.Empty(t, writes)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[id.ID]int{parent: 1}, writes)
+
+	require.NoError(t, fs.Close())
+	loaded, err := NewFs(root, fs.basePath, Options{})
+	require.NoError(t, err)
+	loadedChildren, err := loaded.GetChildren(parent)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, children, loadedChildren)
+}
+
+func TestBatchDeletedRecord(t *testing.T) {
+	t.Parallel()
+
+	fs := newTestFs(t)
+	root := fs.GetRoot()
+
+	boom := errors.New("boom")
+	var dir id.ID
+	err := fs.Batch(func() error {
+		var err error
+		dir, err = fs.Mkdir(root, "dir")
+		require.NoError(t, err)
+		_, err = fs.Touch(dir, "file")
+		require.NoError(t, err)
+
+		// the changes are already visible
+		children, err := fs.GetChildren(dir)
+		require.NoError(t, err)
+		assert.Len(t, children, 1)
+
+		require.NoError(t, fs.Unmount(root, dir))
+		return boom
+	})
+	assert.ErrorIs(t, err, boom)
+
+	// the deleted records are not written at the end of the batch
+	require.NoError(t, fs.Close())
+	loaded, err := NewFs(root, fs.basePath, Options{})
+	require.NoError(t, err)
+	_, err = loaded.Stat(dir)
+	assert.Error(t, err)
+	children, err := loaded.GetChildren(root)
+	require.NoError(t, err)
+	assert.Empty(t, children)
+}
@@ -0,0 +1,26 @@
+package id
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// The string form of an ID is computed by repeated division, which is slow
+// compared to how often the fs needs it to build paths. Recently encoded IDs
+// are kept in a small direct-mapped cache. It can't live inside ID itself,
+// that would make equal IDs compare different depending on whether they
+// were printed
+
+const stringCacheSize = 4096 // power of two
+
+type stringCacheEntry struct {
+	id ID
+	s  string
+}
+
+var stringCache [stringCacheSize]atomic.Pointer[stringCacheEntry]
+
+func (id ID) cacheSlot() *atomic.Pointer[stringCacheEntry] {
+	// the IDs are random, so any of their bytes spread well
+	return &stringCache[binary.LittleEndian.Uint64(id.value[:8])&(stringCacheSize-1)]
+}
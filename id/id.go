@@ -1,11 +1,13 @@
 package id
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/big"
-	"strings"
+	"math/bits"
 )
 
 type ID struct {
@@ -25,63 +27,93 @@ var b58table = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
 const strlen = 22
 
 func (id ID) String() string {
-	table := []byte(b58table)
-	n := new(big.Int).SetBytes(id.value[:])
-
-	e := []byte{}
-
-	zero := big.NewInt(0)
-	base := big.NewInt(58)
-
-	for n.Cmp(zero) != 0 {
-		remainder := new(big.Int)
-		n.DivMod(n, base, remainder)
-		e = append(e, table[remainder.Int64()])
+	slot := id.cacheSlot()
+	if e := slot.Load(); e != nil && e.id == id {
+		return e.s
 	}
 
-	for len(e) < strlen {
-		e = append(e, table[0])
-	}
+	s := id.encode()
+	slot.Store(&stringCacheEntry{id: id, s: s})
+	return s
+}
 
-	// reverse
-	for i, j := 0, len(e)-1; i < j; i, j = i+1, j-1 {
-		e[i], e[j] = e[j], e[i]
+// encode converts the value to base58 as a 128-bit number kept in two words,
+// so nothing but the result is allocated
+func (id ID) encode() string {
+	hi := binary.BigEndian.Uint64(id.value[:8])
+	lo := binary.BigEndian.Uint64(id.value[8:])
+
+	var e [strlen]byte
+	for i := strlen - 1; i >= 0; i-- {
+		var rem uint64
+		hi, rem = bits.Div64(0, hi, 58)
+		lo, rem = bits.Div64(rem, lo, 58)
+		e[i] = b58table[rem]
 	}
 
-	return string(e)
+	return string(e[:])
 }
 
+var (
+	ErrInvalidLength = errors.New("invalid b58 string length")
+	ErrInvalidByte   = errors.New("invalid byte inside b58 string")
+	ErrOverflow      = errors.New("b58 string does not fit into an ID")
+)
+
+// b58index maps a byte to its value in b58table, -1 for bytes outside of it
+var b58index = func() (index [256]int8) {
+	for i := range index {
+		index[i] = -1
+	}
+	for i := range len(b58table) {
+		index[b58table[i]] = int8(i) // #nosec G115: the table has 58 entries
+	}
+	return
+}()
+
 func Parse(s string) (id ID, err error) {
 	if len(s) != strlen {
-		err = fmt.Errorf("invalid b58 string length (%v)", len(s))
+		err = fmt.Errorf("%w (%v)", ErrInvalidLength, len(s))
 		return
 	}
 
-	base := big.NewInt(58)
-	result := big.NewInt(0)
-
+	var hi, lo uint64
+	overflow := false
 	for _, r := range []byte(s) {
-		idx := strings.IndexByte(b58table, r)
+		idx := b58index[r]
 		if idx == -1 {
-			err = fmt.Errorf("invalid byte inside b58 string (%v)", r)
+			err = fmt.Errorf("%w (%v)", ErrInvalidByte, r)
 			return
 		}
-		result.Mul(result, base)
-		result.Add(result, big.NewInt(int64(idx)))
-	}
 
-	bytes := result.Bytes()
+		// (hi, lo) = (hi, lo)*58 + idx, remembering whether it
+		// ever stopped fitting. Invalid bytes later in the string
+		// are still reported first
+		loHi, loLo := bits.Mul64(lo, 58)
+		var carry uint64
+		lo, carry = bits.Add64(loLo, uint64(idx), 0)
+		hiHi, hiLo := bits.Mul64(hi, 58)
+		hi, carry = bits.Add64(hiLo, loHi, carry)
+		if hiHi != 0 || carry != 0 {
+			overflow = true
+		}
+	}
 
-	padding := 16 - len(bytes)
-	if padding > 0 {
-		paddingBytes := make([]byte, padding)
-		bytes = append(paddingBytes, bytes...)
+	if overflow {
+		err = ErrOverflow
+		return
 	}
 
-	copy(id.value[:], bytes)
+	binary.BigEndian.PutUint64(id.value[:8], hi)
+	binary.BigEndian.PutUint64(id.value[8:], lo)
 	return
 }
 
+// Compare orders IDs by their byte value. Returns -1, 0 or +1
+func (id ID) Compare(other ID) int {
+	return bytes.Compare(id.value[:], other.value[:])
+}
+
 func (id ID) MarshalJSON() ([]byte, error) {
 	return json.Marshal(id.String())
 }
@@ -2,6 +2,9 @@ package id
 
 import (
 	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,3 +39,175 @@ func TestIDJsonRoundtrip(t *testing.T) {
 		assert.Equalf(t, tt, v, "value failed trip: %v -> %s -> %v", tt.value, s, v.value)
 	}
 }
+
+func TestIDCompare(t *testing.T) {
+	assert.Equal(t, 0, tests[0].Compare(tests[0]))
+	assert.Equal(t, 1, tests[0].Compare(tests[1]))
+	assert.Equal(t, -1, tests[1].Compare(tests[2]))
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse("abc")
+	assert.ErrorIs(t, err, ErrInvalidLength)
+
+	_, err = Parse("0000000000000000000000")
+	assert.ErrorIs(t, err, ErrInvalidByte)
+
+	_, err = Parse("zzzzzzzzzzzzzzzzzzzzzz")
+	assert.ErrorIs(t, err, ErrOverflow)
+}
+
+func TestStringCache(t *testing.T) {
+	// two IDs fighting over one slot still print right
+	a := ID{value: [16]byte{1}}
+	b := ID{value: [16]byte{1, 15: 1}}
+	assert.Same(t, a.cacheSlot(), b.cacheSlot())
+	for range 3 {
+		assert.Equal(t, a.encode(), a.String())
+		assert.Equal(t, b.encode(), b.String())
+	}
+}
+
+func BenchmarkString(b *testing.B) {
+	ids := make([]ID, 100)
+	for i := range ids {
+		ids[i] = New()
+	}
+
+	b.Run("big", func(b *testing.B) {
+		for i := 0; b.Loop(); i++ {
+			_ = bigString(ids[i%len(ids)])
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; b.Loop(); i++ {
+			_ = ids[i%len(ids)].encode()
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; b.Loop(); i++ {
+			_ = ids[i%len(ids)].String()
+		}
+	})
+}
+
+// bigString and bigParse are the original big.Int implementations, kept as
+// the reference for the fixed-size ones
+func bigString(id ID) string {
+	table := []byte(b58table)
+	n := new(big.Int).SetBytes(id.value[:])
+
+	e := []byte{}
+
+	zero := big.NewInt(0)
+	base := big.NewInt(58)
+
+	for n.Cmp(zero) != 0 {
+		remainder := new(big.Int)
+		n.DivMod(n, base, remainder)
+		e = append(e, table[remainder.Int64()])
+	}
+
+	for len(e) < strlen {
+		e = append(e, table[0])
+	}
+
+	// reverse
+	for i, j := 0, len(e)-1; i < j; i, j = i+1, j-1 {
+		e[i], e[j] = e[j], e[i]
+	}
+
+	return string(e)
+}
+
+func bigParse(s string) (id ID, err error) {
+	if len(s) != strlen {
+		err = fmt.Errorf("%w (%v)", ErrInvalidLength, len(s))
+		return
+	}
+
+	base := big.NewInt(58)
+	result := big.NewInt(0)
+
+	for _, r := range []byte(s) {
+		idx := strings.IndexByte(b58table, r)
+		if idx == -1 {
+			err = fmt.Errorf("%w (%v)", ErrInvalidByte, r)
+			return
+		}
+		result.Mul(result, base)
+		result.Add(result, big.NewInt(int64(idx)))
+	}
+
+	bytes := result.Bytes()
+	if len(bytes) > len(id.value) {
+		err = ErrOverflow
+		return
+	}
+
+	padding := 16 - len(bytes)
+	if padding > 0 {
+		paddingBytes := make([]byte, padding)
+		bytes = append(paddingBytes, bytes...)
+	}
+
+	copy(id.value[:], bytes)
+	return
+}
+
+func FuzzString(f *testing.F) {
+	for _, tt := range tests {
+		f.Add(tt.value[:])
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var id ID
+		copy(id.value[:], b)
+		assert.Equal(t, bigString(id), id.encode())
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	for _, tt := range tests {
+		f.Add(bigString(tt))
+	}
+	f.Add("zzzzzzzzzzzzzzzzzzzzzz")
+	f.Add("1111111111111111111110")
+	f.Add("short")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		want, wantErr := bigParse(s)
+		got, gotErr := Parse(s)
+		if wantErr != nil {
+			assert.EqualError(t, gotErr, wantErr.Error())
+			return
+		}
+		assert.NoError(t, gotErr)
+		assert.Equal(t, want, got)
+	})
+}
+
+func TestMatchesBigInt(t *testing.T) {
+	for range 10000 {
+		id := New()
+		assert.Equal(t, bigString(id), id.encode())
+		parsed, err := Parse(bigString(id))
+		assert.NoError(t, err)
+		assert.Equal(t, id, parsed)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	s := New().String()
+
+	b.Run("big", func(b *testing.B) {
+		for b.Loop() {
+			_, _ = bigParse(s)
+		}
+	})
+	b.Run("fixed", func(b *testing.B) {
+		for b.Loop() {
+			_, _ = Parse(s)
+		}
+	})
+}
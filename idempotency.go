@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyWindow is how long the response to a request with an
+// Idempotency-Key header is kept for retries
+const idempotencyWindow = 24 * time.Hour
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// the bounds of the kept responses, so that the keys of one user or a few
+// big responses can't take all of the memory
+const (
+	idempotencyMaxPerUser = 1000
+	idempotencyMaxEntries = 100000
+	idempotencyMaxBody    = 64 << 10
+)
+
+type idempotencyKey struct {
+	username string
+	key      string
+}
+
+// idempotentResponse is the response to the first request with a key. done
+// is closed once it is filled in, retries arriving before that wait for it
+type idempotentResponse struct {
+	done    chan struct{}
+	expires time.Time
+	request string
+	// ok is false when the response wasn't kept, the retry runs the
+	// request again
+	ok     bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyCache keeps the responses by user and key in memory. The window
+// is the same for every key, so the order of insertion is the order of expiry.
+// A user with maxPerUser keys is refused new ones until they expire, past
+// maxEntries keys the oldest ones are dropped. Bodies over maxBody are not
+// kept at all
+type idempotencyCache struct {
+	mutex     sync.Mutex
+	window    time.Duration
+	responses map[idempotencyKey]*idempotentResponse
+	order     []idempotencyKey
+	perUser   map[string]int
+
+	maxPerUser int
+	maxEntries int
+	maxBody    int
+}
+
+var errTooManyIdempotencyKeys = errors.New("too many idempotency keys in use")
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:     window,
+		responses:  make(map[idempotencyKey]*idempotentResponse),
+		perUser:    make(map[string]int),
+		maxPerUser: idempotencyMaxPerUser,
+		maxEntries: idempotencyMaxEntries,
+		maxBody:    idempotencyMaxBody,
+	}
+}
+
+// claim returns the response stored for the key, or a new one the caller has
+// to fill in and true
+func (c *idempotencyCache) claim(key idempotencyKey, request string) (*idempotentResponse, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for len(c.order) > 0 {
+		res := c.responses[c.order[0]]
+		if res != nil && now.Before(res.expires) {
+			break
+		}
+		c.remove(c.order[0])
+		c.order = c.order[1:]
+	}
+
+	if res, ok := c.responses[key]; ok {
+		return res, false, nil
+	}
+
+	if c.perUser[key.username] >= c.maxPerUser {
+		return nil, false, errTooManyIdempotencyKeys
+	}
+	for len(c.responses) >= c.maxEntries && len(c.order) > 0 {
+		c.remove(c.order[0])
+		c.order = c.order[1:]
+	}
+
+	res := &idempotentResponse{done: make(chan struct{}), expires: now.Add(c.window), request: request}
+	c.responses[key] = res
+	c.perUser[key.username]++
+	c.order = append(c.order, key)
+	return res, true, nil
+}
+
+// forget drops the response, so that the next request with the key runs again
+func (c *idempotencyCache) forget(key idempotencyKey, res *idempotentResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.responses[key] == res {
+		c.remove(key)
+	}
+}
+
+// remove drops the key, the caller holds the mutex
+func (c *idempotencyCache) remove(key idempotencyKey) {
+	if _, ok := c.responses[key]; !ok {
+		return
+	}
+	delete(c.responses, key)
+	if c.perUser[key.username]--; c.perUser[key.username] == 0 {
+		delete(c.perUser, key.username)
+	}
+}
+
+// recordingWriter passes the response through and keeps a copy of it, unless
+// it grows over limit
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	limit  int
+	tooBig bool
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.tooBig && w.body.Len()+len(b) > w.limit {
+		w.tooBig = true
+		w.body = bytes.Buffer{}
+	}
+	if !w.tooBig {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idempotent makes retries of a request with the same Idempotency-Key header
+// get the response of the first one instead of running it again. Keys are
+// per user, so it has to be wrapped in requireLogin. Server errors and
+// responses too big to keep are not kept, the retry runs the request again
+func idempotent(cache *idempotencyCache, log *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		username, ok := userFromContext(r)
+		if key == "" || !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		k := idempotencyKey{username: username, key: key}
+		request := r.Method + " " + r.URL.RequestURI()
+		for {
+			res, first, err := cache.claim(k, request)
+			if err != nil {
+				sendError(log, w, http.StatusTooManyRequests, err.Error())
+				return
+			}
+			if first {
+				rw := &recordingWriter{ResponseWriter: w, limit: cache.maxBody}
+				defer func() {
+					if rw.status == 0 || rw.status >= 500 || rw.tooBig {
+						cache.forget(k, res)
+					} else {
+						res.ok = true
+						res.status = rw.status
+						res.header = w.Header().Clone()
+						res.body = rw.body.Bytes()
+					}
+					close(res.done)
+				}()
+				h.ServeHTTP(rw, r)
+				return
+			}
+
+			if res.request != request {
+				sendError(log, w, http.StatusUnprocessableEntity, "idempotency key was used for another request")
+				return
+			}
+
+			select {
+			case <-res.done:
+			case <-r.Context().Done():
+				sendError(log, w, http.StatusServiceUnavailable, "request cancelled")
+				return
+			}
+			if !res.ok {
+				// the first request failed, this one takes its place
+				continue
+			}
+
+			maps.Copy(w.Header(), res.header)
+			w.WriteHeader(res.status)
+			if _, err := w.Write(res.body); err != nil {
+				log.Error("idempotent", "error", err)
+			}
+			return
+		}
+	})
+}
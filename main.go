@@ -3,18 +3,33 @@ package main
 import (
 	"archiiv/fs"
 	"archiiv/id"
+	"context"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 func main() {
-	log := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Printf("error from %s: %s\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
 
 	srv, conf, err := createServer(log, os.Args[1:], os.Getenv)
 	if err != nil {
@@ -22,7 +37,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	logLevel.Set(conf.logLevel)
+	stopReloading := reloadOnHangup(log, conf, os.Getenv)
+	defer stopReloading()
+
 	err = run(log, srv, conf)
+	if closeErr := conf.files.Close(); closeErr != nil {
+		log.Error("close fs", "error", closeErr)
+	}
 	if err != nil {
 		fmt.Printf("error from run: %s\n", err)
 		os.Exit(1)
@@ -38,36 +60,137 @@ func createServer(log *slog.Logger, args []string, env func(string) string) (htt
 	usersDir := filepath.Join(conf.dataDir, "users")
 	filesDir := filepath.Join(conf.dataDir, "files")
 
-	users, err := newUserStore(usersDir)
+	users, err := newUserStore(usersDir, conf.filePerm)
 	if err != nil {
 		return nil, config{}, fmt.Errorf("new user store: %w", err)
 	}
+	users.policy = conf.usernamePolicy
 
-	files, err := fs.NewFs(conf.rootID, filesDir)
+	files, err := fs.NewFs(conf.rootID, filesDir, fs.Options{
+		DirPerm:           conf.dirPerm,
+		FilePerm:          conf.filePerm,
+		MaxChildren:       conf.maxChildren,
+		MaxDepth:          conf.maxDepth,
+		NormalizeNames:    conf.normalizeNames,
+		FoldNameCase:      conf.foldNameCase,
+		Checksums:         conf.checksums,
+		Shard:             conf.shard,
+		RecordCache:       conf.recordCache,
+		SectionCacheLimit: conf.sectionCacheLimit,
+	})
 	if err != nil {
 		return nil, config{}, fmt.Errorf("new fs: %w", err)
 	}
+	conf.rootID = files.GetRoot()
+	conf.files = files
+	conf.revoked = newRevokedTokens()
+
+	if conf.verifyOnStart || conf.strictVerify {
+		if err = verifyFs(log, files, conf.strictVerify); err != nil {
+			files.Close()
+			return nil, config{}, fmt.Errorf("verify fs: %w", err)
+		}
+	}
 
 	mux := http.NewServeMux()
 	addRoutes(
 		mux,
 		log,
-		conf.secret,
+		conf,
 		users,
 		files,
 	)
 	var srv http.Handler = mux
-	srv = logAccesses(log, srv)
+	if conf.handlerTimeout > 0 {
+		srv = withTimeout(conf.handlerTimeout, srv)
+	}
+	srv = prettyJSON(srv)
+	srv = recoverPanics(log, srv)
+	srv = logAccesses(log, conf.accessLogFormat, os.Stdout, srv)
 
 	return srv, conf, nil
 }
 
+// verifyFs runs fsck over the freshly loaded fs and logs what it finds. With
+// strict set any problem is fatal
+func verifyFs(log *slog.Logger, files *fs.Fs, strict bool) error {
+	problems, err := files.Fsck(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		log.Warn("fs problem", "problem", p)
+	}
+	log.Info("verified fs", "problems", len(problems))
+
+	if strict && len(problems) > 0 {
+		return fmt.Errorf("%d problems, the first is %s", len(problems), problems[0])
+	}
+	return nil
+}
+
 type config struct {
 	host    string
 	port    string
+	h2c     bool
 	secret  string
 	dataDir string
 	rootID  id.ID
+
+	routePrefix    string
+	cacheMaxAge    time.Duration
+	handlerTimeout time.Duration
+
+	dirPerm      os.FileMode
+	filePerm     os.FileMode
+	maxChildren  int
+	maxDepth     int
+	maxTreeDepth int
+	checksums    bool
+	inheritPerms bool
+	shard        bool
+	recordCache  int
+	// sections up to this many bytes are cached in memory
+	sectionCacheLimit int64
+	// names of new records in NFC and case-insensitive names
+	normalizeNames bool
+	foldNameCase   bool
+
+	// strictVerify implies verifyOnStart
+	verifyOnStart bool
+	strictVerify  bool
+
+	allowPrehashedLogin bool
+	sessionCookie       bool
+	usernamePolicy      usernamePolicy
+	obscureNotFound     bool
+	// one of deletedUserKeep, deletedUserStrip and deletedUserReassign
+	deletedUserFiles string
+
+	// bound the user import and the snapshot restore
+	importMaxEntries int
+	importTimeout    time.Duration
+
+	// one of accessLogJSON and accessLogCLF
+	accessLogFormat string
+
+	// how often the logged out tokens that expired are forgotten
+	revokedReapInterval time.Duration
+
+	// the tunables can be changed by reloadConfig, the live ones are in
+	// live. args are the command line to reload from
+	configFile     string
+	maxUploadBytes int64
+	logLevel       slog.Level
+	live           *atomic.Pointer[tunables]
+	args           []string
+
+	// files is the fs opened by createServer. Its dir stays locked until
+	// it is closed
+	files *fs.Fs
+	// revoked are the tokens of the server, see reapRevokedTokens
+	revoked *revokedTokens
 }
 
 func getConfig(args []string, env func(string) string) (conf config, err error) {
@@ -75,9 +198,43 @@ func getConfig(args []string, env func(string) string) (conf config, err error)
 
 	flags.StringVar(&conf.host, "host", "localhost", "")
 	flags.StringVar(&conf.port, "port", "8275", "")
+	flags.BoolVar(&conf.h2c, "h2c", false, "")
 	flags.StringVar(&conf.dataDir, "data_dir", "", "")
+	flags.StringVar(&conf.configFile, "config_file", "", "")
+	flags.Int64Var(&conf.maxUploadBytes, "max_upload_bytes", 0, "")
+	flags.TextVar(&conf.logLevel, "log_level", slog.LevelInfo, "")
+	flags.StringVar(&conf.accessLogFormat, "access_log_format", accessLogJSON, "")
+	flags.BoolVar(&conf.checksums, "checksums", false, "")
+	flags.BoolVar(&conf.shard, "shard", false, "")
+	flags.IntVar(&conf.recordCache, "record_cache", 0, "")
+	flags.Int64Var(&conf.sectionCacheLimit, "section_cache_limit", 0, "")
+	flags.BoolVar(&conf.verifyOnStart, "verify_on_start", false, "")
+	flags.BoolVar(&conf.strictVerify, "strict_verify", false, "")
+	flags.IntVar(&conf.maxChildren, "max_children", 0, "")
+	flags.IntVar(&conf.maxDepth, "max_depth", 0, "")
+	flags.IntVar(&conf.maxTreeDepth, "max_tree_depth", 0, "")
+	flags.BoolVar(&conf.normalizeNames, "normalize_names", false, "")
+	flags.BoolVar(&conf.foldNameCase, "fold_name_case", false, "")
+	flags.BoolVar(&conf.inheritPerms, "inherit_perms", true, "")
+	flags.BoolVar(&conf.allowPrehashedLogin, "allow_prehashed_login", true, "")
+	flags.BoolVar(&conf.sessionCookie, "session_cookie", false, "")
+	flags.BoolVar(&conf.obscureNotFound, "obscure_not_found", false, "")
+	flags.StringVar(&conf.deletedUserFiles, "deleted_user_files", deletedUserKeep, "")
+	flags.IntVar(&conf.usernamePolicy.minLen, "username_min_len", defaultUsernamePolicy.minLen, "")
+	flags.IntVar(&conf.usernamePolicy.maxLen, "username_max_len", defaultUsernamePolicy.maxLen, "")
+	var reservedUsernames string
+	flags.StringVar(&reservedUsernames, "reserved_usernames", strings.Join(defaultUsernamePolicy.reserved, ","), "")
 	var rootIDString string
 	flags.StringVar(&rootIDString, "root_id", "", "")
+	flags.StringVar(&conf.routePrefix, "route_prefix", "", "")
+	flags.DurationVar(&conf.cacheMaxAge, "cache_max_age", 0, "")
+	flags.DurationVar(&conf.handlerTimeout, "handler_timeout", 0, "")
+	flags.IntVar(&conf.importMaxEntries, "import_max_entries", 100000, "")
+	flags.DurationVar(&conf.importTimeout, "import_timeout", 10*time.Minute, "")
+	flags.DurationVar(&conf.revokedReapInterval, "revoked_reap_interval", time.Hour, "")
+	var dirPermString, filePermString string
+	flags.StringVar(&dirPermString, "dir_perm", "0750", "")
+	flags.StringVar(&filePermString, "file_perm", "0600", "")
 
 	err = flags.Parse(args)
 	if err != nil {
@@ -85,22 +242,126 @@ func getConfig(args []string, env func(string) string) (conf config, err error)
 		return
 	}
 
+	if conf.configFile != "" {
+		var fileArgs []string
+		fileArgs, err = readConfigFile(conf.configFile)
+		if err != nil {
+			err = fmt.Errorf("config file: %w", err)
+			return
+		}
+		// parsed again so that the command line wins over the file
+		err = flags.Parse(append(fileArgs, args...))
+		if err != nil {
+			err = fmt.Errorf("config file flags parse: %w", err)
+			return
+		}
+	}
+
 	if !filepath.IsAbs(conf.dataDir) {
 		err = fmt.Errorf("data dir must be absolute path (is %#v)", conf.dataDir)
 		return
 	}
 
+	if !validHost(conf.host) {
+		err = fmt.Errorf("host must be empty, an IP address or a hostname (is %#v)", conf.host)
+		return
+	}
+	if !validPort(conf.port) {
+		err = fmt.Errorf("port must be a number from 0 to 65535 or a service name (is %#v)", conf.port)
+		return
+	}
+
+	conf.routePrefix = strings.TrimSuffix(conf.routePrefix, "/")
+	if conf.routePrefix != "" && !strings.HasPrefix(conf.routePrefix, "/") {
+		err = fmt.Errorf("route prefix must start with a slash (is %#v)", conf.routePrefix)
+		return
+	}
+
+	if conf.usernamePolicy.minLen < 1 || conf.usernamePolicy.maxLen < conf.usernamePolicy.minLen {
+		err = fmt.Errorf("username length bounds must satisfy 1 <= min <= max (are %d and %d)",
+			conf.usernamePolicy.minLen, conf.usernamePolicy.maxLen)
+		return
+	}
+
+	switch conf.deletedUserFiles {
+	case deletedUserKeep, deletedUserStrip, deletedUserReassign:
+	default:
+		err = fmt.Errorf("deleted user files must be keep, strip or reassign (is %#v)", conf.deletedUserFiles)
+		return
+	}
+
+	switch conf.accessLogFormat {
+	case accessLogJSON, accessLogCLF:
+	default:
+		err = fmt.Errorf("access log format must be json or clf (is %#v)", conf.accessLogFormat)
+		return
+	}
+
+	for _, name := range strings.Split(reservedUsernames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			conf.usernamePolicy.reserved = append(conf.usernamePolicy.reserved, name)
+		}
+	}
+
 	conf.secret = env("ARCHIIV_SECRET")
 
-	conf.rootID, err = id.Parse(rootIDString)
+	// without the flag the fs reads the root ID from the data dir
+	if rootIDString != "" {
+		conf.rootID, err = id.Parse(rootIDString)
+		if err != nil {
+			err = fmt.Errorf("id parse: %w", err)
+			return
+		}
+	}
+
+	conf.dirPerm, err = parsePerm(dirPermString, 0700)
+	if err != nil {
+		err = fmt.Errorf("dir perm: %w", err)
+		return
+	}
+
+	conf.filePerm, err = parsePerm(filePermString, 0600)
 	if err != nil {
-		err = fmt.Errorf("id parse: %w", err)
+		err = fmt.Errorf("file perm: %w", err)
+		return
+	}
+
+	if conf.maxUploadBytes < 0 {
+		err = fmt.Errorf("max upload bytes can't be negative (is %d)", conf.maxUploadBytes)
 		return
 	}
 
+	if conf.maxChildren < 0 {
+		err = fmt.Errorf("max children can't be negative (is %d)", conf.maxChildren)
+		return
+	}
+
+	conf.args = args
+	conf.live = new(atomic.Pointer[tunables])
+	conf.live.Store(conf.tunables())
 	return
 }
 
+// parsePerm parses an octal permission string. The server itself has to keep
+// the `required` owner bits, otherwise it couldn't use its own files
+func parsePerm(s string, required os.FileMode) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("not an octal number (is %#v)", s)
+	}
+
+	if perm > 0777 {
+		return 0, fmt.Errorf("out of range (is %#o)", perm)
+	}
+
+	mode := os.FileMode(perm)
+	if mode&required != required {
+		return 0, fmt.Errorf("missing owner bits %#o (is %#o)", required, perm)
+	}
+
+	return mode, nil
+}
+
 func greet(log *slog.Logger) {
 	hour := time.Now().Hour()
 	switch {
@@ -117,10 +378,48 @@ func goodbye(log *slog.Logger) {
 	log.Info("Goodbye")
 }
 
-func run(log *slog.Logger, srv http.Handler, conf config) error {
-	greet(log)
-	defer goodbye(log)
+// validHost checks the host to listen on. Empty means every interface, IPv6
+// addresses go without the brackets
+func validHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return true
+	}
+
+	host = strings.TrimSuffix(host, ".")
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
 
+// validPort checks the port to listen on, a number or a name from the
+// services database
+func validPort(port string) bool {
+	if n, err := strconv.Atoi(port); err == nil {
+		return n >= 0 && n <= 65535
+	}
+	if port == "" {
+		// the lookup takes it as 0
+		return false
+	}
+	_, err := net.LookupPort("tcp", port)
+	return err == nil
+}
+
+func newHTTPServer(srv http.Handler, conf config) *http.Server {
 	httpServer := &http.Server{
 		Addr:    net.JoinHostPort(conf.host, conf.port),
 		Handler: srv,
@@ -128,6 +427,26 @@ func run(log *slog.Logger, srv http.Handler, conf config) error {
 		ReadHeaderTimeout: 1 * time.Second,
 	}
 
+	// cleartext HTTP/2 for proxies that multiplex many small requests over
+	// one connection, HTTP/1.1 keeps working next to it
+	if conf.h2c {
+		httpServer.Protocols = new(http.Protocols)
+		httpServer.Protocols.SetHTTP1(true)
+		httpServer.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return httpServer
+}
+
+func run(log *slog.Logger, srv http.Handler, conf config) error {
+	greet(log)
+	defer goodbye(log)
+
+	httpServer := newHTTPServer(srv, conf)
+
+	stopReaping := reapRevokedTokens(log, conf.revoked, conf.revokedReapInterval)
+	defer stopReaping()
+
 	log.Info("listening", "address", httpServer.Addr)
 	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Error("listening and serving", "error", err)
@@ -2,14 +2,35 @@ package main
 
 import (
 	"archiiv/fs"
+	"archiiv/id"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -21,20 +42,27 @@ func newTestServer(t *testing.T) http.Handler {
 }
 
 func newTestServerWithUsers(t *testing.T, users map[string][64]byte) http.Handler {
+	srv, _ := newTestServerWithRoot(t, users)
+	return srv
+}
+
+func newTestServerWithRoot(t *testing.T, users map[string][64]byte, args ...string) (http.Handler, id.ID) {
+	return newTestServerWithSecret(t, users, generateSecret(), args...)
+}
+
+func newTestServerWithSecret(t *testing.T, users map[string][64]byte, secret string, args ...string) (http.Handler, id.ID) {
 	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
 
 	dir := t.TempDir()
-	rootID, err := fs.InitFsDir(dir, users)
+	rootID, err := fs.InitFsDir(dir, users, fs.Options{})
 	if err != nil {
 		t.Error(err)
 	}
 
-	secret := generateSecret()
-
-	srv, _, err := createServer(log, []string{
+	srv, conf, err := createServer(log, append([]string{
 		"--data_dir", dir,
 		"--root_id", rootID.String(),
-	}, func(s string) string {
+	}, args...), func(s string) string {
 		if s == "ARCHIIV_SECRET" {
 			return secret
 		}
@@ -44,8 +72,9 @@ func newTestServerWithUsers(t *testing.T, users map[string][64]byte) http.Handle
 	if err != nil {
 		t.Fatalf("newTestServer: %v", err)
 	}
+	t.Cleanup(func() { conf.files.Close() })
 
-	return srv
+	return srv, rootID
 }
 
 func decodeResponse[T any](t *testing.T, r *http.Response) (v T) {
@@ -131,6 +160,7 @@ func loginHelper(t *testing.T, srv http.Handler, username, pwd string) string {
 		Data struct {
 			Token      string    `json:"token"`
 			ExpireDate time.Time `json:"expireDate"`
+			Roles      []string  `json:"roles"`
 		} `json:"data"`
 	}
 
@@ -172,6 +202,7 @@ func TestLogin(t *testing.T) {
 		Data struct {
 			Token      string    `json:"token"`
 			ExpireDate time.Time `json:"expireDate"`
+			Roles      []string  `json:"roles"`
 		} `json:"data"`
 	}](t, res)
 	assert.Equal(t, true, response.Ok)
@@ -225,3 +256,3441 @@ func TestDelete(t *testing.T) {
 	assert.Equal(t, http.StatusOK, res.StatusCode)
 	assert.Equal(t, "{\"ok\":true}\n", getBody(t, res))
 }
+
+func TestDeleteUserFiles(t *testing.T) {
+	t.Parallel()
+	all := fs.PermOwner | fs.PermRead | fs.PermWrite
+
+	for _, mode := range []string{"keep", "strip", "reassign"} {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+			srv, root := newTestServerWithRoot(t, map[string][64]byte{
+				"prokop": hashPassword("catboy123"),
+				"marek":  hashPassword("heslo"),
+				"admin":  hashPassword("admin"),
+			}, "--deleted_user_files", mode)
+			token := loginHelper(t, srv, "prokop", "catboy123")
+			marekToken := loginHelper(t, srv, "marek", "heslo")
+			adminToken := loginHelper(t, srv, "admin", "admin")
+
+			shared := touchHelper(t, srv, token, root, "shared")
+			fm := readMetaHelper(t, srv, token, shared)
+			fm.Perms["marek"] = fs.PermRead | fs.PermWrite
+			res := hitPost(t, srv, "/api/v1/upload/"+shared.String()+"/meta", token, fm)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+
+			owned := touchHelper(t, srv, marekToken, root, "owned")
+
+			// a new marek must not get what the deleted one would have
+			sharedDir := mkdirHelper(t, srv, token, root, "shared-dir")
+			res = hitPost(t, srv, "/api/v1/defaultperms/"+sharedDir.String(), token, map[string]uint8{"marek": fs.PermRead})
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+
+			res = hitPost(t, srv, "/api/v1/delete/marek", adminToken, nil)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+
+			defaults := readMetaHelper(t, srv, token, sharedDir).DefaultChildPerms
+			switch mode {
+			case "keep":
+				assert.Equal(t, map[string]uint8{"marek": fs.PermRead}, defaults)
+			case "strip":
+				assert.Empty(t, defaults)
+			case "reassign":
+				assert.Equal(t, map[string]uint8{"admin": fs.PermRead}, defaults)
+			}
+
+			sharedPerms := readMetaHelper(t, srv, token, shared).Perms
+			switch mode {
+			case "keep":
+				assert.Equal(t, map[string]uint8{"prokop": all, "marek": fs.PermRead | fs.PermWrite}, sharedPerms)
+			case "strip":
+				assert.Equal(t, map[string]uint8{"prokop": all}, sharedPerms)
+			case "reassign":
+				assert.Equal(t, map[string]uint8{"prokop": all, "admin": fs.PermRead | fs.PermWrite}, sharedPerms)
+				fm := readMetaHelper(t, srv, adminToken, owned)
+				assert.Equal(t, "admin", fm.CreatedBy)
+				assert.Equal(t, map[string]uint8{"admin": all}, fm.Perms)
+			}
+
+			res = hitPost(t, srv, "/api/v1/delete/marek", adminToken, nil)
+			expectFail(t, res, http.StatusNotFound, "username not found")
+		})
+	}
+
+	_, _, err := createServer(slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		[]string{"--data_dir", t.TempDir(), "--deleted_user_files", "burn"}, func(string) string { return "" })
+	assert.ErrorContains(t, err, "deleted user files must be keep, strip or reassign")
+}
+
+func TestOwned(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+		"admin":  hashPassword("admin"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+	adminToken := loginHelper(t, srv, "admin", "admin")
+
+	dir := mkdirHelper(t, srv, token, root, "dir")
+	file := touchHelper(t, srv, token, dir, "file")
+	marekFile := touchHelper(t, srv, marekToken, root, "file")
+
+	owned := func(username string) []id.ID {
+		res := hitGet(srv, "/api/v1/owned/"+username, adminToken)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return decodeResponse[struct {
+			Ok   bool    `json:"ok"`
+			Data []id.ID `json:"data"`
+		}](t, res).Data
+	}
+
+	assert.ElementsMatch(t, []id.ID{dir, file}, owned("prokop"))
+	assert.Equal(t, []id.ID{marekFile}, owned("marek"))
+	assert.Equal(t, []id.ID{}, owned("anicka"))
+
+	res := hitGet(srv, "/api/v1/owned/prokop", token)
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+}
+
+// cancelOnWrite cancels the request once the response has started
+type cancelOnWrite struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w cancelOnWrite) Write(b []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w cancelOnWrite) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestOwnedFailsMidStream(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	root, err := fs.InitFsDir(dir, nil, fs.Options{})
+	assert.NoError(t, err)
+	files, err := fs.NewFs(root, filepath.Join(dir, "files"), fs.Options{})
+	assert.NoError(t, err)
+	t.Cleanup(func() { files.Close() })
+
+	for _, name := range []string{"a", "b", "c"} {
+		u, err := files.Touch(root, name)
+		assert.NoError(t, err)
+		assert.NoError(t, files.InitFileMeta(root, u, "prokop", false))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/owned/prokop", nil).WithContext(ctx)
+	req.SetPathValue("username", "prokop")
+	w := cancelOnWrite{httptest.NewRecorder(), cancel}
+	handleOwned(files, slog.New(slog.NewJSONHandler(io.Discard, nil))).ServeHTTP(w, req)
+
+	// the status went out with the first record, the body still tells
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res struct {
+		Ok    bool    `json:"ok"`
+		Data  []id.ID `json:"data"`
+		Error string  `json:"error"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.False(t, res.Ok)
+	assert.Len(t, res.Data, 1)
+	assert.Equal(t, "owned: context canceled", res.Error)
+}
+
+func touchHelper(t *testing.T, srv http.Handler, token string, parent id.ID, name string) id.ID {
+	res := hitPost(t, srv, "/api/v1/touch/"+parent.String()+"/"+name, token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	b := decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			NewFileID id.ID `json:"new_file_id"`
+		} `json:"data"`
+	}](t, res)
+
+	return b.Data.NewFileID
+}
+
+func TestConcurrentUploadsDontInterleave(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "race")
+	target := "/api/v1/upload/" + file.String() + "/data"
+
+	inputs := []string{
+		strings.Repeat("a", 1<<20),
+		strings.Repeat("b", 1<<20),
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		for _, in := range inputs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res := hit(srv, http.MethodPost, target, token, strings.NewReader(in))
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+			}()
+		}
+	}
+	wg.Wait()
+
+	res := hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, inputs, getBody(t, res))
+}
+
+func TestConfigPerms(t *testing.T) {
+	t.Parallel()
+	rootID := id.New().String()
+	env := func(string) string { return "" }
+
+	conf, err := getConfig([]string{"--data_dir", "/tmp", "--root_id", rootID, "--dir_perm", "700", "--file_perm", "0640"}, env)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), conf.dirPerm)
+	assert.Equal(t, os.FileMode(0640), conf.filePerm)
+
+	for _, bad := range []string{"abc", "0899", "01777", "0400", "0"} {
+		_, err = getConfig([]string{"--data_dir", "/tmp", "--root_id", rootID, "--file_perm", bad}, env)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestConfigMaxChildren(t *testing.T) {
+	t.Parallel()
+	rootID := id.New().String()
+	env := func(string) string { return "" }
+
+	conf, err := getConfig([]string{"--data_dir", "/tmp", "--root_id", rootID, "--max_children", "0"}, env)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conf.maxChildren)
+
+	_, err = getConfig([]string{"--data_dir", "/tmp", "--root_id", rootID, "--max_children", "-1"}, env)
+	assert.EqualError(t, err, "max children can't be negative (is -1)")
+}
+
+func TestLoginPlaintextPassword(t *testing.T) {
+	t.Parallel()
+	users := map[string][64]byte{"prokop": hashPassword("catboy123")}
+	srv := newTestServerWithUsers(t, users)
+
+	type plaintextLoginRequest struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	expectFail(t, hitPost(t, srv, "/api/v1/login", "", plaintextLoginRequest{Username: "prokop", Password: "eek"}), http.StatusForbidden, "wrong name or password")
+
+	plainToken := decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Token      string    `json:"token"`
+			ExpireDate time.Time `json:"expireDate"`
+			Roles      []string  `json:"roles"`
+		} `json:"data"`
+	}](t, hitPost(t, srv, "/api/v1/login", "", plaintextLoginRequest{Username: "prokop", Password: "catboy123"})).Data.Token
+	hashedToken := loginHelper(t, srv, "prokop", "catboy123")
+
+	for _, token := range []string{plainToken, hashedToken} {
+		expectStringLooksLikeToken(t, token)
+		res := hitGet(srv, "/api/v1/whoami", token)
+		assert.Equal(t, "{\"ok\":true,\"data\":{\"name\":\"prokop\"}}\n", getBody(t, res))
+	}
+
+	srv, _ = newTestServerWithRoot(t, users, "--allow_prehashed_login=false")
+	expectFail(t, hitPost(t, srv, "/api/v1/login", "", loginRequest{Username: "prokop", Password: hashPassword("catboy123")}), http.StatusBadRequest, "pre-hashed passwords are not accepted")
+	res := hitPost(t, srv, "/api/v1/login", "", plaintextLoginRequest{Username: "prokop", Password: "catboy123"})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestChunkedUpload(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "chunked")
+	target := "/api/v1/upload/" + file.String() + "/data"
+
+	res := hit(srv, http.MethodHead, target, token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "0", res.Header.Get("Upload-Offset"))
+
+	// second chunk arrives first
+	res = hit(srv, http.MethodPost, target+"?offset=6", token, strings.NewReader("brave "))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hit(srv, http.MethodHead, target, token, nil)
+	assert.Equal(t, "12", res.Header.Get("Upload-Offset"))
+
+	res = hit(srv, http.MethodPost, target+"?offset=0", token, strings.NewReader("hello "))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hit(srv, http.MethodPost, target+"?offset=12", token, strings.NewReader("world"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)
+	assert.Equal(t, "hello brave world", getBody(t, res))
+
+	res = hit(srv, http.MethodPost, target+"?offset=-1", token, strings.NewReader("x"))
+	expectFail(t, res, http.StatusBadRequest, "invalid offset")
+}
+
+func TestConcurrentChunkedUpload(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "chunked")
+	target := "/api/v1/upload/" + file.String() + "/data"
+
+	const chunkSize = 1 << 12
+	chunks := "abcdefghijklmnop"
+
+	var wg sync.WaitGroup
+	for i, c := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			offset := strconv.Itoa(i * chunkSize)
+			res := hit(srv, http.MethodPost, target+"?offset="+offset, token, strings.NewReader(strings.Repeat(string(c), chunkSize)))
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+		}()
+	}
+	wg.Wait()
+
+	var want strings.Builder
+	for _, c := range chunks {
+		want.WriteString(strings.Repeat(string(c), chunkSize))
+	}
+
+	res := hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)
+	assert.Equal(t, want.String(), getBody(t, res))
+}
+
+func TestPanicRecovery(t *testing.T) {
+	t.Parallel()
+	var logs bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	srv := recoverPanics(log, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("oh no")
+	}))
+
+	res := hitGet(srv, "/boom", "")
+	expectFail(t, res, http.StatusInternalServerError, "500 internal server error")
+	assert.Contains(t, logs.String(), `"panic":"oh no"`)
+	assert.Contains(t, logs.String(), `"stack":`)
+}
+
+func forgeToken(t *testing.T, secret string, payload tokenPayload) string {
+	payloadBytes, err := payloadToBytes(payload)
+	assert.NoError(t, err)
+
+	priv, err := secretToKeys(secret)
+	assert.NoError(t, err)
+
+	signature, err := priv.Sign(nil, payloadBytes, &ed25519.Options{})
+	assert.NoError(t, err)
+
+	tokenBytes, err := gobEncode(fullToken{Data: payload, Sign: signature})
+	assert.NoError(t, err)
+
+	return base64.URLEncoding.EncodeToString(tokenBytes)
+}
+
+func TestExpiredToken(t *testing.T) {
+	t.Parallel()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	secret := generateSecret()
+
+	token := forgeToken(t, secret, tokenPayload{
+		Username:  "prokop",
+		Timestamp: time.Now().Add(-tokenTTL - time.Second),
+	})
+
+	res := hitGet(requireLogin(secret, nil, log, handleWhoami(0, log)), "/api/v1/whoami", token)
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+
+	// without requireLogin there is no user in the context
+	res = hitGet(handleWhoami(0, log), "/api/v1/whoami", token)
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+
+	res = hitPost(t, adminOnly(secret, nil, log, http.NotFoundHandler()), "/", forgeToken(t, secret, tokenPayload{
+		Username:  "admin",
+		Timestamp: time.Now().Add(-tokenTTL - time.Second),
+	}), nil)
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+}
+
+func TestUserInContext(t *testing.T) {
+	t.Parallel()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	secret := generateSecret()
+
+	var seen []string
+	probe := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := userFromContext(r)
+		assert.True(t, ok)
+		seen = append(seen, username)
+	})
+
+	for _, username := range []string{"prokop", "matěj", adminUsername} {
+		token := forgeToken(t, secret, tokenPayload{Username: username, Timestamp: time.Now()})
+		res := hitGet(requireLogin(secret, nil, log, probe), "/", token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	assert.Equal(t, []string{"prokop", "matěj", adminUsername}, seen)
+
+	token := forgeToken(t, secret, tokenPayload{Username: adminUsername, Timestamp: time.Now()})
+	res := hitGet(adminOnly(secret, nil, log, probe), "/", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, adminUsername, seen[len(seen)-1])
+
+	_, ok := userFromContext(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.False(t, ok)
+}
+
+func TestVerifyToken(t *testing.T) {
+	t.Parallel()
+	secret := generateSecret()
+	srv, _ := newTestServerWithSecret(t, map[string][64]byte{"prokop": hashPassword("catboy123")}, secret)
+
+	type verifyResponse struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Valid     bool       `json:"valid"`
+			Username  string     `json:"username"`
+			ExpiresAt *time.Time `json:"expiresAt"`
+		} `json:"data"`
+	}
+
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	res := hitGet(srv, "/api/v1/token/verify", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	v := decodeResponse[verifyResponse](t, res)
+	assert.True(t, v.Data.Valid)
+	assert.Equal(t, "prokop", v.Data.Username)
+	if assert.NotNil(t, v.Data.ExpiresAt) {
+		assert.WithinDuration(t, time.Now().Add(tokenTTL), *v.Data.ExpiresAt, time.Minute)
+	}
+
+	expired := forgeToken(t, secret, tokenPayload{
+		Username:  "prokop",
+		Timestamp: time.Now().Add(-tokenTTL - time.Second),
+	})
+
+	for _, token := range []string{expired, "garbage", ""} {
+		res = hitGet(srv, "/api/v1/token/verify", token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "{\"ok\":true,\"data\":{\"valid\":false}}\n", getBody(t, res))
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	t.Parallel()
+	srv := newTestServerWithUsers(t, map[string][64]byte{"matuush": hashPassword("kadit")})
+
+	token := loginHelper(t, srv, "matuush", "kadit")
+
+	for _, header := range []string{token, "Bearer " + token, "bearer " + token, "BEARER " + token} {
+		res := hitGet(srv, "/api/v1/whoami", header)
+		assert.Equal(t, http.StatusOK, res.StatusCode, header)
+		assert.Equal(t, "{\"ok\":true,\"data\":{\"name\":\"matuush\"}}\n", getBody(t, res))
+	}
+
+	res := hitGet(srv, "/api/v1/whoami", "Basic "+token)
+	expectFail(t, res, http.StatusUnauthorized, "401 unauthorized")
+}
+
+func TestCookieSession(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServerWithRoot(t, map[string][64]byte{"matuush": hashPassword("kadit")}, "--session_cookie")
+
+	res := hitPost(t, srv, "/api/v1/login", "", loginRequest{Username: "matuush", Password: hashPassword("kadit")})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == sessionCookieName {
+			cookie = c
+		}
+	}
+	if !assert.NotNil(t, cookie) {
+		return
+	}
+	assert.True(t, cookie.HttpOnly)
+	assert.True(t, cookie.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/whoami", nil)
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	res = w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "{\"ok\":true,\"data\":{\"name\":\"matuush\"}}\n", getBody(t, res))
+
+	// without the flag no cookie is set
+	srv = newTestServerWithUsers(t, map[string][64]byte{"matuush": hashPassword("kadit")})
+	res = hitPost(t, srv, "/api/v1/login", "", loginRequest{Username: "matuush", Password: hashPassword("kadit")})
+	assert.Empty(t, res.Cookies())
+}
+
+func TestRoutePrefix(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServerWithRoot(t, map[string][64]byte{"matuush": hashPassword("kadit")}, "--route_prefix", "/archiiv/")
+
+	res := hitPost(t, srv, "/archiiv/api/v1/login", "", loginRequest{Username: "matuush", Password: hashPassword("kadit")})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	token := decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Token      string    `json:"token"`
+			ExpireDate time.Time `json:"expireDate"`
+			Roles      []string  `json:"roles"`
+		} `json:"data"`
+	}](t, res).Data.Token
+
+	res = hitGet(srv, "/archiiv/api/v1/whoami", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "{\"ok\":true,\"data\":{\"name\":\"matuush\"}}\n", getBody(t, res))
+
+	res = hitGet(srv, "/api/v1/whoami", token)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	_, err := getConfig([]string{"--data_dir", "/tmp", "--root_id", id.New().String(), "--route_prefix", "archiiv"}, func(string) string { return "" })
+	assert.Error(t, err)
+}
+
+func TestCatContentDisposition(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	plain := touchHelper(t, srv, token, root, "report.pdf")
+	quoted := touchHelper(t, srv, token, root, url.PathEscape(`my "best" photo.jpg`))
+
+	for _, file := range []id.ID{plain, quoted} {
+		res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("content"))
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	res := hitGet(srv, "/api/v1/cat/"+plain.String()+"/data", token)
+	assert.Equal(t, `attachment; filename=report.pdf`, res.Header.Get("Content-Disposition"))
+	assert.Equal(t, "content", getBody(t, res))
+
+	res = hitGet(srv, "/api/v1/cat/"+plain.String()+"/data?inline=true", token)
+	assert.Equal(t, `inline; filename=report.pdf`, res.Header.Get("Content-Disposition"))
+
+	res = hitGet(srv, "/api/v1/cat/"+quoted.String()+"/data", token)
+	assert.Equal(t, `attachment; filename="my \"best\" photo.jpg"`, res.Header.Get("Content-Disposition"))
+
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
+	assert.NoError(t, err)
+	assert.Equal(t, `my "best" photo.jpg`, params["filename"])
+}
+
+func TestMoveSection(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	src := touchHelper(t, srv, token, root, "src")
+	dst := touchHelper(t, srv, token, root, "dst")
+
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+src.String()+"/thumb", token, strings.NewReader("tiny picture"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/movesection/"+src.String()+"/thumb/"+dst.String()+"/preview", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitGet(srv, "/api/v1/cat/"+dst.String()+"/preview", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "tiny picture", getBody(t, res))
+
+	res = hitGet(srv, "/api/v1/cat/"+src.String()+"/thumb", token)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/movesection/"+dst.String()+"/preview/"+src.String()+"/bad.name", token, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// the meta can't be moved, neither in nor out
+	res = hitPost(t, srv, "/api/v1/movesection/"+dst.String()+"/preview/"+src.String()+"/meta", token, nil)
+	expectFail(t, res, http.StatusBadRequest, "move section: invalid name: meta section can't be moved")
+	res = hitPost(t, srv, "/api/v1/movesection/"+src.String()+"/meta/"+dst.String()+"/stolen", token, nil)
+	expectFail(t, res, http.StatusBadRequest, "move section: invalid name: meta section can't be moved")
+
+	res = hitPost(t, srv, "/api/v1/movesection/"+src.String()+"/missing/"+dst.String()+"/other", token, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestMoveSectionPerms(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	victim := touchHelper(t, srv, token, root, "victim")
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+victim.String()+"/data", token, strings.NewReader("secret"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	own := touchHelper(t, srv, marekToken, root, "own")
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+own.String()+"/data", marekToken, strings.NewReader("mine"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// neither out of someone else's record nor into it
+	res = hitPost(t, srv, "/api/v1/movesection/"+victim.String()+"/data/"+own.String()+"/stolen", marekToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hitPost(t, srv, "/api/v1/movesection/"+own.String()+"/data/"+victim.String()+"/planted", marekToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	res = hitGet(srv, "/api/v1/cat/"+victim.String()+"/data", token)
+	assert.Equal(t, "secret", getBody(t, res))
+	res = hitGet(srv, "/api/v1/cat/"+own.String()+"/data", marekToken)
+	assert.Equal(t, "mine", getBody(t, res))
+}
+
+func TestFsErrorStatus(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	dir := mkdirHelper(t, srv, token, root, "dir")
+	sub := mkdirHelper(t, srv, token, dir, "sub")
+	file := touchHelper(t, srv, token, dir, "file")
+	missing := id.New().String()
+
+	post := func(target string) *http.Response {
+		return hitPost(t, srv, target, token, nil)
+	}
+	for _, tc := range []struct {
+		name   string
+		res    *http.Response
+		status int
+	}{
+		{"ls missing", hitGet(srv, "/api/v1/ls/"+missing, token), http.StatusNotFound},
+		{"cat missing section", hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token), http.StatusNotFound},
+		{"cat bad section", hitGet(srv, "/api/v1/cat/"+file.String()+"/bad.name", token), http.StatusBadRequest},
+		{"touch into missing", post("/api/v1/touch/" + missing + "/x"), http.StatusNotFound},
+		{"touch into file", post("/api/v1/touch/" + file.String() + "/x"), http.StatusBadRequest},
+		{"mkdir into missing", post("/api/v1/mkdir/" + missing + "/x"), http.StatusNotFound},
+		{"mkdir into file", post("/api/v1/mkdir/" + file.String() + "/x"), http.StatusBadRequest},
+		{"mount missing", post("/api/v1/mount/" + dir.String() + "/" + missing), http.StatusNotFound},
+		{"mount twice", post("/api/v1/mount/" + dir.String() + "/" + file.String()), http.StatusConflict},
+		{"mount cycle", post("/api/v1/mount/" + sub.String() + "/" + dir.String()), http.StatusBadRequest},
+		{"unmount not mounted", post("/api/v1/unmount/" + sub.String() + "/" + file.String()), http.StatusNotFound},
+		{"upload bad section", hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/bad.name", token, strings.NewReader("x")), http.StatusBadRequest},
+	} {
+		assert.Equal(t, tc.status, tc.res.StatusCode, tc.name)
+	}
+}
+
+func mkdirHelper(t *testing.T, srv http.Handler, token string, parent id.ID, name string) id.ID {
+	res := hitPost(t, srv, "/api/v1/mkdir/"+parent.String()+"/"+name, token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	b := decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			NewDirID id.ID `json:"new_dir_id"`
+		} `json:"data"`
+	}](t, res)
+
+	return b.Data.NewDirID
+}
+
+func lsHelper(t *testing.T, srv http.Handler, token, target string) []id.ID {
+	res := hitGet(srv, target, token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	return decodeResponse[struct {
+		Ok   bool    `json:"ok"`
+		Data []id.ID `json:"data"`
+	}](t, res).Data
+}
+
+func TestLsTypeFilter(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	parent := mkdirHelper(t, srv, token, root, "mixed")
+	dir1 := mkdirHelper(t, srv, token, parent, "dir1")
+	file1 := touchHelper(t, srv, token, parent, "file1")
+	dir2 := mkdirHelper(t, srv, token, parent, "dir2")
+	file2 := touchHelper(t, srv, token, parent, "file2")
+
+	target := "/api/v1/ls/" + parent.String()
+	assert.ElementsMatch(t, []id.ID{dir1, file1, dir2, file2}, lsHelper(t, srv, token, target))
+	assert.ElementsMatch(t, []id.ID{dir1, dir2}, lsHelper(t, srv, token, target+"?type=dir"))
+	assert.ElementsMatch(t, []id.ID{file1, file2}, lsHelper(t, srv, token, target+"?type=file"))
+
+	empty := mkdirHelper(t, srv, token, parent, "empty")
+	assert.Empty(t, lsHelper(t, srv, token, "/api/v1/ls/"+empty.String()+"?type=dir"))
+
+	expectFail(t, hitGet(srv, target+"?type=symlink", token), http.StatusBadRequest, "type must be dir or file")
+}
+
+type lsPageResponse struct {
+	Children []id.ID `json:"children"`
+	Next     string  `json:"next"`
+}
+
+func lsPageHelper(t *testing.T, srv http.Handler, token, target string) lsPageResponse {
+	res := hitGet(srv, target, token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	return decodeResponse[struct {
+		Ok   bool           `json:"ok"`
+		Data lsPageResponse `json:"data"`
+	}](t, res).Data
+}
+
+func TestLsCursor(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	parent := mkdirHelper(t, srv, token, root, "paged")
+	var want []id.ID
+	for i := range 7 {
+		want = append(want, touchHelper(t, srv, token, parent, fmt.Sprintf("file%d", i)))
+	}
+	target := "/api/v1/ls/" + parent.String()
+
+	// the pages are in the order of ID.Compare
+	first := lsPageHelper(t, srv, token, target+"?limit=3")
+	if !assert.Len(t, first.Children, 3) || !assert.NotEmpty(t, first.Next) {
+		return
+	}
+	assert.True(t, slices.IsSortedFunc(first.Children, id.ID.Compare))
+
+	// a child added and one removed between the pages move neither the
+	// rest of the listing nor what was already seen. The removed one is
+	// the child the cursor points at
+	added := touchHelper(t, srv, token, parent, "added")
+	removed := first.Children[2]
+	res := hitPost(t, srv, "/api/v1/unmount/"+parent.String()+"/"+removed.String(), token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	seen := slices.Clone(first.Children)
+	next := first.Next
+	for next != "" {
+		page := lsPageHelper(t, srv, token, target+"?limit=3&cursor="+next)
+		assert.LessOrEqual(t, len(page.Children), 3)
+		seen = append(seen, page.Children...)
+		next = page.Next
+	}
+
+	for _, u := range want {
+		assert.Contains(t, seen, u)
+	}
+	assert.Len(t, seen, len(slices.Compact(slices.SortedFunc(slices.Values(seen), id.ID.Compare))), "duplicates")
+	// the new child shows up if it sorts after the first page
+	if added.Compare(first.Children[2]) > 0 {
+		assert.Contains(t, seen, added)
+	} else {
+		assert.NotContains(t, seen, added)
+	}
+
+	// without a limit the rest is one page
+	page := lsPageHelper(t, srv, token, target+"?cursor="+first.Next)
+	assert.Empty(t, page.Next)
+	assert.Equal(t, seen[3:], page.Children)
+
+	expectFail(t, hitGet(srv, target+"?cursor=nonsense", token), http.StatusBadRequest, "invalid cursor")
+	expectFail(t, hitGet(srv, target+"?limit=0", token), http.StatusBadRequest, "limit must be a number from 1 to 1000")
+	expectFail(t, hitGet(srv, target+"?limit=1001", token), http.StatusBadRequest, "limit must be a number from 1 to 1000")
+
+	// without them it is the plain listing
+	assert.Len(t, lsHelper(t, srv, token, target), 7)
+}
+
+func readMetaHelper(t *testing.T, srv http.Handler, token string, file id.ID) fs.FileMeta {
+	res := hitGet(srv, "/api/v1/cat/"+file.String()+"/meta", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var fm fs.FileMeta
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&fm))
+	return fm
+}
+
+// grantHelper gives the user the perm bits on the file through its meta
+func grantHelper(t *testing.T, srv http.Handler, token string, file id.ID, user string, perm uint8) {
+	fm := readMetaHelper(t, srv, token, file)
+	fm.Perms[user] |= perm
+	res := hitPost(t, srv, "/api/v1/upload/"+file.String()+"/meta", token, fm)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestPermsInheritance(t *testing.T) {
+	t.Parallel()
+	users := map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	}
+
+	for _, inherit := range []bool{true, false} {
+		srv, root := newTestServerWithRoot(t, users, fmt.Sprintf("--inherit_perms=%v", inherit))
+		token := loginHelper(t, srv, "prokop", "catboy123")
+
+		shared := mkdirHelper(t, srv, token, root, "shared")
+		fm := readMetaHelper(t, srv, token, shared)
+		assert.Equal(t, "prokop", fm.CreatedBy)
+		assert.Equal(t, map[string]uint8{"prokop": fs.PermOwner | fs.PermRead | fs.PermWrite}, fm.Perms)
+
+		fm.Perms["marek"] = fs.PermRead
+		res := hitPost(t, srv, "/api/v1/upload/"+shared.String()+"/meta", token, fm)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		file := touchHelper(t, srv, token, shared, "file")
+		fm = readMetaHelper(t, srv, token, file)
+		assert.Equal(t, file, fm.Id)
+		assert.Equal(t, fs.PermOwner|fs.PermRead|fs.PermWrite, fm.Perms["prokop"])
+		if inherit {
+			assert.Equal(t, fs.PermRead, fm.Perms["marek"])
+		} else {
+			assert.NotContains(t, fm.Perms, "marek")
+		}
+	}
+}
+
+func TestLsETag(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	dir := mkdirHelper(t, srv, token, root, "dir")
+	touchHelper(t, srv, token, dir, "first")
+
+	target := "/api/v1/ls/" + dir.String()
+	res := hitGet(srv, target, token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	conditionalLs := func(target, etag string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", token)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	res = conditionalLs(target, etag)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Empty(t, getBody(t, res))
+
+	// same listing filtered is a different representation
+	res = conditionalLs(target+"?type=dir", etag)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	touchHelper(t, srv, token, dir, "second")
+
+	res = conditionalLs(target, etag)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.NotEqual(t, etag, res.Header.Get("ETag"))
+	assert.Len(t, decodeResponse[struct {
+		Ok   bool    `json:"ok"`
+		Data []id.ID `json:"data"`
+	}](t, res).Data, 2)
+
+	// an empty directory turned into a file lists the same, but it isn't the
+	// same representation
+	empty := mkdirHelper(t, srv, token, root, "empty")
+	res = hitGet(srv, "/api/v1/ls/"+empty.String(), token)
+	etag = res.Header.Get("ETag")
+	res = hitPost(t, srv, "/api/v1/settype/"+empty.String()+"/false", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = conditionalLs("/api/v1/ls/"+empty.String(), etag)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.NotEqual(t, etag, res.Header.Get("ETag"))
+}
+
+func multipartBody(t *testing.T, parts map[string]string) (io.Reader, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, content := range parts {
+		pw, err := mw.CreateFormField(name)
+		assert.NoError(t, err)
+		_, err = pw.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, mw.Close())
+	return &buf, mw.FormDataContentType()
+}
+
+func TestMultipartUpload(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "photo.jpg")
+
+	upload := func(parts map[string]string) *http.Response {
+		body, contentType := multipartBody(t, parts)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/upload/"+file.String(), body)
+		req.Header.Set("Authorization", token)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	res := upload(map[string]string{"data": "jpeg bytes", "caption": "sunset"})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	assert.Equal(t, "jpeg bytes", getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)))
+	assert.Equal(t, "sunset", getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/caption", token)))
+
+	// an invalid section name fails the whole upload
+	res = upload(map[string]string{"data": "other bytes", "bad.name": "x"})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, "jpeg bytes", getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)))
+}
+
+func TestMetaUploadTakesOwner(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	file := touchHelper(t, srv, token, root, "file")
+	fm := readMetaHelper(t, srv, token, file)
+	fm.Perms["marek"] = fs.PermRead | fs.PermWrite
+	res := hitPost(t, srv, "/api/v1/upload/"+file.String()+"/meta", token, fm)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	granted := readMetaHelper(t, srv, token, file).Perms
+
+	// marek writes the data, but can't take over the ownership
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", marekToken, strings.NewReader("data"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	fm.Perms["marek"] = fs.PermOwner | fs.PermRead | fs.PermWrite
+	res = hitPost(t, srv, "/api/v1/upload/"+file.String()+"/meta", marekToken, fm)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hitPost(t, srv, "/api/v1/upload/"+file.String()+"/meta?offset=0", marekToken, fm)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	b, err := json.Marshal(fm)
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, contentType := multipartBody(t, map[string]string{"meta": string(b)})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/upload/"+file.String(), body)
+	req.Header.Set("Authorization", marekToken)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	expectFail(t, w.Result(), http.StatusForbidden, "403 forbidden")
+
+	assert.Equal(t, granted, readMetaHelper(t, srv, token, file).Perms)
+}
+
+func TestDiskUsageEndpoint(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	a := mkdirHelper(t, srv, token, root, "a")
+	b := mkdirHelper(t, srv, token, root, "b")
+	file := touchHelper(t, srv, token, a, "file")
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader(strings.Repeat("x", 1000)))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hitPost(t, srv, "/api/v1/mount/"+b.String()+"/"+file.String(), token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	du := func(dir id.ID) int64 {
+		res := hitGet(srv, "/api/v1/du/"+dir.String(), token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return decodeResponse[struct {
+			Ok   bool `json:"ok"`
+			Data struct {
+				Size int64 `json:"size"`
+			} `json:"data"`
+		}](t, res).Data.Size
+	}
+
+	// meta sections written on create count too, the shared file only once
+	assert.Greater(t, du(file), int64(1000))
+	assert.Equal(t, du(a)+du(b)-du(file), du(root))
+}
+
+func TestTreeHashEndpoint(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	dir := mkdirHelper(t, srv, token, root, "synced")
+	file := touchHelper(t, srv, token, dir, "file")
+	upload := func(content string) {
+		res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader(content))
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	treeHash := func(u id.ID) string {
+		res := hitGet(srv, "/api/v1/treehash/"+u.String(), token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return decodeResponse[struct {
+			Ok   bool `json:"ok"`
+			Data struct {
+				Hash string `json:"hash"`
+			} `json:"data"`
+		}](t, res).Data.Hash
+	}
+
+	upload("first")
+	before := treeHash(dir)
+	assert.Len(t, before, 64)
+	assert.Equal(t, before, treeHash(dir))
+
+	upload("second")
+	assert.NotEqual(t, before, treeHash(dir))
+	upload("first")
+	assert.Equal(t, before, treeHash(dir))
+
+	expectFail(t, hitGet(srv, "/api/v1/treehash/"+dir.String(), marekToken), http.StatusForbidden, "403 forbidden")
+
+	// what marek can't read doesn't show in the hash marek gets
+	grantHelper(t, srv, token, dir, "marek", permRead)
+	marekHash := func() string {
+		res := hitGet(srv, "/api/v1/treehash/"+dir.String(), marekToken)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return decodeResponse[struct {
+			Ok   bool `json:"ok"`
+			Data struct {
+				Hash string `json:"hash"`
+			} `json:"data"`
+		}](t, res).Data.Hash
+	}
+	seen := marekHash()
+	assert.NotEqual(t, before, seen)
+	upload("changed")
+	assert.Equal(t, seen, marekHash())
+	assert.NotEqual(t, before, treeHash(dir))
+
+	// the compressed upload hashes the same as the plain one
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data?compress=gzip", token, strings.NewReader("first"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, before, treeHash(dir))
+}
+
+func TestCacheHeaders(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")}, "--cache_max_age", "30s")
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	res := hitGet(srv, "/api/v1/whoami", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "private, max-age=30", res.Header.Get("Cache-Control"))
+
+	file := touchHelper(t, srv, token, root, "file")
+	res = hitGet(srv, "/api/v1/stat/"+file.String(), token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "private, max-age=30", res.Header.Get("Cache-Control"))
+
+	lastModified, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), lastModified, time.Minute)
+
+	info := decodeResponse[struct {
+		Ok   bool        `json:"ok"`
+		Data fs.FileInfo `json:"data"`
+	}](t, res).Data
+	assert.Equal(t, "file", info.Name)
+	assert.Equal(t, file, info.ID)
+	assert.False(t, info.IsDir)
+}
+
+func TestDetach(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"admin":  hashPassword("heslo123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	adminToken := loginHelper(t, srv, "admin", "heslo123")
+
+	a := mkdirHelper(t, srv, token, root, "a")
+	b := mkdirHelper(t, srv, token, root, "b")
+	c := mkdirHelper(t, srv, token, root, "c")
+	file := touchHelper(t, srv, token, a, "file")
+	for _, p := range []id.ID{b, c} {
+		res := hitPost(t, srv, "/api/v1/mount/"+p.String()+"/"+file.String(), token, nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	res := hitPost(t, srv, "/api/v1/detach/"+file.String(), token, nil)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/detach/"+file.String(), adminToken, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "{\"ok\":true}\n", getBody(t, res))
+
+	for _, p := range []id.ID{a, b, c} {
+		assert.Empty(t, lsHelper(t, srv, token, "/api/v1/ls/"+p.String()))
+	}
+	res = hitGet(srv, "/api/v1/stat/"+file.String(), token)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/detach/"+root.String(), adminToken, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, "{\"ok\":false,\"error\":\"can't detach the root\"}\n", getBody(t, res))
+}
+
+func TestPrettyJSON(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	mkdirHelper(t, srv, token, root, "a")
+
+	compact := getBody(t, hitGet(srv, "/api/v1/stat/"+root.String(), token))
+	assert.NotContains(t, strings.TrimSuffix(compact, "\n"), "\n")
+
+	pretty := getBody(t, hitGet(srv, "/api/v1/stat/"+root.String()+"?pretty=true", token))
+	assert.Contains(t, pretty, "\n  \"data\": {\n    \"id\":")
+
+	var a, b any
+	assert.NoError(t, json.Unmarshal([]byte(compact), &a))
+	assert.NoError(t, json.Unmarshal([]byte(pretty), &b))
+	assert.Equal(t, a, b)
+}
+
+func TestH2C(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newHTTPServer(srv, config{h2c: true})
+	ts.Start()
+	defer ts.Close()
+
+	get := func(protocols *http.Protocols) *http.Response {
+		client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/whoami", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	res := get(&h2c)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, "{\"ok\":true,\"data\":{\"name\":\"prokop\"}}\n", getBody(t, res))
+
+	var h1 http.Protocols
+	h1.SetHTTP1(true)
+	res = get(&h1)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 1, res.ProtoMajor)
+	res.Body.Close()
+}
+
+func TestCopyPerms(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	}, "--inherit_perms=false")
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	all := fs.PermOwner | fs.PermRead | fs.PermWrite
+
+	src := touchHelper(t, srv, token, root, "src")
+	fm := readMetaHelper(t, srv, token, src)
+	fm.Perms["marek"] = fs.PermRead
+	res := hitPost(t, srv, "/api/v1/upload/"+src.String()+"/meta", token, fm)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	setup := func(name string) id.ID {
+		dst := touchHelper(t, srv, token, root, name)
+		fm := readMetaHelper(t, srv, token, dst)
+		fm.Perms["anicka"] = fs.PermWrite
+		fm.Perms["marek"] = fs.PermWrite
+		res := hitPost(t, srv, "/api/v1/upload/"+dst.String()+"/meta", token, fm)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return dst
+	}
+
+	replaced := setup("replaced")
+	res = hitPost(t, srv, "/api/v1/perms/copy/"+src.String()+"/"+replaced.String(), token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]uint8{"prokop": all, "marek": fs.PermRead},
+		readMetaHelper(t, srv, token, replaced).Perms)
+
+	merged := setup("merged")
+	res = hitPost(t, srv, "/api/v1/perms/copy/"+src.String()+"/"+merged.String()+"?mode=merge", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]uint8{"prokop": all, "marek": fs.PermRead | fs.PermWrite, "anicka": fs.PermWrite},
+		readMetaHelper(t, srv, token, merged).Perms)
+
+	res = hitPost(t, srv, "/api/v1/perms/copy/"+src.String()+"/"+merged.String()+"?mode=bogus", token, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// marek only reads src and owns neither
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+	res = hitPost(t, srv, "/api/v1/perms/copy/"+src.String()+"/"+merged.String(), marekToken, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Equal(t, "{\"ok\":false,\"error\":\"403 forbidden\"}\n", getBody(t, res))
+}
+
+func TestPermsWildcard(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	file := touchHelper(t, srv, token, root, "file")
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("hello"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/data", marekToken)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Equal(t, "{\"ok\":false,\"error\":\"403 forbidden\"}\n", getBody(t, res))
+
+	fm := readMetaHelper(t, srv, token, file)
+	fm.Perms[fs.PermEveryone] = fs.PermRead
+	res = hitPost(t, srv, "/api/v1/upload/"+file.String()+"/meta", token, fm)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/data", marekToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "hello", getBody(t, res))
+
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", marekToken, strings.NewReader("bye"))
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Equal(t, "hello", getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)))
+}
+
+func TestPermReadMeta(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	file := touchHelper(t, srv, token, root, "file")
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("hello"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitGet(srv, "/api/v1/stat/"+file.String(), marekToken)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	fm := readMetaHelper(t, srv, token, file)
+	fm.Perms["marek"] = fs.PermReadMeta
+	res = hitPost(t, srv, "/api/v1/upload/"+file.String()+"/meta", token, fm)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// marek sees the file, but not what is in it
+	res = hitGet(srv, "/api/v1/stat/"+file.String(), marekToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, lsHelper(t, srv, marekToken, "/api/v1/ls/"+root.String()), file)
+	assert.Equal(t, fm.Perms, readMetaHelper(t, srv, marekToken, file).Perms)
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/meta", marekToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/data", marekToken)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	res = hitGet(srv, "/api/v1/bundle/"+file.String(), marekToken)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+}
+
+func TestChown(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+		"anicka": hashPassword("heslo2"),
+		"admin":  hashPassword("admin"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+	anickaToken := loginHelper(t, srv, "anicka", "heslo2")
+	adminToken := loginHelper(t, srv, "admin", "admin")
+	all := fs.PermOwner | fs.PermRead | fs.PermWrite
+
+	file := touchHelper(t, srv, token, root, "file")
+
+	// anicka owns nothing
+	res := hitPost(t, srv, "/api/v1/chown/"+file.String()+"/anicka", anickaToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	res = hitPost(t, srv, "/api/v1/chown/"+file.String()+"/nobody", token, nil)
+	expectFail(t, res, http.StatusNotFound, "username not found")
+
+	res = hitPost(t, srv, "/api/v1/chown/"+file.String()+"/marek", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	fm := readMetaHelper(t, srv, marekToken, file)
+	assert.Equal(t, "marek", fm.CreatedBy)
+	assert.Equal(t, map[string]uint8{"prokop": fs.PermRead | fs.PermWrite, "marek": all}, fm.Perms)
+
+	// prokop isn't the owner anymore
+	res = hitPost(t, srv, "/api/v1/chown/"+file.String()+"/prokop", token, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	// co-owners lose the ownership as well
+	grantHelper(t, srv, marekToken, file, "prokop", fs.PermOwner)
+	res = hitPost(t, srv, "/api/v1/chown/"+file.String()+"/anicka", adminToken, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	fm = readMetaHelper(t, srv, anickaToken, file)
+	assert.Equal(t, "anicka", fm.CreatedBy)
+	assert.Equal(t, map[string]uint8{"prokop": fs.PermRead | fs.PermWrite, "marek": fs.PermRead | fs.PermWrite, "anicka": all}, fm.Perms)
+}
+
+func TestDefaultPerms(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	dir := mkdirHelper(t, srv, token, root, "shared")
+	file := touchHelper(t, srv, token, dir, "file")
+
+	// only the owner sets them
+	res := hitPost(t, srv, "/api/v1/defaultperms/"+dir.String(), marekToken, map[string]uint8{"marek": fs.PermRead})
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	res = hitPost(t, srv, "/api/v1/defaultperms/"+dir.String(), token, map[string]uint8{"marek": fs.PermOwner})
+	expectFail(t, res, http.StatusBadRequest, `default perms of "marek": owner bit can't be granted by default`)
+
+	res = hitPost(t, srv, "/api/v1/defaultperms/"+file.String(), token, map[string]uint8{"marek": fs.PermRead})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/defaultperms/"+dir.String(), token, map[string]uint8{"nobody": fs.PermRead})
+	expectFail(t, res, http.StatusBadRequest, `default perms of "nobody": unknown user`)
+
+	res = hitPost(t, srv, "/api/v1/defaultperms/"+dir.String(), token, map[string]uint8{"marek": fs.PermReadMeta << 1})
+	expectFail(t, res, http.StatusBadRequest, `default perms of "marek": unknown permission bits`)
+
+	res = hitPost(t, srv, "/api/v1/defaultperms/"+dir.String(), token, map[string]uint8{"marek": fs.PermRead | fs.PermReadMeta})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// records created from now on get them, the earlier ones don't
+	child := touchHelper(t, srv, token, dir, "child")
+	fm := readMetaHelper(t, srv, marekToken, child)
+	assert.Equal(t, map[string]uint8{
+		"prokop": fs.PermOwner | fs.PermRead | fs.PermWrite,
+		"marek":  fs.PermRead | fs.PermReadMeta,
+	}, fm.Perms)
+
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/meta", marekToken)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	dir := mkdirHelper(t, srv, token, root, "dir")
+	res := hitGet(srv, "/api/v1/ls/"+dir.String(), token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	version := strings.Trim(res.Header.Get("ETag"), `"`)
+
+	type watchResponse struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Changed  bool    `json:"changed"`
+			Version  string  `json:"version"`
+			Children []id.ID `json:"children"`
+		} `json:"data"`
+	}
+
+	// nothing happens, so the watch times out
+	res = hitGet(srv, "/api/v1/watch/"+dir.String()+"?version="+version+"&timeout=10ms", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	b := decodeResponse[watchResponse](t, res)
+	assert.False(t, b.Data.Changed)
+	assert.Equal(t, version, b.Data.Version)
+
+	done := make(chan watchResponse)
+	go func() {
+		res := hitGet(srv, "/api/v1/watch/"+dir.String()+"?version="+version+"&timeout=1m", token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		done <- decodeResponse[watchResponse](t, res)
+	}()
+
+	file := touchHelper(t, srv, token, dir, "file")
+
+	select {
+	case b = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch not unblocked by touch")
+	}
+	assert.True(t, b.Data.Changed)
+	assert.NotEqual(t, version, b.Data.Version)
+	assert.Equal(t, []id.ID{file}, b.Data.Children)
+
+	res = hitGet(srv, "/api/v1/watch/"+dir.String()+"?timeout=1h", token)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	// registered first so it runs after the streams are cancelled
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	subscribe := func(token string) *bufio.Reader {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/v1/events", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+		br := bufio.NewReader(res.Body)
+		line, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, ": subscribed\n", line)
+		_, err = br.ReadString('\n')
+		assert.NoError(t, err)
+		return br
+	}
+
+	next := func(br *bufio.Reader) (string, fs.Event) {
+		var typ string
+		var ev fs.Event
+		for {
+			line, err := br.ReadString('\n')
+			assert.NoError(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return typ, ev
+			case strings.HasPrefix(line, "event: "):
+				typ = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev))
+			}
+		}
+	}
+
+	prokop := subscribe(token)
+	marek := subscribe(marekToken)
+
+	private := mkdirHelper(t, srv, token, root, "private")
+	typ, ev := next(prokop)
+	assert.Equal(t, fs.EventCreate, typ)
+	assert.Equal(t, fs.Event{Type: fs.EventCreate, ID: private, Parent: root, Name: "private"}, ev)
+
+	// marek sees the mkdir in the root, but not the touch in the directory
+	// only prokop can read
+	_, ev = next(marek)
+	assert.Equal(t, private, ev.ID)
+
+	secret := touchHelper(t, srv, token, private, "secret")
+	_, ev = next(prokop)
+	assert.Equal(t, secret, ev.ID)
+
+	public := touchHelper(t, srv, token, root, "public")
+	_, ev = next(prokop)
+	assert.Equal(t, public, ev.ID)
+	_, ev = next(marek)
+	assert.Equal(t, fs.Event{Type: fs.EventCreate, ID: public, Parent: root, Name: "public"}, ev)
+
+	// renames of sections show to those who can read the record
+	for _, file := range []id.ID{secret, public} {
+		res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("content"))
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	res := hitPost(t, srv, "/api/v1/renamesection/"+secret.String()+"/data/old", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	typ, ev = next(prokop)
+	assert.Equal(t, fs.EventRename, typ)
+	assert.Equal(t, fs.Event{Type: fs.EventRename, ID: secret, Section: "old", From: secret, OldSection: "data"}, ev)
+
+	res = hitPost(t, srv, "/api/v1/movesection/"+public.String()+"/data/"+secret.String()+"/data", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_, ev = next(prokop)
+	assert.Equal(t, fs.Event{Type: fs.EventRename, ID: secret, Section: "data", From: public, OldSection: "data"}, ev)
+
+	grantHelper(t, srv, token, public, "marek", permRead)
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+public.String()+"/thumb", token, strings.NewReader("tiny"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hitPost(t, srv, "/api/v1/renamesection/"+public.String()+"/thumb/small", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_, ev = next(marek)
+	assert.Equal(t, fs.Event{Type: fs.EventRename, ID: public, Section: "small", From: public, OldSection: "thumb"}, ev)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")}, "--handler_timeout", "1ns")
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	res := hitGet(srv, "/api/v1/du/"+root.String(), token)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "{\"ok\":false,\"error\":\"handler timeout\"}\n", getBody(t, res))
+}
+
+func TestBundle(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "photo")
+	for section, content := range map[string]string{"data": "jpeg bytes", "thumb": "tiny jpeg"} {
+		res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/"+section, token, strings.NewReader(content))
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	res := hitGet(srv, "/api/v1/bundle/"+file.String(), token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=photo.zip`, res.Header.Get("Content-Disposition"))
+
+	body := []byte(getBody(t, res))
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assert.NoError(t, err)
+
+	entries := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		r.Close()
+		entries[f.Name] = string(content)
+	}
+
+	// meta is written on touch
+	assert.Equal(t, []string{"data", "meta", "thumb"}, slices.Sorted(maps.Keys(entries)))
+	assert.Equal(t, "jpeg bytes", entries["data"])
+	assert.Equal(t, "tiny jpeg", entries["thumb"])
+}
+
+func TestLoginRoles(t *testing.T) {
+	t.Parallel()
+	srv := newTestServerWithUsers(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"admin":  hashPassword("heslo123"),
+	})
+
+	roles := func(username, pwd string) []string {
+		res := hitPost(t, srv, "/api/v1/login", "", loginRequest{Username: username, Password: hashPassword(pwd)})
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return decodeResponse[struct {
+			Ok   bool `json:"ok"`
+			Data struct {
+				Token      string    `json:"token"`
+				ExpireDate time.Time `json:"expireDate"`
+				Roles      []string  `json:"roles"`
+			} `json:"data"`
+		}](t, res).Data.Roles
+	}
+
+	assert.Equal(t, []string{"admin"}, roles("admin", "heslo123"))
+	assert.Equal(t, []string{}, roles("prokop", "catboy123"))
+}
+
+func TestImportUsers(t *testing.T) {
+	t.Parallel()
+	srv := newTestServerWithUsers(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"admin":  hashPassword("heslo123"),
+	})
+	adminToken := loginHelper(t, srv, "admin", "heslo123")
+
+	type row struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	type rowResult struct {
+		Username string `json:"username"`
+		Ok       bool   `json:"ok"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	res := hitPost(t, srv, "/api/v1/users/import", loginHelper(t, srv, "prokop", "catboy123"), []row{})
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/users/import", adminToken, []row{
+		{"marek", "heslo"},
+		{"anicka", "tajne"},
+	})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []rowResult{{"marek", true, ""}, {"anicka", true, ""}}, decodeResponse[struct {
+		Ok   bool        `json:"ok"`
+		Data []rowResult `json:"data"`
+	}](t, res).Data)
+	loginHelper(t, srv, "marek", "heslo")
+	loginHelper(t, srv, "anicka", "tajne")
+
+	invalid := []row{{"pepa", "heslo"}, {"bad/name", "heslo"}, {"prokop", "heslo"}}
+
+	res = hitPost(t, srv, "/api/v1/users/import?strict=true", adminToken, invalid)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Contains(t, getBody(t, res), "nothing imported, bad/name")
+	res = hitPost(t, srv, "/api/v1/login", "", row{"pepa", "heslo"})
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/users/import", adminToken, invalid)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	results := decodeResponse[struct {
+		Ok   bool        `json:"ok"`
+		Data []rowResult `json:"data"`
+	}](t, res).Data
+	assert.Len(t, results, 3)
+	assert.True(t, results[0].Ok)
+	assert.False(t, results[1].Ok)
+	assert.Contains(t, results[1].Error, "username may only contain")
+	assert.Equal(t, rowResult{"prokop", false, "user already exists"}, results[2])
+	loginHelper(t, srv, "pepa", "heslo")
+	loginHelper(t, srv, "prokop", "catboy123")
+
+	// a row without a password would get the zero hash, anyone could log in
+	// with it prehashed. A repeated row would overwrite the first one
+	res = hitPost(t, srv, "/api/v1/users/import", adminToken, []map[string]any{
+		{"username": "jozef"},
+		{"username": "karel", "password": nil},
+		{"username": "lucie", "password": "prvni"},
+		{"username": "lucie", "password": "druhe"},
+	})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []rowResult{
+		{"jozef", false, "password is missing"},
+		{"karel", false, "password is missing"},
+		{"lucie", true, ""},
+		{"lucie", false, "duplicate username"},
+	}, decodeResponse[struct {
+		Ok   bool        `json:"ok"`
+		Data []rowResult `json:"data"`
+	}](t, res).Data)
+	res = hitPost(t, srv, "/api/v1/login", "", map[string]any{"username": "jozef", "password": [64]byte{}})
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	loginHelper(t, srv, "lucie", "prvni")
+
+	res = hitPost(t, srv, "/api/v1/users/import?strict=true", adminToken, []row{{"mirek", "heslo"}, {"mirek", "jine"}})
+	expectFail(t, res, http.StatusBadRequest, "nothing imported, mirek: duplicate username")
+}
+
+func TestImportUsersLimit(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServerWithRoot(t, map[string][64]byte{
+		"admin": hashPassword("heslo123"),
+	}, "--import_max_entries", "2")
+	adminToken := loginHelper(t, srv, "admin", "heslo123")
+
+	type row struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	type rowResult struct {
+		Username string `json:"username"`
+		Ok       bool   `json:"ok"`
+		Error    string `json:"error,omitempty"`
+	}
+	rows := []row{{"marek", "heslo"}, {"anicka", "tajne"}, {"pepa", "heslo"}}
+
+	res := hitPost(t, srv, "/api/v1/users/import?strict=true", adminToken, rows)
+	expectFail(t, res, http.StatusBadRequest, "nothing imported, more than 2 entries")
+
+	res = hitPost(t, srv, "/api/v1/users/import", adminToken, rows)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "more than 2 entries", res.Header.Get("Import-Truncated"))
+	assert.Equal(t, []rowResult{{"marek", true, ""}, {"anicka", true, ""}}, decodeResponse[struct {
+		Ok   bool        `json:"ok"`
+		Data []rowResult `json:"data"`
+	}](t, res).Data)
+	loginHelper(t, srv, "anicka", "tajne")
+	res = hitPost(t, srv, "/api/v1/login", "", row{"pepa", "heslo"})
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/users/import", adminToken, rows[2:])
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Import-Truncated"))
+	loginHelper(t, srv, "pepa", "heslo")
+
+	res = hitPost(t, srv, "/api/v1/users/import", adminToken, row{"pepa", "heslo"})
+	expectFail(t, res, http.StatusBadRequest, "decode json: expected an array of users")
+}
+
+func TestSectionExists(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "file")
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("hello"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	type existsResponse struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Exists bool  `json:"exists"`
+			Size   int64 `json:"size"`
+		} `json:"data"`
+	}
+
+	res = hitGet(srv, "/api/v1/section/"+file.String()+"/data/exists", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	b := decodeResponse[existsResponse](t, res)
+	assert.True(t, b.Data.Exists)
+	assert.Equal(t, int64(5), b.Data.Size)
+
+	res = hitGet(srv, "/api/v1/section/"+file.String()+"/thumb/exists", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	b = decodeResponse[existsResponse](t, res)
+	assert.False(t, b.Data.Exists)
+	assert.Zero(t, b.Data.Size)
+
+	res = hitPost(t, srv, "/api/v1/renamesection/"+file.String()+"/data/thumb", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hitGet(srv, "/api/v1/section/"+file.String()+"/data/exists", token)
+	assert.False(t, decodeResponse[existsResponse](t, res).Data.Exists)
+	res = hitGet(srv, "/api/v1/section/"+file.String()+"/thumb/exists", token)
+	assert.True(t, decodeResponse[existsResponse](t, res).Data.Exists)
+
+	res = hitGet(srv, "/api/v1/section/"+file.String()+"/a.b/exists", token)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = hitGet(srv, "/api/v1/section/"+id.New().String()+"/data/exists", token)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestMkdirp(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	type mkdirpResponse struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			DirID   id.ID `json:"dir_id"`
+			Created int   `json:"created"`
+		} `json:"data"`
+	}
+	mkdirp := func(path string) mkdirpResponse {
+		res := hitPost(t, srv, "/api/v1/mkdirp/"+root.String()+"?path="+url.QueryEscape(path), token, nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return decodeResponse[mkdirpResponse](t, res)
+	}
+
+	first := mkdirp("a/b/c")
+	assert.Equal(t, 3, first.Data.Created)
+
+	// the path is there now, nothing is created twice
+	again := mkdirp("/a/b/c/")
+	assert.Equal(t, first.Data.DirID, again.Data.DirID)
+	assert.Equal(t, 0, again.Data.Created)
+
+	rootChildren := lsHelper(t, srv, token, "/api/v1/ls/"+root.String())
+	if !assert.Len(t, rootChildren, 1) {
+		return
+	}
+	a := rootChildren[0]
+	aChildren := lsHelper(t, srv, token, "/api/v1/ls/"+a.String())
+	if !assert.Len(t, aChildren, 1) {
+		return
+	}
+	assert.Equal(t, []id.ID{first.Data.DirID}, lsHelper(t, srv, token, "/api/v1/ls/"+aChildren[0].String()))
+
+	sibling := mkdirp("a/b/d")
+	assert.Equal(t, 1, sibling.Data.Created)
+	assert.Len(t, lsHelper(t, srv, token, "/api/v1/ls/"+aChildren[0].String()), 2)
+
+	// the created directories get their meta like with mkdir
+	assert.Equal(t, "prokop", readMetaHelper(t, srv, token, sibling.Data.DirID).CreatedBy)
+
+	touchHelper(t, srv, token, a, "file")
+	res := hitPost(t, srv, "/api/v1/mkdirp/"+root.String()+"?path=a/file/x", token, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = hitPost(t, srv, "/api/v1/mkdirp/"+root.String()+"?path=a//x", token, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = hitPost(t, srv, "/api/v1/mkdirp/"+root.String(), token, nil)
+	expectFail(t, res, http.StatusBadRequest, "path is required")
+}
+
+func TestMkdirpPerms(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	}, "--inherit_perms=false")
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	// marek writes in shared, but not in prokop's private directory in it
+	shared := mkdirHelper(t, srv, token, root, "shared")
+	grantHelper(t, srv, token, shared, "marek", fs.PermRead|fs.PermWrite)
+	private := mkdirHelper(t, srv, token, shared, "private")
+
+	res := hitPost(t, srv, "/api/v1/mkdirp/"+shared.String()+"?path=private/planted", marekToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+	assert.Empty(t, lsHelper(t, srv, token, "/api/v1/ls/"+private.String()))
+
+	// going through it to an existing directory creates nothing there
+	grantHelper(t, srv, token, private, "marek", fs.PermRead)
+	res = hitPost(t, srv, "/api/v1/mkdirp/"+shared.String()+"?path=private", marekToken, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// in its own directories it goes on
+	res = hitPost(t, srv, "/api/v1/mkdirp/"+shared.String()+"?path=own/deeper", marekToken, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			DirID   id.ID `json:"dir_id"`
+			Created int   `json:"created"`
+		} `json:"data"`
+	}](t, res).Data.Created)
+}
+
+func TestParentWriteAccess(t *testing.T) {
+	t.Parallel()
+	users := map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	}
+
+	for _, obscure := range []bool{false, true} {
+		args := []string{"--inherit_perms=false"}
+		status, message := http.StatusForbidden, "403 forbidden"
+		if obscure {
+			args = append(args, "--obscure_not_found")
+			status, message = http.StatusNotFound, "file not found"
+		}
+		srv, root := newTestServerWithRoot(t, users, args...)
+		token := loginHelper(t, srv, "prokop", "catboy123")
+		marekToken := loginHelper(t, srv, "marek", "heslo")
+
+		// marek sees prokop's directory, but can't write in it
+		private := mkdirHelper(t, srv, token, root, "private")
+		grantHelper(t, srv, token, private, "marek", fs.PermRead)
+		secret := touchHelper(t, srv, token, private, "secret")
+		own := touchHelper(t, srv, marekToken, root, "own")
+
+		for _, target := range []string{
+			"/api/v1/touch/" + private.String() + "/planted",
+			"/api/v1/mkdir/" + private.String() + "/planted",
+			"/api/v1/mount/" + private.String() + "/" + own.String(),
+			"/api/v1/unmount/" + private.String() + "/" + secret.String(),
+		} {
+			expectFail(t, hitPost(t, srv, target, marekToken, nil), status, message)
+		}
+		assert.Equal(t, []id.ID{secret}, lsHelper(t, srv, token, "/api/v1/ls/"+private.String()))
+
+		// with write access all of it goes through
+		grantHelper(t, srv, token, private, "marek", fs.PermWrite)
+		for _, target := range []string{
+			"/api/v1/touch/" + private.String() + "/planted",
+			"/api/v1/mkdir/" + private.String() + "/planted-dir",
+			"/api/v1/mount/" + private.String() + "/" + own.String(),
+			"/api/v1/unmount/" + private.String() + "/" + secret.String(),
+		} {
+			assert.Equal(t, http.StatusOK, hitPost(t, srv, target, marekToken, nil).StatusCode, target)
+		}
+	}
+}
+
+func TestSectionTypes(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "photo")
+	upload := func(section, typ, content string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/upload/"+file.String()+"/"+section, strings.NewReader(content))
+		req.Header.Set("Authorization", token)
+		req.Header.Set("Content-Type", typ)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	assert.Equal(t, http.StatusOK, upload("data", "image/jpeg", "jpeg bytes").StatusCode)
+	assert.Equal(t, http.StatusOK, upload("thumb", "image/png", "png bytes").StatusCode)
+
+	res := hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)
+	assert.Equal(t, "image/jpeg", res.Header.Get("Content-Type"))
+	assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/thumb", token)
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+
+	fm := readMetaHelper(t, srv, token, file)
+	assert.Equal(t, map[string]string{"data": "image/jpeg", "thumb": "image/png"}, fm.SectionTypes)
+
+	// a broken type is refused before anything is written, a valid one is
+	// stored in its canonical form
+	res = upload("data", "text/html; charset", "<script>")
+	expectFail(t, res, http.StatusBadRequest, `invalid content type "text/html; charset"`)
+	assert.Equal(t, "jpeg bytes", getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)))
+	assert.Equal(t, http.StatusOK, upload("caption", "Text/Plain; Charset=utf-8", "a cat").StatusCode)
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/caption", token)
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+
+	// the meta can carry anything, cat doesn't pass it on
+	fm = readMetaHelper(t, srv, token, file)
+	fm.SectionTypes["thumb"] = "image/png; ;"
+	res = hitPost(t, srv, "/api/v1/upload/"+file.String()+"/meta", token, fm)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/thumb", token)
+	assert.Equal(t, "application/octet-stream", res.Header.Get("Content-Type"))
+	assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+
+	// meta written before SectionTypes has the type of data in 'type'
+	legacy := touchHelper(t, srv, token, root, "legacy")
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+legacy.String()+"/meta", token, strings.NewReader(
+		`{"id":"`+legacy.String()+`","type":"text/plain","perms":{"prokop":7},"hooks":[]}`))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+legacy.String()+"/data", token, strings.NewReader("hello"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitGet(srv, "/api/v1/cat/"+legacy.String()+"/data", token)
+	assert.Equal(t, "text/plain", res.Header.Get("Content-Type"))
+	assert.Equal(t, "hello", getBody(t, res))
+}
+
+func TestValidateID(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	type validateResponse struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Valid  bool   `json:"valid"`
+			Reason string `json:"reason,omitempty"`
+		} `json:"data"`
+	}
+
+	validate := func(s string) validateResponse {
+		res := hitGet(srv, "/api/v1/validate/"+s, "")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return decodeResponse[validateResponse](t, res)
+	}
+
+	b := validate(id.New().String())
+	assert.True(t, b.Data.Valid)
+	assert.Empty(t, b.Data.Reason)
+
+	b = validate("abc")
+	assert.False(t, b.Data.Valid)
+	assert.Contains(t, b.Data.Reason, "length")
+
+	b = validate("0000000000000000000000")
+	assert.False(t, b.Data.Valid)
+	assert.Contains(t, b.Data.Reason, "invalid byte")
+}
+
+func TestTreeDepth(t *testing.T) {
+	t.Parallel()
+	users := map[string][64]byte{"prokop": hashPassword("catboy123")}
+
+	for _, args := range [][]string{nil, {"--max_tree_depth", "1"}} {
+		srv, root := newTestServerWithRoot(t, users, args...)
+		token := loginHelper(t, srv, "prokop", "catboy123")
+
+		a := mkdirHelper(t, srv, token, root, "a")
+		b := mkdirHelper(t, srv, token, a, "b")
+		file := touchHelper(t, srv, token, b, "file")
+		empty := mkdirHelper(t, srv, token, root, "empty")
+
+		tree := func(query string) fs.TreeNode {
+			res := hitGet(srv, "/api/v1/tree/"+root.String()+query, token)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			return decodeResponse[struct {
+				Ok   bool        `json:"ok"`
+				Data fs.TreeNode `json:"data"`
+			}](t, res).Data
+		}
+
+		shallow := fs.TreeNode{ID: root, IsDir: true, Children: []fs.TreeNode{
+			{ID: a, Name: "a", IsDir: true, Truncated: true},
+			{ID: empty, Name: "empty", IsDir: true},
+		}}
+		assert.Equal(t, shallow, tree("?depth=1"))
+
+		full := fs.TreeNode{ID: root, IsDir: true, Children: []fs.TreeNode{
+			{ID: a, Name: "a", IsDir: true, Children: []fs.TreeNode{
+				{ID: b, Name: "b", IsDir: true, Children: []fs.TreeNode{
+					{ID: file, Name: "file"},
+				}},
+			}},
+			{ID: empty, Name: "empty", IsDir: true},
+		}}
+		if args == nil {
+			assert.Equal(t, full, tree(""))
+		} else {
+			// capped by the config
+			assert.Equal(t, shallow, tree(""))
+			assert.Equal(t, shallow, tree("?depth=5"))
+		}
+
+		res := hitGet(srv, "/api/v1/tree/"+root.String()+"?depth=-1", token)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func TestTreePerms(t *testing.T) {
+	t.Parallel()
+	users := map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	}
+
+	for _, obscure := range []bool{false, true} {
+		var args []string
+		if obscure {
+			args = append(args, "--obscure_not_found")
+		}
+		srv, root := newTestServerWithRoot(t, users, append(args, "--inherit_perms=false")...)
+		token := loginHelper(t, srv, "prokop", "catboy123")
+		marekToken := loginHelper(t, srv, "marek", "heslo")
+
+		shared := mkdirHelper(t, srv, token, root, "shared")
+		grantHelper(t, srv, token, shared, "marek", fs.PermRead)
+		visible := touchHelper(t, srv, token, shared, "visible")
+		grantHelper(t, srv, token, visible, "marek", fs.PermRead)
+		touchHelper(t, srv, token, shared, "hidden")
+		private := mkdirHelper(t, srv, token, root, "private")
+		touchHelper(t, srv, token, private, "secret")
+
+		res := hitGet(srv, "/api/v1/tree/"+root.String(), marekToken)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		tree := decodeResponse[struct {
+			Ok   bool        `json:"ok"`
+			Data fs.TreeNode `json:"data"`
+		}](t, res).Data
+		assert.Equal(t, fs.TreeNode{ID: root, IsDir: true, Children: []fs.TreeNode{
+			{ID: shared, Name: "shared", IsDir: true, Children: []fs.TreeNode{
+				{ID: visible, Name: "visible"},
+			}},
+		}}, tree)
+
+		res = hitGet(srv, "/api/v1/tree/"+private.String(), marekToken)
+		if obscure {
+			expectFail(t, res, http.StatusNotFound, "file not found")
+		} else {
+			expectFail(t, res, http.StatusForbidden, "403 forbidden")
+		}
+
+		// the owner sees everything
+		res = hitGet(srv, "/api/v1/tree/"+private.String(), token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+}
+
+func TestCompressedSection(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "log.txt")
+	content := strings.Repeat("the same line over and over\n", 4000)
+
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data?compress=gzip", token, strings.NewReader(content))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]string{"data": fs.EncodingGzip}, readMetaHelper(t, srv, token, file).SectionEncodings)
+
+	// du counts the bytes on disk
+	res = hitGet(srv, "/api/v1/du/"+file.String(), token)
+	size := decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Size int64 `json:"size"`
+		} `json:"data"`
+	}](t, res).Data.Size
+	assert.Less(t, size, int64(len(content))/10)
+
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, content, getBody(t, res))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/cat/"+file.String()+"/data", nil)
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	zr, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	decompressed, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(decompressed))
+
+	// a plain upload replaces the compressed one
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("plain"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, readMetaHelper(t, srv, token, file).SectionEncodings)
+	assert.Equal(t, "plain", getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)))
+
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data?compress=gzip&offset=0", token, strings.NewReader("x"))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data?compress=zstd", token, strings.NewReader("x"))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestCompressedSectionOffsetAndMove(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	src := touchHelper(t, srv, token, root, "src")
+	dst := touchHelper(t, srv, token, root, "dst")
+	content := strings.Repeat("compressible ", 1000)
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+src.String()+"/data?compress=gzip", token, strings.NewReader(content))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// a plain chunk would corrupt the stored stream
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+src.String()+"/data?offset=0", token, strings.NewReader("plain"))
+	expectFail(t, res, http.StatusBadRequest, "compressed sections can't be written at an offset")
+	assert.Equal(t, map[string]string{"data": fs.EncodingGzip}, readMetaHelper(t, srv, token, src).SectionEncodings)
+	assert.Equal(t, content, getBody(t, hitGet(srv, "/api/v1/cat/"+src.String()+"/data", token)))
+
+	// the encoding goes with a moved section, the replaced one's is gone
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+dst.String()+"/other?compress=gzip", token, strings.NewReader("replaced"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+src.String()+"/plain", token, strings.NewReader("plain"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/movesection/"+src.String()+"/data/"+dst.String()+"/moved", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hitPost(t, srv, "/api/v1/movesection/"+src.String()+"/plain/"+dst.String()+"/other", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	assert.Empty(t, readMetaHelper(t, srv, token, src).SectionEncodings)
+	assert.Equal(t, map[string]string{"moved": fs.EncodingGzip}, readMetaHelper(t, srv, token, dst).SectionEncodings)
+	assert.Equal(t, content, getBody(t, hitGet(srv, "/api/v1/cat/"+dst.String()+"/moved", token)))
+	assert.Equal(t, "plain", getBody(t, hitGet(srv, "/api/v1/cat/"+dst.String()+"/other", token)))
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	t.Parallel()
+	assert.True(t, acceptsGzip("gzip"))
+	assert.True(t, acceptsGzip("deflate, gzip;q=0.5"))
+	assert.True(t, acceptsGzip("*"))
+	assert.False(t, acceptsGzip(""))
+	assert.False(t, acceptsGzip("br"))
+	assert.False(t, acceptsGzip("gzip;q=0"))
+}
+
+func TestRenameSection(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "file")
+	for section, content := range map[string]string{"notes": "some notes", "summary": "short"} {
+		res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/"+section, token, strings.NewReader(content))
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	res := hitPost(t, srv, "/api/v1/renamesection/"+file.String()+"/notes/description", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "some notes", getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/description", token)))
+
+	res = hitPost(t, srv, "/api/v1/renamesection/"+file.String()+"/notes/other", token, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/renamesection/"+file.String()+"/description/summary", token, nil)
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	assert.Equal(t, "{\"ok\":false,\"error\":\"section already exists\"}\n", getBody(t, res))
+	assert.Equal(t, "some notes", getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/description", token)))
+	assert.Equal(t, "short", getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/summary", token)))
+
+	res = hitPost(t, srv, "/api/v1/renamesection/"+file.String()+"/meta/old-meta", token, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestSetType(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	stat := func(u id.ID) fs.FileInfo {
+		res := hitGet(srv, "/api/v1/stat/"+u.String(), token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return decodeResponse[struct {
+			Ok   bool        `json:"ok"`
+			Data fs.FileInfo `json:"data"`
+		}](t, res).Data
+	}
+
+	empty := mkdirHelper(t, srv, token, root, "empty")
+	res := hitPost(t, srv, "/api/v1/settype/"+empty.String()+"/false", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.False(t, stat(empty).IsDir)
+	assert.Equal(t, []id.ID{empty}, lsHelper(t, srv, token, "/api/v1/ls/"+root.String()+"?type=file"))
+
+	res = hitPost(t, srv, "/api/v1/settype/"+empty.String()+"/true", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, stat(empty).IsDir)
+
+	full := mkdirHelper(t, srv, token, root, "full")
+	touchHelper(t, srv, token, full, "file")
+	res = hitPost(t, srv, "/api/v1/settype/"+full.String()+"/false", token, nil)
+	expectFail(t, res, http.StatusConflict, "set type: directory is not empty")
+	assert.True(t, stat(full).IsDir)
+
+	res = hitPost(t, srv, "/api/v1/settype/"+root.String()+"/false", token, nil)
+	expectFail(t, res, http.StatusConflict, "set type: the root must stay a directory")
+
+	res = hitPost(t, srv, "/api/v1/settype/"+full.String()+"/maybe", token, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestSetTypeTakesOwner(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	dir := mkdirHelper(t, srv, token, root, "dir")
+	res := hitPost(t, srv, "/api/v1/settype/"+dir.String()+"/false", marekToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	// writing isn't enough
+	grantHelper(t, srv, token, dir, "marek", fs.PermRead|fs.PermWrite)
+	res = hitPost(t, srv, "/api/v1/settype/"+dir.String()+"/false", marekToken, nil)
+	expectFail(t, res, http.StatusForbidden, "403 forbidden")
+
+	res = hitGet(srv, "/api/v1/stat/"+dir.String(), token)
+	assert.True(t, decodeResponse[struct {
+		Ok   bool        `json:"ok"`
+		Data fs.FileInfo `json:"data"`
+	}](t, res).Data.IsDir)
+
+	res = hitPost(t, srv, "/api/v1/settype/"+id.New().String()+"/false", token, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestWriteErrorDiskFull(t *testing.T) {
+	t.Parallel()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+	w := httptest.NewRecorder()
+	sendWriteError(log, w, "io copy", &os.PathError{Op: "write", Path: "/secret/path", Err: syscall.ENOSPC})
+	res := w.Result()
+	assert.Equal(t, http.StatusInsufficientStorage, res.StatusCode)
+	body := getBody(t, res)
+	assert.Equal(t, "{\"ok\":false,\"error\":\"insufficient storage\"}\n", body)
+	assert.NotContains(t, body, "/secret/path")
+
+	// other errors don't tell the path either, wrapped or not
+	w = httptest.NewRecorder()
+	sendWriteError(log, w, "io copy", fmt.Errorf("section x: %w", &os.PathError{Op: "write", Path: "/secret/path", Err: syscall.EIO}))
+	res = w.Result()
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	assert.Equal(t, "{\"ok\":false,\"error\":\"io copy: write: input/output error\"}\n", getBody(t, res))
+
+	w = httptest.NewRecorder()
+	sendFsError(log, w, "put section", &os.LinkError{Op: "rename", Old: "/secret/old", New: "/secret/new", Err: syscall.EACCES})
+	res = w.Result()
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	assert.NotContains(t, getBody(t, res), "/secret")
+
+	w = httptest.NewRecorder()
+	sendFsError(log, w, "open section", &os.PathError{Op: "open", Path: "/secret/path", Err: os.ErrNotExist})
+	res = w.Result()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.NotContains(t, getBody(t, res), "/secret")
+}
+
+func TestBundleETag(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "photo")
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("jpeg bytes"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	target := "/api/v1/bundle/" + file.String()
+	res = hitGet(srv, target, token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	etag := res.Header.Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`), etag)
+
+	conditionalBundle := func(etag string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", token)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	res = conditionalBundle(etag)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Empty(t, getBody(t, res))
+
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/thumb", token, strings.NewReader("tiny jpeg"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = conditionalBundle(etag)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.NotEqual(t, etag, res.Header.Get("ETag"))
+}
+
+func TestCreateUserReservedName(t *testing.T) {
+	t.Parallel()
+	srv := newTestServerWithUsers(t, map[string][64]byte{"admin": hashPassword("heslo123")})
+	adminToken := loginHelper(t, srv, "admin", "heslo123")
+
+	res := hitPost(t, srv, "/api/v1/create/roles", adminToken, map[string]string{"password": "heslo"})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Contains(t, getBody(t, res), "username is reserved")
+	res = hitPost(t, srv, "/api/v1/create/Roles", adminToken, map[string]string{"password": "heslo"})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = hitPost(t, srv, "/api/v1/create/marek", adminToken, map[string]string{"password": "heslo"})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	loginHelper(t, srv, "marek", "heslo")
+
+	res = hitPost(t, srv, "/api/v1/create/marek", adminToken, map[string]string{"password": "jine"})
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+}
+
+func TestCreateUserPasswordNotLogged(t *testing.T) {
+	t.Parallel()
+	var accessLog bytes.Buffer
+	srv := newTestServerWithUsers(t, map[string][64]byte{"admin": hashPassword("heslo123")})
+	logged := logAccesses(slog.New(slog.NewJSONHandler(io.Discard, nil)), accessLogCLF, &accessLog, srv)
+	adminToken := loginHelper(t, srv, "admin", "heslo123")
+
+	res := hitPost(t, logged, "/api/v1/create/marek", adminToken, map[string]string{"password": "tajne heslo"})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	loginHelper(t, srv, "marek", "tajne heslo")
+	assert.Contains(t, accessLog.String(), "/api/v1/create/marek")
+	assert.NotContains(t, accessLog.String(), "tajne")
+
+	// the pre-hashed form works too
+	res = hitPost(t, srv, "/api/v1/create/anicka", adminToken, map[string]any{"password": hashPassword("heslo2")})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	loginHelper(t, srv, "anicka", "heslo2")
+
+	res = hitPost(t, srv, "/api/v1/create/nobody", adminToken, map[string]string{})
+	expectFail(t, res, http.StatusBadRequest, "password is missing")
+}
+
+func TestObscureNotFound(t *testing.T) {
+	t.Parallel()
+	users := map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	}
+
+	for _, obscure := range []bool{false, true} {
+		var args []string
+		if obscure {
+			args = append(args, "--obscure_not_found")
+		}
+		srv, root := newTestServerWithRoot(t, users, args...)
+		token := loginHelper(t, srv, "prokop", "catboy123")
+		marekToken := loginHelper(t, srv, "marek", "heslo")
+
+		file := touchHelper(t, srv, token, root, "file")
+		res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("hello"))
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		forbidden := hitGet(srv, "/api/v1/cat/"+file.String()+"/data", marekToken)
+		missing := hitGet(srv, "/api/v1/cat/"+id.New().String()+"/data", marekToken)
+		forbiddenBody, missingBody := getBody(t, forbidden), getBody(t, missing)
+
+		if obscure {
+			assert.Equal(t, http.StatusNotFound, forbidden.StatusCode)
+			assert.Equal(t, missing.StatusCode, forbidden.StatusCode)
+			assert.Equal(t, missingBody, forbiddenBody)
+		} else {
+			assert.Equal(t, http.StatusForbidden, forbidden.StatusCode)
+			assert.Equal(t, http.StatusNotFound, missing.StatusCode)
+		}
+
+		// the owner still gets the file
+		res = hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		// listing a directory doesn't tell it exists either
+		dir := mkdirHelper(t, srv, token, root, "dir")
+		for _, endpoint := range []string{"/api/v1/ls/", "/api/v1/du/", "/api/v1/watch/"} {
+			forbidden := hitGet(srv, endpoint+dir.String(), marekToken)
+			missing := hitGet(srv, endpoint+id.New().String(), marekToken)
+			forbiddenBody, missingBody := getBody(t, forbidden), getBody(t, missing)
+
+			if obscure {
+				assert.Equal(t, http.StatusNotFound, forbidden.StatusCode, endpoint)
+				assert.Equal(t, missingBody, forbiddenBody, endpoint)
+			} else {
+				assert.Equal(t, http.StatusForbidden, forbidden.StatusCode, endpoint)
+				assert.Equal(t, http.StatusNotFound, missing.StatusCode, endpoint)
+			}
+
+			res = hitGet(srv, endpoint+dir.String()+"?timeout=1ms", token)
+			assert.Equal(t, http.StatusOK, res.StatusCode, endpoint)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	t.Parallel()
+	users := map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"admin":  hashPassword("heslo123"),
+	}
+
+	src, srcRoot := newTestServerWithRoot(t, users)
+	token := loginHelper(t, src, "prokop", "catboy123")
+	dir := mkdirHelper(t, src, token, srcRoot, "dir")
+	file := touchHelper(t, src, token, dir, "file")
+	res := hit(src, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("hello"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitGet(src, "/api/v1/snapshot", token)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res = hitGet(src, "/api/v1/snapshot", loginHelper(t, src, "admin", "heslo123"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/x-tar", res.Header.Get("Content-Type"))
+	snapshot := getBody(t, res)
+
+	dst, dstRoot := newTestServerWithRoot(t, users)
+	dstAdmin := loginHelper(t, dst, "admin", "heslo123")
+	res = hit(dst, http.MethodPost, "/api/v1/restore", dstAdmin, strings.NewReader(snapshot))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	dstToken := loginHelper(t, dst, "prokop", "catboy123")
+	assert.Equal(t, []id.ID{dir}, lsHelper(t, dst, dstToken, "/api/v1/ls/"+dstRoot.String()))
+	assert.Equal(t, []id.ID{file}, lsHelper(t, dst, dstToken, "/api/v1/ls/"+dir.String()))
+	assert.Equal(t, "hello", getBody(t, hitGet(dst, "/api/v1/cat/"+file.String()+"/data", dstToken)))
+
+	res = hit(dst, http.MethodPost, "/api/v1/restore", dstAdmin, strings.NewReader(snapshot))
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+}
+
+func TestImportSnapshot(t *testing.T) {
+	t.Parallel()
+	users := map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"admin":  hashPassword("heslo123"),
+	}
+
+	src, srcRoot := newTestServerWithRoot(t, users)
+	token := loginHelper(t, src, "prokop", "catboy123")
+	dir := mkdirHelper(t, src, token, srcRoot, "dir")
+	file := touchHelper(t, src, token, dir, "file")
+	res := hit(src, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("hello"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	snapshot := getBody(t, hitGet(src, "/api/v1/snapshot", loginHelper(t, src, "admin", "heslo123")))
+
+	dst, dstRoot := newTestServerWithRoot(t, users)
+	dstToken := loginHelper(t, dst, "prokop", "catboy123")
+	into := mkdirHelper(t, dst, dstToken, dstRoot, "imported")
+
+	res = hit(dst, http.MethodPost, "/api/v1/import/"+into.String(), dstToken, strings.NewReader(snapshot))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	dstAdmin := loginHelper(t, dst, "admin", "heslo123")
+	res = hit(dst, http.MethodPost, "/api/v1/import/"+into.String(), dstAdmin, strings.NewReader(snapshot))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Imported int `json:"imported"`
+		} `json:"data"`
+	}](t, res).Data.Imported)
+
+	// the records keep their IDs and their meta
+	assert.Equal(t, []id.ID{dir}, lsHelper(t, dst, dstToken, "/api/v1/ls/"+into.String()))
+	assert.Equal(t, []id.ID{file}, lsHelper(t, dst, dstToken, "/api/v1/ls/"+dir.String()))
+	assert.Equal(t, "hello", getBody(t, hitGet(dst, "/api/v1/cat/"+file.String()+"/data", dstToken)))
+	assert.Equal(t, "prokop", readMetaHelper(t, dst, dstToken, file).CreatedBy)
+
+	res = hit(dst, http.MethodPost, "/api/v1/import/"+dstRoot.String(), dstAdmin, strings.NewReader(snapshot))
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	res = hit(dst, http.MethodPost, "/api/v1/import/"+file.String(), dstAdmin, strings.NewReader(snapshot))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestStartWithDataDirOnly(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	rootID, err := fs.InitFsDir(dir, map[string][64]byte{"prokop": hashPassword("catboy123")}, fs.Options{})
+	assert.NoError(t, err)
+
+	secret := generateSecret()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	srv, conf, err := createServer(log, []string{"--data_dir", dir}, func(s string) string {
+		if s == "ARCHIIV_SECRET" {
+			return secret
+		}
+		return ""
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, rootID, conf.rootID)
+
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	touchHelper(t, srv, token, rootID, "file")
+	assert.Len(t, lsHelper(t, srv, token, "/api/v1/ls/"+rootID.String()), 1)
+
+	// only one server can use the data dir at a time
+	_, _, err = createServer(log, []string{"--data_dir", dir}, func(string) string { return "" })
+	assert.ErrorIs(t, err, fs.ErrLocked)
+	assert.NoError(t, conf.files.Close())
+
+	// the flag still overrides the marker
+	_, _, err = createServer(log, []string{"--data_dir", dir, "--root_id", id.New().String()}, func(string) string { return "" })
+	assert.ErrorContains(t, err, "the root ID not found in fs")
+}
+
+func TestVerifyOnStart(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	rootID, err := fs.InitFsDir(dir, nil, fs.Options{})
+	assert.NoError(t, err)
+
+	// the root points at a child that doesn't exist
+	rootPath := filepath.Join(dir, "files", rootID.String())
+	content, err := json.Marshal(map[string]any{"is_dir": true, "name": "", "children": []id.ID{id.New()}})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(rootPath, content, 0600))
+
+	start := func(args ...string) (string, error) {
+		var logs bytes.Buffer
+		log := slog.New(slog.NewJSONHandler(&logs, nil))
+		_, conf, err := createServer(log, append([]string{
+			"--data_dir", dir,
+			"--root_id", rootID.String(),
+		}, args...), func(string) string { return "" })
+		if err == nil {
+			assert.NoError(t, conf.files.Close())
+		}
+		return logs.String(), err
+	}
+
+	logs, err := start()
+	assert.NoError(t, err)
+	assert.NotContains(t, logs, "dangling child")
+
+	logs, err = start("--verify_on_start")
+	assert.NoError(t, err)
+	assert.Contains(t, logs, "dangling child")
+	assert.Contains(t, logs, `"level":"WARN"`)
+
+	_, err = start("--strict_verify")
+	assert.ErrorContains(t, err, "dangling child")
+}
+
+func TestMeta(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	getMeta := func(file id.ID, token string) (*http.Response, fs.FileMeta) {
+		res := hitGet(srv, "/api/v1/meta/"+file.String(), token)
+		if res.StatusCode != http.StatusOK {
+			return res, fs.FileMeta{}
+		}
+		return res, decodeResponse[struct {
+			Ok   bool        `json:"ok"`
+			Data fs.FileMeta `json:"data"`
+		}](t, res).Data
+	}
+
+	file := touchHelper(t, srv, token, root, "file")
+	res, fm := getMeta(file, token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, file, fm.Id)
+	assert.Equal(t, "prokop", fm.CreatedBy)
+	assert.Equal(t, fs.PermOwner|fs.PermRead|fs.PermWrite, fm.Perms["prokop"])
+
+	// the root has no meta section
+	res, fm = getMeta(root, token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, fs.FileMeta{Id: root, SectionTypes: map[string]string{}, Perms: map[string]uint8{}, Hooks: []string{}}, fm)
+
+	res, _ = getMeta(file, loginHelper(t, srv, "marek", "heslo"))
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res, _ = getMeta(id.New(), token)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestRebuildMeta(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"admin":  hashPassword("heslo123"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	adminToken := loginHelper(t, srv, "admin", "heslo123")
+
+	rebuild := func(file id.ID, token string) *http.Response {
+		return hitPost(t, srv, "/api/v1/meta/"+file.String()+"/rebuild", token, strings.NewReader(""))
+	}
+
+	file := touchHelper(t, srv, token, root, "file")
+	expectFail(t, rebuild(file, token), http.StatusConflict, "meta is intact")
+
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/meta", token, strings.NewReader("{garbage"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hitGet(srv, "/api/v1/meta/"+file.String(), token)
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+
+	// nobody can be told to be the owner by the broken meta
+	res = rebuild(file, token)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res = rebuild(file, adminToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	fm := decodeResponse[struct {
+		Ok   bool        `json:"ok"`
+		Data fs.FileMeta `json:"data"`
+	}](t, res).Data
+	assert.Equal(t, file, fm.Id)
+	assert.Equal(t, "admin", fm.CreatedBy)
+	assert.NotZero(t, fm.CreatedAt)
+	assert.Equal(t, map[string]uint8{"admin": fs.PermOwner | fs.PermRead | fs.PermWrite}, fm.Perms)
+
+	res = hitGet(srv, "/api/v1/meta/"+file.String(), adminToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hitGet(srv, "/api/v1/meta/"+file.String(), token)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	expectFail(t, rebuild(id.New(), adminToken), http.StatusNotFound, "file not found")
+}
+
+func TestLoginPasswordForms(t *testing.T) {
+	t.Parallel()
+	hash := hashPassword("catboy123")
+
+	array, err := json.Marshal(hash)
+	assert.NoError(t, err)
+	forms := []string{
+		string(array),
+		`{"hex": "` + hex.EncodeToString(hash[:]) + `"}`,
+		`{"base64": "` + base64.StdEncoding.EncodeToString(hash[:]) + `"}`,
+	}
+	for _, form := range forms {
+		var p loginPassword
+		assert.NoError(t, json.Unmarshal([]byte(form), &p), form)
+		assert.Equal(t, loginPassword{hash: hash, prehashed: true}, p, form)
+	}
+
+	var p loginPassword
+	assert.NoError(t, json.Unmarshal([]byte(`"catboy123"`), &p))
+	assert.Equal(t, loginPassword{hash: hash, prehashed: false}, p)
+
+	for _, bad := range []string{
+		`{"hex": "abcd"}`,
+		`{"hex": "zz"}`,
+		`{"base64": "!"}`,
+		`{}`,
+		`{"hex": "", "base64": ""}`,
+		`{"sha512": "abcd"}`,
+	} {
+		assert.Error(t, json.Unmarshal([]byte(bad), new(loginPassword)), bad)
+	}
+
+	// the encoded forms log in like the array does
+	srv := newTestServerWithUsers(t, map[string][64]byte{"prokop": hash})
+	res := hitPost(t, srv, "/api/v1/login", "", map[string]any{
+		"username": "prokop",
+		"password": map[string]string{"hex": hex.EncodeToString(hash[:])},
+	})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	t.Parallel()
+	secret := generateSecret()
+	srv, root := newTestServerWithSecret(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"admin":  hashPassword("heslo123"),
+	}, secret, "--max_children", "7", "--dir_perm", "0700")
+
+	res := hitGet(srv, "/api/v1/config", loginHelper(t, srv, "prokop", "catboy123"))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res = hitGet(srv, "/api/v1/config", loginHelper(t, srv, "admin", "heslo123"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body := getBody(t, res)
+	assert.NotContains(t, body, secret)
+	assert.NotContains(t, strings.ToLower(body), "secret")
+
+	var conf struct {
+		Data map[string]any `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &conf))
+	assert.Equal(t, root.String(), conf.Data["rootId"])
+	assert.Equal(t, tokenTTL.String(), conf.Data["tokenTtl"])
+	assert.Equal(t, float64(7), conf.Data["maxChildren"])
+	assert.Equal(t, "0700", conf.Data["dirPerm"])
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Parallel()
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	secret := generateSecret()
+	env := func(s string) string {
+		if s == "ARCHIIV_SECRET" {
+			return secret
+		}
+		return ""
+	}
+
+	dir := t.TempDir()
+	rootID, err := fs.InitFsDir(dir, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"admin":  hashPassword("heslo123"),
+	}, fs.Options{})
+	assert.NoError(t, err)
+
+	configFile := filepath.Join(t.TempDir(), "archiiv.conf")
+	writeConfig := func(lines ...string) {
+		assert.NoError(t, os.WriteFile(configFile, []byte(strings.Join(lines, "\n")), 0600))
+	}
+	writeConfig("# limits", "--max_upload_bytes=10", "--data_dir="+dir)
+
+	srv, conf, err := createServer(log, []string{
+		"--root_id", rootID.String(),
+		"--config_file", configFile,
+	}, env)
+	assert.NoError(t, err)
+	assert.Equal(t, dir, conf.dataDir)
+
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	file := touchHelper(t, srv, token, rootID, "file")
+	upload := func() *http.Response {
+		return hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("twenty bytes of data"))
+	}
+	expectFail(t, upload(), http.StatusRequestEntityTooLarge, "upload is larger than 10 bytes")
+
+	// the data dir can't change without a restart, the limit can
+	writeConfig("--max_upload_bytes=100", "--data_dir="+t.TempDir(), "--log_level=debug")
+	assert.NoError(t, reloadConfig(log, conf, env))
+	assert.Equal(t, http.StatusOK, upload().StatusCode)
+
+	res := hitGet(srv, "/api/v1/config", loginHelper(t, srv, "admin", "heslo123"))
+	var reported struct {
+		Data map[string]any `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&reported))
+	assert.Equal(t, dir, reported.Data["dataDir"])
+	assert.Equal(t, float64(100), reported.Data["maxUploadBytes"])
+	assert.Equal(t, "DEBUG", reported.Data["logLevel"])
+
+	// a broken config keeps the old values
+	writeConfig("--max_upload_bytes=-1")
+	assert.Error(t, reloadConfig(log, conf, env))
+	assert.Equal(t, int64(100), conf.live.Load().maxUploadBytes)
+}
+
+func TestLoginBadRequests(t *testing.T) {
+	t.Parallel()
+	srv := newTestServerWithUsers(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+
+	post := func(contentType, body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	expectFail(t, post("application/x-www-form-urlencoded", "username=prokop&password=catboy123"),
+		http.StatusUnsupportedMediaType, "login expects application/json")
+	expectFail(t, post("text/plain", `{"username":"prokop","password":"catboy123"}`),
+		http.StatusUnsupportedMediaType, "login expects application/json")
+	expectFail(t, post("application/json", ""), http.StatusBadRequest, "empty body")
+	expectFail(t, post("application/json", `{"username":"prokop",`), http.StatusBadRequest, "malformed json")
+	expectFail(t, post("application/json", `{"password":"catboy123"}`), http.StatusBadRequest, "missing username")
+	expectFail(t, post("application/json", `{"username":"prokop"}`), http.StatusBadRequest, "missing password")
+
+	res := post("application/json; charset=utf-8", `{"username":"prokop","password":"catboy123"}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	// no type at all is still fine
+	res = post("", `{"username":"prokop","password":"catboy123"}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestSectionsDetail(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	file := touchHelper(t, srv, token, root, "photo")
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/upload/"+file.String()+"/data", strings.NewReader("jpeg bytes"))
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "image/jpeg")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	res := hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/notes", token, strings.NewReader("hi"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = hitGet(srv, "/api/v1/sections/"+file.String(), token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []string{"data", "meta", "notes"}, decodeResponse[struct {
+		Ok   bool     `json:"ok"`
+		Data []string `json:"data"`
+	}](t, res).Data)
+
+	res = hitGet(srv, "/api/v1/sections/"+file.String()+"?detail=true", token)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	infos := decodeResponse[struct {
+		Ok   bool             `json:"ok"`
+		Data []fs.SectionInfo `json:"data"`
+	}](t, res).Data
+	if assert.Len(t, infos, 3) {
+		assert.Equal(t, "data", infos[0].Name)
+		assert.Equal(t, int64(len("jpeg bytes")), infos[0].Size)
+		assert.Equal(t, "image/jpeg", infos[0].Type)
+		assert.WithinDuration(t, time.Now(), infos[0].Modified, time.Minute)
+
+		assert.Equal(t, "meta", infos[1].Name)
+		assert.Positive(t, infos[1].Size)
+
+		assert.Equal(t, "notes", infos[2].Name)
+		assert.Equal(t, int64(2), infos[2].Size)
+		assert.Empty(t, infos[2].Type)
+	}
+
+	res = hitGet(srv, "/api/v1/sections/"+root.String(), token)
+	assert.Equal(t, "{\"ok\":true,\"data\":[]}\n", getBody(t, res))
+	res = hitGet(srv, "/api/v1/sections/"+file.String()+"?detail=maybe", token)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("kočička"),
+	})
+	prokop := loginHelper(t, srv, "prokop", "catboy123")
+	marek := loginHelper(t, srv, "marek", "kočička")
+
+	post := func(target, token, key string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		req.Header.Add("Authorization", token)
+		req.Header.Add("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	touch := "/api/v1/touch/" + root.String() + "/file"
+	status, first := post(touch, prokop, "retry-1")
+	assert.Equal(t, http.StatusOK, status)
+	status, retry := post(touch, prokop, "retry-1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, first, retry)
+	assert.Len(t, lsHelper(t, srv, prokop, "/api/v1/ls/"+root.String()), 1)
+
+	// keys are per user
+	status, other := post(touch, marek, "retry-1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, first, other)
+	assert.Len(t, lsHelper(t, srv, prokop, "/api/v1/ls/"+root.String()), 2)
+
+	status, _ = post("/api/v1/mkdir/"+root.String()+"/dir", prokop, "retry-1")
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	// the recorded response is still indented when asked for
+	status, pretty := post("/api/v1/mkdir/"+root.String()+"/pretty?pretty=true", prokop, "retry-2")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, pretty, "\n  \"data\": ")
+	status, retry = post("/api/v1/mkdir/"+root.String()+"/pretty?pretty=true", prokop, "retry-2")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, pretty, retry)
+
+	// without the header every request runs
+	touchHelper(t, srv, prokop, root, "file")
+	assert.Len(t, lsHelper(t, srv, prokop, "/api/v1/ls/"+root.String()), 4)
+}
+
+func TestIdempotencyLimits(t *testing.T) {
+	t.Parallel()
+	cache := newIdempotencyCache(time.Hour)
+	cache.maxPerUser, cache.maxEntries, cache.maxBody = 2, 3, 8
+
+	runs := 0
+	h := idempotent(cache, slog.New(slog.NewJSONHandler(io.Discard, nil)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		_, _ = io.WriteString(w, r.URL.Query().Get("body"))
+	}))
+	post := func(user, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/?body="+body, nil)
+		req = req.WithContext(context.WithValue(req.Context(), usernameKey{}, user))
+		req.Header.Add("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// big responses go through, but aren't kept
+	for range 2 {
+		w := post("prokop", "big", "more-than-eight")
+		assert.Equal(t, "more-than-eight", w.Body.String())
+	}
+	assert.Equal(t, 2, runs)
+	assert.Empty(t, cache.responses)
+
+	assert.Equal(t, http.StatusOK, post("prokop", "a", "a").Code)
+	assert.Equal(t, http.StatusOK, post("prokop", "b", "b").Code)
+	w := post("prokop", "c", "c")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, 4, runs)
+	// the kept ones still answer
+	assert.Equal(t, "a", post("prokop", "a", "a").Body.String())
+	assert.Equal(t, 4, runs)
+
+	// past the global limit the oldest go
+	assert.Equal(t, http.StatusOK, post("marek", "a", "a").Code)
+	assert.Equal(t, http.StatusOK, post("marek", "b", "b").Code)
+	assert.Len(t, cache.responses, 3)
+	assert.NotContains(t, cache.responses, idempotencyKey{"prokop", "a"})
+	assert.Equal(t, map[string]int{"prokop": 1, "marek": 2}, cache.perUser)
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	t.Parallel()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, "twelve bytes")
+	})
+
+	var clf bytes.Buffer
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/ls/x?pretty=true", nil)
+	before := time.Now()
+	logAccesses(slog.New(slog.NewJSONHandler(io.Discard, nil)), accessLogCLF, &clf, h).ServeHTTP(httptest.NewRecorder(), req)
+
+	line := clf.String()
+	assert.Regexp(t, `^192\.0\.2\.1 - - \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /api/v1/ls/x\?pretty=true HTTP/1\.1" 201 12\n$`, line)
+	start, end := strings.Index(line, "["), strings.Index(line, "]")
+	at, err := time.Parse(clfTimeFormat, line[start+1:end])
+	assert.NoError(t, err)
+	assert.WithinDuration(t, before, at, 2*time.Second)
+
+	var logs bytes.Buffer
+	logAccesses(slog.New(slog.NewJSONHandler(&logs, nil)), accessLogJSON, &clf, h).ServeHTTP(httptest.NewRecorder(), req)
+	var entry struct {
+		Msg    string `json:"msg"`
+		Method string `json:"method"`
+		URL    string `json:"url"`
+		Status int    `json:"status"`
+		Size   int64  `json:"size"`
+	}
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+	assert.Equal(t, "request", entry.Msg)
+	assert.Equal(t, http.MethodGet, entry.Method)
+	assert.Equal(t, "/api/v1/ls/x", entry.URL)
+	assert.Equal(t, http.StatusCreated, entry.Status)
+	assert.Equal(t, int64(12), entry.Size)
+	assert.Equal(t, line, clf.String(), "json goes to the server log only")
+
+	_, _, err = createServer(slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		[]string{"--data_dir", t.TempDir(), "--access_log_format", "apache"}, func(string) string { return "" })
+	assert.ErrorContains(t, err, "access log format must be json or clf")
+}
+
+func TestTime(t *testing.T) {
+	t.Parallel()
+	srv := newTestServerWithUsers(t, map[string][64]byte{})
+
+	type timeResponse struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Time            time.Time `json:"time"`
+			TokenTTL        string    `json:"tokenTTL"`
+			TokenTTLSeconds int64     `json:"tokenTTLSeconds"`
+		} `json:"data"`
+	}
+
+	// no login needed, a client with an expired token asks too
+	res := hitGet(srv, "/api/v1/time", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	v := decodeResponse[timeResponse](t, res)
+	assert.True(t, v.Ok)
+	assert.WithinDuration(t, time.Now(), v.Data.Time, time.Second)
+	assert.Equal(t, time.UTC, v.Data.Time.Location())
+	assert.Equal(t, tokenTTL.String(), v.Data.TokenTTL)
+	assert.Equal(t, int64(tokenTTL.Seconds()), v.Data.TokenTTLSeconds)
+}
+
+func TestRoutesEndpoint(t *testing.T) {
+	t.Parallel()
+	type routeInfo struct {
+		Method  string `json:"method"`
+		Pattern string `json:"pattern"`
+		Auth    string `json:"auth"`
+	}
+	listRoutes := func(srv http.Handler, target string) []routeInfo {
+		var routes []routeInfo
+		for _, rt := range listRoutesHelper(t, srv, target) {
+			routes = append(routes, routeInfo{rt.Method, rt.Pattern, rt.Auth})
+		}
+		return routes
+	}
+
+	routes := listRoutes(newTestServerWithUsers(t, nil), "/api/v1/routes")
+	for _, want := range []routeInfo{
+		{http.MethodGet, "/api/v1/ls/{id}", authLogin},
+		{http.MethodGet, "/api/v1/cat/{id}/{section}", authLogin},
+		{http.MethodPost, "/api/v1/upload/{id}/{section}", authLogin},
+		{http.MethodHead, "/api/v1/upload/{id}/{section}", authLogin},
+		{http.MethodPost, "/api/v1/touch/{id}/{name}", authLogin},
+		{http.MethodPost, "/api/v1/mkdir/{id}/{name}", authLogin},
+		{http.MethodPost, "/api/v1/login", authNone},
+		{http.MethodGet, "/api/v1/validate/{id}", authNone},
+		{http.MethodGet, "/api/v1/routes", authNone},
+		{http.MethodGet, "/api/v1/config", authAdmin},
+		{http.MethodPost, "/api/v1/create/{username}", authAdmin},
+	} {
+		assert.Contains(t, routes, want)
+	}
+
+	seen := make(map[routeInfo]bool)
+	for _, rt := range routes {
+		assert.False(t, seen[rt], "%v listed twice", rt)
+		seen[rt] = true
+	}
+
+	// the listed patterns are the ones to call
+	srv, _ := newTestServerWithRoot(t, nil, "--route_prefix", "/archiiv/")
+	assert.Contains(t, listRoutes(srv, "/archiiv/api/v1/routes"), routeInfo{http.MethodGet, "/archiiv/api/v1/routes", authNone})
+}
+
+type routeResponse struct {
+	Method     string   `json:"method"`
+	Pattern    string   `json:"pattern"`
+	Auth       string   `json:"auth"`
+	Middleware []string `json:"middleware"`
+}
+
+func listRoutesHelper(t *testing.T, srv http.Handler, target string) []routeResponse {
+	res := hitGet(srv, target, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	return decodeResponse[struct {
+		Ok   bool            `json:"ok"`
+		Data []routeResponse `json:"data"`
+	}](t, res).Data
+}
+
+func TestRouteTable(t *testing.T) {
+	t.Parallel()
+	srv := newTestServerWithUsers(t, nil)
+
+	var (
+		public   = []string{}
+		loggedIn = []string{authLogin}
+		mutating = []string{authLogin, "idempotent"}
+		uploads  = []string{authLogin, "limitUploads"}
+		admins   = []string{authAdmin}
+	)
+	want := map[string][]string{
+		"GET /api/v1/ls/{id}":                                                loggedIn,
+		"GET /api/v1/watch/{id}":                                             loggedIn,
+		"GET /api/v1/events":                                                 loggedIn,
+		"GET /api/v1/validate/{id}":                                          public,
+		"GET /api/v1/stat/{id}":                                              loggedIn,
+		"POST /api/v1/statmany":                                              loggedIn,
+		"GET /api/v1/meta/{id}":                                              loggedIn,
+		"POST /api/v1/meta/{id}/rebuild":                                     mutating,
+		"GET /api/v1/sections/{id}":                                          loggedIn,
+		"GET /api/v1/section/{id}/{section}/exists":                          loggedIn,
+		"GET /api/v1/cat/{id}/{section}":                                     loggedIn,
+		"GET /api/v1/bundle/{id}":                                            loggedIn,
+		"POST /api/v1/upload/{id}/{section}":                                 uploads,
+		"POST /api/v1/upload/{id}":                                           uploads,
+		"HEAD /api/v1/upload/{id}/{section}":                                 loggedIn,
+		"POST /api/v1/allocate/{id}/{section}":                               mutating,
+		"GET /api/v1/tree/{id}":                                              loggedIn,
+		"GET /api/v1/du/{id}":                                                loggedIn,
+		"GET /api/v1/treehash/{id}":                                          loggedIn,
+		"POST /api/v1/renamesection/{id}/{old}/{new}":                        mutating,
+		"POST /api/v1/movesection/{srcID}/{srcSection}/{dstID}/{dstSection}": mutating,
+		"POST /api/v1/touch/{id}/{name}":                                     mutating,
+		"POST /api/v1/mkdir/{id}/{name}":                                     mutating,
+		"POST /api/v1/mkdirp/{id}":                                           mutating,
+		"POST /api/v1/perms/copy/{srcID}/{dstID}":                            mutating,
+		"POST /api/v1/chown/{id}/{username}":                                 mutating,
+		"POST /api/v1/defaultperms/{id}":                                     mutating,
+		"POST /api/v1/settype/{id}/{isDir}":                                  mutating,
+		"POST /api/v1/mount/{parentID}/{childID}":                            mutating,
+		"POST /api/v1/unmount/{parentID}/{childID}":                          mutating,
+		"POST /api/v1/login":                                                 public,
+		"POST /api/v1/logout":                                                loggedIn,
+		"POST /api/v1/relogin":                                               public,
+		"GET /api/v1/token/verify":                                           public,
+		"GET /api/v1/whoami":                                                 loggedIn,
+		"GET /api/v1/routes":                                                 public,
+		"GET /api/v1/time":                                                   public,
+		"POST /api/v1/detach/{id}":                                           admins,
+		"GET /api/v1/owned/{username}":                                       admins,
+		"GET /api/v1/config":                                                 admins,
+		"GET /api/v1/snapshot":                                               admins,
+		"POST /api/v1/restore":                                               admins,
+		"POST /api/v1/import/{id}":                                           admins,
+		"POST /api/v1/users/import":                                          admins,
+		"POST /api/v1/delete/{username}":                                     admins,
+		"POST /api/v1/create/{username}":                                     admins,
+	}
+
+	got := make(map[string][]string)
+	for _, rt := range listRoutesHelper(t, srv, "/api/v1/routes") {
+		got[rt.Method+" "+rt.Pattern] = rt.Middleware
+	}
+	assert.Equal(t, want, got)
+
+	// the middleware is really there, the routes that need a login refuse
+	// requests without one
+	params := regexp.MustCompile(`\{[^}]+\}`)
+	for pattern, middleware := range want {
+		if len(middleware) == 0 || (middleware[0] != authLogin && middleware[0] != authAdmin) {
+			continue
+		}
+		method, path, _ := strings.Cut(pattern, " ")
+		res := hit(srv, method, params.ReplaceAllString(path, id.New().String()), "", nil)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode, pattern)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	res := hit(srv, http.MethodDelete, "/api/v1/ls/"+root.String(), token, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Equal(t, "GET, HEAD", res.Header.Get("Allow"))
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.Equal(t, responseError{Ok: false, Error: "405 method not allowed", Code: "method_not_allowed"}, decodeResponse[responseError](t, res))
+
+	res = hit(srv, http.MethodGet, "/api/v1/upload/"+root.String()+"/data", token, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Equal(t, "HEAD, POST", res.Header.Get("Allow"))
+
+	// no login needed to find out
+	res = hit(srv, http.MethodPut, "/api/v1/login", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Equal(t, "POST", res.Header.Get("Allow"))
+
+	// the allowed methods still work and unknown paths are still not found
+	assert.Equal(t, http.StatusOK, hit(srv, http.MethodHead, "/api/v1/ls/"+root.String(), token, nil).StatusCode)
+	assert.Equal(t, http.StatusNotFound, hit(srv, http.MethodDelete, "/api/v1/nope", token, nil).StatusCode)
+}
+
+func TestAllocate(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	}, "--max_upload_bytes", strconv.Itoa(2<<20))
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	file := touchHelper(t, srv, token, root, "big")
+
+	res := hitPost(t, srv, "/api/v1/allocate/"+file.String()+"/data?size="+strconv.Itoa(1<<20), token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// the offset is what has been written, not the allocated size
+	uploadOffset := func() string {
+		res := hit(srv, http.MethodHead, "/api/v1/upload/"+file.String()+"/data", token, nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		return res.Header.Get("Upload-Offset")
+	}
+	assert.Equal(t, "0", uploadOffset())
+
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data?offset=10", token, strings.NewReader("chunk"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token)
+	body := getBody(t, res)
+	assert.Len(t, body, 1<<20)
+	assert.Equal(t, "\x00chunk\x00", body[9:16])
+	assert.Equal(t, "0", uploadOffset(), "past a gap")
+
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data?offset=0", token, strings.NewReader(strings.Repeat("x", 12)))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "12", uploadOffset())
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data?offset=12", token, strings.NewReader(strings.Repeat("y", 1<<20-12)))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, strconv.Itoa(1<<20), uploadOffset(), "whole")
+
+	// a plain upload makes it whole whatever was written before
+	res = hitPost(t, srv, "/api/v1/allocate/"+file.String()+"/data?size=100", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "0", uploadOffset())
+	res = hit(srv, http.MethodPost, "/api/v1/upload/"+file.String()+"/data", token, strings.NewReader("short"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "5", uploadOffset())
+
+	res = hitPost(t, srv, "/api/v1/allocate/"+file.String()+"/data?size=-1", token, nil)
+	expectFail(t, res, http.StatusBadRequest, "invalid size")
+	res = hitPost(t, srv, "/api/v1/allocate/"+file.String()+"/data", token, nil)
+	expectFail(t, res, http.StatusBadRequest, "invalid size")
+	res = hitPost(t, srv, "/api/v1/allocate/"+file.String()+"/data?size="+strconv.Itoa(3<<20), token, nil)
+	expectFail(t, res, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload is larger than %d bytes", 2<<20))
+	res = hitPost(t, srv, "/api/v1/allocate/"+file.String()+"/meta?size=10", token, nil)
+	expectFail(t, res, http.StatusBadRequest, "meta can't be allocated")
+
+	res = hitPost(t, srv, "/api/v1/allocate/"+file.String()+"/data?size=10", loginHelper(t, srv, "marek", "heslo"), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestHostAndPortValidation(t *testing.T) {
+	t.Parallel()
+	env := func(string) string { return "" }
+	start := func(args ...string) error {
+		_, err := getConfig(append([]string{"--data_dir", "/tmp", "--root_id", id.New().String()}, args...), env)
+		return err
+	}
+
+	for _, port := range []string{"0", "8275", "65535", "http"} {
+		assert.NoError(t, start("--port", port), port)
+	}
+	for _, port := range []string{"65536", "-1", "abc", "", "80 "} {
+		assert.ErrorContains(t, start("--port", port), "port must be a number from 0 to 65535 or a service name", port)
+	}
+
+	for _, host := range []string{"", "localhost", "archiiv.example.org", "127.0.0.1", "::1", "fe80::1%eth0"} {
+		assert.NoError(t, start("--host", host), host)
+	}
+	for _, host := range []string{"[::1]", "local host", "-archiiv", "archiiv..org", "http://localhost", "archiiv:8275", strings.Repeat("a", 64)} {
+		assert.ErrorContains(t, start("--host", host), "host must be empty, an IP address or a hostname", host)
+	}
+}
+
+func TestStatMany(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	marekToken := loginHelper(t, srv, "marek", "heslo")
+
+	type statManyResponse struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			Files  map[string]fs.FileInfo `json:"files"`
+			Errors map[string]string      `json:"errors"`
+		} `json:"data"`
+	}
+
+	a := touchHelper(t, srv, token, root, "a")
+	dir := mkdirHelper(t, srv, token, root, "dir")
+	private := touchHelper(t, srv, marekToken, root, "private")
+	unknown := id.New()
+
+	res := hitPost(t, srv, "/api/v1/statmany", token, []id.ID{a, dir, private, unknown})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	stats := decodeResponse[statManyResponse](t, res).Data
+	assert.Len(t, stats.Files, 2)
+	assert.Equal(t, "a", stats.Files[a.String()].Name)
+	assert.False(t, stats.Files[a.String()].IsDir)
+	assert.Equal(t, "dir", stats.Files[dir.String()].Name)
+	assert.True(t, stats.Files[dir.String()].IsDir)
+	assert.Equal(t, map[string]string{private.String(): "forbidden", unknown.String(): "not found"}, stats.Errors)
+
+	res = hitPost(t, srv, "/api/v1/statmany", token, []id.ID{})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	stats = decodeResponse[statManyResponse](t, res).Data
+	assert.Empty(t, stats.Files)
+	assert.Empty(t, stats.Errors)
+
+	res = hitPost(t, srv, "/api/v1/statmany", token, make([]id.ID, maxStatMany+1))
+	expectFail(t, res, http.StatusBadRequest, fmt.Sprintf("at most %d ids per request", maxStatMany))
+	res = hitPost(t, srv, "/api/v1/statmany", token, make([]id.ID, 3*maxStatMany))
+	expectFail(t, res, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d ids per request", maxStatMany))
+	res = hitPost(t, srv, "/api/v1/statmany", token, map[string]string{})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// forbidden looks like missing with --obscure_not_found
+	srv, root = newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"marek":  hashPassword("heslo"),
+	}, "--obscure_not_found")
+	private = touchHelper(t, srv, loginHelper(t, srv, "marek", "heslo"), root, "private")
+	res = hitPost(t, srv, "/api/v1/statmany", loginHelper(t, srv, "prokop", "catboy123"), []id.ID{private})
+	assert.Equal(t, map[string]string{private.String(): "not found"}, decodeResponse[statManyResponse](t, res).Data.Errors)
+}
+
+func TestCreateWithID(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{
+		"prokop": hashPassword("catboy123"),
+		"admin":  hashPassword("heslo123"),
+	})
+	token := loginHelper(t, srv, "admin", "heslo123")
+
+	dir, file := id.New(), id.New()
+	prokop := loginHelper(t, srv, "prokop", "catboy123")
+	res := hitPost(t, srv, "/api/v1/mkdir/"+root.String()+"/docs?id="+dir.String(), prokop, nil)
+	expectFail(t, res, http.StatusForbidden, "only the admin can choose the id")
+	res = hitPost(t, srv, "/api/v1/touch/"+root.String()+"/docs?id="+dir.String(), prokop, nil)
+	expectFail(t, res, http.StatusForbidden, "only the admin can choose the id")
+
+	res = hitPost(t, srv, "/api/v1/mkdir/"+root.String()+"/docs?id="+dir.String(), token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, dir, decodeResponse[struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			NewDirID id.ID `json:"new_dir_id"`
+		} `json:"data"`
+	}](t, res).Data.NewDirID)
+
+	res = hitPost(t, srv, "/api/v1/touch/"+dir.String()+"/notes?id="+file.String(), token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []id.ID{file}, lsHelper(t, srv, token, "/api/v1/ls/"+dir.String()))
+	assert.Equal(t, "admin", readMetaHelper(t, srv, token, file).CreatedBy)
+
+	res = hitPost(t, srv, "/api/v1/touch/"+root.String()+"/again?id="+file.String(), token, nil)
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	res = hitPost(t, srv, "/api/v1/mkdir/"+root.String()+"/bad?id=nope", token, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, []id.ID{dir}, lsHelper(t, srv, token, "/api/v1/ls/"+root.String()))
+}
+
+func TestUploadChecksum(t *testing.T) {
+	t.Parallel()
+	srv, root := newTestServerWithRoot(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+	file := touchHelper(t, srv, token, root, "file")
+
+	upload := func(content string, header map[string]string, query string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/upload/"+file.String()+"/data"+query, strings.NewReader(content))
+		req.Header.Add("Authorization", token)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Result()
+	}
+	cat := func() string {
+		return getBody(t, hitGet(srv, "/api/v1/cat/"+file.String()+"/data", token))
+	}
+
+	sha := sha256.Sum256([]byte("hello"))
+	res := upload("hello", map[string]string{"X-Checksum-SHA256": hex.EncodeToString(sha[:])}, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]string{"data": "sha256:" + hex.EncodeToString(sha[:])}, readMetaHelper(t, srv, token, file).SectionChecksums)
+
+	// the bad content never replaces the section
+	res = upload("hellp", map[string]string{"X-Checksum-SHA256": hex.EncodeToString(sha[:])}, "")
+	expectFail(t, res, http.StatusBadRequest, "checksum mismatch (sha256)")
+	assert.Equal(t, "hello", cat())
+	res = upload("hellp", map[string]string{"X-Checksum-SHA256": hex.EncodeToString(sha[:])}, "?compress=gzip")
+	expectFail(t, res, http.StatusBadRequest, "checksum mismatch (sha256)")
+	assert.Equal(t, "hello", cat())
+
+	sum := md5.Sum([]byte("world")) // #nosec G401
+	res = upload("world", map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(sum[:])}, "?compress=gzip")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "world", cat())
+	assert.Equal(t, map[string]string{"data": "md5:" + hex.EncodeToString(sum[:])}, readMetaHelper(t, srv, token, file).SectionChecksums)
+	res = upload("world!", map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(sum[:])}, "")
+	expectFail(t, res, http.StatusBadRequest, "checksum mismatch (md5)")
+
+	// a write without a checksum forgets the old one
+	res = upload("unverified", nil, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, readMetaHelper(t, srv, token, file).SectionChecksums)
+
+	res = upload("hello", map[string]string{"X-Checksum-SHA256": "nope"}, "")
+	expectFail(t, res, http.StatusBadRequest, "X-Checksum-SHA256 must be a hex encoded sha256")
+	res = upload("hello", map[string]string{"X-Checksum-SHA256": hex.EncodeToString(sha[:])}, "?offset=0")
+	expectFail(t, res, http.StatusBadRequest, "checksums can't be verified for uploads at an offset")
+	assert.Equal(t, "unverified", cat())
+}
+
+func TestLogout(t *testing.T) {
+	t.Parallel()
+	srv := newTestServerWithUsers(t, map[string][64]byte{"prokop": hashPassword("catboy123")})
+	token := loginHelper(t, srv, "prokop", "catboy123")
+
+	assert.Equal(t, http.StatusOK, hitGet(srv, "/api/v1/whoami", token).StatusCode)
+	res := hitPost(t, srv, "/api/v1/logout", token, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	expectFail(t, hitGet(srv, "/api/v1/whoami", token), http.StatusUnauthorized, "401 unauthorized")
+	expectFail(t, hitPost(t, srv, "/api/v1/logout", token, nil), http.StatusUnauthorized, "401 unauthorized")
+	assert.Equal(t, "{\"ok\":true,\"data\":{\"valid\":false}}\n", getBody(t, hitGet(srv, "/api/v1/token/verify", token)))
+
+	// the other sessions go on
+	assert.Equal(t, http.StatusOK, hitGet(srv, "/api/v1/whoami", loginHelper(t, srv, "prokop", "catboy123")).StatusCode)
+}
+
+func TestReapRevokedTokens(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	var clockLock sync.Mutex
+	now := start
+	advance := func(d time.Duration) {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		now = now.Add(d)
+	}
+
+	revoked := newRevokedTokens()
+	revoked.now = func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+	revoked.revoke("soon", start.Add(time.Hour))
+	revoked.revoke("later", start.Add(2*time.Hour))
+
+	assert.Equal(t, 0, revoked.prune())
+	advance(90 * time.Minute)
+	assert.Equal(t, 1, revoked.prune())
+	assert.False(t, revoked.isRevoked("soon"))
+	assert.True(t, revoked.isRevoked("later"))
+
+	// the reaper does the same on its own
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	stop := reapRevokedTokens(log, revoked, time.Millisecond)
+	defer stop()
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, revoked.isRevoked("later"))
+	advance(time.Hour)
+	assert.Eventually(t, func() bool { return revoked.len() == 0 }, time.Second, time.Millisecond)
+
+	var none *revokedTokens
+	assert.False(t, none.isRevoked("anything"))
+}
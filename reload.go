@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// tunables are the settings that can change without a restart. On SIGHUP the
+// configuration is read again and only these are taken from it, everything
+// else (data dir, root ID, ...) stays as the server started
+type tunables struct {
+	// maxUploadBytes limits the body of an upload. Zero means unlimited
+	maxUploadBytes int64
+	logLevel       slog.Level
+}
+
+// logLevel is the level of the server log, see main
+var logLevel = new(slog.LevelVar)
+
+func (conf config) tunables() *tunables {
+	return &tunables{
+		maxUploadBytes: conf.maxUploadBytes,
+		logLevel:       conf.logLevel,
+	}
+}
+
+// readConfigFile reads flags from the config file, one per line in the same
+// form as on the command line. Empty lines and lines starting with # are
+// skipped
+func readConfigFile(path string) ([]string, error) {
+	f, err := os.Open(path) // #nosec G304: the path comes from the operator
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var args []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args = append(args, line)
+	}
+	return args, scanner.Err()
+}
+
+// reloadConfig reads the configuration again and applies its tunables. The
+// command line still takes precedence over the config file
+func reloadConfig(log *slog.Logger, conf config, env func(string) string) error {
+	fresh, err := getConfig(conf.args, env)
+	if err != nil {
+		return err
+	}
+
+	t := fresh.tunables()
+	conf.live.Store(t)
+	logLevel.Set(t.logLevel)
+
+	log.Info("reloaded config", "max_upload_bytes", t.maxUploadBytes, "log_level", t.logLevel)
+	return nil
+}
+
+// reloadOnHangup calls reloadConfig on every SIGHUP until stop is called
+func reloadOnHangup(log *slog.Logger, conf config, env func(string) string) (stop func()) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-hangups:
+				if err := reloadConfig(log, conf, env); err != nil {
+					log.Error("reload config", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hangups)
+		close(done)
+	}
+}
+
+// limitUploads applies the current upload limit to the request body. Reading
+// past it fails with *http.MaxBytesError
+func limitUploads(live *atomic.Pointer[tunables], h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit := live.Load().maxUploadBytes; limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// revokedTokens are the tokens logged out before they expired. A token is
+// only kept until it would have expired anyway, reapRevokedTokens drops it
+// after that
+type revokedTokens struct {
+	mutex   sync.Mutex
+	expires map[string]time.Time
+	// now is the clock, replaced in tests
+	now func() time.Time
+}
+
+func newRevokedTokens() *revokedTokens {
+	return &revokedTokens{expires: make(map[string]time.Time), now: time.Now}
+}
+
+func (rt *revokedTokens) revoke(token string, expires time.Time) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.expires[token] = expires
+}
+
+// isRevoked is false for every token without a revoked set, as in tests that
+// build the handlers themselves
+func (rt *revokedTokens) isRevoked(token string) bool {
+	if rt == nil {
+		return false
+	}
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	_, ok := rt.expires[token]
+	return ok
+}
+
+func (rt *revokedTokens) len() int {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	return len(rt.expires)
+}
+
+// prune drops the tokens that expired, they fail verification on their own
+// now. It returns how many were dropped
+func (rt *revokedTokens) prune() int {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	now := rt.now()
+	pruned := 0
+	for token, expires := range rt.expires {
+		if !now.Before(expires) {
+			delete(rt.expires, token)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// reapRevokedTokens prunes the revoked tokens every interval until stop is
+// called. A zero interval never prunes
+func reapRevokedTokens(log *slog.Logger, revoked *revokedTokens, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ticker.C:
+				if n := revoked.prune(); n > 0 {
+					log.Debug("pruned revoked tokens", "pruned", n, "left", revoked.len())
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		wg.Wait()
+	}
+}
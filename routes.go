@@ -4,28 +4,145 @@ import (
 	"archiiv/fs"
 	"log/slog"
 	"net/http"
+	"slices"
 )
 
+// The authentication a route requires
+const (
+	authNone  = "none"
+	authLogin = "login"
+	authAdmin = "admin"
+)
+
+// middleware wraps the handler of a route. The name is how the route table
+// reports it, the authentication ones are named authLogin and authAdmin
+type middleware struct {
+	name string
+	wrap func(http.Handler) http.Handler
+}
+
+// route is an entry of the route table. addRoutes wraps the handler in the
+// middleware, the first one is the outermost
+type route struct {
+	method     string
+	pattern    string
+	middleware []middleware
+	handler    http.Handler
+}
+
+// auth is the authentication the route requires
+func (rt route) auth() string {
+	for _, m := range rt.middleware {
+		if m.name == authLogin || m.name == authAdmin {
+			return m.name
+		}
+	}
+	return authNone
+}
+
 func addRoutes(
 	mux *http.ServeMux,
 	log *slog.Logger,
-	secret string,
+	conf config,
 	userStore userStore,
 	fileStore *fs.Fs,
 ) {
-	mux.Handle("GET /api/v1/ls/{id}", requireLogin(secret, log, handleLs(fileStore, log)))
-	mux.Handle("GET /api/v1/cat/{id}/{section}", requireLogin(secret, log, handleCat(fileStore, log)))
-	mux.Handle("POST /api/v1/upload/{id}/{section}", requireLogin(secret, log, handleUpload(log, fileStore)))
-	mux.Handle("POST /api/v1/touch/{id}/{name}", requireLogin(secret, log, handleTouch(fileStore, log)))
-	mux.Handle("POST /api/v1/mkdir/{id}/{name}", requireLogin(secret, log, handleMkdir(fileStore, log)))
-	mux.Handle("POST /api/v1/mount/{parentID}/{childID}", requireLogin(secret, log, handleMount(fileStore, log)))
-	mux.Handle("POST /api/v1/unmount/{parentID}/{childID}", requireLogin(secret, log, handleUnmount(fileStore, log)))
-
-	mux.Handle("POST /api/v1/login", handleLogin(secret, log, userStore))
-	mux.Handle("POST /api/v1/relogin", http.NotFoundHandler()) // generates a new session token given old token
-	mux.Handle("GET /api/v1/whoami", requireLogin(secret, log, handleWhoami(secret, log)))
-	mux.Handle("POST /api/v1/delete/{username}", adminOnly(secret, log, handleDeleteUser(secret, log, userStore)))
-	mux.Handle("POST /api/v1/create/{username}/{password}", adminOnly(secret, log, http.NotFoundHandler()))
+	secret := conf.secret
+	idempotency := newIdempotencyCache(idempotencyWindow)
+
+	login := middleware{authLogin, func(h http.Handler) http.Handler { return requireLogin(secret, conf.revoked, log, h) }}
+	admin := middleware{authAdmin, func(h http.Handler) http.Handler { return adminOnly(secret, conf.revoked, log, h) }}
+	// idempotency keys are per user, it has to come after login
+	retry := middleware{"idempotent", func(h http.Handler) http.Handler { return idempotent(idempotency, log, h) }}
+	upload := middleware{"limitUploads", func(h http.Handler) http.Handler { return limitUploads(conf.live, h) }}
+
+	var (
+		public   []middleware
+		loggedIn = []middleware{login}
+		mutating = []middleware{login, retry}
+		uploads  = []middleware{login, upload}
+		admins   = []middleware{admin}
+	)
+
+	var routes []route
+	routes = []route{
+		{http.MethodGet, "/api/v1/ls/{id}", loggedIn, handleLs(fileStore, conf.obscureNotFound, log)},
+		{http.MethodGet, "/api/v1/watch/{id}", loggedIn, handleWatch(fileStore, conf.obscureNotFound, log)},
+		{http.MethodGet, "/api/v1/events", loggedIn, handleEvents(fileStore, log)},
+		{http.MethodGet, "/api/v1/validate/{id}", public, handleValidateID(log)},
+		{http.MethodGet, "/api/v1/stat/{id}", loggedIn, handleStat(fileStore, conf.obscureNotFound, conf.cacheMaxAge, log)},
+		{http.MethodPost, "/api/v1/statmany", loggedIn, handleStatMany(fileStore, conf.obscureNotFound, log)},
+		{http.MethodGet, "/api/v1/meta/{id}", loggedIn, handleMeta(fileStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/meta/{id}/rebuild", mutating, handleRebuildMeta(fileStore, conf.obscureNotFound, log)},
+		{http.MethodGet, "/api/v1/sections/{id}", loggedIn, handleSections(fileStore, conf.obscureNotFound, log)},
+		{http.MethodGet, "/api/v1/section/{id}/{section}/exists", loggedIn, handleSectionExists(fileStore, conf.obscureNotFound, log)},
+		{http.MethodGet, "/api/v1/cat/{id}/{section}", loggedIn, handleCat(fileStore, conf.obscureNotFound, log)},
+		{http.MethodGet, "/api/v1/bundle/{id}", loggedIn, handleBundle(fileStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/upload/{id}/{section}", uploads, handleUpload(log, fileStore, conf.obscureNotFound)},
+		{http.MethodPost, "/api/v1/upload/{id}", uploads, handleUploadMultipart(log, fileStore, conf.obscureNotFound)},
+		{http.MethodHead, "/api/v1/upload/{id}/{section}", loggedIn, handleUploadOffset(log, fileStore, conf.obscureNotFound)},
+		{http.MethodPost, "/api/v1/allocate/{id}/{section}", mutating, handleAllocate(fileStore, conf.obscureNotFound, conf.live, log)},
+		{http.MethodGet, "/api/v1/tree/{id}", loggedIn, handleTree(fileStore, conf.maxTreeDepth, conf.obscureNotFound, log)},
+		{http.MethodGet, "/api/v1/du/{id}", loggedIn, handleDiskUsage(fileStore, conf.obscureNotFound, log)},
+		{http.MethodGet, "/api/v1/treehash/{id}", loggedIn, handleTreeHash(fileStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/renamesection/{id}/{old}/{new}", mutating, handleRenameSection(fileStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/movesection/{srcID}/{srcSection}/{dstID}/{dstSection}", mutating, handleMoveSection(fileStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/touch/{id}/{name}", mutating, handleTouch(fileStore, conf.inheritPerms, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/mkdir/{id}/{name}", mutating, handleMkdir(fileStore, conf.inheritPerms, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/mkdirp/{id}", mutating, handleMkdirp(fileStore, conf.inheritPerms, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/perms/copy/{srcID}/{dstID}", mutating, handleCopyPerms(fileStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/chown/{id}/{username}", mutating, handleChown(fileStore, userStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/defaultperms/{id}", mutating, handleDefaultPerms(fileStore, userStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/settype/{id}/{isDir}", mutating, handleSetType(fileStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/mount/{parentID}/{childID}", mutating, handleMount(fileStore, conf.obscureNotFound, log)},
+		{http.MethodPost, "/api/v1/unmount/{parentID}/{childID}", mutating, handleUnmount(fileStore, conf.obscureNotFound, log)},
+
+		{http.MethodPost, "/api/v1/login", public, handleLogin(secret, conf.allowPrehashedLogin, conf.sessionCookie, log, userStore)},
+		{http.MethodPost, "/api/v1/logout", loggedIn, handleLogout(secret, conf.revoked, log)},
+		{http.MethodPost, "/api/v1/relogin", public, http.NotFoundHandler()}, // generates a new session token given old token
+		{http.MethodGet, "/api/v1/token/verify", public, handleVerifyToken(secret, conf.revoked, log)},
+		{http.MethodGet, "/api/v1/whoami", loggedIn, handleWhoami(conf.cacheMaxAge, log)},
+		{http.MethodGet, "/api/v1/routes", public, handleRoutes(conf.routePrefix, &routes, log)},
+		{http.MethodGet, "/api/v1/time", public, handleTime(log)},
+		{http.MethodPost, "/api/v1/detach/{id}", admins, handleDetach(fileStore, log)},
+		{http.MethodGet, "/api/v1/owned/{username}", admins, handleOwned(fileStore, log)},
+		{http.MethodGet, "/api/v1/config", admins, handleConfig(conf, log)},
+		{http.MethodGet, "/api/v1/snapshot", admins, handleSnapshot(fileStore, log)},
+		{http.MethodPost, "/api/v1/restore", admins, handleRestore(fileStore, conf.importMaxEntries, conf.importTimeout, log)},
+		{http.MethodPost, "/api/v1/import/{id}", admins, handleImport(fileStore, conf.importMaxEntries, conf.importTimeout, log)},
+		{http.MethodPost, "/api/v1/users/import", admins, handleImportUsers(log, userStore, conf.importMaxEntries, conf.importTimeout)},
+		{http.MethodPost, "/api/v1/delete/{username}", admins, handleDeleteUser(secret, log, userStore, fileStore, conf.deletedUserFiles)},
+		{http.MethodPost, "/api/v1/create/{username}", admins, handleCreateUser(log, userStore)},
+	}
+
+	// every route lives under the configured prefix, so the API can be
+	// mounted next to other services behind one reverse proxy
+	var patterns []string
+	allow := make(map[string][]string)
+	for _, rt := range routes {
+		h := rt.handler
+		for _, m := range slices.Backward(rt.middleware) {
+			h = m.wrap(h)
+		}
+		mux.Handle(rt.method+" "+conf.routePrefix+rt.pattern, h)
+
+		if _, ok := allow[rt.pattern]; !ok {
+			patterns = append(patterns, rt.pattern)
+		}
+		allow[rt.pattern] = append(allow[rt.pattern], rt.method)
+		if rt.method == http.MethodGet {
+			// the mux serves HEAD with the GET handler
+			allow[rt.pattern] = append(allow[rt.pattern], http.MethodHead)
+		}
+	}
+
+	// the other methods of the same paths, the patterns without a method
+	// are less specific than the routes
+	for _, pattern := range patterns {
+		slices.Sort(allow[pattern])
+		methods := slices.Compact(allow[pattern])
+		mux.Handle(conf.routePrefix+pattern, handleMethodNotAllowed(methods, log))
+	}
 
 	mux.Handle("/", http.NotFoundHandler())
 }
@@ -1,41 +1,80 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 // All user data is stored in a directory. Each user has a file named after
-// their username. Username has to be [A-Za-z0-9_-]+
+// their username. Username has to be [A-Za-z0-9_-]+ and its length within the
+// usernamePolicy
 
 type userStore struct {
 	// path of the users directory
 	path string
+	// mode of newly created user files
+	filePerm os.FileMode
+	policy   usernamePolicy
 }
 
-func newUserStore(path string) (us userStore, err error) {
+// usernamePolicy bounds the length of usernames. They end up as file names,
+// so there has to be an upper bound. Reserved names are kept free for files
+// living next to the users, compared case-insensitively for the sake of
+// case-insensitive filesystems
+type usernamePolicy struct {
+	minLen   int
+	maxLen   int
+	reserved []string
+}
+
+var defaultUsernamePolicy = usernamePolicy{minLen: 1, maxLen: 64, reserved: []string{"roles"}}
+
+func newUserStore(path string, filePerm os.FileMode) (us userStore, err error) {
 	path = filepath.Clean(path)
 	if !filepath.IsAbs(path) {
 		err = fmt.Errorf("users directory has to be absolute path (is: %v)", path)
 	} else {
-		us = userStore{path: path}
+		us = userStore{path: path, filePerm: filePerm, policy: defaultUsernamePolicy}
 	}
 	return
 }
 
-var usernameRegex = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+var usernameRegex = regexp.MustCompile("^[A-Za-z0-9_-]*$")
 
-func usernameIsSane(username string) error {
-	if !usernameRegex.MatchString(username) {
-		return fmt.Errorf("username does not match the usernameRegex (is %v)", username)
+var (
+	errUsernameTooShort = errors.New("username too short")
+	errUsernameTooLong  = errors.New("username too long")
+	errUsernameBadChar  = errors.New("username may only contain A-Z, a-z, 0-9, _ and -")
+	errUsernameReserved = errors.New("username is reserved")
+)
+
+func (p usernamePolicy) check(username string) error {
+	switch {
+	case len(username) < p.minLen:
+		return fmt.Errorf("%w (min %d, is %d)", errUsernameTooShort, p.minLen, len(username))
+	case len(username) > p.maxLen:
+		return fmt.Errorf("%w (max %d, is %d)", errUsernameTooLong, p.maxLen, len(username))
+	case !usernameRegex.MatchString(username):
+		return fmt.Errorf("%w (is %q)", errUsernameBadChar, username)
+	}
+	for _, reserved := range p.reserved {
+		if strings.EqualFold(username, reserved) {
+			return fmt.Errorf("%w (is %q)", errUsernameReserved, username)
+		}
 	}
 	return nil
 }
 
+func (us *userStore) usernameIsSane(username string) error {
+	return us.policy.check(username)
+}
+
 func (fm *userStore) userPassword(username string) (pwd [64]byte, err error) {
-	if err = usernameIsSane(username); err != nil {
+	if err = fm.usernameIsSane(username); err != nil {
 		return
 	}
 	filename := filepath.Join(fm.path, username)
@@ -50,16 +89,37 @@ func (fm *userStore) userPassword(username string) (pwd [64]byte, err error) {
 	return
 }
 
+func (us *userStore) userExists(username string) (bool, error) {
+	if err := us.usernameIsSane(username); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(filepath.Join(us.path, username))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func (fm *userStore) setUserPassword(username string, pwd [64]byte) error {
-	if err := usernameIsSane(username); err != nil {
+	if err := fm.usernameIsSane(username); err != nil {
 		return err
 	}
 	filename := filepath.Join(fm.path, username)
-	return os.WriteFile(filename, pwd[:], 0600)
+	return os.WriteFile(filename, pwd[:], fm.filePerm)
 }
 
+// What happens to the permissions of a deleted user, see --deleted_user_files.
+// keep leaves them be, strip removes them from every record and reassign
+// hands them and the ownership of the user's records over to the admin
+const (
+	deletedUserKeep     = "keep"
+	deletedUserStrip    = "strip"
+	deletedUserReassign = "reassign"
+)
+
+// deleteUser removes the user's password file. Their permissions on the
+// records are cleaned up by the caller, see handleDeleteUser
 func (us userStore) deleteUser(name string) error {
-	// TODO: GC user files here?
 	filename := filepath.Join(us.path, name)
 	return os.Remove(filename)
 }
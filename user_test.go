@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsernamePolicy(t *testing.T) {
+	t.Parallel()
+	p := usernamePolicy{minLen: 3, maxLen: 8}
+
+	assert.ErrorIs(t, p.check(""), errUsernameTooShort)
+	assert.ErrorIs(t, p.check("ab"), errUsernameTooShort)
+	assert.NoError(t, p.check("abc"))
+	assert.NoError(t, p.check("abcdefgh"))
+	assert.ErrorIs(t, p.check("abcdefghi"), errUsernameTooLong)
+	assert.ErrorIs(t, p.check("ab/cd"), errUsernameBadChar)
+	assert.ErrorIs(t, p.check("ab.cd"), errUsernameBadChar)
+
+	p.reserved = []string{"roles"}
+	assert.ErrorIs(t, p.check("roles"), errUsernameReserved)
+	assert.ErrorIs(t, p.check("ROLES"), errUsernameReserved)
+	assert.NoError(t, p.check("roles2"))
+
+	assert.NoError(t, defaultUsernamePolicy.check(strings.Repeat("a", defaultUsernamePolicy.maxLen)))
+	assert.ErrorIs(t, defaultUsernamePolicy.check(strings.Repeat("a", 10_000)), errUsernameTooLong)
+}
+
+func TestUsernamePolicyConfig(t *testing.T) {
+	t.Parallel()
+	args := []string{"--data_dir", "/tmp", "--root_id", "WXC2BGKFiiDAjBWbf6wayV"}
+	env := func(string) string { return "" }
+
+	conf, err := getConfig(append(args, "--username_min_len", "2", "--username_max_len", "4"), env)
+	assert.NoError(t, err)
+	assert.Equal(t, usernamePolicy{minLen: 2, maxLen: 4, reserved: []string{"roles"}}, conf.usernamePolicy)
+
+	conf, err = getConfig(append(args, "--reserved_usernames", "roles, trash,"), env)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"roles", "trash"}, conf.usernamePolicy.reserved)
+
+	_, err = getConfig(append(args, "--username_min_len", "0"), env)
+	assert.Error(t, err)
+	_, err = getConfig(append(args, "--username_min_len", "5", "--username_max_len", "4"), env)
+	assert.Error(t, err)
+}
+
+// Not parallel, it replaces passwordsEqual
+func TestLoginComparesMissingUser(t *testing.T) {
+	users, err := newUserStore(t.TempDir(), 0600)
+	require.NoError(t, err)
+	users.policy = defaultUsernamePolicy
+	require.NoError(t, users.setUserPassword("prokop", hashPassword("catboy123")))
+
+	secret := generateSecret()
+
+	var compared [][64]byte
+	orig := passwordsEqual
+	passwordsEqual = func(a, b [64]byte) bool {
+		compared = append(compared, a)
+		return orig(a, b)
+	}
+	t.Cleanup(func() { passwordsEqual = orig })
+
+	ok, _ := login("prokop", hashPassword("catboy123"), secret, users)
+	assert.True(t, ok)
+	ok, _ = login("prokop", hashPassword("wrong"), secret, users)
+	assert.False(t, ok)
+
+	// the missing user is compared against the dummy
+	ok, _ = login("nobody", dummyPassword, secret, users)
+	assert.False(t, ok)
+	assert.Equal(t, [][64]byte{hashPassword("catboy123"), hashPassword("catboy123"), dummyPassword}, compared)
+}